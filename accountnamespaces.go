@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// awsAccountIdPattern matches the 12 digits of an AWS account ID.
+var awsAccountIdPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// parseAccountNamespaces parses comma-separated account=namespace pairs,
+// where an @path item is replaced by the pairs in that file, separated by
+// commas or whitespace, ignoring # comments.
+func parseAccountNamespaces(spec string) (map[string]string, error) {
+	var pairs []string
+	for _, item := range splitList(spec) {
+		if !strings.HasPrefix(item, "@") {
+			pairs = append(pairs, item)
+			continue
+		}
+		b, err := ioutil.ReadFile(strings.TrimPrefix(item, "@"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the account namespace map: %s", err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			pairs = append(pairs, strings.FieldsFunc(line, func(r rune) bool {
+				return r == ',' || unicode.IsSpace(r)
+			})...)
+		}
+	}
+	namespaces := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid --account-namespace-map entry \"%s\", expected account=namespace", pair)
+		}
+		account, namespace := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !awsAccountIdPattern.MatchString(account) {
+			return nil, fmt.Errorf("invalid --account-namespace-map account ID \"%s\", expected 12 digits", account)
+		}
+		if previous, ok := namespaces[account]; ok && previous != namespace {
+			return nil, fmt.Errorf("--account-namespace-map maps account %s to both \"%s\" and \"%s\"", account, previous, namespace)
+		}
+		namespaces[account] = namespace
+	}
+	return namespaces, nil
+}
+
+func (c *CheckConfig) validateAccountNamespaces() error {
+	var err error
+	c.accountNamespaceMap, err = parseAccountNamespaces(c.accountNamespaces)
+	return err
+}
+
+// accountNamespace returns the namespace --account-namespace-map routes the
+// instances of an account to when discovering several accounts with
+// --aws-assume-role-arns, "" if none.
+func (c *CheckConfig) accountNamespace(account *awsAccount) string {
+	if account == nil || account.RoleArn == "" {
+		return ""
+	}
+	return c.accountNamespaceMap[account.Id]
+}
+
+// accountNamespaceCount is the number of instances of an account discovered
+// into a namespace.
+type accountNamespaceCount struct {
+	account   string
+	namespace string
+}
+
+// printAccountNamespaces writes the instances discovered per account and
+// namespace when --account-namespace-map is in use, so that misrouted
+// accounts stand out.
+func (s *runSummary) printAccountNamespaces(w io.Writer, c *CheckConfig) {
+	if len(c.accountNamespaceMap) == 0 || len(s.accountNamespaces) == 0 {
+		return
+	}
+	counts := make([]accountNamespaceCount, 0, len(s.accountNamespaces))
+	for count := range s.accountNamespaces {
+		counts = append(counts, count)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].account != counts[j].account {
+			return counts[i].account < counts[j].account
+		}
+		return counts[i].namespace < counts[j].namespace
+	})
+	for _, count := range counts {
+		account := count.account
+		if account == "" {
+			account = "unresolved"
+		}
+		mapped := "mapped"
+		if _, ok := c.accountNamespaceMap[count.account]; !ok {
+			mapped = "unmapped"
+		}
+		fmt.Fprintf(w, "account %s (%s): %d instances in namespace \"%s\"\n", account, mapped, s.accountNamespaces[count], count.namespace)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAccountNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "accounts")
+	if err := ioutil.WriteFile(path, []byte("# teams\n333333333333=data 444444444444=ops\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces, err := parseAccountNamespaces("111111111111=payments, 222222222222=web,@" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"111111111111": "payments", "222222222222": "web", "333333333333": "data", "444444444444": "ops"}
+	if !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("unexpected namespaces %v", namespaces)
+	}
+	for _, spec := range []string{"111111111111", "1111=payments", "111111111111=", "111111111111=a,111111111111=b", "@" + filepath.Join(dir, "missing")} {
+		if _, err := parseAccountNamespaces(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestAccountNamespaceRouting(t *testing.T) {
+	c := testConfig()
+	c.accountNamespaces = "111111111111=payments"
+	if err := c.validateAccountNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+	mapped := testInstance("i-0", "running")
+	mapped.Account = &awsAccount{RoleArn: "arn:aws:iam::111111111111:role/discovery", Id: "111111111111"}
+	unmapped := testInstance("i-1", "running")
+	unmapped.Account = &awsAccount{RoleArn: "arn:aws:iam::222222222222:role/discovery", Id: "222222222222"}
+	// The map only applies to the accounts of assumed roles.
+	single := testInstance("i-2", "running")
+	single.Account = &awsAccount{Id: "111111111111"}
+	for instance, namespace := range map[*discoveredInstance]string{mapped: "payments", unmapped: "default", single: "default"} {
+		if got := c.buildEntity(instance).Namespace; got != namespace {
+			t.Errorf("instance %s routed to %s, expected %s", *instance.InstanceId, got, namespace)
+		}
+	}
+	if namespaces := c.pruneNamespaces(nil); !reflect.DeepEqual(namespaces, []string{"default", "payments"}) {
+		t.Errorf("unexpected prune namespaces %v", namespaces)
+	}
+
+	summary := newRunSummary()
+	summary.accountNamespaces[accountNamespaceCount{account: "111111111111", namespace: "payments"}] = 3
+	summary.accountNamespaces[accountNamespaceCount{account: "222222222222", namespace: "default"}] = 1
+	var output bytes.Buffer
+	summary.print(&output, c)
+	for _, line := range []string{
+		"account 111111111111 (mapped): 3 instances in namespace \"payments\"\n",
+		"account 222222222222 (unmapped): 1 instances in namespace \"default\"\n",
+	} {
+		if !strings.Contains(output.String(), line) {
+			t.Errorf("summary is missing %q:\n%s", line, output.String())
+		}
+	}
+}
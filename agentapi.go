@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+const (
+	transportBackendApi = "backend-api"
+	transportAgentApi   = "agent-api"
+
+	// agentEventCheck is the check of the events submitted to the agent
+	// events API, which register the entity they carry.
+	agentEventCheck = "ec2-discovery"
+)
+
+// validateTransportArgs rejects, with --transport agent-api, the options
+// that need to read, update or delete entities, which only the backend API
+// can do.
+func (c *CheckConfig) validateTransportArgs() error {
+	switch c.transport {
+	case "", transportBackendApi:
+		return nil
+	case transportAgentApi:
+	default:
+		return fmt.Errorf("invalid --transport \"%s\", expected %s or %s", c.transport, transportBackendApi, transportAgentApi)
+	}
+	unsupported := []struct {
+		option string
+		set    bool
+	}{
+		{"--prune", c.prune},
+		{"--delete-on-states", c.deleteOnStates != ""},
+		{"--adopt-existing", c.adoptExisting},
+		{"--write-strategy replace", c.writeStrategy == writeStrategyReplace},
+		{"--create-proxy-check", c.createProxyCheck},
+		{"--lock-ttl", c.lockTtl != ""},
+		{"--mode monitor", c.mode == modeMonitor},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			return fmt.Errorf("%s is not supported with --transport %s, which can only submit entities to the local agent, not read, update or delete them", option.option, transportAgentApi)
+		}
+	}
+	agentUrl, err := url.Parse(c.agentApiUrl)
+	if err != nil || (agentUrl.Scheme != "http" && agentUrl.Scheme != "https") || agentUrl.Host == "" {
+		return fmt.Errorf("invalid --agent-api-url \"%s\", expected e.g. http://127.0.0.1:3031", c.agentApiUrl)
+	}
+	c.agentApiUrl = strings.TrimRight(c.agentApiUrl, "/")
+	return nil
+}
+
+// submitAgentEvent registers the entity of an instance through the events
+// API of the local agent, as the entity of an OK event.
+func (c *CheckConfig) submitAgentEvent(entity *corev2.Entity) registrationResult {
+	if c.dryRun {
+		c.logEntity("dry-run: would submit entity for EC2 instance \"%s\" to the agent", entity.Name)
+		return registrationResult{Entity: entity.Name, Outcome: outcomeDryRun}
+	}
+	check := corev2.Check{
+		ObjectMeta: corev2.ObjectMeta{Name: agentEventCheck, Namespace: entity.Namespace},
+		Output:     fmt.Sprintf("registered by sensu-ec2-discovery (correlation ID %s)", c.correlationId),
+		Executed:   time.Now().Unix(),
+	}
+	event := corev2.Event{ObjectMeta: corev2.ObjectMeta{Namespace: entity.Namespace}, Entity: entity, Check: &check}
+	b, err := json.Marshal(&event)
+	if err != nil {
+		return c.failedRegistration(entity, err)
+	}
+	req, err := http.NewRequestWithContext(c.requestContext(), "POST", c.agentApiUrl+"/events", bytes.NewReader(b))
+	if err != nil {
+		return c.failedRegistration(entity, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return c.failedRegistration(entity, fmt.Errorf("failed to submit the event to the agent: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return c.failedRegistration(entity, fmt.Errorf("failed to submit the event to the agent: %w", c.statusError(resp)))
+	}
+	c.logEntity("submitted entity for EC2 instance \"%s\" to the agent", entity.Name)
+	return registrationResult{Entity: entity.Name, Outcome: outcomeSubmitted}
+}
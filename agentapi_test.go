@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestSubmitAgentEvent(t *testing.T) {
+	var events []corev2.Event
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var event corev2.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events = append(events, event)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer agent.Close()
+
+	c := testConfig()
+	c.transport = transportAgentApi
+	c.agentApiUrl = agent.URL + "/"
+	if err := c.validateTransportArgs(); err != nil {
+		t.Fatal(err)
+	}
+	run := c.newDiscoveryRun()
+	c.processInstance(run, testInstance("i-0123", "running"))
+	if run.summary.outcomes[outcomeSubmitted] != 1 || len(events) != 1 {
+		t.Fatalf("unexpected outcomes %v, %d events", run.summary.outcomes, len(events))
+	}
+	event := events[0]
+	if event.Entity.Name != "i-0123" || event.Entity.EntityClass != "proxy" || event.Entity.Labels[managedByLabel] != managedByValue || event.Check.Name != agentEventCheck {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	var output bytes.Buffer
+	run.summary.print(&output, c)
+	if !strings.Contains(output.String(), "transport: agent-api, 1 entities submitted to the agent at "+agent.URL+",") {
+		t.Errorf("unexpected summary:\n%s", output.String())
+	}
+
+	agent.Close()
+	if result := c.registerInstance(testInstance("i-0456", "running")); result.Outcome != outcomeFailed {
+		t.Errorf("unexpected result without an agent: %+v", result)
+	}
+}
+
+func TestValidateTransportArgs(t *testing.T) {
+	c := testConfig()
+	c.transport = transportAgentApi
+	c.agentApiUrl = "http://127.0.0.1:3031"
+	c.prune = true
+	if err := c.validateTransportArgs(); err == nil || !strings.Contains(err.Error(), "--prune is not supported") {
+		t.Errorf("expected --prune to be rejected, got %v", err)
+	}
+	c.prune = false
+	c.writeStrategy = writeStrategyReplace
+	if err := c.validateTransportArgs(); err == nil {
+		t.Error("expected --write-strategy replace to be rejected")
+	}
+	c.writeStrategy = writeStrategyUpsert
+	c.agentApiUrl = "127.0.0.1:3031"
+	if err := c.validateTransportArgs(); err == nil {
+		t.Error("expected an invalid agent API URL to be rejected")
+	}
+	c.transport = "websocket"
+	if err := c.validateTransportArgs(); err == nil {
+		t.Error("expected an invalid transport to be rejected")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// isAmbiguousWriteError tells whether a write failed after its request may
+// have reached the Sensu API: it timed out, or the connection was reset or
+// closed before the response. A refused connection is not ambiguous.
+func isAmbiguousWriteError(err error) bool {
+	var timeoutErr *apiTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// resolveAmbiguousCreate finds out whether the create of an entity, which
+// failed with the ambiguous err, did create it, and retries the create
+// once if it did not. An entity found as it would be written resolves as
+// 201 Created, one found otherwise as 409 Conflict, for the update path.
+func (c *CheckConfig) resolveAmbiguousCreate(entity *corev2.Entity, postBody []byte, err error) (*http.Response, error) {
+	log.Printf("WARNING: creating entity \"%s\" failed after the request may have been sent: %s, reading it back", entity.Name, err)
+	existing, getErr := c.getEntity(entity.Namespace, entity.Name)
+	if getErr != nil {
+		log.Printf("ERROR: failed to read back entity \"%s\": %s", entity.Name, getErr)
+		return nil, err
+	}
+	if existing == nil {
+		c.logEntity("entity \"%s\" was not created, retrying", entity.Name)
+		return c.sensuApiRequest("POST", entity.Namespace, entitiesPath(entity.Namespace), bytes.NewReader(postBody))
+	}
+	if !isManaged(existing, managedByValue) {
+		return resolvedResponse(http.StatusConflict), nil
+	}
+	if updated := c.updatedEntity(existing, entity); updated != nil && entityChanged(existing, updated) {
+		c.logEntity("entity \"%s\" was created but differs, updating it", entity.Name)
+		return resolvedResponse(http.StatusConflict), nil
+	}
+	c.logEntity("entity \"%s\" was created", entity.Name)
+	return resolvedResponse(http.StatusCreated), nil
+}
+
+// resolvedResponse stands for the response an ambiguous create did not get.
+func resolvedResponse(statusCode int) *http.Response {
+	return &http.Response{StatusCode: statusCode, Body: ioutil.NopCloser(bytes.NewReader(nil))}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// flakyBackend serves the fake backend but drops the response to the
+// first drop entity creates, after persisting them when persist is set.
+type flakyBackend struct {
+	*fakeBackend
+	flaky   *httptest.Server
+	drop    int
+	persist bool
+	// stall, when set, delays the dropped responses instead of closing
+	// the connection.
+	stall time.Duration
+	// tamper changes the entity persisted by a dropped create.
+	tamper func()
+}
+
+func newFlakyBackend(drop int, persist bool) *flakyBackend {
+	b := &flakyBackend{fakeBackend: newFakeBackend(), drop: drop, persist: persist}
+	b.flaky = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.Lock()
+		dropping := r.Method == "POST" && b.drop > 0
+		if dropping {
+			b.drop--
+		}
+		b.Unlock()
+		if !dropping {
+			b.serveHTTP(w, r)
+			return
+		}
+		if b.persist {
+			b.serveHTTP(httptest.NewRecorder(), r)
+			if b.tamper != nil {
+				b.tamper()
+			}
+		} else {
+			b.Lock()
+			b.requests = append(b.requests, r.Method+" "+r.URL.Path)
+			b.Unlock()
+		}
+		if b.stall > 0 {
+			time.Sleep(b.stall)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	return b
+}
+
+func (b *flakyBackend) Close() {
+	b.flaky.Close()
+	b.fakeBackend.Close()
+}
+
+func (b *flakyBackend) checkConfig() *CheckConfig {
+	c := b.fakeBackend.checkConfig()
+	c.sensuApiUrl = b.flaky.URL
+	return c
+}
+
+func (b *flakyBackend) count(request string) int {
+	b.Lock()
+	defer b.Unlock()
+	n := 0
+	for _, r := range b.requests {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRegisterInstanceAfterDroppedResponse(t *testing.T) {
+	const post = "POST /api/core/v2/namespaces/default/entities"
+	const put = "PUT /api/core/v2/namespaces/default/entities/i-0123"
+
+	// Created, response lost: read back and counted as created.
+	b := newFlakyBackend(1, true)
+	c := b.checkConfig()
+	if result := c.registerInstance(testInstance("i-0123", "running")); result.Outcome != outcomeCreated {
+		t.Errorf("persisted create: unexpected result %+v", result)
+	}
+	if b.count(post) != 1 || b.count(put) != 0 {
+		t.Errorf("persisted create: unexpected requests %v", b.requests)
+	}
+	b.Close()
+
+	// Not created: the create is retried.
+	b = newFlakyBackend(1, false)
+	c = b.checkConfig()
+	if result := c.registerInstance(testInstance("i-0123", "running")); result.Outcome != outcomeCreated {
+		t.Errorf("lost create: unexpected result %+v", result)
+	}
+	if b.count(post) != 2 || b.entity("i-0123") == nil {
+		t.Errorf("lost create: not retried, requests %v", b.requests)
+	}
+	b.Close()
+
+	// Created with other content: updated.
+	b = newFlakyBackend(1, true)
+	b.tamper = func() {
+		b.Lock()
+		b.entities["i-0123"].Labels[instanceStateLabel] = "pending"
+		b.Unlock()
+	}
+	c = b.checkConfig()
+	if result := c.registerInstance(testInstance("i-0123", "running")); result.Outcome != outcomeUpdated {
+		t.Errorf("differing create: unexpected result %+v", result)
+	}
+	if b.count(put) != 1 || b.entity("i-0123").Labels[instanceStateLabel] != "running" {
+		t.Errorf("differing create: not updated, requests %v", b.requests)
+	}
+	b.Close()
+
+	// Lost twice: failed, without a third attempt.
+	b = newFlakyBackend(2, false)
+	c = b.checkConfig()
+	if result := c.registerInstance(testInstance("i-0123", "running")); result.Outcome != outcomeFailed {
+		t.Errorf("lost creates: unexpected result %+v", result)
+	}
+	if b.count(post) != 2 {
+		t.Errorf("lost creates: unexpected requests %v", b.requests)
+	}
+	b.Close()
+
+	// Timed out by --sensu-api-timeout after the create was persisted.
+	b = newFlakyBackend(1, true)
+	b.stall = 500 * time.Millisecond
+	c = b.checkConfig()
+	c.sensuApiTimeoutDuration = 100 * time.Millisecond
+	if result := c.registerInstance(testInstance("i-0123", "running")); result.Outcome != outcomeCreated {
+		t.Errorf("timed out create: unexpected result %+v", result)
+	}
+	if b.count(post) != 1 || b.count("GET /api/core/v2/namespaces/default/entities/i-0123") != 1 {
+		t.Errorf("timed out create: not read back, requests %v", b.requests)
+	}
+	b.Close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audited write actions. Dry-runs record the would-* variants when
+// --audit-dry-run is set.
+const (
+	auditCreate      = "create"
+	auditUpdate      = "update"
+	auditAdopt       = "adopt"
+	auditDelete      = "delete"
+	auditWouldCreate = "would-create"
+	auditWouldUpdate = "would-update"
+	auditWouldDelete = "would-delete"
+)
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Timestamp     string `json:"timestamp"`
+	Action        string `json:"action"`
+	Entity        string `json:"entity"`
+	Namespace     string `json:"namespace"`
+	InstanceId    string `json:"aws_instance_id"`
+	Outcome       string `json:"outcome"`
+	Error         string `json:"error,omitempty"`
+	CorrelationId string `json:"correlation_id"`
+}
+
+// auditLog appends a JSON line per write action to --audit-log-file. Its
+// methods do nothing on a nil log, and failing to write only warns.
+type auditLog struct {
+	sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	failed bool
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (a *auditLog) write(record auditRecord) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	b, err := json.Marshal(record)
+	if err == nil {
+		_, err = a.writer.Write(append(b, '\n'))
+	}
+	if err != nil && !a.failed {
+		a.failed = true
+		log.Printf("WARNING: failed to write the audit log: %s", err)
+	}
+}
+
+// close flushes and syncs the log to disk. It may be called more than once.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.file == nil {
+		return
+	}
+	err := a.writer.Flush()
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.file = nil
+	if err != nil {
+		log.Printf("WARNING: failed to write the audit log: %s", err)
+	}
+}
+
+// openAudit opens --audit-log-file, if set, for the run. Failing to open it
+// only warns.
+func (c *CheckConfig) openAudit() {
+	if c.auditLogFile == "" {
+		return
+	}
+	audit, err := openAuditLog(c.auditLogFile)
+	if err != nil {
+		log.Printf("WARNING: failed to open the audit log: %s", err)
+		return
+	}
+	c.audit = audit
+}
+
+// auditAction records a write action on an entity, or a would-* action of a
+// dry-run when --audit-dry-run is set.
+func (c *CheckConfig) auditAction(action string, namespace string, name string, instanceId string, err error) {
+	outcome := "success"
+	switch action {
+	case auditWouldCreate, auditWouldUpdate, auditWouldDelete:
+		if !c.auditDryRun {
+			return
+		}
+		outcome = "dry-run"
+	}
+	record := auditRecord{
+		Timestamp:     time.Now().UTC().Format(time.RFC3339Nano),
+		Action:        action,
+		Entity:        name,
+		Namespace:     namespace,
+		InstanceId:    instanceId,
+		Outcome:       outcome,
+		CorrelationId: c.correlationId,
+	}
+	if err != nil {
+		record.Outcome = "failed"
+		record.Error = err.Error()
+	}
+	c.audit.write(record)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func readAuditLog(t *testing.T, path string) []auditRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid audit log line %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := newFakeBackend()
+	defer backend.Close()
+
+	c := backend.checkConfig()
+	c.auditLogFile = filepath.Join(dir, "audit.jsonl")
+	c.openAudit()
+	c.registerInstance(testInstance("i-0123", "running"))
+	c.registerInstance(testInstance("i-0123", "stopped"))
+	c.deleteInstanceEntity(testInstance("i-0123", "terminated"))
+	c.audit.close()
+	run := c.correlationId
+
+	// A dry-run only records would-* actions with --audit-dry-run.
+	c = backend.checkConfig()
+	c.auditLogFile = filepath.Join(dir, "audit.jsonl")
+	c.dryRun = true
+	c.openAudit()
+	c.registerInstance(testInstance("i-0456", "running"))
+	c.auditDryRun = true
+	c.registerInstance(testInstance("i-0789", "running"))
+	c.audit.close()
+
+	records := readAuditLog(t, c.auditLogFile)
+	var actions []string
+	for i, record := range records {
+		actions = append(actions, record.Action+" "+record.Entity+" "+record.Outcome)
+		// Each run records its own correlation ID.
+		correlationId := run
+		if i >= 3 {
+			correlationId = c.correlationId
+		}
+		if record.Namespace != "default" || record.InstanceId != record.Entity || record.Timestamp == "" || record.CorrelationId != correlationId {
+			t.Errorf("unexpected record: %+v", record)
+		}
+	}
+	expected := []string{"create i-0123 success", "update i-0123 success", "delete i-0123 success", "would-create i-0789 dry-run"}
+	if len(actions) != len(expected) {
+		t.Fatalf("unexpected audit log: %v", actions)
+	}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Errorf("unexpected audit log: %v", actions)
+			break
+		}
+	}
+}
+
+func TestAuditLogWriteFailure(t *testing.T) {
+	c := testConfig()
+	c.auditLogFile = filepath.Join(os.DevNull, "audit.jsonl")
+	c.openAudit()
+	if c.audit != nil {
+		t.Fatal("expected the audit log to fail to open")
+	}
+	// Auditing without a log does nothing.
+	c.auditAction(auditCreate, "default", "i-0123", "i-0123", nil)
+	c.audit.close()
+}
+
+func TestAuditLogPrefixedNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := newFakeBackend()
+	defer backend.Close()
+
+	prefixed := func(state string) *discoveredInstance {
+		instance := testInstance("i-0123", state)
+		instance.Account = &awsAccount{Id: "123456789012", Alias: "prod"}
+		return instance
+	}
+	config := func() *CheckConfig {
+		c := backend.checkConfig()
+		c.awsAssumeRoleArns = "arn:aws:iam::123456789012:role/discovery,arn:aws:iam::210987654321:role/discovery"
+		if c.accountPrefixTemplate, err = parseInstanceTemplate("account-prefix-template", "{{ .AccountAlias }}-"); err != nil {
+			t.Fatal(err)
+		}
+		c.auditLogFile = filepath.Join(dir, "audit.jsonl")
+		c.diff = newDiffReport()
+		c.openAudit()
+		return c
+	}
+
+	c := config()
+	c.registerInstance(prefixed("running"))
+	c.dryRun = true
+	c.auditDryRun = true
+	c.deleteInstanceEntity(prefixed("terminated"))
+	c.dryRun = false
+	c.deleteInstanceEntity(prefixed("terminated"))
+	c.audit.close()
+	if len(c.diff.Delete) != 2 || c.diff.Delete[0].InstanceId != "i-0123" {
+		t.Errorf("unexpected deletions: %+v", c.diff.Delete)
+	}
+
+	// An ignored entity is reported with its instance ID too.
+	c = config()
+	c.registerInstance(prefixed("running"))
+	backend.entity("prod-i-0123").Annotations[ignoreAnnotation] = ignoreValue
+	c.deleteInstanceEntity(prefixed("terminated"))
+	c.audit.close()
+	if len(c.diff.Ignore) != 1 || c.diff.Ignore[0].InstanceId != "i-0123" {
+		t.Errorf("unexpected ignored entities: %+v", c.diff.Ignore)
+	}
+
+	records := readAuditLog(t, c.auditLogFile)
+	var actions []string
+	for _, record := range records {
+		actions = append(actions, record.Action)
+		if record.Entity != "prod-i-0123" || record.InstanceId != "i-0123" {
+			t.Errorf("unexpected record: %+v", record)
+		}
+	}
+	if strings.Join(actions, ",") != "create,would-delete,delete,create" {
+		t.Errorf("unexpected audit log: %v", actions)
+	}
+}
+
+func TestAuditLogFailedRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := newFakeBackend()
+	defer backend.Close()
+	// The first entity created is rejected.
+	var rejected int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && atomic.CompareAndSwapInt32(&rejected, 0, 1) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		backend.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.simulate = 2
+	c.simulateLabelSize = 1
+	c.failureCriticalThreshold = 1
+	c.auditLogFile = filepath.Join(dir, "audit.jsonl")
+	status, err := c.discoverInstances(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != statusCritical {
+		t.Errorf("unexpected status %d", status)
+	}
+
+	// The records of a failed run are on disk once it returns.
+	var outcomes []string
+	for _, record := range readAuditLog(t, c.auditLogFile) {
+		outcomes = append(outcomes, record.Action+" "+record.Outcome)
+	}
+	sort.Strings(outcomes)
+	if strings.Join(outcomes, ",") != "create failed,create success" {
+		t.Errorf("unexpected audit log: %v", outcomes)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// validateAwsCredentials checks that the static credential options, when
+// used, are complete.
+func (c *CheckConfig) validateAwsCredentials() error {
+	if c.awsSecretAccessKey != "" && c.awsAccessKeyId == "" {
+		return fmt.Errorf("--aws-secret-access-key requires --aws-access-key-id")
+	}
+	if c.awsAccessKeyId != "" && c.awsSecretAccessKey == "" {
+		return fmt.Errorf("--aws-access-key-id requires --aws-secret-access-key")
+	}
+	if c.awsSessionToken != "" && c.awsAccessKeyId == "" {
+		return fmt.Errorf("--aws-session-token requires --aws-access-key-id and --aws-secret-access-key")
+	}
+	// Temporary credentials issued by STS have ASIA access key IDs and are
+	// rejected with InvalidClientTokenId unless sent with their token.
+	if strings.HasPrefix(c.awsAccessKeyId, "ASIA") && c.awsSessionToken == "" {
+		return fmt.Errorf("--aws-access-key-id is a temporary credential and requires --aws-session-token")
+	}
+	return nil
+}
+
+// awsAccount is a credential context discovery runs in: the default
+// credentials, or a role assumed with them.
+type awsAccount struct {
+	RoleArn string
+	Id      string
+	Alias   string
+
+	// hostnames caches the Route 53 records of the account, see
+	// resolveInstanceHostnames.
+	hostnames map[string]string
+
+	// prefix is the prefix of the entity names of the account, see
+	// accountPrefix.
+	prefixOnce sync.Once
+	prefix     string
+}
+
+// awsAccounts returns the credential contexts to discover, one per role to
+// assume or only the default credentials.
+func (c *CheckConfig) awsAccounts() []*awsAccount {
+	var accounts []*awsAccount
+	for _, roleArn := range strings.Split(c.awsAssumeRoleArns, ",") {
+		if roleArn = strings.TrimSpace(roleArn); roleArn != "" {
+			accounts = append(accounts, &awsAccount{RoleArn: roleArn})
+		}
+	}
+	if len(accounts) == 0 {
+		accounts = append(accounts, &awsAccount{})
+	}
+	return accounts
+}
+
+// newAwsSession creates a session for the region, using the static
+// credentials when configured and the default credential chain otherwise,
+// and assuming the account's role if it has one.
+func (c *CheckConfig) newAwsSession(region string, account *awsAccount) (*session.Session, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(region),
+	}
+	if c.awsUseFipsEndpoints {
+		awsConfig.EndpointResolver = endpoints.ResolverFunc(fipsResolver)
+	}
+	if c.awsAccessKeyId != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(
+			c.awsAccessKeyId,
+			c.awsSecretAccessKey,
+			c.awsSessionToken,
+		)
+	}
+	awsSession, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	awsSession.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(userAgent()))
+	awsSession.Handlers.CompleteAttempt.PushBack(c.trackAwsRequest)
+	c.awsTimeoutHandlers(&awsSession.Handlers)
+	if account == nil || account.RoleArn == "" {
+		return awsSession, nil
+	}
+	roleSession, err := session.NewSession(awsConfig.Copy(&aws.Config{
+		Credentials: stscreds.NewCredentials(awsSession, account.RoleArn),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	roleSession.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(userAgent()))
+	roleSession.Handlers.CompleteAttempt.PushBack(c.trackAwsRequest)
+	c.awsTimeoutHandlers(&roleSession.Handlers)
+	return roleSession, nil
+}
+
+// resolveAccount resolves the ID, and optionally the alias, of the account
+// the credentials belong to. The ID is required when assuming roles, as it
+// is what tells the accounts apart; a missing alias is never an error.
+func (c *CheckConfig) resolveAccount(account *awsAccount) error {
+	defer c.timings.since("credentials", time.Now())
+	awsSession, err := c.newAwsSession(defaultRegion(), account)
+	if err != nil {
+		return err
+	}
+	identity, err := sts.New(awsSession).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		err = classifyAwsError(err, "sts:GetCallerIdentity", defaultRegion())
+		if account.RoleArn != "" {
+			return fmt.Errorf("failed to resolve the AWS account of role %s: %s", account.RoleArn, err)
+		}
+		log.Printf("WARNING: failed to resolve the AWS account: %s", err)
+		return nil
+	}
+	account.Id = aws.StringValue(identity.Account)
+	c.logDebug("using AWS identity %s", aws.StringValue(identity.Arn))
+
+	if !c.resolveAccountAlias {
+		return nil
+	}
+	aliases, err := iam.New(awsSession).ListAccountAliases(&iam.ListAccountAliasesInput{})
+	if err != nil {
+		log.Printf("WARNING: failed to resolve the alias of AWS account %s: %s", account.Id, err)
+		return nil
+	}
+	if len(aliases.AccountAliases) > 0 {
+		account.Alias = aws.StringValue(aliases.AccountAliases[0])
+	}
+	return nil
+}
+
+// defaultRegion is the region used for calls that are not tied to one of
+// the discovered regions.
+func defaultRegion() string {
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+// resolveRegions returns the regions to discover, expanding "all" into every
+// region available to the account. With --instances-from-stdin, these are
+// the regions the instances read are in.
+func (c *CheckConfig) resolveRegions() ([]string, error) {
+	regions, err := c.configuredRegions()
+	if err != nil {
+		return nil, err
+	}
+	if c.stdinInstances != nil {
+		regions = c.stdinRegions(regions)
+		if err := c.validateRegionNames(regions); err != nil {
+			return nil, err
+		}
+	} else if strings.TrimSpace(c.ec2InstanceRegions) != "all" {
+		return regions, nil
+	}
+	return regions, c.validateFipsRegions(regions)
+}
+
+func (c *CheckConfig) configuredRegions() ([]string, error) {
+	if strings.TrimSpace(c.ec2InstanceRegions) != "all" {
+		return strings.Split(c.ec2InstanceRegions, ","), nil
+	}
+	awsSession, err := c.newAwsSession(defaultRegion(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.expandAllRegions(ec2.New(awsSession), c.includeNotOptedIn)
+}
+
+// expandAllRegions lists every region, including the opt-in regions
+// DescribeRegions omits by default. Regions the account has not opted into
+// are left out unless includeNotOptedIn is set.
+func (c *CheckConfig) expandAllRegions(svc ec2iface.EC2API, includeNotOptedIn bool) ([]string, error) {
+	result, err := svc.DescribeRegions(&ec2.DescribeRegionsInput{AllRegions: aws.Bool(true)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list regions: %s", classifyAwsError(err, "ec2:DescribeRegions", defaultRegion()))
+	}
+	var regions []string
+	for _, region := range result.Regions {
+		name := aws.StringValue(region.RegionName)
+		status := aws.StringValue(region.OptInStatus)
+		c.logDebug("region %s opt-in status: %s", name, status)
+		if includeNotOptedIn || status == "opted-in" || status == "opt-in-not-required" {
+			regions = append(regions, name)
+		}
+	}
+	c.logDebug("expanded all regions to: %s", strings.Join(regions, ","))
+	return regions, nil
+}
+
+// classifyAwsError appends a remediation hint to the AWS errors users can
+// fix themselves: missing or expired credentials, missing permissions and
+// disabled regions. Other errors are returned unchanged.
+func classifyAwsError(err error, action string, region string) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	var hint string
+	switch aerr.Code() {
+	case "NoCredentialProviders":
+		hint = "set AWS_PROFILE or the --aws-access-key-id and --aws-secret-access-key options, or attach an instance profile"
+	case "ExpiredToken", "ExpiredTokenException", "RequestExpired":
+		hint = "refresh the temporary credentials and their session token"
+	case "UnauthorizedOperation", "AccessDenied", "AccessDeniedException":
+		hint = fmt.Sprintf("grant %s in region %s", action, region)
+	case "AuthFailure":
+		hint = fmt.Sprintf("check the credentials are valid and region %s is enabled for the account", region)
+	case "OptInRequired":
+		hint = fmt.Sprintf("enable region %s for the account or remove it from --ec2-instance-regions", region)
+	default:
+		return err
+	}
+	return fmt.Errorf("%s: %s (%s)", aerr.Code(), aerr.Message(), hint)
+}
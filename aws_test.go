@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeEC2 implements the EC2 calls used by discovery; calling any other
+// method panics.
+type fakeEC2 struct {
+	ec2iface.EC2API
+	regions []*ec2.Region
+}
+
+func (f *fakeEC2) DescribeRegions(input *ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+	var regions []*ec2.Region
+	for _, region := range f.regions {
+		if aws.BoolValue(input.AllRegions) || aws.StringValue(region.OptInStatus) != "not-opted-in" {
+			regions = append(regions, region)
+		}
+	}
+	return &ec2.DescribeRegionsOutput{Regions: regions}, nil
+}
+
+func TestValidateAwsCredentials(t *testing.T) {
+	cases := []struct {
+		id, secret, token string
+		valid             bool
+	}{
+		{"", "", "", true},
+		{"AKIAEXAMPLE", "secret", "", true},
+		{"ASIAEXAMPLE", "secret", "token", true},
+		{"ASIAEXAMPLE", "secret", "", false},
+		{"AKIAEXAMPLE", "", "", false},
+		{"", "secret", "", false},
+		{"", "", "token", false},
+	}
+	for _, tc := range cases {
+		c := testConfig()
+		c.awsAccessKeyId, c.awsSecretAccessKey, c.awsSessionToken = tc.id, tc.secret, tc.token
+		if err := c.validateAwsCredentials(); (err == nil) != tc.valid {
+			t.Errorf("validateAwsCredentials(%q, %q, %q) = %v", tc.id, tc.secret, tc.token, err)
+		}
+	}
+}
+
+func TestExpandAllRegions(t *testing.T) {
+	svc := &fakeEC2{regions: []*ec2.Region{
+		{RegionName: aws.String("us-east-1"), OptInStatus: aws.String("opt-in-not-required")},
+		{RegionName: aws.String("af-south-1"), OptInStatus: aws.String("opted-in")},
+		{RegionName: aws.String("ap-east-1"), OptInStatus: aws.String("not-opted-in")},
+	}}
+
+	c := testConfig()
+	regions, err := c.expandAllRegions(svc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(regions, ",") != "us-east-1,af-south-1" {
+		t.Errorf("unexpected regions: %v", regions)
+	}
+
+	regions, _ = c.expandAllRegions(svc, true)
+	if strings.Join(regions, ",") != "us-east-1,af-south-1,ap-east-1" {
+		t.Errorf("unexpected regions including not opted in: %v", regions)
+	}
+}
+
+func TestAwsAccounts(t *testing.T) {
+	c := testConfig()
+	if accounts := c.awsAccounts(); len(accounts) != 1 || accounts[0].RoleArn != "" {
+		t.Errorf("expected only the default credentials, got %+v", accounts)
+	}
+
+	c.awsAssumeRoleArns = "arn:aws:iam::111111111111:role/discovery, arn:aws:iam::222222222222:role/discovery,"
+	accounts := c.awsAccounts()
+	if len(accounts) != 2 || accounts[1].RoleArn != "arn:aws:iam::222222222222:role/discovery" {
+		t.Errorf("unexpected accounts: %+v", accounts)
+	}
+}
+
+func TestClassifyAwsError(t *testing.T) {
+	cases := []struct {
+		code, hint string
+	}{
+		{"NoCredentialProviders", "set AWS_PROFILE"},
+		{"ExpiredToken", "refresh the temporary credentials"},
+		{"UnauthorizedOperation", "grant ec2:DescribeInstances in region eu-south-1"},
+		{"AuthFailure", "region eu-south-1 is enabled"},
+		{"OptInRequired", "enable region eu-south-1"},
+	}
+	for _, c := range cases {
+		err := classifyAwsError(awserr.New(c.code, "request failed", nil), "ec2:DescribeInstances", "eu-south-1")
+		if !strings.HasPrefix(err.Error(), c.code+": request failed (") || !strings.Contains(err.Error(), c.hint) {
+			t.Errorf("unexpected classification of %s: %s", c.code, err)
+		}
+	}
+
+	unknown := awserr.New("Throttling", "rate exceeded", nil)
+	if err := classifyAwsError(unknown, "ec2:DescribeInstances", "eu-south-1"); err != unknown {
+		t.Errorf("unknown error was not passed through: %s", err)
+	}
+	plain := errors.New("connection reset")
+	if err := classifyAwsError(plain, "ec2:DescribeInstances", "eu-south-1"); err != plain {
+		t.Errorf("non-AWS error was not passed through: %s", err)
+	}
+}
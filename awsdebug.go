@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// trackAwsRequest records the ID of the last request of each region, to
+// annotate the region's errors with, and with --aws-debug logs every
+// attempt: the operation, endpoint, attempt number, status and request ID.
+// Request headers, and so the credentials, are never logged.
+func (c *CheckConfig) trackAwsRequest(r *request.Request) {
+	region := aws.StringValue(r.Config.Region)
+	if r.RequestID != "" {
+		c.awsRequestIdsMu.Lock()
+		if c.awsRequestIds == nil {
+			c.awsRequestIds = make(map[string]string)
+		}
+		c.awsRequestIds[region] = r.RequestID
+		c.awsRequestIdsMu.Unlock()
+	}
+	if !c.awsDebug {
+		return
+	}
+	var method, endpoint string
+	if r.HTTPRequest != nil {
+		method = r.HTTPRequest.Method
+		endpoint = r.HTTPRequest.URL.Scheme + "://" + r.HTTPRequest.URL.Host + r.HTTPRequest.URL.Path
+	}
+	status := 0
+	if r.HTTPResponse != nil {
+		status = r.HTTPResponse.StatusCode
+	}
+	if r.Error != nil {
+		log.Printf("DEBUG: AWS %s:%s %s %s (region %s) attempt %d: status %d, request ID %s, error: %s", r.ClientInfo.ServiceName, r.Operation.Name, method, endpoint, region, r.RetryCount+1, status, r.RequestID, r.Error)
+		return
+	}
+	log.Printf("DEBUG: AWS %s:%s %s %s (region %s) attempt %d: status %d, request ID %s", r.ClientInfo.ServiceName, r.Operation.Name, method, endpoint, region, r.RetryCount+1, status, r.RequestID)
+}
+
+// lastAwsRequestId returns the ID of the last AWS request made in a region
+// since forgetAwsRequestId, if any.
+func (c *CheckConfig) lastAwsRequestId(region string) string {
+	c.awsRequestIdsMu.Lock()
+	defer c.awsRequestIdsMu.Unlock()
+	return c.awsRequestIds[region]
+}
+
+func (c *CheckConfig) forgetAwsRequestId(region string) {
+	c.awsRequestIdsMu.Lock()
+	defer c.awsRequestIdsMu.Unlock()
+	delete(c.awsRequestIds, region)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestTrackAwsRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amzn-Requestid", "req-0123")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<Response><Errors><Error><Code>UnauthorizedOperation</Code><Message>denied</Message></Error></Errors><RequestID>req-0123</RequestID></Response>`))
+	}))
+	defer server.Close()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	c := testConfig()
+	c.awsAccessKeyId, c.awsSecretAccessKey = "AKIAEXAMPLE", "very-secret"
+	c.awsDebug = true
+	awsSession, err := c.newAwsSession("us-west-2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := ec2.New(awsSession, &aws.Config{Endpoint: aws.String(server.URL)})
+	if _, err := svc.DescribeRegions(&ec2.DescribeRegionsInput{}); err == nil {
+		t.Fatal("expected the request to fail")
+	}
+
+	if id := c.lastAwsRequestId("us-west-2"); id != "req-0123" {
+		t.Errorf("unexpected last request ID %q", id)
+	}
+	output := logged.String()
+	if !strings.Contains(output, "DEBUG: AWS ec2:DescribeRegions POST "+server.URL+"/ (region us-west-2) attempt 1: status 403, request ID req-0123") {
+		t.Errorf("unexpected log output: %s", output)
+	}
+	if strings.Contains(output, "AKIAEXAMPLE") || strings.Contains(output, "very-secret") {
+		t.Errorf("credentials logged: %s", output)
+	}
+
+	c.forgetAwsRequestId("us-west-2")
+	if id := c.lastAwsRequestId("us-west-2"); id != "" {
+		t.Errorf("unexpected last request ID %q", id)
+	}
+}
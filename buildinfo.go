@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// buildInfo is what the binary knows about its build, from the -X ldflags
+// of .goreleaser.yml. Fields the build did not set read "unknown".
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentBuildInfo() buildInfo {
+	known := func(value string) string {
+		if value == "" {
+			return "unknown"
+		}
+		return value
+	}
+	return buildInfo{Version: known(version), Commit: known(commit), Date: known(date), GoVersion: runtime.Version()}
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("%s %s (commit %s, built %s, %s)", managedByValue, b.Version, b.Commit, b.Date, b.GoVersion)
+}
+
+// userAgent identifies the build in the requests made to the Sensu and AWS
+// APIs, and in the provenance annotation of the entities.
+func userAgent() string {
+	return managedByValue + "/" + currentBuildInfo().Version
+}
+
+// writeBuildInfo writes the build info as JSON, for --print-build-info.
+func writeBuildInfo(w io.Writer) error {
+	b, err := json.Marshal(currentBuildInfo())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// TestReleaseLdflags fails when the release build stops setting a build
+// info variable, or sets one that no longer exists.
+func TestReleaseLdflags(t *testing.T) {
+	b, err := ioutil.ReadFile(".goreleaser.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := make(map[string]bool)
+	for _, match := range regexp.MustCompile(`-X main\.(\w+)=`).FindAllStringSubmatch(string(b), -1) {
+		set[match[1]] = true
+	}
+	variables := map[string]*string{"version": &version, "commit": &commit, "date": &date}
+	for name := range variables {
+		if !set[name] {
+			t.Errorf(".goreleaser.yml does not set main.%s", name)
+		}
+	}
+	for name := range set {
+		if _, ok := variables[name]; !ok {
+			t.Errorf(".goreleaser.yml sets unknown variable main.%s", name)
+		}
+	}
+
+	// A build without the ldflags says so rather than printing nothing.
+	info := currentBuildInfo()
+	if info.Version != "dev" || info.Commit != "unknown" || info.Date != "unknown" {
+		t.Errorf("unexpected build info %+v", info)
+	}
+	var out bytes.Buffer
+	if err := writeBuildInfo(&out); err != nil {
+		t.Fatal(err)
+	}
+	var printed map[string]string
+	if err := json.Unmarshal(out.Bytes(), &printed); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"version", "commit", "date", "go_version"} {
+		if printed[key] == "" {
+			t.Errorf("empty %s in %s", key, out.String())
+		}
+	}
+}
+
+func TestBuildInfoPlumbing(t *testing.T) {
+	defer func(v, c, d string) { version, commit, date = v, c, d }(version, commit, date)
+	version, commit, date = "1.2.3", "abc1234", "2026-10-17T00:00:00Z"
+
+	if !strings.HasPrefix(currentBuildInfo().String(), "sensu-ec2-discovery 1.2.3 (commit abc1234, built 2026-10-17T00:00:00Z, go") {
+		t.Errorf("unexpected build info %s", currentBuildInfo())
+	}
+
+	c := testConfig()
+	entity := c.buildEntity(testInstance("i-0123", "running"))
+	if entity.Annotations[provenanceAnnotation] != "sensu-ec2-discovery/1.2.3" {
+		t.Errorf("unexpected provenance %q", entity.Annotations[provenanceAnnotation])
+	}
+	// A new build alone does not rewrite the entities.
+	version = "1.2.4"
+	if changes := diffEntity(entity, c.buildEntity(testInstance("i-0123", "running"))); len(changes) > 0 {
+		t.Errorf("unexpected changes %v", changes)
+	}
+
+	var summary bytes.Buffer
+	newRunSummary().print(&summary, c)
+	if !strings.Contains(summary.String(), "(sensu-ec2-discovery/1.2.4, correlation ID ") {
+		t.Errorf("unexpected summary %q", summary.String())
+	}
+
+	c.awsAccessKeyId, c.awsSecretAccessKey = "AKIAEXAMPLE", "very-secret"
+	awsSession, err := c.newAwsSession("us-east-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := ec2.New(awsSession).DescribeInstancesRequest(&ec2.DescribeInstancesInput{})
+	if err := req.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if agent := req.HTTPRequest.Header.Get("User-Agent"); !strings.HasSuffix(agent, " sensu-ec2-discovery/1.2.4") {
+		t.Errorf("unexpected AWS User-Agent %q", agent)
+	}
+}
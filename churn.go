@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// churnControl defers the updates of entities written less than
+// --min-update-interval ago, unless a --significant-fields field changed.
+// The write times are kept in --state-file.
+type churnControl struct {
+	sync.Mutex
+	written  map[string]time.Time
+	deferred int
+}
+
+// parseSignificantFields reads a comma-separated list of name, class,
+// subscriptions, state, network, label:<key> and annotation:<key>, as the
+// fields of diffEntity they stand for.
+func parseSignificantFields(spec string) (map[string]bool, error) {
+	fields := make(map[string]bool)
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "":
+		case field == "name" || field == "class" || field == "subscriptions":
+			fields[field] = true
+		case field == "state":
+			fields["label:"+instanceStateLabel] = true
+		case field == "network":
+			fields["system.network"] = true
+		case strings.HasPrefix(field, "label:") && field != "label:",
+			strings.HasPrefix(field, "annotation:") && field != "annotation:":
+			fields[field] = true
+		default:
+			return nil, fmt.Errorf("invalid --significant-fields field \"%s\", expected name, class, subscriptions, state, network, label:<key> or annotation:<key>", field)
+		}
+	}
+	return fields, nil
+}
+
+func (c *CheckConfig) validateChurnArgs() error {
+	if c.minUpdateInterval == "" {
+		return nil
+	}
+	if c.stateFile == "" {
+		return fmt.Errorf("--min-update-interval requires --state-file, which records when the entities were written")
+	}
+	var err error
+	if c.minUpdateDuration, err = time.ParseDuration(c.minUpdateInterval); err != nil {
+		return fmt.Errorf("invalid --min-update-interval: %s", err)
+	}
+	if c.significantFieldSet, err = parseSignificantFields(c.significantFields); err != nil {
+		return err
+	}
+	return nil
+}
+
+// loadChurnControl loads when the entities were last written by previous
+// runs.
+func (c *CheckConfig) loadChurnControl() error {
+	state, err := loadState(c.stateFile)
+	if err != nil {
+		return err
+	}
+	c.churn = &churnControl{written: make(map[string]time.Time)}
+	if state != nil && state.Updates != nil {
+		c.churn.written = state.Updates
+	}
+	return nil
+}
+
+// churnSnapshot returns the write times that still defer updates, for the
+// state file to keep.
+func (c *CheckConfig) churnSnapshot(now time.Time) map[string]time.Time {
+	if c.churn == nil {
+		return nil
+	}
+	c.churn.Lock()
+	defer c.churn.Unlock()
+	snapshot := make(map[string]time.Time)
+	for key, writtenAt := range c.churn.written {
+		if now.Sub(writtenAt) < c.minUpdateDuration {
+			snapshot[key] = writtenAt
+		}
+	}
+	return snapshot
+}
+
+func churnKey(entity *corev2.Entity) string {
+	return entity.Namespace + "/" + entity.Name
+}
+
+// significantChange reports whether writing updated over existing changes
+// one of the --significant-fields.
+func (c *CheckConfig) significantChange(existing *corev2.Entity, updated *corev2.Entity) bool {
+	if c.significantFieldSet["name"] && existing.Name != updated.Name {
+		return true
+	}
+	if c.significantFieldSet["class"] && existing.EntityClass != updated.EntityClass {
+		return true
+	}
+	for _, change := range diffEntity(existing, updated) {
+		if c.significantFieldSet[change.Field] {
+			return true
+		}
+	}
+	return false
+}
+
+// deferUpdate reports whether the update of an entity is deferred, it
+// having been written less than --min-update-interval ago with no
+// significant change since.
+func (c *CheckConfig) deferUpdate(existing *corev2.Entity, updated *corev2.Entity, now time.Time) bool {
+	if c.churn == nil {
+		return false
+	}
+	c.churn.Lock()
+	writtenAt, ok := c.churn.written[churnKey(existing)]
+	c.churn.Unlock()
+	if !ok || now.Sub(writtenAt) >= c.minUpdateDuration || c.significantChange(existing, updated) {
+		return false
+	}
+	c.churn.Lock()
+	c.churn.deferred++
+	c.churn.Unlock()
+	c.logDebug("deferring the update of entity \"%s\", written %s ago", existing.Name, now.Sub(writtenAt).Round(time.Second))
+	return true
+}
+
+// entityWritten records when an entity was written, for deferUpdate.
+func (c *CheckConfig) entityWritten(entity *corev2.Entity, now time.Time) {
+	if c.churn == nil {
+		return
+	}
+	c.churn.Lock()
+	defer c.churn.Unlock()
+	c.churn.written[churnKey(entity)] = now
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestMinUpdateInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := testConfig()
+	c.minUpdateInterval = "1h"
+	c.significantFields = "name,class,subscriptions,state"
+	if err := c.validateChurnArgs(); err == nil {
+		t.Error("expected an error without --state-file")
+	}
+	c.stateFile = filepath.Join(dir, "state.json")
+	if err := c.validateChurnArgs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.loadChurnControl(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	existing := corev2.FixtureEntity("web-01")
+	existing.EntityClass = corev2.EntityProxyClass
+	existing.Labels = map[string]string{managedByLabel: managedByValue, instanceStateLabel: "running", "uptime": "1d"}
+	c.entityWritten(existing, now.Add(-10*time.Minute))
+
+	desired := corev2.FixtureEntity("web-01")
+	desired.EntityClass = corev2.EntityProxyClass
+	desired.Labels = map[string]string{managedByLabel: managedByValue, instanceStateLabel: "running", "uptime": "2d"}
+	if updated := c.planUpdate(existing, desired); updated != nil {
+		t.Errorf("update not deferred: %v", diffEntity(existing, updated))
+	}
+	if c.churn.deferred != 1 {
+		t.Errorf("unexpected %d deferred updates", c.churn.deferred)
+	}
+
+	// A significant change is written regardless.
+	desired.Labels[instanceStateLabel] = "stopped"
+	if c.planUpdate(existing, desired) == nil {
+		t.Error("state change deferred")
+	}
+
+	// So is any change once the interval has passed.
+	desired.Labels[instanceStateLabel] = "running"
+	c.entityWritten(existing, now.Add(-2*time.Hour))
+	if c.planUpdate(existing, desired) == nil {
+		t.Error("update deferred after the interval")
+	}
+
+	// The state file only keeps the write times that still defer updates.
+	other := corev2.FixtureEntity("web-02")
+	c.entityWritten(other, now)
+	snapshot := c.churnSnapshot(now)
+	if len(snapshot) != 1 || snapshot[churnKey(other)].IsZero() {
+		t.Errorf("unexpected snapshot %v", snapshot)
+	}
+}
+
+func TestParseSignificantFields(t *testing.T) {
+	fields, err := parseSignificantFields("state, network,label:env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"label:" + instanceStateLabel, "system.network", "label:env"} {
+		if !fields[field] {
+			t.Errorf("missing field %s in %v", field, fields)
+		}
+	}
+	if _, err := parseSignificantFields("uptime"); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
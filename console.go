@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// consoleUrlAnnotation links to the EC2 console page of the instance of an
+// entity, with --console-links.
+const consoleUrlAnnotation = "sensu.io/plugins/ec2-discovery/console-url"
+
+// consoleHosts are the console hostnames of the partitions that do not
+// use per-region hostnames.
+var consoleHosts = map[string]string{
+	endpoints.AwsCnPartitionID:    "console.amazonaws.cn",
+	endpoints.AwsUsGovPartitionID: "console.amazonaws-us-gov.com",
+}
+
+// consoleUrl returns the EC2 console URL of an instance, for the partition
+// of its region. It only depends on the region and ID of the instance, so
+// it changes, and the entity is updated, only when they do.
+func consoleUrl(instance *discoveredInstance) string {
+	region := instance.Region
+	host := region + ".console.aws.amazon.com"
+	if partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		if partitionHost, ok := consoleHosts[partition.ID()]; ok {
+			host = partitionHost
+		}
+	}
+	return fmt.Sprintf("https://%s/ec2/home?region=%s#InstanceDetails:instanceId=%s", host, region, aws.StringValue(instance.InstanceId))
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestConsoleUrl(t *testing.T) {
+	for region, expected := range map[string]string{
+		"us-west-2":     "https://us-west-2.console.aws.amazon.com/ec2/home?region=us-west-2#InstanceDetails:instanceId=i-0123",
+		"cn-north-1":    "https://console.amazonaws.cn/ec2/home?region=cn-north-1#InstanceDetails:instanceId=i-0123",
+		"us-gov-west-1": "https://console.amazonaws-us-gov.com/ec2/home?region=us-gov-west-1#InstanceDetails:instanceId=i-0123",
+	} {
+		instance := testInstance("i-0123", "running")
+		instance.Region = region
+		if url := consoleUrl(instance); url != expected {
+			t.Errorf("%s: unexpected URL %s", region, url)
+		}
+	}
+}
+
+func TestConsoleLinkUpdates(t *testing.T) {
+	c := testConfig()
+	c.consoleLinks = true
+	existing := c.buildEntity(testInstance("i-0123", "running"))
+	if existing.Annotations[consoleUrlAnnotation] == "" {
+		t.Fatal("missing console URL annotation")
+	}
+	if updated := c.planUpdate(existing, c.buildEntity(testInstance("i-0123", "running"))); updated != nil {
+		t.Errorf("spurious update: %v", diffEntity(existing, updated))
+	}
+
+	moved := testInstance("i-0123", "running")
+	moved.Region = "eu-west-1"
+	updated := c.planUpdate(existing, c.buildEntity(moved))
+	if updated == nil || updated.Annotations[consoleUrlAnnotation] != consoleUrl(moved) {
+		t.Errorf("the console URL was not updated: %+v", updated)
+	}
+}
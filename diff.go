@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// entityChange is the before and after value of a field of an entity, e.g.
+// label:env. An empty value means the field is absent.
+type entityChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// entityDiff is what reconciliation does to a single entity.
+type entityDiff struct {
+	Entity     string         `json:"entity"`
+	Namespace  string         `json:"namespace"`
+	InstanceId string         `json:"aws_instance_id"`
+	Changes    []entityChange `json:"changes,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+}
+
+// diffReport collects the entities a run creates, updates and deletes, or
+// would in a dry-run, see --diff. Its methods do nothing on a nil report.
+type diffReport struct {
+	sync.Mutex
+	Create []entityDiff `json:"create"`
+	Update []entityDiff `json:"update"`
+	Delete []entityDiff `json:"delete"`
+	Ignore []entityDiff `json:"ignore"`
+}
+
+func newDiffReport() *diffReport {
+	return &diffReport{Create: []entityDiff{}, Update: []entityDiff{}, Delete: []entityDiff{}, Ignore: []entityDiff{}}
+}
+
+// diffEntity lists the changes writing updated over existing makes, other
+// than to the last-seen timestamp, the provenance and the discovered keys.
+// Updates are planned from it, so that the diff report and the updates
+// made cannot disagree.
+func diffEntity(existing *corev2.Entity, updated *corev2.Entity) []entityChange {
+	changes := diffStringMaps("label:", existing.Labels, updated.Labels)
+	changes = append(changes, diffStringMaps("annotation:", existing.Annotations, updated.Annotations, lastSeenAnnotation, provenanceAnnotation, discoveredLabelsAnnotation, discoveredAnnotationsAnnotation)...)
+	if !stringSlicesEqual(existing.Subscriptions, updated.Subscriptions) {
+		changes = append(changes, entityChange{Field: "subscriptions", Before: strings.Join(existing.Subscriptions, ","), After: strings.Join(updated.Subscriptions, ",")})
+	}
+	if !existing.System.Network.Equal(&updated.System.Network) {
+		changes = append(changes, entityChange{Field: "system.network", Before: describeNetwork(existing.System.Network), After: describeNetwork(updated.System.Network)})
+	}
+	return changes
+}
+
+func diffStringMaps(prefix string, before map[string]string, after map[string]string, ignore ...string) []entityChange {
+	var keys []string
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	ignored := make(map[string]bool)
+	for _, key := range ignore {
+		ignored[key] = true
+	}
+	var changes []entityChange
+	for _, key := range keys {
+		if !ignored[key] && before[key] != after[key] {
+			changes = append(changes, entityChange{Field: prefix + key, Before: before[key], After: after[key]})
+		}
+	}
+	return changes
+}
+
+func describeNetwork(network corev2.Network) string {
+	var addresses []string
+	for _, iface := range network.Interfaces {
+		addresses = append(addresses, iface.Addresses...)
+	}
+	return strings.Join(addresses, ",")
+}
+
+func newEntityDiff(entity *corev2.Entity) entityDiff {
+	return entityDiff{Entity: entity.Name, Namespace: entity.Namespace, InstanceId: entityInstanceId(entity)}
+}
+
+func (r *diffReport) create(entity *corev2.Entity) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.Create = append(r.Create, newEntityDiff(entity))
+}
+
+func (r *diffReport) update(existing *corev2.Entity, updated *corev2.Entity) {
+	if r == nil {
+		return
+	}
+	diff := newEntityDiff(existing)
+	diff.Changes = diffEntity(existing, updated)
+	r.Lock()
+	defer r.Unlock()
+	r.Update = append(r.Update, diff)
+}
+
+func (r *diffReport) delete(namespace string, name string, instanceId string, reason string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.Delete = append(r.Delete, entityDiff{Entity: name, Namespace: namespace, InstanceId: instanceId, Reason: reason})
+}
+
+// ignore records an entity left alone for its ignore annotation, once.
+func (r *diffReport) ignore(namespace string, name string, instanceId string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, diff := range r.Ignore {
+		if diff.Namespace == namespace && diff.Entity == name {
+			return
+		}
+	}
+	r.Ignore = append(r.Ignore, entityDiff{Entity: name, Namespace: namespace, InstanceId: instanceId, Reason: fmt.Sprintf("annotated %s: %s", ignoreAnnotation, ignoreValue)})
+}
+
+func sortEntityDiffs(diffs []entityDiff) {
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Namespace != diffs[j].Namespace {
+			return diffs[i].Namespace < diffs[j].Namespace
+		}
+		return diffs[i].Entity < diffs[j].Entity
+	})
+}
+
+// print writes the report as text, one line per entity and changed field,
+// or as a JSON document.
+func (r *diffReport) print(w io.Writer, format string) error {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, diffs := range [][]entityDiff{r.Create, r.Update, r.Delete, r.Ignore} {
+		sortEntityDiffs(diffs)
+	}
+	if format == "json" {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", b)
+		return nil
+	}
+	for _, diff := range r.Create {
+		fmt.Fprintf(w, "+ create %s/%s (aws_instance_id=%s)\n", diff.Namespace, diff.Entity, diff.InstanceId)
+	}
+	for _, diff := range r.Update {
+		fmt.Fprintf(w, "~ update %s/%s (aws_instance_id=%s)\n", diff.Namespace, diff.Entity, diff.InstanceId)
+		for _, change := range diff.Changes {
+			fmt.Fprintf(w, "    %s: %q -> %q\n", change.Field, change.Before, change.After)
+		}
+	}
+	for _, diff := range r.Delete {
+		fmt.Fprintf(w, "- delete %s/%s (aws_instance_id=%s): %s\n", diff.Namespace, diff.Entity, diff.InstanceId, diff.Reason)
+	}
+	for _, diff := range r.Ignore {
+		fmt.Fprintf(w, "! ignore %s/%s (aws_instance_id=%s): %s\n", diff.Namespace, diff.Entity, diff.InstanceId, diff.Reason)
+	}
+	fmt.Fprintf(w, "diff: %d to create, %d to update, %d to delete, %d ignored\n", len(r.Create), len(r.Update), len(r.Delete), len(r.Ignore))
+	return nil
+}
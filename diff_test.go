@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestDiffReport(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.dryRun = true
+	c.diff = newDiffReport()
+
+	existing := c.buildEntity(testInstance("i-0456", "running"))
+	existing.Labels["env"] = "dev"
+	existing.Subscriptions = []string{"entity:i-0456"}
+	backend.entities["i-0456"] = existing
+	backend.entities["i-0789"] = c.buildEntity(testInstance("i-0789", "running"))
+	ignored := c.buildEntity(testInstance("i-0999", "running"))
+	ignored.Annotations[ignoreAnnotation] = ignoreValue
+	ignored.Labels["env"] = "tuned"
+	backend.entities["i-0999"] = ignored
+
+	c.registerInstance(testInstance("i-0123", "running"))
+	c.registerInstance(testInstance("i-0456", "stopped"))
+	c.registerInstance(testInstance("i-0789", "running"))
+	if result := c.registerInstance(testInstance("i-0999", "stopped")); result.Outcome != outcomeIgnored {
+		t.Errorf("unexpected result for an ignored entity: %+v", result)
+	}
+	report := c.planOrphanPrune([]*corev2.Entity{backend.entities["i-0789"], ignored}, map[string]bool{}, nil, 0, time.Now())
+	c.pruneMaxDelete = 10
+	if err := c.executePrune(report); err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	if err := c.diff.print(&output, "text"); err != nil {
+		t.Fatal(err)
+	}
+	expected := `+ create default/i-0123 (aws_instance_id=i-0123)
+~ update default/i-0456 (aws_instance_id=i-0456)
+    label:aws_instance_state: "running" -> "stopped"
+- delete default/i-0789 (aws_instance_id=i-0789): not in discovery results
+! ignore default/i-0999 (aws_instance_id=i-0999): annotated sensu.io/ec2-discovery: ignore
+diff: 1 to create, 1 to update, 1 to delete, 1 ignored
+`
+	if output.String() != expected {
+		t.Errorf("unexpected diff:\n%s", output.String())
+	}
+
+	output.Reset()
+	if err := c.diff.print(&output, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded diffReport
+	if err := json.Unmarshal(output.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Create) != 1 || len(decoded.Update) != 1 || len(decoded.Update[0].Changes) != 1 || len(decoded.Delete) != 1 || len(decoded.Ignore) != 1 {
+		t.Errorf("unexpected JSON diff: %s", output.String())
+	}
+	if len(backend.requests) == 0 || strings.Contains(strings.Join(backend.requests, ","), "PUT") {
+		t.Errorf("the dry-run wrote entities: %v", backend.requests)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// dryRunWriter returns where --dry-run prints the entities it would write,
+// os.Stdout when unset.
+func (c *CheckConfig) dryRunWriter() io.Writer {
+	if c.dryRunOut != nil {
+		return c.dryRunOut
+	}
+	return os.Stdout
+}
+
+// printDryRunEntity prints an entity --dry-run would write, with verb
+// register or update.
+func (c *CheckConfig) printDryRunEntity(verb string, entity *corev2.Entity) {
+	keys := make([]string, 0, len(entity.Labels))
+	for key := range entity.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := make([]string, 0, len(keys))
+	for _, key := range keys {
+		labels = append(labels, key+"="+entity.Labels[key])
+	}
+	c.dryRunLock.Lock()
+	defer c.dryRunLock.Unlock()
+	fmt.Fprintf(c.dryRunWriter(), "dry-run: would %s entity \"%s\" in namespace \"%s\", labels %s\n", verb, entity.Name, entity.Namespace, strings.Join(labels, ","))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDryRunWithoutCredentials(t *testing.T) {
+	c := &CheckConfig{sensuApiUrl: "http://127.0.0.1:8080"}
+	if err := c.validateSensuCredentials(); err == nil {
+		t.Error("expected Sensu credentials to be required")
+	}
+	c = &CheckConfig{sensuApiUrl: "http://127.0.0.1:8080", dryRun: true, prune: true}
+	if err := c.validateSensuCredentials(); err == nil {
+		t.Error("expected --prune to require Sensu credentials with --dry-run")
+	}
+	c = &CheckConfig{sensuApiUrl: "http://127.0.0.1:8080", dryRun: true}
+	if err := c.validateSensuCredentials(); err != nil || !c.dryRunOffline {
+		t.Errorf("expected a dry-run without Sensu credentials, got %v", err)
+	}
+
+	backend := newFakeBackend()
+	defer backend.Close()
+	c = backend.checkConfig()
+	c.dryRun = true
+	c.dryRunOffline = true
+	var out bytes.Buffer
+	c.dryRunOut = &out
+	run := c.newDiscoveryRun()
+	for _, instance := range []*discoveredInstance{testInstance("i-0123", "running"), testInstance("i-0456", "stopped")} {
+		c.processInstance(run, instance)
+	}
+	if len(backend.requests) != 0 {
+		t.Errorf("a dry-run without credentials called the Sensu API: %v", backend.requests)
+	}
+	if !strings.Contains(out.String(), `dry-run: would register entity "i-0123" in namespace "default", labels `) ||
+		!strings.Contains(out.String(), "sensu.io/managed_by=sensu-ec2-discovery") {
+		t.Errorf("unexpected dry-run output %q", out.String())
+	}
+
+	out.Reset()
+	run.summary.print(&out, c)
+	if !strings.Contains(out.String(), "dry-run: 2 entities would be registered, 0 updated across 1 regions") {
+		t.Errorf("unexpected summary %q", out.String())
+	}
+}
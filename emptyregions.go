@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseRegionMinimums parses the comma-separated region=count pairs of
+// --region-minimums.
+func parseRegionMinimums(spec string) (map[string]int, error) {
+	minimums := make(map[string]int)
+	for _, pair := range splitList(spec) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid --region-minimums entry \"%s\", expected region=count", pair)
+		}
+		minimum, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || minimum < 0 {
+			return nil, fmt.Errorf("invalid --region-minimums count \"%s\" for region %s", parts[1], parts[0])
+		}
+		minimums[strings.TrimSpace(parts[0])] = minimum
+	}
+	return minimums, nil
+}
+
+// emptyRegions describes the regions described successfully that yielded
+// no instance with --warn-on-empty-region, or fewer than their
+// --region-minimums. When --state-file is set, regions the previous run
+// did not describe have no history to expect anything from and are only
+// held to --warn-on-empty-region.
+func (c *CheckConfig) emptyRegions(s *runSummary) []string {
+	if !c.warnOnEmptyRegion && len(c.regionMinimumMap) == 0 {
+		return nil
+	}
+	var regions []string
+	for region := range s.regions {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	var empty []string
+	for _, region := range regions {
+		if s.failedRegions[region] {
+			continue
+		}
+		count := s.regions[region]
+		minimum, expected := c.regionMinimumMap[region]
+		if expected && s.previousRegions != nil {
+			_, expected = s.previousRegions[region]
+		}
+		switch {
+		case expected && count < minimum:
+			empty = append(empty, fmt.Sprintf("region %s yielded %d instances, expected at least %d", region, count, minimum))
+		case c.warnOnEmptyRegion && count == 0:
+			empty = append(empty, fmt.Sprintf("region %s yielded no instances", region))
+		}
+	}
+	return empty
+}
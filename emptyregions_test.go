@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEmptyRegions(t *testing.T) {
+	c := testConfig()
+	summary := newRunSummary()
+	summary.regions = map[string]int{"us-east-1": 0, "us-west-2": 4, "eu-west-1": 0, "ap-south-1": 0}
+	summary.failedRegions["ap-south-1"] = true
+	if empty := c.emptyRegions(summary); empty != nil {
+		t.Errorf("unexpected empty regions without --warn-on-empty-region: %v", empty)
+	}
+
+	c.warnOnEmptyRegion = true
+	expected := []string{"region eu-west-1 yielded no instances", "region us-east-1 yielded no instances"}
+	if empty := c.emptyRegions(summary); !reflect.DeepEqual(empty, expected) {
+		t.Errorf("unexpected empty regions %v", empty)
+	}
+
+	minimums, err := parseRegionMinimums("us-west-2=10, eu-west-1=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.warnOnEmptyRegion = false
+	c.regionMinimumMap = minimums
+	expected = []string{"region eu-west-1 yielded 0 instances, expected at least 1", "region us-west-2 yielded 4 instances, expected at least 10"}
+	if empty := c.emptyRegions(summary); !reflect.DeepEqual(empty, expected) {
+		t.Errorf("unexpected empty regions %v", empty)
+	}
+
+	// Regions the previous run did not describe are exempt from their
+	// minimum.
+	summary.previousRegions = map[string]int{"us-west-2": 12}
+	summary.emptyRegions = c.emptyRegions(summary)
+	expected = []string{"region us-west-2 yielded 4 instances, expected at least 10"}
+	if !reflect.DeepEqual(summary.emptyRegions, expected) {
+		t.Errorf("unexpected empty regions %v", summary.emptyRegions)
+	}
+	if status, category := summary.statusCause(c); status != statusWarning || category != categoryEmptyRegion {
+		t.Errorf("unexpected status: %d (%s)", status, category)
+	}
+	var output bytes.Buffer
+	summary.print(&output, c)
+	if !strings.Contains(output.String(), "empty region: region us-west-2 yielded 4 instances, expected at least 10\n") {
+		t.Errorf("summary does not list the empty region:\n%s", output.String())
+	}
+
+	for _, spec := range []string{"us-east-1", "us-east-1=many", "=3", "us-east-1=-1"} {
+		if _, err := parseRegionMinimums(spec); err == nil {
+			t.Errorf("expected an error for --region-minimums %q", spec)
+		}
+	}
+}
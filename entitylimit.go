@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// entityCountHeader and entityLimitHeader are set on API responses by
+	// backends whose license caps the number of entities.
+	entityCountHeader = "Sensu-Entity-Count"
+	entityLimitHeader = "Sensu-Entity-Limit"
+)
+
+// entityLimit is the entity count of the backend before the run and the
+// entity limit of its license, zero when unknown.
+type entityLimit struct {
+	count int
+	limit int
+}
+
+// loadEntityLimit fetches the entity count and limit of the backend from
+// the headers of a single-entity list request, counting the entities of the
+// namespaces to discover into when the backend does not report the count.
+// The limit defaults to --entity-limit.
+func (c *CheckConfig) loadEntityLimit() error {
+	c.entityLimit = &entityLimit{limit: int(c.entityLimitOverride)}
+	resp, err := c.sensuApiRequest("GET", c.sensuNamespace, entitiesPath(c.sensuNamespace)+"?limit=1", nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the entity count: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch the entity count: %w", c.statusError(resp))
+	}
+	if limit, err := strconv.Atoi(resp.Header.Get(entityLimitHeader)); err == nil && limit > 0 && c.entityLimitOverride == 0 {
+		c.entityLimit.limit = limit
+	}
+	if count, err := strconv.Atoi(resp.Header.Get(entityCountHeader)); err == nil {
+		c.entityLimit.count = count
+	} else {
+		for _, namespace := range c.pruneNamespaces(nil) {
+			entities, err := c.listEntities(namespace)
+			if err != nil {
+				return err
+			}
+			c.entityLimit.count += len(entities)
+		}
+	}
+	if c.entityLimit.limit == 0 {
+		log.Printf("INFO: the backend has %d entities and does not report its entity limit, set --entity-limit", c.entityLimit.count)
+		return nil
+	}
+	if c.entityLimitReached(c.entityLimit.count) {
+		log.Printf("WARNING: the backend has %d entities, %d%% of its limit of %d, before registering", c.entityLimit.count, c.entityLimit.count*100/c.entityLimit.limit, c.entityLimit.limit)
+	} else {
+		c.logDebug("the backend has %d entities of its limit of %d", c.entityLimit.count, c.entityLimit.limit)
+	}
+	return nil
+}
+
+// entityLimitReached reports whether count is at least
+// --entity-limit-warning-percent of the entity limit.
+func (c *CheckConfig) entityLimitReached(count int) bool {
+	return c.entityLimit != nil && c.entityLimit.limit > 0 && uint64(count)*100 >= c.entityLimitWarningPercent*uint64(c.entityLimit.limit)
+}
+
+// projectedEntityCount is the entity count of the backend once the entities
+// created, or that would be created, by the run are added.
+func (s *runSummary) projectedEntityCount(c *CheckConfig) int {
+	if c.entityLimit == nil {
+		return 0
+	}
+	return c.entityLimit.count + s.outcomes[outcomeCreated] + s.outcomes[outcomeDryRun]
+}
+
+// isEntityLimitRejection reports whether err is the backend refusing an
+// entity because its license entity limit is reached.
+func isEntityLimitRejection(err error) bool {
+	var statusErr *apiStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	if statusErr.statusCode == http.StatusPaymentRequired {
+		return true
+	}
+	return statusErr.statusCode >= 400 && statusErr.statusCode < 500 && strings.Contains(strings.ToLower(statusErr.message), "entity limit")
+}
+
+// entityLimitRejected logs the first registration of the run the license
+// rejected as a warning and the others at debug, since they are reported
+// together in the summary.
+func (c *CheckConfig) entityLimitRejected(name string, err error) {
+	if atomic.AddInt32(&c.entityLimitRejections, 1) == 1 {
+		log.Printf("WARNING: entity limit reached, the backend rejected entity \"%s\": %s", name, err)
+		return
+	}
+	c.logDebug("entity limit reached, the backend rejected entity \"%s\": %s", name, err)
+}
+
+// printEntityLimit reports the registrations the license rejected, and the
+// entity count projected after the run when it reaches
+// --entity-limit-warning-percent of the limit.
+func (s *runSummary) printEntityLimit(w io.Writer, c *CheckConfig) {
+	counts := ""
+	if c.entityLimit != nil && c.entityLimit.limit > 0 {
+		counts = fmt.Sprintf(" (%d entities before the run, limit %d)", c.entityLimit.count, c.entityLimit.limit)
+	}
+	if s.entityLimitRejected > 0 {
+		fmt.Fprintf(w, "entity limit reached: the backend license rejected %d registrations%s\n", s.entityLimitRejected, counts)
+	}
+	if s.entityLimitApproaching(c) {
+		projected := s.projectedEntityCount(c)
+		fmt.Fprintf(w, "entity limit approaching: %d entities after the run, %d%% of the limit of %d (--entity-limit-warning-percent %d)\n", projected, projected*100/c.entityLimit.limit, c.entityLimit.limit, c.entityLimitWarningPercent)
+	}
+}
+
+// entityLimitApproaching reports whether the projected entity count
+// reaches --entity-limit-warning-percent of the limit.
+func (s *runSummary) entityLimitApproaching(c *CheckConfig) bool {
+	return c.entityLimitWarningPercent > 0 && c.entityLimitReached(s.projectedEntityCount(c))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestLoadEntityLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(entityCountHeader, "90")
+		w.Header().Set(entityLimitHeader, "100")
+		fmt.Fprint(w, "[]")
+	}))
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.entityLimitWarningPercent = 95
+	if err := c.loadEntityLimit(); err != nil {
+		t.Fatal(err)
+	}
+	if c.entityLimit.count != 90 || c.entityLimit.limit != 100 {
+		t.Fatalf("unexpected entity limit %+v", c.entityLimit)
+	}
+
+	summary := newRunSummary()
+	summary.add(registrationResult{InstanceId: "i-0", Outcome: outcomeCreated})
+	if summary.entityLimitApproaching(c) {
+		t.Error("91 entities of 100 reach 95% of the limit")
+	}
+	for i := 1; i <= 4; i++ {
+		summary.add(registrationResult{InstanceId: fmt.Sprintf("i-%d", i), Outcome: outcomeCreated})
+	}
+	if status, category := summary.statusCause(c); status != statusWarning || category != categoryEntityLimit {
+		t.Errorf("unexpected status: %d (%s)", status, category)
+	}
+	var output bytes.Buffer
+	summary.print(&output, c)
+	if !strings.Contains(output.String(), "entity limit approaching: 95 entities after the run, 95% of the limit of 100") {
+		t.Errorf("summary does not report the projected entity count:\n%s", output.String())
+	}
+}
+
+func TestLoadEntityLimitCounted(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	for _, name := range []string{"a", "b"} {
+		backend.entities[name] = corev2.FixtureEntity(name)
+	}
+
+	c := backend.checkConfig()
+	c.entityLimitWarningPercent = 80
+	c.entityLimitOverride = 10
+	if err := c.loadEntityLimit(); err != nil {
+		t.Fatal(err)
+	}
+	if c.entityLimit.count != 2 || c.entityLimit.limit != 10 {
+		t.Errorf("unexpected entity limit %+v", c.entityLimit)
+	}
+}
+
+func TestEntityLimitRejection(t *testing.T) {
+	c := testConfig()
+	c.entityLimit = &entityLimit{count: 100, limit: 100}
+	summary := newRunSummary()
+	for i, err := range []error{
+		&apiStatusError{statusCode: http.StatusPaymentRequired, message: "402 Payment Required"},
+		&apiStatusError{statusCode: http.StatusForbidden, message: "403 Forbidden: Entity limit reached for this license"},
+	} {
+		if !isEntityLimitRejection(err) {
+			t.Errorf("%s is not recognized as an entity limit rejection", err)
+		}
+		result := c.failedRegistration(corev2.FixtureEntity(fmt.Sprintf("i-%d", i)), err)
+		summary.add(result)
+	}
+	if isEntityLimitRejection(&apiStatusError{statusCode: http.StatusForbidden, message: "403 Forbidden"}) {
+		t.Error("a plain 403 is recognized as an entity limit rejection")
+	}
+
+	var output bytes.Buffer
+	summary.print(&output, c)
+	if !strings.Contains(output.String(), "entity limit reached: the backend license rejected 2 registrations (100 entities before the run, limit 100)\n") {
+		t.Errorf("summary does not report the entity limit:\n%s", output.String())
+	}
+	if strings.Contains(output.String(), "failed: ") {
+		t.Errorf("summary lists the rejected instances:\n%s", output.String())
+	}
+	if status, _ := summary.statusCause(c); status != statusWarning {
+		t.Errorf("unexpected status %d", status)
+	}
+}
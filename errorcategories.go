@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// The error categories of the run summary. Runbook automation parses them,
+// so they must never be renamed.
+const (
+	errorCategoryAwsAuth       = "aws-auth"
+	errorCategoryAwsThrottle   = "aws-throttle"
+	errorCategoryAwsFilter     = "aws-filter"
+	errorCategorySensuAuth     = "sensu-auth"
+	errorCategorySensuConflict = "sensu-conflict"
+	errorCategorySensu5xx      = "sensu-5xx"
+	errorCategoryNetwork       = "network"
+	errorCategoryValidation    = "validation"
+	errorCategoryOther         = "other"
+)
+
+// errorCategory tells what kind of failure err is, for automated triage.
+func errorCategory(err error) string {
+	var timeoutErr *apiTimeoutError
+	var regionTimeoutErr *regionTimeoutError
+	if errors.As(err, &timeoutErr) || errors.As(err, &regionTimeoutErr) {
+		return errorCategoryNetwork
+	}
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) {
+		switch code := statusErr.statusCode; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return errorCategorySensuAuth
+		case code == http.StatusConflict:
+			return errorCategorySensuConflict
+		case code >= 500:
+			return errorCategorySensu5xx
+		case code == http.StatusBadRequest || code == http.StatusUnprocessableEntity:
+			return errorCategoryValidation
+		}
+		return errorCategoryOther
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch code := awsErr.Code(); {
+		case request.IsErrorThrottle(awsErr):
+			return errorCategoryAwsThrottle
+		case code == "NoCredentialProviders", code == "AuthFailure", code == "OptInRequired",
+			code == "InvalidClientTokenId", code == "SignatureDoesNotMatch", code == "RequestExpired",
+			strings.HasPrefix(code, "ExpiredToken"), code == "UnauthorizedOperation", strings.HasPrefix(code, "AccessDenied"):
+			return errorCategoryAwsAuth
+		case strings.HasPrefix(code, "InvalidParameter"), code == "InvalidFilter", strings.HasPrefix(code, "InvalidInstanceID."):
+			return errorCategoryAwsFilter
+		case code == request.ErrCodeRequestError, code == request.ErrCodeResponseTimeout, code == request.CanceledErrorCode:
+			return errorCategoryNetwork
+		}
+		return errorCategoryOther
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) {
+		return errorCategoryNetwork
+	}
+	return errorCategoryOther
+}
+
+// errorCategoryCounts counts the failures of a run per category, keeping
+// the first few of each as examples.
+type errorCategoryCounts struct {
+	sync.Mutex
+	categories map[string]*errorCategoryCount
+}
+
+type errorCategoryCount struct {
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+}
+
+// recordError counts the failure err of the run, keeping example as one
+// of its category unless --error-examples are kept already.
+func (c *CheckConfig) recordError(err error, example string) {
+	category := errorCategory(err)
+	t := &c.errorCategories
+	t.Lock()
+	defer t.Unlock()
+	if t.categories == nil {
+		t.categories = make(map[string]*errorCategoryCount)
+	}
+	count, ok := t.categories[category]
+	if !ok {
+		count = &errorCategoryCount{Examples: []string{}}
+		t.categories[category] = count
+	}
+	count.Count++
+	if uint64(len(count.Examples)) < c.errorExamples {
+		count.Examples = append(count.Examples, example)
+	}
+}
+
+// snapshot returns the counts of the categories that occurred.
+func (t *errorCategoryCounts) snapshot() map[string]errorCategoryCount {
+	t.Lock()
+	defer t.Unlock()
+	snapshot := make(map[string]errorCategoryCount)
+	for category, count := range t.categories {
+		snapshot[category] = errorCategoryCount{Count: count.Count, Examples: append([]string{}, count.Examples...)}
+	}
+	return snapshot
+}
+
+// print writes the categories as a single JSON line, ending the check
+// output, when the run failed anything. The categories come out sorted.
+func (t *errorCategoryCounts) print(w io.Writer) error {
+	snapshot := t.snapshot()
+	if len(snapshot) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(struct {
+		ErrorCategories map[string]errorCategoryCount `json:"error_categories"`
+	}{snapshot})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestErrorCategory(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{awserr.New("Throttling", "Rate exceeded", nil), "aws-throttle"},
+		{awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil), "aws-throttle"},
+		{awserr.New("UnauthorizedOperation", "You are not authorized", nil), "aws-auth"},
+		{awserr.New("NoCredentialProviders", "no valid providers in chain", nil), "aws-auth"},
+		{awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil), "aws-auth"},
+		{awserr.New("InvalidParameterValue", "The filter 'tag:' is invalid", nil), "aws-filter"},
+		{awserr.New("RequestError", "send request failed", nil), "network"},
+		{&apiStatusError{statusCode: 401}, "sensu-auth"},
+		{&apiStatusError{statusCode: 403}, "sensu-auth"},
+		{&apiStatusError{statusCode: 409}, "sensu-conflict"},
+		{&apiStatusError{statusCode: 500}, "sensu-5xx"},
+		{&apiStatusError{statusCode: 503}, "sensu-5xx"},
+		{&apiStatusError{statusCode: 400}, "validation"},
+		{&apiStatusError{statusCode: 422}, "validation"},
+		{fmt.Errorf("register: %w", &apiStatusError{statusCode: 502}), "sensu-5xx"},
+		{&url.Error{Op: "Put", URL: "http://127.0.0.1:8080", Err: errors.New("connection refused")}, "network"},
+		{&apiTimeoutError{side: timeoutSideSensu, operation: "PUT", timeout: time.Second}, "network"},
+		{&regionTimeoutError{timeout: time.Minute}, "network"},
+		{errors.New("something else"), "other"},
+	}
+	for _, test := range tests {
+		if got := errorCategory(test.err); got != test.want {
+			t.Errorf("errorCategory(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	c := testConfig()
+	c.errorExamples = 2
+
+	var out bytes.Buffer
+	if err := c.errorCategories.print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no output without failures, got %q", out.String())
+	}
+
+	for i := 0; i < 3; i++ {
+		c.recordError(&apiStatusError{statusCode: 500}, fmt.Sprintf("register entity i-%d: boom", i))
+	}
+	c.recordError(awserr.New("UnauthorizedOperation", "denied", nil), "region us-west-2: denied")
+	if err := c.errorCategories.print(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"error_categories":{"aws-auth":{"count":1,"examples":["region us-west-2: denied"]},"sensu-5xx":{"count":3,"examples":["register entity i-0: boom","register entity i-1: boom"]}}}` + "\n"
+	if out.String() != want {
+		t.Errorf("expected %s, got %s", want, out.String())
+	}
+}
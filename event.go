@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sensu/sensu-plugins-go-library/sensu"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// triggeringEvent returns the event the check was executed for. The plugin
+// library does not read it for checks, so it is read from stdin on demand.
+func (c *CheckConfig) triggeringEvent(event *corev2.Event) (*corev2.Event, error) {
+	if event != nil {
+		return event, nil
+	}
+	b, err := ioutil.ReadAll(c.stdinReader())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the event from stdin: %s", err)
+	}
+	event = &corev2.Event{}
+	if err := json.Unmarshal(b, event); err != nil {
+		return nil, fmt.Errorf("failed to decode the event from stdin: %s", err)
+	}
+	return event, nil
+}
+
+// optionSet reports whether option was given as a flag in args or through
+// its environment variable, rather than left at its default.
+func optionSet(option *sensu.PluginConfigOption, args []string) bool {
+	if _, ok := os.LookupEnv(option.Env); ok {
+		return true
+	}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--"+option.Argument || strings.HasPrefix(arg, "--"+option.Argument+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceOption returns the --sensu-namespace option.
+func (c *CheckConfig) namespaceOption() *sensu.PluginConfigOption {
+	for _, option := range sensuApiConfigOptions(c) {
+		if option.Value == &c.sensuNamespace {
+			return option
+		}
+	}
+	panic("no --sensu-namespace option")
+}
+
+// applyEventNamespace registers the entities in the namespace of the
+// triggering event when --sensu-namespace is left at its default: the
+// annotation override of the check or entity, then the namespace of the
+// entity, then that of the check. The plugin library does not apply the
+// annotation overrides of checks, so that of the namespace is applied here.
+func (c *CheckConfig) applyEventNamespace(event *corev2.Event, args []string) {
+	option := c.namespaceOption()
+	if event == nil || optionSet(option, args) {
+		return
+	}
+	key := path.Join(c.PluginConfig.Keyspace, option.Path)
+	var namespace, source string
+	switch {
+	case event.Check != nil && event.Check.Annotations[key] != "":
+		namespace, source = event.Check.Annotations[key], "the check annotation "+key
+	case event.Entity != nil && event.Entity.Annotations[key] != "":
+		namespace, source = event.Entity.Annotations[key], "the entity annotation "+key
+	case event.Entity != nil && event.Entity.Namespace != "":
+		namespace, source = event.Entity.Namespace, "the namespace of entity "+event.Entity.Name
+	case event.Check != nil && event.Check.Namespace != "":
+		namespace, source = event.Check.Namespace, "the namespace of check "+event.Check.Name
+	default:
+		return
+	}
+	c.sensuNamespace = namespace
+	log.Printf("INFO: registering in namespace %s, from %s", namespace, source)
+}
+
+// applyEntityLabelFilters overrides the region and tag filters with the
+// labels of the triggering entity, according to a comma-separated list of
+// label=role mappings where role is "region" or "tag:<key>". Labels missing
+// from the entity leave the flag values in place.
+func (c *CheckConfig) applyEntityLabelFilters(event *corev2.Event, mappings string) error {
+	var labels map[string]string
+	if event != nil && event.Entity != nil {
+		labels = event.Entity.Labels
+	}
+
+	tags, err := parseLabelSelectors(c.ec2FilterTags)
+	if err != nil {
+		return fmt.Errorf("invalid --ec2-filter-tags: %s", err)
+	}
+	tagKeys := orderedTagKeys(c.ec2FilterTags)
+
+	for _, mapping := range strings.Split(mappings, ",") {
+		mapping = strings.TrimSpace(mapping)
+		if mapping == "" {
+			continue
+		}
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid --filters-from-entity-labels mapping \"%s\", expected label=role", mapping)
+		}
+		label, role := parts[0], parts[1]
+		switch {
+		case role == "region":
+		case strings.HasPrefix(role, "tag:") && len(role) > len("tag:"):
+		default:
+			return fmt.Errorf("invalid filter role \"%s\", expected region or tag:<key>", role)
+		}
+		value, ok := labels[label]
+		if !ok || value == "" {
+			continue
+		}
+		if role == "region" {
+			c.ec2InstanceRegions = value
+			continue
+		}
+		key := strings.TrimPrefix(role, "tag:")
+		if _, ok := tags[key]; !ok {
+			tagKeys = append(tagKeys, key)
+		}
+		tags[key] = value
+	}
+
+	var pairs []string
+	for _, key := range tagKeys {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+	c.ec2FilterTags = strings.Join(pairs, ",")
+	log.Printf("INFO: effective filters: regions=%s tags=%s", c.ec2InstanceRegions, c.ec2FilterTags)
+	return nil
+}
+
+// orderedTagKeys returns the keys of a key=value list in order.
+func orderedTagKeys(pairs string) []string {
+	var keys []string
+	for _, pair := range strings.Split(pairs, ",") {
+		if key := strings.TrimSpace(strings.SplitN(pair, "=", 2)[0]); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
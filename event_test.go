@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestApplyEntityLabelFilters(t *testing.T) {
+	c := testConfig()
+	c.stdin = strings.NewReader(`{"entity":{"metadata":{"name":"scope-prod","labels":{"aws_region":"us-east-1","env":"prod"}}}}`)
+	c.ec2InstanceRegions = "us-west-2"
+	c.ec2FilterTags = "Team=ops,Environment=dev"
+
+	event, err := c.triggeringEvent(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.applyEntityLabelFilters(event, "aws_region=region,env=tag:Environment,tier=tag:Tier"); err != nil {
+		t.Fatal(err)
+	}
+	if c.ec2InstanceRegions != "us-east-1" {
+		t.Errorf("unexpected regions: %s", c.ec2InstanceRegions)
+	}
+	if c.ec2FilterTags != "Team=ops,Environment=prod" {
+		t.Errorf("unexpected tags: %s", c.ec2FilterTags)
+	}
+
+	if err := c.applyEntityLabelFilters(event, "env=zone"); err == nil {
+		t.Error("expected an error for an unknown filter role")
+	}
+}
+
+func TestApplyEventNamespace(t *testing.T) {
+	os.Unsetenv("SENSU_NAMESPACE")
+	event := corev2.FixtureEvent("web-01", "ec2-discovery")
+	event.Entity.Namespace = "team-a"
+	event.Check.Namespace = "team-b"
+
+	c := testConfig()
+	c.Keyspace = "sensu.io/plugins/ec2-discovery"
+	c.applyEventNamespace(event, nil)
+	if c.sensuNamespace != "team-a" {
+		t.Errorf("unexpected namespace %s", c.sensuNamespace)
+	}
+
+	event.Entity.Namespace = ""
+	c = testConfig()
+	c.applyEventNamespace(event, nil)
+	if c.sensuNamespace != "team-b" {
+		t.Errorf("unexpected namespace %s from the check", c.sensuNamespace)
+	}
+
+	// The annotation override wins over the namespace of the event.
+	c = testConfig()
+	c.Keyspace = "sensu.io/plugins/ec2-discovery"
+	event.Check.Annotations = map[string]string{"sensu.io/plugins/ec2-discovery/sensu-namespace": "team-c"}
+	c.applyEventNamespace(event, nil)
+	if c.sensuNamespace != "team-c" {
+		t.Errorf("unexpected namespace %s with an annotation", c.sensuNamespace)
+	}
+
+	// So do the flag and the environment variable, even at the default.
+	for _, args := range [][]string{{"--sensu-namespace", "default"}, {"--sensu-namespace=default"}} {
+		c = testConfig()
+		c.applyEventNamespace(event, args)
+		if c.sensuNamespace != "default" {
+			t.Errorf("unexpected namespace %s with %v", c.sensuNamespace, args)
+		}
+	}
+	os.Setenv("SENSU_NAMESPACE", "default")
+	defer os.Unsetenv("SENSU_NAMESPACE")
+	c = testConfig()
+	c.applyEventNamespace(event, nil)
+	if c.sensuNamespace != "default" {
+		t.Errorf("unexpected namespace %s with $SENSU_NAMESPACE", c.sensuNamespace)
+	}
+
+	// Without an event the default is kept.
+	os.Unsetenv("SENSU_NAMESPACE")
+	c = testConfig()
+	c.applyEventNamespace(nil, nil)
+	if c.sensuNamespace != "default" {
+		t.Errorf("unexpected namespace %s without an event", c.sensuNamespace)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+func (c *CheckConfig) validateExecutionShardArgs() error {
+	if c.shardCount == 0 {
+		return fmt.Errorf("--shard-count must be at least 1")
+	}
+	if c.shardIndex >= c.shardCount {
+		return fmt.Errorf("--shard-index %d is out of range for --shard-count %d, expected 0 to %d", c.shardIndex, c.shardCount, c.shardCount-1)
+	}
+	return nil
+}
+
+// shardOf returns the shard of an instance among count, hashing its ID so
+// that every execution agrees on it without coordination.
+func shardOf(instanceId string, count uint64) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(instanceId))
+	return uint64(h.Sum32()) % count
+}
+
+// inShard reports whether an instance belongs to this execution with
+// --shard-index and --shard-count. Instances are discovered, and their
+// entities pruned, by their shard only.
+func (c *CheckConfig) inShard(instanceId string) bool {
+	return c.shardCount <= 1 || shardOf(instanceId, c.shardCount) == c.shardIndex
+}
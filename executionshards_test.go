@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestExecutionShards(t *testing.T) {
+	shards := make([]*CheckConfig, 4)
+	for i := range shards {
+		shards[i] = testConfig()
+		shards[i].shardIndex, shards[i].shardCount = uint64(i), 4
+	}
+	counts := make([]int, len(shards))
+	for n := 0; n < 1000; n++ {
+		id := fmt.Sprintf("i-%017x", n)
+		owners := 0
+		for i, c := range shards {
+			if c.inShard(id) {
+				owners++
+				counts[i]++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("instance %s belongs to %d shards", id, owners)
+		}
+	}
+	for i, count := range counts {
+		if count < 150 {
+			t.Errorf("shard %d only got %d of 1000 instances", i, count)
+		}
+	}
+
+	// Prune leaves the entities of the other shards alone.
+	var entities []*corev2.Entity
+	for n := 0; n < 20; n++ {
+		id := fmt.Sprintf("i-%017x", n)
+		entities = append(entities, testEntity(id, "proxy", map[string]string{managedByLabel: managedByValue, instanceIdLabel: id}))
+	}
+	report := shards[1].planOrphanPrune(entities, map[string]bool{}, nil, 0, time.Now())
+	for _, decision := range report.Delete {
+		if shardOf(decision.InstanceId, 4) != 1 {
+			t.Errorf("shard 1 would delete %s of shard %d", decision.InstanceId, shardOf(decision.InstanceId, 4))
+		}
+	}
+	if len(report.Delete) == 0 || len(report.Delete) == len(entities) {
+		t.Errorf("unexpected %d deletions", len(report.Delete))
+	}
+}
+
+func TestValidateExecutionShardArgs(t *testing.T) {
+	c := testConfig()
+	c.shardIndex, c.shardCount = 4, 4
+	if err := c.validateExecutionShardArgs(); err == nil {
+		t.Error("expected an error for an out of range --shard-index")
+	}
+	c.shardCount = 0
+	if err := c.validateExecutionShardArgs(); err == nil {
+		t.Error("expected an error for --shard-count 0")
+	}
+}
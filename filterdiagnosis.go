@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// maxFilterDiagnosisCalls bounds the DescribeInstances calls spent finding
+// the filter EC2 rejected.
+const maxFilterDiagnosisCalls = 5
+
+// isInvalidParameterValue reports whether err is EC2 rejecting a value of
+// the request.
+func isInvalidParameterValue(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == "InvalidParameterValue"
+}
+
+// diagnoseFilters finds which filter, and value if it has several, EC2
+// rejected with InvalidParameterValue, since the error does not tell. The
+// filters are tried one at a time with DryRun, within
+// maxFilterDiagnosisCalls calls, once per run. It returns "" unless
+// diagnosed, and with --no-filter-diagnosis.
+func (c *CheckConfig) diagnoseFilters(ctx context.Context, svc ec2iface.EC2API, filters []*ec2.Filter, err error) string {
+	if c.noFilterDiagnosis || !isInvalidParameterValue(err) {
+		return ""
+	}
+	c.filterDiagnosisOnce.Do(func() {
+		c.filterDiagnosis = c.findRejectedFilter(ctx, svc, filters)
+	})
+	return c.filterDiagnosis
+}
+
+func (c *CheckConfig) findRejectedFilter(ctx context.Context, svc ec2iface.EC2API, filters []*ec2.Filter) string {
+	calls := 0
+	rejects := func(filter *ec2.Filter) bool {
+		calls++
+		_, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+			DryRun:  aws.Bool(true),
+			Filters: []*ec2.Filter{filter},
+		})
+		c.logDebug("filter diagnosis: %s: %v", describeFilters([]*ec2.Filter{filter}), err)
+		return isInvalidParameterValue(err)
+	}
+	for i, filter := range filters {
+		if calls == maxFilterDiagnosisCalls {
+			return fmt.Sprintf("the rejected filter is not among the first %d of %d filters", i, len(filters))
+		}
+		if !rejects(filter) {
+			continue
+		}
+		name, values := aws.StringValue(filter.Name), aws.StringValueSlice(filter.Values)
+		if len(values) > 1 {
+			for _, value := range values {
+				if calls == maxFilterDiagnosisCalls {
+					break
+				}
+				if rejects(&ec2.Filter{Name: filter.Name, Values: aws.StringSlice([]string{value})}) {
+					return fmt.Sprintf("filter %s with value '%s' was rejected", name, value)
+				}
+			}
+		}
+		return fmt.Sprintf("filter %s with value '%s' was rejected", name, strings.Join(values, ","))
+	}
+	return ""
+}
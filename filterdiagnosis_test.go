@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeFilterValidation rejects the filters with a value in invalid, and
+// otherwise answers DryRunOperation.
+type fakeFilterValidation struct {
+	ec2iface.EC2API
+	invalid map[string]bool
+	calls   int
+}
+
+func (f *fakeFilterValidation) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	f.calls++
+	if !aws.BoolValue(input.DryRun) {
+		return nil, errors.New("not a dry run")
+	}
+	for _, filter := range input.Filters {
+		for _, value := range filter.Values {
+			if f.invalid[aws.StringValue(value)] {
+				return nil, awserr.New("InvalidParameterValue", "The filter value is invalid", nil)
+			}
+		}
+	}
+	return nil, awserr.New("DryRunOperation", "Request would have succeeded", nil)
+}
+
+func TestDiagnoseFilters(t *testing.T) {
+	filters := []*ec2.Filter{
+		{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"running"})},
+		{Name: aws.String("tag:Environment"), Values: aws.StringSlice([]string{"production", "stag\x00ing"})},
+		{Name: aws.String("tag:Team"), Values: aws.StringSlice([]string{"web"})},
+	}
+	rejected := awserr.New("InvalidParameterValue", "The filter value is invalid", nil)
+
+	c := testConfig()
+	svc := &fakeFilterValidation{invalid: map[string]bool{"stag\x00ing": true}}
+	diagnosis := c.diagnoseFilters(context.Background(), svc, filters, rejected)
+	if diagnosis != "filter tag:Environment with value 'stag\x00ing' was rejected" {
+		t.Errorf("unexpected diagnosis %q", diagnosis)
+	}
+	if svc.calls != 4 {
+		t.Errorf("unexpected %d calls", svc.calls)
+	}
+
+	// The diagnosis is made once per run.
+	if c.diagnoseFilters(context.Background(), svc, filters, rejected) != diagnosis || svc.calls != 4 {
+		t.Errorf("diagnosis repeated, %d calls", svc.calls)
+	}
+
+	// Only InvalidParameterValue errors are diagnosed.
+	c = testConfig()
+	if diagnosis := c.diagnoseFilters(context.Background(), svc, filters, awserr.New("UnauthorizedOperation", "", nil)); diagnosis != "" {
+		t.Errorf("unexpected diagnosis %q", diagnosis)
+	}
+
+	c = testConfig()
+	c.noFilterDiagnosis = true
+	if diagnosis := c.diagnoseFilters(context.Background(), svc, filters, rejected); diagnosis != "" {
+		t.Errorf("unexpected diagnosis %q with --no-filter-diagnosis", diagnosis)
+	}
+}
+
+func TestDiagnoseFiltersBounded(t *testing.T) {
+	var filters []*ec2.Filter
+	for _, team := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		filters = append(filters, &ec2.Filter{Name: aws.String("tag:Team"), Values: aws.StringSlice([]string{team})})
+	}
+	c := testConfig()
+	svc := &fakeFilterValidation{invalid: map[string]bool{"g": true}}
+	diagnosis := c.diagnoseFilters(context.Background(), svc, filters, awserr.New("InvalidParameterValue", "", nil))
+	if svc.calls != maxFilterDiagnosisCalls {
+		t.Errorf("unexpected %d calls", svc.calls)
+	}
+	if !strings.Contains(diagnosis, "not among the first 5 of 7 filters") {
+		t.Errorf("unexpected diagnosis %q", diagnosis)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/robertkrimen/otto"
+)
+
+// filterExpression is a JavaScript expression, as in Sensu filters, that
+// selects the discovered instances it evaluates to true for. It sees:
+//
+//	instance_id    the instance ID
+//	region         the region of the instance
+//	tags           the tags, by key, e.g. tags.Environment
+//	instance_type  e.g. "m5.large"
+//	state          e.g. "running"
+//	launch_time    the launch time, in Unix seconds
+//	now            the current time, in Unix seconds
+//	subnet_id      the subnet ID, "" outside a VPC
+//	vpc_id         the VPC ID, "" outside a VPC
+//	lifecycle      "spot", "scheduled" or "normal"
+//
+// e.g. instance_type.indexOf("m5") == 0 && now - launch_time > 7 * 86400
+type filterExpression struct {
+	source string
+	script *otto.Script
+	// timeout bounds the evaluation for an instance, see matches.
+	timeout time.Duration
+	// runtimes holds the runtimes of the workers between evaluations.
+	runtimes sync.Pool
+}
+
+// filterExpressionTimeout is how long an expression may take to evaluate
+// for an instance.
+const filterExpressionTimeout = 100 * time.Millisecond
+
+// errFilterExpressionTimeout interrupts an expression that ran for longer
+// than its timeout.
+var errFilterExpressionTimeout = errors.New("filter expression timed out")
+
+// compileFilterExpression compiles an expression, failing on syntax errors.
+func compileFilterExpression(source string) (*filterExpression, error) {
+	script, err := otto.New().Compile("filter-expression", source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --filter-expression: %s", err)
+	}
+	f := &filterExpression{source: source, script: script, timeout: filterExpressionTimeout}
+	f.runtimes.New = func() interface{} {
+		vm := otto.New()
+		vm.Interrupt = make(chan func(), 1)
+		return vm
+	}
+	return f, nil
+}
+
+// filterExpressionContext is the context an instance is evaluated in.
+func filterExpressionContext(instance *discoveredInstance, now time.Time) map[string]interface{} {
+	tags := make(map[string]interface{})
+	for _, tag := range instance.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	var state string
+	if instance.State != nil {
+		state = aws.StringValue(instance.State.Name)
+	}
+	var launchTime int64
+	if instance.LaunchTime != nil {
+		launchTime = instance.LaunchTime.Unix()
+	}
+	lifecycle := "normal"
+	if instance.InstanceLifecycle != nil {
+		lifecycle = aws.StringValue(instance.InstanceLifecycle)
+	}
+	return map[string]interface{}{
+		"instance_id":   aws.StringValue(instance.InstanceId),
+		"region":        instance.Region,
+		"tags":          tags,
+		"instance_type": aws.StringValue(instance.InstanceType),
+		"state":         state,
+		"launch_time":   launchTime,
+		"now":           now.Unix(),
+		"subnet_id":     aws.StringValue(instance.SubnetId),
+		"vpc_id":        aws.StringValue(instance.VpcId),
+		"lifecycle":     lifecycle,
+	}
+}
+
+// matches evaluates the expression for an instance. Instances are processed
+// concurrently, so each evaluation takes a runtime of its own from the
+// pool, returning it once done. Expressions that throw, do not evaluate to
+// a boolean or run for longer than the timeout are errors.
+func (f *filterExpression) matches(instance *discoveredInstance, now time.Time) (matched bool, err error) {
+	vm := f.runtimes.Get().(*otto.Otto)
+	timer := time.AfterFunc(f.timeout, func() {
+		vm.Interrupt <- func() {
+			panic(errFilterExpressionTimeout)
+		}
+	})
+	defer func() {
+		// An interrupted runtime, or one about to be, is not reused.
+		if !timer.Stop() {
+			if caught := recover(); caught != nil {
+				if caught != errFilterExpressionTimeout {
+					panic(caught)
+				}
+				matched, err = false, fmt.Errorf("evaluation exceeded %s", f.timeout)
+			}
+			return
+		}
+		f.runtimes.Put(vm)
+	}()
+
+	for name, value := range filterExpressionContext(instance, now) {
+		if err := vm.Set(name, value); err != nil {
+			return false, err
+		}
+	}
+	value, err := vm.Run(f.script)
+	if err != nil {
+		return false, err
+	}
+	if !value.IsBoolean() {
+		return false, fmt.Errorf("evaluated to %s, not a boolean", value)
+	}
+	return value.ToBoolean()
+}
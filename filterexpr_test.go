@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestCompileFilterExpression(t *testing.T) {
+	if _, err := compileFilterExpression(`instance_type.indexOf("m5") == 0 &&`); err == nil {
+		t.Error("expected a syntax error")
+	}
+}
+
+func TestFilterExpressionMatches(t *testing.T) {
+	now := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	instance := testInstance("i-0123", "running")
+	instance.InstanceType = aws.String("m5.large")
+	instance.LaunchTime = aws.Time(now.Add(-10 * 24 * time.Hour))
+	instance.SubnetId = aws.String("subnet-a")
+	instance.VpcId = aws.String("vpc-1")
+	instance.Tags = []*ec2.Tag{{Key: aws.String("Environment"), Value: aws.String("prod")}}
+
+	tests := []struct {
+		expression string
+		matches    bool
+		err        bool
+	}{
+		{`instance_type.indexOf("m5") == 0 && now - launch_time > 7 * 86400 && subnet_id != "subnet-x"`, true, false},
+		{`tags.Environment == "prod" && state == "running" && lifecycle == "normal"`, true, false},
+		{`vpc_id == "vpc-2" || region != "us-west-2"`, false, false},
+		{`tags.team.length > 0`, false, true},
+		{`instance_type`, false, true},
+	}
+	for _, test := range tests {
+		expression, err := compileFilterExpression(test.expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, err := expression.matches(instance, now)
+		if matches != test.matches || (err != nil) != test.err {
+			t.Errorf("%s: unexpected result %v, %v", test.expression, matches, err)
+		}
+	}
+}
+
+func TestFilterExpressionTimeout(t *testing.T) {
+	expression, err := compileFilterExpression(`state == "running" || (function() { while (true) {} })()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expression.timeout = 20 * time.Millisecond
+	now := time.Now()
+
+	// The runaway evaluation is an error for its instance only, and the
+	// runtimes left go on evaluating the others.
+	start := time.Now()
+	if matches, err := expression.matches(testInstance("i-0123", "stopped"), now); matches || err == nil || !strings.Contains(err.Error(), "exceeded") {
+		t.Errorf("expected the evaluation to time out, got %v, %v", matches, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the evaluation was interrupted after %s", elapsed)
+	}
+	for i := 0; i < 3; i++ {
+		if matches, err := expression.matches(testInstance("i-0456", "running"), now); !matches || err != nil {
+			t.Errorf("unexpected result %v, %v", matches, err)
+		}
+	}
+}
+
+func TestProcessInstanceFilterExpression(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	var err error
+	if c.filterExpression, err = compileFilterExpression(`tags.team.indexOf("web") == 0`); err != nil {
+		t.Fatal(err)
+	}
+
+	web := testInstance("i-1", "running")
+	web.Tags = []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("web")}}
+	api := testInstance("i-2", "running")
+	api.Tags = []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("api")}}
+	run := c.newDiscoveryRun()
+	c.processInstance(run, web)
+	c.processInstance(run, api)
+	c.processInstance(run, testInstance("i-3", "running"))
+
+	if run.summary.discovered != 1 || !run.discovered["i-1"] || backend.entity("i-1") == nil {
+		t.Errorf("expected only i-1 to be discovered: %v", run.discovered)
+	}
+	var output bytes.Buffer
+	run.summary.print(&output, c)
+	if !strings.Contains(output.String(), "--filter-expression rejected 1 instances, failed on 1") {
+		t.Errorf("unexpected summary:\n%s", output.String())
+	}
+}
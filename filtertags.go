@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// applyFilterTagArgs folds the deprecated --ec2-instance-tags into
+// --ec2-filter-tags. Neither decides which tags become labels: every tag
+// does.
+func (c *CheckConfig) applyFilterTagArgs() {
+	if c.ec2InstanceTags == "" {
+		return
+	}
+	if c.ec2FilterTags == "" {
+		log.Printf("WARNING: --ec2-instance-tags is deprecated, use --ec2-filter-tags")
+		c.ec2FilterTags = c.ec2InstanceTags
+		return
+	}
+	log.Printf("WARNING: --ec2-instance-tags is deprecated and given along with --ec2-filter-tags, filtering on both")
+	c.ec2FilterTags = c.ec2FilterTags + "," + c.ec2InstanceTags
+}
+
+// tagFilters returns the DescribeInstances filters of a key=value list, in
+// its order.
+func tagFilters(list string) ([]*ec2.Filter, error) {
+	var filters []*ec2.Filter
+	for _, pair := range splitList(list) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid --ec2-filter-tags \"%s\", expected key=value", pair)
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + parts[0]),
+			Values: []*string{aws.String(parts[1])},
+		})
+	}
+	return filters, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestApplyFilterTagArgs(t *testing.T) {
+	tests := []struct {
+		filterTags, instanceTags, want string
+	}{
+		{"Environment=prod", "", "Environment=prod"},
+		{"", "Environment=prod", "Environment=prod"},
+		{"Environment=prod", "Team=db", "Environment=prod,Team=db"},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.ec2FilterTags, c.ec2InstanceTags = test.filterTags, test.instanceTags
+		c.applyFilterTagArgs()
+		if c.ec2FilterTags != test.want {
+			t.Errorf("--ec2-filter-tags %q --ec2-instance-tags %q: expected %q, got %q", test.filterTags, test.instanceTags, test.want, c.ec2FilterTags)
+		}
+	}
+}
+
+func TestTagFilters(t *testing.T) {
+	filters, err := tagFilters("Team=db, Environment=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 2 || aws.StringValue(filters[0].Name) != "tag:Team" || aws.StringValue(filters[1].Name) != "tag:Environment" || aws.StringValue(filters[1].Values[0]) != "prod" {
+		t.Errorf("unexpected filters %v", filters)
+	}
+	if _, err := tagFilters("Team"); err == nil {
+		t.Error("expected a tag without a value to be rejected")
+	}
+
+	// Filtering does not limit the tags labeled.
+	c := testConfig()
+	c.ec2FilterTags = "Team=db"
+	instance := testInstance("i-0123", "running")
+	instance.Tags = []*ec2.Tag{{Key: aws.String("Team"), Value: aws.String("db")}, {Key: aws.String("Owner"), Value: aws.String("alice")}}
+	if entity := c.buildEntity(instance); entity.Labels["Owner"] != "alice" {
+		t.Errorf("unexpected labels %v", entity.Labels)
+	}
+}
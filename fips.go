@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// fipsEndpoints are the FIPS 140-2 endpoints of the services discovery
+// requires, by service and region. The endpoint model of the AWS SDK does
+// not include them for EC2. In GovCloud, the standard endpoints are the
+// FIPS ones.
+var fipsEndpoints = map[string]map[string]string{
+	endpoints.Ec2ServiceID: {
+		"us-east-1":     "ec2-fips.us-east-1.amazonaws.com",
+		"us-east-2":     "ec2-fips.us-east-2.amazonaws.com",
+		"us-west-1":     "ec2-fips.us-west-1.amazonaws.com",
+		"us-west-2":     "ec2-fips.us-west-2.amazonaws.com",
+		"ca-central-1":  "ec2-fips.ca-central-1.amazonaws.com",
+		"us-gov-east-1": "ec2.us-gov-east-1.amazonaws.com",
+		"us-gov-west-1": "ec2.us-gov-west-1.amazonaws.com",
+	},
+	endpoints.StsServiceID: {
+		"us-east-1":     "sts-fips.us-east-1.amazonaws.com",
+		"us-east-2":     "sts-fips.us-east-2.amazonaws.com",
+		"us-west-1":     "sts-fips.us-west-1.amazonaws.com",
+		"us-west-2":     "sts-fips.us-west-2.amazonaws.com",
+		"us-gov-east-1": "sts.us-gov-east-1.amazonaws.com",
+		"us-gov-west-1": "sts.us-gov-west-1.amazonaws.com",
+	},
+}
+
+// fipsResolver resolves the EC2 and STS endpoints to their FIPS variant,
+// failing for regions without one rather than falling back to a non-FIPS
+// endpoint. Other services use the default endpoints.
+func fipsResolver(service string, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+	hostnames, ok := fipsEndpoints[service]
+	if !ok {
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	}
+	hostname, ok := hostnames[region]
+	if !ok {
+		return endpoints.ResolvedEndpoint{}, fmt.Errorf("no FIPS endpoint for %s in region %s", service, region)
+	}
+	return endpoints.ResolvedEndpoint{URL: "https://" + hostname, SigningRegion: region}, nil
+}
+
+// validateFipsRegions checks, with --aws-use-fips-endpoints, that EC2 has a
+// FIPS endpoint in every region to discover and that STS has one in the
+// default region, as well as in every region when assuming roles.
+func (c *CheckConfig) validateFipsRegions(regions []string) error {
+	if !c.awsUseFipsEndpoints {
+		return nil
+	}
+	required := map[string][]string{endpoints.StsServiceID: {defaultRegion()}}
+	for _, region := range regions {
+		region = strings.TrimSpace(region)
+		required[endpoints.Ec2ServiceID] = append(required[endpoints.Ec2ServiceID], region)
+		if c.awsAssumeRoleArns != "" {
+			required[endpoints.StsServiceID] = append(required[endpoints.StsServiceID], region)
+		}
+	}
+	var missing []string
+	for _, service := range []string{endpoints.Ec2ServiceID, endpoints.StsServiceID} {
+		for _, region := range required[service] {
+			if hostname, ok := fipsEndpoints[service][region]; ok {
+				c.logDebug("using FIPS endpoint %s for %s in region %s", hostname, service, region)
+			} else if entry := fmt.Sprintf("%s in %s", service, region); !stringInSlice(entry, missing) {
+				missing = append(missing, entry)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("--aws-use-fips-endpoints: no FIPS endpoint for %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
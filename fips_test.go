@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+func TestFipsResolver(t *testing.T) {
+	resolved, err := fipsResolver(endpoints.Ec2ServiceID, "us-west-2")
+	if err != nil || resolved.URL != "https://ec2-fips.us-west-2.amazonaws.com" || resolved.SigningRegion != "us-west-2" {
+		t.Errorf("unexpected EC2 endpoint: %+v, %v", resolved, err)
+	}
+	if _, err := fipsResolver(endpoints.StsServiceID, "eu-west-1"); err == nil {
+		t.Error("expected an error for a region without a FIPS endpoint")
+	}
+	// Other services use the default endpoints.
+	resolved, err = fipsResolver(endpoints.Route53ServiceID, "us-west-2")
+	if err != nil || resolved.URL != "https://route53.amazonaws.com" {
+		t.Errorf("unexpected Route 53 endpoint: %+v, %v", resolved, err)
+	}
+}
+
+func TestValidateFipsRegions(t *testing.T) {
+	c := testConfig()
+	if err := c.validateFipsRegions([]string{"eu-west-1"}); err != nil {
+		t.Errorf("unexpected error without --aws-use-fips-endpoints: %s", err)
+	}
+
+	c.awsUseFipsEndpoints = true
+	if err := c.validateFipsRegions([]string{"us-east-1", " us-gov-west-1"}); err != nil {
+		t.Error(err)
+	}
+	err := c.validateFipsRegions([]string{"us-east-1", "eu-west-1", "ca-central-1"})
+	if err == nil || !strings.Contains(err.Error(), "no FIPS endpoint for ec2 in eu-west-1") || strings.Contains(err.Error(), "sts") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Assuming roles requires STS in every region.
+	c.awsAssumeRoleArns = "arn:aws:iam::123456789012:role/discovery"
+	err = c.validateFipsRegions([]string{"ca-central-1"})
+	if err == nil || !strings.Contains(err.Error(), "sts in ca-central-1") {
+		t.Errorf("unexpected error when assuming roles: %v", err)
+	}
+}
@@ -4,6 +4,10 @@ go 1.13
 
 require (
 	github.com/aws/aws-sdk-go v1.28.9
+	github.com/ghodss/yaml v1.0.0
+	github.com/google/uuid v1.1.1
+	github.com/modern-go/reflect2 v1.0.3-0.20250322232337-35a7c28c31ee // indirect
+	github.com/robertkrimen/otto v0.0.0-20180617131154-15f95af6e78d
 	github.com/sensu/sensu-go v0.0.0-20200131164840-40b1d5938251
 	github.com/sensu/sensu-plugins-go-library v0.0.0-20191221230613-61034fabbb46
 )
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// hibernationLabel is "hibernated" on the entities of instances stopped by
+// a hibernation, which come back with their memory intact, "configured" on
+// those of the other instances enabled for hibernation and "none"
+// otherwise.
+const hibernationLabel = "aws_hibernation"
+
+const (
+	hibernationNone       = "none"
+	hibernationConfigured = "configured"
+	hibernationHibernated = "hibernated"
+
+	// hibernateStateReasonCode is the state reason of the instances
+	// stopping or stopped by a hibernation.
+	hibernateStateReasonCode = "Client.UserInitiatedHibernate"
+)
+
+// instanceHibernation returns the hibernation label value of an instance,
+// empty when its description says nothing about hibernation.
+func instanceHibernation(instance *ec2.Instance) string {
+	if instance.State != nil && instance.StateReason != nil {
+		switch aws.StringValue(instance.State.Name) {
+		case ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped:
+			if aws.StringValue(instance.StateReason.Code) == hibernateStateReasonCode {
+				return hibernationHibernated
+			}
+		}
+	}
+	if instance.HibernationOptions == nil {
+		return ""
+	}
+	if aws.BoolValue(instance.HibernationOptions.Configured) {
+		return hibernationConfigured
+	}
+	return hibernationNone
+}
+
+// keepsHibernatedInstance tells whether an instance is hibernated and, with
+// --treat-hibernated-as-running, kept registered whatever
+// --delete-on-states says.
+func (c *CheckConfig) keepsHibernatedInstance(instance *ec2.Instance) bool {
+	return c.treatHibernatedAsRunning && instanceHibernation(instance) == hibernationHibernated
+}
+
+// keepsHibernatedEntity tells whether an entity is that of a hibernated
+// instance, which prune keeps with --treat-hibernated-as-running even when
+// the instance is no longer discovered, say when --ec2-instance-states
+// leaves stopped instances out.
+func (c *CheckConfig) keepsHibernatedEntity(entity *corev2.Entity) bool {
+	return c.treatHibernatedAsRunning && entity.Labels[hibernationLabel] == hibernationHibernated
+}
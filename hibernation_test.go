@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestInstanceHibernation(t *testing.T) {
+	for _, test := range []struct {
+		state      string
+		reason     string
+		configured *bool
+		expected   string
+	}{
+		{"running", "", nil, ""},
+		{"running", "", aws.Bool(false), hibernationNone},
+		{"running", "", aws.Bool(true), hibernationConfigured},
+		{"stopped", "Client.UserInitiatedShutdown", aws.Bool(true), hibernationConfigured},
+		{"stopped", hibernateStateReasonCode, aws.Bool(true), hibernationHibernated},
+		{"stopping", hibernateStateReasonCode, aws.Bool(true), hibernationHibernated},
+	} {
+		instance := testInstance("i-0123", test.state)
+		if test.reason != "" {
+			instance.StateReason = &ec2.StateReason{Code: aws.String(test.reason)}
+		}
+		if test.configured != nil {
+			instance.HibernationOptions = &ec2.HibernationOptions{Configured: test.configured}
+		}
+		label, ok := testConfig().buildEntity(instance).Labels[hibernationLabel]
+		if label != test.expected || ok != (test.expected != "") {
+			t.Errorf("%s (%s): unexpected label %q", test.state, test.reason, label)
+		}
+	}
+}
+
+func TestTreatHibernatedAsRunning(t *testing.T) {
+	instance := testInstance("i-0123", "stopped")
+	instance.StateReason = &ec2.StateReason{Code: aws.String(hibernateStateReasonCode)}
+	instance.HibernationOptions = &ec2.HibernationOptions{Configured: aws.Bool(true)}
+	c := testConfig()
+	if c.keepsHibernatedInstance(instance.Instance) {
+		t.Error("hibernated instance kept without --treat-hibernated-as-running")
+	}
+	c.treatHibernatedAsRunning = true
+	if !c.keepsHibernatedInstance(instance.Instance) {
+		t.Error("hibernated instance not kept")
+	}
+	if c.keepsHibernatedInstance(testInstance("i-0456", "stopped").Instance) {
+		t.Error("stopped instance kept")
+	}
+
+	// Prune keeps the entities of hibernated instances left out of the
+	// discovery.
+	entities := []*corev2.Entity{
+		c.buildEntity(instance),
+		testEntity("i-0456", "proxy", map[string]string{managedByLabel: managedByValue, instanceIdLabel: "i-0456"}),
+	}
+	report := c.planOrphanPrune(entities, map[string]bool{}, nil, 0, time.Now())
+	if len(report.Delete) != 1 || report.Delete[0].Entity != "i-0456" || report.Retained != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
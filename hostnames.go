@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+)
+
+// maxConcurrentLookups bounds the hostname lookups in flight at once.
+const maxConcurrentLookups = 16
+
+// hostnameLookup resolves the hostname of a private IP address.
+type hostnameLookup func(ctx context.Context, address string) (string, error)
+
+// resolveInstanceHostnames sets the fqdn of the instances of a region, from
+// Route 53 when --route53-zone-id is set and from PTR records otherwise.
+// Lookups share the --dns-lookup-budget, so slow DNS cannot hold up the run,
+// and are bounded by ctx.
+func (c *CheckConfig) resolveInstanceHostnames(ctx context.Context, awsSession *session.Session, instances []*discoveredInstance) {
+	if len(instances) == 0 {
+		return
+	}
+	defer c.timings.since("enrichment", time.Now())
+	ctx, cancel := context.WithTimeout(ctx, c.dnsLookupBudgetDuration)
+	defer cancel()
+
+	lookup := c.ptrLookup()
+	if c.route53ZoneId != "" {
+		account := instances[0].Account
+		if account.hostnames == nil {
+			hostnames, err := route53Hostnames(ctx, route53.New(awsSession), c.route53ZoneId)
+			if err != nil {
+				log.Printf("ERROR: failed to list the records of Route 53 zone %s: %s", c.route53ZoneId, classifyAwsError(err, "route53:ListResourceRecordSets", instances[0].Region))
+			}
+			account.hostnames = hostnames
+		}
+		lookup = func(ctx context.Context, address string) (string, error) {
+			if name, ok := account.hostnames[address]; ok {
+				return name, nil
+			}
+			return "", fmt.Errorf("no A record for %s in zone %s", address, c.route53ZoneId)
+		}
+	}
+	c.lookupHostnames(ctx, instances, lookup, c.dnsLookupTimeoutDuration)
+}
+
+// lookupHostnames resolves the hostnames of the instances concurrently,
+// each lookup bounded by timeout and all of them by ctx. Instances whose
+// lookup fails fall back to their EC2 DNS name.
+func (c *CheckConfig) lookupHostnames(ctx context.Context, instances []*discoveredInstance, lookup hostnameLookup, timeout time.Duration) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentLookups)
+	for _, instance := range instances {
+		instance.Fqdn = ec2DnsName(instance)
+		address := aws.StringValue(instance.PrivateIpAddress)
+		if address == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(instance *discoveredInstance) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+			lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			name, err := lookup(lookupCtx, address)
+			if err != nil {
+				c.logDebug("hostname lookup of %s failed, using %s: %s", address, instance.Fqdn, err)
+				return
+			}
+			instance.Fqdn = name
+		}(instance)
+	}
+	wg.Wait()
+}
+
+// ptrLookup looks up PTR records, with the --dns-resolver if one is set.
+func (c *CheckConfig) ptrLookup() hostnameLookup {
+	resolver := net.DefaultResolver
+	if c.dnsResolver != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, c.dnsResolver)
+			},
+		}
+	}
+	return func(ctx context.Context, address string) (string, error) {
+		names, err := resolver.LookupAddr(ctx, address)
+		if err != nil {
+			return "", err
+		}
+		if len(names) == 0 {
+			return "", fmt.Errorf("no PTR record for %s", address)
+		}
+		return strings.TrimSuffix(names[0], "."), nil
+	}
+}
+
+// route53Hostnames maps the addresses of the A records of a hosted zone to
+// their names.
+func route53Hostnames(ctx context.Context, svc route53iface.Route53API, zoneId string) (map[string]string, error) {
+	hostnames := make(map[string]string)
+	input := &route53.ListResourceRecordSetsInput{HostedZoneId: aws.String(zoneId)}
+	err := svc.ListResourceRecordSetsPagesWithContext(ctx, input, func(page *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+		for _, recordSet := range page.ResourceRecordSets {
+			if aws.StringValue(recordSet.Type) != route53.RRTypeA {
+				continue
+			}
+			for _, record := range recordSet.ResourceRecords {
+				address := aws.StringValue(record.Value)
+				if _, ok := hostnames[address]; !ok {
+					hostnames[address] = strings.TrimSuffix(aws.StringValue(recordSet.Name), ".")
+				}
+			}
+		}
+		return true
+	})
+	return hostnames, err
+}
+
+func ec2DnsName(instance *discoveredInstance) string {
+	if name := aws.StringValue(instance.PrivateDnsName); name != "" {
+		return name
+	}
+	return aws.StringValue(instance.PublicDnsName)
+}
+
+// shortHostname returns the private DNS name of an instance without the
+// --hostname-strip-domains suffix it ends with or, when it ends with none,
+// only its first label. Instances without a private DNS name fall back to their Name
+// tag, then their ID.
+func (c *CheckConfig) shortHostname(instance *ec2.Instance) string {
+	name := strings.TrimSuffix(aws.StringValue(instance.PrivateDnsName), ".")
+	if name == "" {
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) == "Name" && aws.StringValue(tag.Value) != "" {
+				return aws.StringValue(tag.Value)
+			}
+		}
+		return aws.StringValue(instance.InstanceId)
+	}
+	for _, domain := range splitList(c.hostnameStripDomains) {
+		suffix := "." + strings.Trim(domain, ".")
+		if strings.HasSuffix(strings.ToLower(name), strings.ToLower(suffix)) && len(name) > len(suffix) {
+			return name[:len(name)-len(suffix)]
+		}
+	}
+	return strings.SplitN(name, ".", 2)[0]
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+)
+
+// fakeRoute53 serves the record sets of a hosted zone one per page.
+type fakeRoute53 struct {
+	route53iface.Route53API
+	recordSets []*route53.ResourceRecordSet
+}
+
+func (f *fakeRoute53) ListResourceRecordSetsPagesWithContext(ctx aws.Context, input *route53.ListResourceRecordSetsInput, fn func(*route53.ListResourceRecordSetsOutput, bool) bool, opts ...request.Option) error {
+	for i, recordSet := range f.recordSets {
+		page := &route53.ListResourceRecordSetsOutput{ResourceRecordSets: []*route53.ResourceRecordSet{recordSet}}
+		if !fn(page, i == len(f.recordSets)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestLookupHostnames(t *testing.T) {
+	instance := func(id string, address string) *discoveredInstance {
+		instance := testInstance(id, "running")
+		instance.PrivateIpAddress = aws.String(address)
+		instance.PrivateDnsName = aws.String("ip-" + id + ".ec2.internal")
+		return instance
+	}
+	instances := []*discoveredInstance{
+		instance("resolved", "10.0.0.1"),
+		instance("failed", "10.0.0.2"),
+		instance("slow", "10.0.0.3"),
+	}
+	lookup := func(ctx context.Context, address string) (string, error) {
+		switch address {
+		case "10.0.0.1":
+			return "web-1.prod.example.com", nil
+		case "10.0.0.3":
+			<-ctx.Done()
+			return "", ctx.Err()
+		default:
+			return "", errors.New("no PTR record")
+		}
+	}
+
+	start := time.Now()
+	testConfig().lookupHostnames(context.Background(), instances, lookup, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookups were not bounded by their timeout: %s", elapsed)
+	}
+	for i, expected := range []string{"web-1.prod.example.com", "ip-failed.ec2.internal", "ip-slow.ec2.internal"} {
+		if instances[i].Fqdn != expected {
+			t.Errorf("unexpected fqdn of %s: %s", *instances[i].InstanceId, instances[i].Fqdn)
+		}
+	}
+}
+
+func TestRoute53Hostnames(t *testing.T) {
+	svc := &fakeRoute53{recordSets: []*route53.ResourceRecordSet{
+		{Name: aws.String("web-1.prod.example.com."), Type: aws.String("A"), ResourceRecords: []*route53.ResourceRecord{{Value: aws.String("10.0.0.1")}}},
+		{Name: aws.String("prod.example.com."), Type: aws.String("TXT"), ResourceRecords: []*route53.ResourceRecord{{Value: aws.String("10.0.0.2")}}},
+		{Name: aws.String("db-1.prod.example.com."), Type: aws.String("A"), ResourceRecords: []*route53.ResourceRecord{{Value: aws.String("10.0.0.2")}}},
+	}}
+
+	hostnames, err := route53Hostnames(context.Background(), svc, "Z123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hostnames) != 2 || hostnames["10.0.0.1"] != "web-1.prod.example.com" || hostnames["10.0.0.2"] != "db-1.prod.example.com" {
+		t.Errorf("unexpected hostnames: %v", hostnames)
+	}
+}
+
+func TestShortHostname(t *testing.T) {
+	c := testConfig()
+	instance := &ec2.Instance{
+		InstanceId:     aws.String("i-0123"),
+		PrivateDnsName: aws.String("ip-10-2-3-4.ec2.internal"),
+		Tags:           []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("web-1")}},
+	}
+	if hostname := c.shortHostname(instance); hostname != "ip-10-2-3-4" {
+		t.Errorf("unexpected hostname: %s", hostname)
+	}
+
+	c.hostnameStripDomains = "corp.example.com,.ec2.internal"
+	instance.PrivateDnsName = aws.String("web-1.payments.corp.example.com")
+	if hostname := c.shortHostname(instance); hostname != "web-1.payments" {
+		t.Errorf("unexpected hostname with a stripped domain: %s", hostname)
+	}
+	instance.PrivateDnsName = aws.String("ip-10-2-3-4.eu-west-1.compute.internal")
+	if hostname := c.shortHostname(instance); hostname != "ip-10-2-3-4" {
+		t.Errorf("unexpected hostname without a matching domain: %s", hostname)
+	}
+
+	instance.PrivateDnsName = aws.String("")
+	if hostname := c.shortHostname(instance); hostname != "web-1" {
+		t.Errorf("unexpected hostname without DNS: %s", hostname)
+	}
+	instance.Tags = nil
+	if hostname := c.shortHostname(instance); hostname != "i-0123" {
+		t.Errorf("unexpected hostname without DNS or Name tag: %s", hostname)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// The AMI labels of --resolve-amis: the name of the image of the instance
+// and whether it is current, past its deprecation time or deregistered.
+const (
+	amiNameLabel   = "aws_ami_name"
+	amiStatusLabel = "aws_ami_status"
+)
+
+const (
+	amiStatusCurrent    = "current"
+	amiStatusDeprecated = "deprecated"
+	amiStatusMissing    = "missing"
+)
+
+// amiStatuses are the AMI statuses in the order their metrics are written.
+var amiStatuses = []string{amiStatusCurrent, amiStatusDeprecated, amiStatusMissing}
+
+// maxImageIdsPerCall caps the image IDs of a DescribeImages call.
+const maxImageIdsPerCall = 200
+
+// imageInfo is what --resolve-amis found out about an image.
+type imageInfo struct {
+	Name            string
+	DeprecationTime time.Time
+	Missing         bool
+}
+
+// status returns the AMI status of the image at a time, deprecated only
+// once its deprecation time has passed.
+func (i *imageInfo) status(now time.Time) string {
+	switch {
+	case i.Missing:
+		return amiStatusMissing
+	case !i.DeprecationTime.IsZero() && !now.UTC().Before(i.DeprecationTime):
+		return amiStatusDeprecated
+	default:
+		return amiStatusCurrent
+	}
+}
+
+// imageCache holds the images described during the run, by ID, and counts
+// the instances per AMI status.
+type imageCache struct {
+	sync.Mutex
+	images   map[string]*imageInfo
+	statuses map[string]int
+	failed   int
+}
+
+func newImageCache() *imageCache {
+	return &imageCache{images: make(map[string]*imageInfo), statuses: make(map[string]int)}
+}
+
+// resolveInstanceImages describes the images of the instances of a region
+// page not described yet during the run, in batches, and sets the image
+// and AMI status of the instances. Images DescribeImages does not return
+// are deregistered.
+func (c *CheckConfig) resolveInstanceImages(ctx context.Context, svc ec2iface.EC2API, region string, instances []*discoveredInstance, now time.Time) {
+	if c.images == nil || len(instances) == 0 {
+		return
+	}
+	defer c.timings.since("enrichment", time.Now())
+	var ids []string
+	c.images.Lock()
+	for _, instance := range instances {
+		id := aws.StringValue(instance.ImageId)
+		if _, ok := c.images.images[id]; id != "" && !ok && !stringInSlice(id, ids) {
+			ids = append(ids, id)
+		}
+	}
+	c.images.Unlock()
+
+	for start := 0; start < len(ids); start += maxImageIdsPerCall {
+		end := start + maxImageIdsPerCall
+		if end > len(ids) {
+			end = len(ids)
+		}
+		images, err := describeImages(ctx, svc, ids[start:end])
+		if err != nil {
+			c.imagesFailed(region, end-start, classifyAwsError(err, "ec2:DescribeImages", region))
+			continue
+		}
+		c.images.Lock()
+		for _, id := range ids[start:end] {
+			image, ok := images[id]
+			if !ok {
+				image = &imageInfo{Missing: true}
+			}
+			c.images.images[id] = image
+		}
+		c.images.Unlock()
+	}
+
+	c.images.Lock()
+	defer c.images.Unlock()
+	for _, instance := range instances {
+		if image, ok := c.images.images[aws.StringValue(instance.ImageId)]; ok {
+			instance.Image = image
+			instance.AmiStatus = image.status(now)
+			c.images.statuses[instance.AmiStatus]++
+		}
+	}
+}
+
+// describeImages describes images by ID. Listing deregistered images by ID
+// fails the whole call, so a batch that does is described again filtering
+// on image-id, which leaves them out instead.
+func describeImages(ctx context.Context, svc ec2iface.EC2API, ids []string) (map[string]*imageInfo, error) {
+	deprecation := make(map[string]time.Time)
+	capture := request.Option(func(r *request.Request) {
+		r.Handlers.Unmarshal.PushFront(func(r *request.Request) {
+			captureDeprecationTimes(r, deprecation)
+		})
+	})
+	output, err := svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: aws.StringSlice(ids)}, capture)
+	if aerr, ok := err.(awserr.Error); ok && strings.HasPrefix(aerr.Code(), "InvalidAMIID.") {
+		output, err = svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+			Filters: []*ec2.Filter{{Name: aws.String("image-id"), Values: aws.StringSlice(ids)}},
+		}, capture)
+	}
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string]*imageInfo)
+	for _, image := range output.Images {
+		id := aws.StringValue(image.ImageId)
+		images[id] = &imageInfo{Name: aws.StringValue(image.Name), DeprecationTime: deprecation[id]}
+	}
+	return images, nil
+}
+
+// describeImagesDeprecation is the part of a DescribeImages response the
+// vendored AWS SDK, which predates AMI deprecation, does not unmarshal.
+type describeImagesDeprecation struct {
+	Images []struct {
+		ImageId         string `xml:"imageId"`
+		DeprecationTime string `xml:"deprecationTime"`
+	} `xml:"imagesSet>item"`
+}
+
+// captureDeprecationTimes reads the deprecation times of the images of a
+// DescribeImages response before the SDK unmarshals it.
+func captureDeprecationTimes(r *request.Request, deprecation map[string]time.Time) {
+	if r.HTTPResponse == nil || r.HTTPResponse.Body == nil {
+		return
+	}
+	body, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	r.HTTPResponse.Body.Close()
+	r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	parseDeprecationTimes(bytes.NewReader(body), deprecation)
+}
+
+func parseDeprecationTimes(body io.Reader, deprecation map[string]time.Time) {
+	var response describeImagesDeprecation
+	if err := xml.NewDecoder(body).Decode(&response); err != nil {
+		return
+	}
+	for _, image := range response.Images {
+		if at, err := time.Parse(time.RFC3339, image.DeprecationTime); err == nil {
+			deprecation[image.ImageId] = at.UTC()
+		}
+	}
+}
+
+// imagesFailed logs the first failure of the run as a warning, like
+// protectionFailed, and the others at debug.
+func (c *CheckConfig) imagesFailed(region string, count int, err error) {
+	c.images.Lock()
+	c.images.failed += count
+	first := c.images.failed == count
+	c.images.Unlock()
+	if first {
+		log.Printf("WARNING: failed to describe %d AMIs in %s: %s", count, region, err)
+		return
+	}
+	c.logDebug("failed to describe %d AMIs in %s: %s", count, region, err)
+}
+
+// imageLabels returns the AMI labels of an instance, if resolved.
+func imageLabels(instance *discoveredInstance) map[string]string {
+	if instance.Image == nil {
+		return nil
+	}
+	labels := map[string]string{amiStatusLabel: instance.AmiStatus}
+	if instance.Image.Name != "" {
+		labels[amiNameLabel] = instance.Image.Name
+	}
+	return labels
+}
+
+// printMetrics writes the instances per AMI status in the Prometheus text
+// format.
+func (i *imageCache) printMetrics(w io.Writer) {
+	if i == nil {
+		return
+	}
+	i.Lock()
+	defer i.Unlock()
+	for _, status := range amiStatuses {
+		fmt.Fprintf(w, "sensu_ec2_discovery_ami_instances{status=\"%s\"} %d\n", status, i.statuses[status])
+	}
+}
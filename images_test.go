@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// describeImagesResponse answers DescribeImages with the images among
+// those asked for, failing like EC2 when one of them is deregistered and
+// they are listed by ID.
+func describeImagesResponse(w http.ResponseWriter, r *http.Request) {
+	images := map[string]string{
+		"ami-current":    `<item><imageId>ami-current</imageId><name>base-2020</name><blockDeviceMapping><item><deviceName>/dev/xvda</deviceName></item></blockDeviceMapping></item>`,
+		"ami-deprecated": `<item><imageId>ami-deprecated</imageId><name>base-2019</name><deprecationTime>2020-01-01T00:00:00.000Z</deprecationTime></item>`,
+		"ami-scheduled":  `<item><imageId>ami-scheduled</imageId><name>base-2021</name><deprecationTime>2030-01-01T00:00:00.000Z</deprecationTime></item>`,
+	}
+	r.ParseForm()
+	var items []string
+	for key, values := range r.PostForm {
+		if !strings.HasPrefix(key, "ImageId.") && !strings.HasPrefix(key, "Filter.1.Value.") {
+			continue
+		}
+		item, ok := images[values[0]]
+		if !ok && strings.HasPrefix(key, "ImageId.") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<Response><Errors><Error><Code>InvalidAMIID.NotFound</Code><Message>not found</Message></Error></Errors></Response>`))
+			return
+		}
+		items = append(items, item)
+	}
+	w.Write([]byte(`<DescribeImagesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><imagesSet>` + strings.Join(items, "") + `</imagesSet></DescribeImagesResponse>`))
+}
+
+func TestResolveInstanceImages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(describeImagesResponse))
+	defer server.Close()
+
+	c := testConfig()
+	c.awsAccessKeyId, c.awsSecretAccessKey = "AKIAEXAMPLE", "very-secret"
+	c.images = newImageCache()
+	awsSession, err := c.newAwsSession("us-west-2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := ec2.New(awsSession, &aws.Config{Endpoint: aws.String(server.URL)})
+
+	var instances []*discoveredInstance
+	for _, image := range []string{"ami-current", "ami-deprecated", "ami-scheduled", "ami-deregistered", "ami-current"} {
+		instance := testInstance("i-"+image, "running")
+		instance.ImageId = aws.String(image)
+		instances = append(instances, instance)
+	}
+	now := time.Date(2020, 2, 1, 0, 0, 0, 0, time.FixedZone("PST", -8*3600))
+	c.resolveInstanceImages(context.Background(), svc, "us-west-2", instances, now)
+
+	for i, expected := range []map[string]string{
+		{amiNameLabel: "base-2020", amiStatusLabel: amiStatusCurrent},
+		{amiNameLabel: "base-2019", amiStatusLabel: amiStatusDeprecated},
+		{amiNameLabel: "base-2021", amiStatusLabel: amiStatusCurrent},
+		{amiStatusLabel: amiStatusMissing},
+		{amiNameLabel: "base-2020", amiStatusLabel: amiStatusCurrent},
+	} {
+		if labels := imageLabels(instances[i]); !reflect.DeepEqual(labels, expected) {
+			t.Errorf("%s: unexpected labels %v", aws.StringValue(instances[i].InstanceId), labels)
+		}
+	}
+
+	var metrics bytes.Buffer
+	c.images.printMetrics(&metrics)
+	expected := "sensu_ec2_discovery_ami_instances{status=\"current\"} 3\n" +
+		"sensu_ec2_discovery_ami_instances{status=\"deprecated\"} 1\n" +
+		"sensu_ec2_discovery_ami_instances{status=\"missing\"} 1\n"
+	if metrics.String() != expected {
+		t.Errorf("unexpected metrics:\n%s", metrics.String())
+	}
+}
+
+func TestImageStatus(t *testing.T) {
+	deprecation := time.Date(2020, 2, 1, 12, 0, 0, 0, time.UTC)
+	image := &imageInfo{DeprecationTime: deprecation}
+	// 11:00 UTC is 12:00 in UTC+1, before the deprecation time.
+	if status := image.status(time.Date(2020, 2, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))); status != amiStatusCurrent {
+		t.Errorf("unexpected status %s before the deprecation time", status)
+	}
+	if status := image.status(deprecation); status != amiStatusDeprecated {
+		t.Errorf("unexpected status %s at the deprecation time", status)
+	}
+	if status := (&imageInfo{Missing: true}).status(deprecation); status != amiStatusMissing {
+		t.Errorf("unexpected status %s", status)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// Label merge strategies, how the upsert write strategy merges discovered
+// labels and annotations into those of an existing entity.
+const (
+	// labelMergeOverwrite writes exactly the discovered labels and
+	// annotations, dropping those set by hand.
+	labelMergeOverwrite = "overwrite"
+	// labelMergePreserveExisting keeps the value of every label and
+	// annotation already set, adding new ones only. The labels and
+	// annotations of the plugin are always refreshed.
+	labelMergePreserveExisting = "preserve-existing"
+	// labelMergeEc2Wins writes the discovered values over those set and
+	// removes what the plugin wrote once but no longer discovers, such as
+	// a tag removed in EC2. Labels and annotations set by hand are kept.
+	labelMergeEc2Wins = "ec2-wins"
+)
+
+const (
+	// discoveredLabelsAnnotation lists the label keys the plugin last
+	// wrote, so that those no longer discovered can be removed.
+	discoveredLabelsAnnotation = "sensu.io/plugins/ec2-discovery/discovered-labels"
+	// discoveredAnnotationsAnnotation lists the annotation keys the plugin
+	// last wrote.
+	discoveredAnnotationsAnnotation = "sensu.io/plugins/ec2-discovery/discovered-annotations"
+)
+
+// pluginAnnotationPrefix prefixes the annotations generated by the plugin.
+const pluginAnnotationPrefix = "sensu.io/plugins/ec2-discovery/"
+
+func (c *CheckConfig) validateLabelMergeStrategy() error {
+	switch c.labelMergeStrategy {
+	case labelMergeOverwrite, labelMergePreserveExisting, labelMergeEc2Wins:
+		return nil
+	}
+	return fmt.Errorf("invalid --label-merge-strategy \"%s\", expected %s, %s or %s", c.labelMergeStrategy, labelMergeOverwrite, labelMergePreserveExisting, labelMergeEc2Wins)
+}
+
+// recordDiscoveredKeys annotates an entity with the keys of its discovered
+// labels and annotations.
+func recordDiscoveredKeys(entity *corev2.Entity) {
+	entity.Annotations[discoveredLabelsAnnotation] = joinKeys(entity.Labels)
+	entity.Annotations[discoveredAnnotationsAnnotation] = ""
+	entity.Annotations[discoveredAnnotationsAnnotation] = joinKeys(entity.Annotations)
+}
+
+// joinKeys returns the sorted keys of m, comma-separated.
+func joinKeys(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// mergeLabels merges the discovered labels into the existing ones per
+// --label-merge-strategy.
+func (c *CheckConfig) mergeLabels(existing *corev2.Entity, desired *corev2.Entity) map[string]string {
+	return c.mergeStringMaps(existing.Labels, desired.Labels, existing.Annotations[discoveredLabelsAnnotation], func(key string) bool {
+		return stringInSlice(key, pluginLabels)
+	})
+}
+
+// mergeAnnotations merges the discovered annotations into the existing
+// ones per --label-merge-strategy.
+func (c *CheckConfig) mergeAnnotations(existing *corev2.Entity, desired *corev2.Entity) map[string]string {
+	merged := c.mergeStringMaps(existing.Annotations, desired.Annotations, existing.Annotations[discoveredAnnotationsAnnotation], func(key string) bool {
+		return strings.HasPrefix(key, pluginAnnotationPrefix)
+	})
+	// Terminated instances keep the time they were last seen, see
+	// --prune-grace-period.
+	if _, ok := desired.Annotations[lastSeenAnnotation]; !ok {
+		if lastSeen, ok := keptLastSeen(existing, time.Now()); ok {
+			merged[lastSeenAnnotation] = lastSeen
+		}
+	}
+	return merged
+}
+
+// mergeStringMaps merges discovered into existing, where previous lists
+// the keys discovered by the last write and plugin tells the keys the
+// plugin generates, which always take their discovered value.
+func (c *CheckConfig) mergeStringMaps(existing map[string]string, discovered map[string]string, previous string, plugin func(string) bool) map[string]string {
+	merged := make(map[string]string)
+	if c.labelMergeStrategy != labelMergeOverwrite {
+		for key, value := range existing {
+			merged[key] = value
+		}
+	}
+	if c.labelMergeStrategy == labelMergeEc2Wins {
+		for _, key := range splitList(previous) {
+			if _, ok := discovered[key]; !ok {
+				delete(merged, key)
+			}
+		}
+	}
+	for key, value := range discovered {
+		if _, ok := merged[key]; ok && c.labelMergeStrategy == labelMergePreserveExisting && !plugin(key) {
+			continue
+		}
+		merged[key] = value
+	}
+	return merged
+}
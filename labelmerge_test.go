@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestLabelMergeStrategies(t *testing.T) {
+	for _, test := range []struct {
+		strategy string
+		env      string
+		team     bool
+		contact  bool
+	}{
+		{labelMergeOverwrite, "prod", false, false},
+		{labelMergePreserveExisting, "staging", true, true},
+		{labelMergeEc2Wins, "prod", false, true},
+	} {
+		backend := newFakeBackend()
+		c := backend.checkConfig()
+		c.labelMergeStrategy = test.strategy
+		instance := testInstance("i-0123", "running")
+		instance.Tags = []*ec2.Tag{{Key: aws.String("env"), Value: aws.String("prod")}, {Key: aws.String("team"), Value: aws.String("db")}}
+		c.registerInstance(instance)
+
+		// An operator labels the entity and changes its env label, then
+		// the team tag is removed in EC2.
+		entity := backend.entity("i-0123")
+		entity.Labels["contact"] = "team-db"
+		entity.Labels["env"] = "staging"
+		entity.Annotations["runbook"] = "https://example.com/runbook"
+		instance.Tags = instance.Tags[:1]
+		c.registerInstance(instance)
+
+		entity = backend.entity("i-0123")
+		if entity.Labels["env"] != test.env {
+			t.Errorf("%s: expected env %q, got %v", test.strategy, test.env, entity.Labels)
+		}
+		if _, ok := entity.Labels["team"]; ok != test.team {
+			t.Errorf("%s: expected removed tag kept %v, got %v", test.strategy, test.team, entity.Labels)
+		}
+		if _, ok := entity.Labels["contact"]; ok != test.contact {
+			t.Errorf("%s: expected hand-set label kept %v, got %v", test.strategy, test.contact, entity.Labels)
+		}
+		if _, ok := entity.Annotations["runbook"]; ok != test.contact {
+			t.Errorf("%s: expected hand-set annotation kept %v, got %v", test.strategy, test.contact, entity.Annotations)
+		}
+		if entity.Labels[managedByLabel] != managedByValue || entity.Labels[instanceStateLabel] != "running" {
+			t.Errorf("%s: plugin labels not written: %v", test.strategy, entity.Labels)
+		}
+		backend.Close()
+	}
+}
+
+func TestValidateLabelMergeStrategy(t *testing.T) {
+	c := testConfig()
+	c.labelMergeStrategy = "union"
+	if err := c.validateLabelMergeStrategy(); err == nil {
+		t.Error("expected an invalid --label-merge-strategy to be rejected")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// extraLabelsAnnotation holds, as a JSON object, the labels beyond
+// --max-labels.
+const extraLabelsAnnotation = "sensu.io/plugins/ec2-discovery/extra-labels"
+
+// pluginLabels are the labels the plugin generates, which are always kept
+// since discovery, prune and adoption rely on them.
+var pluginLabels = []string{
+	managedByLabel,
+	instanceIdLabel,
+	instanceStateLabel,
+	regionLabel,
+	accountIdLabel,
+	accountAliasLabel,
+	fqdnLabel,
+	hostnameLabel,
+	reservationOwnerLabel,
+	requesterLabel,
+	foreignReservationLabel,
+	terminationProtectionLabel,
+	hibernationLabel,
+	rootVolumeTypeLabel,
+	rootVolumeSizeLabel,
+	ebsTotalSizeLabel,
+	amiNameLabel,
+	amiStatusLabel,
+	stateReasonCodeLabel,
+	silencingLabel,
+}
+
+// labelPriority orders the labels of an entity, most important first: the
+// plugin labels, then those of --priority-labels in their order, then the
+// others by key, so that the same labels are always kept.
+func (c *CheckConfig) labelPriority(labels map[string]string) []string {
+	rank := make(map[string]int)
+	for i, key := range pluginLabels {
+		rank[key] = i - len(pluginLabels)
+	}
+	for i, key := range splitList(c.priorityLabels) {
+		if _, ok := rank[key]; !ok {
+			rank[key] = i + 1
+		}
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, iRanked := rank[keys[i]]
+		rj, jRanked := rank[keys[j]]
+		switch {
+		case iRanked && jRanked:
+			return ri < rj
+		case iRanked != jRanked:
+			return iRanked
+		default:
+			return keys[i] < keys[j]
+		}
+	})
+	return keys
+}
+
+// limitLabels keeps the --max-labels most important labels of an entity
+// and moves the others into the extra labels annotation. Plugin labels are
+// kept even beyond the limit.
+func (c *CheckConfig) limitLabels(entity *corev2.Entity) {
+	if c.maxLabels == 0 || uint64(len(entity.Labels)) <= c.maxLabels {
+		return
+	}
+	extra := make(map[string]string)
+	for i, key := range c.labelPriority(entity.Labels) {
+		if uint64(i) < c.maxLabels || stringInSlice(key, pluginLabels) {
+			continue
+		}
+		extra[key] = entity.Labels[key]
+		delete(entity.Labels, key)
+	}
+	if len(extra) == 0 {
+		return
+	}
+	// Maps marshal with sorted keys, so unchanged labels never show as an
+	// update.
+	b, _ := json.Marshal(extra)
+	entity.Annotations[extraLabelsAnnotation] = string(b)
+}
+
+// extraLabels returns the labels an entity moved into its extra labels
+// annotation.
+func extraLabels(entity *corev2.Entity) map[string]string {
+	extra := make(map[string]string)
+	if value, ok := entity.Annotations[extraLabelsAnnotation]; ok {
+		_ = json.Unmarshal([]byte(value), &extra)
+	}
+	return extra
+}
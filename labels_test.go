@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// taggedInstance returns an instance with n tags, tag-00 to tag-<n-1>.
+func taggedInstance(n int) *discoveredInstance {
+	instance := testInstance("i-0123", "running")
+	for i := n - 1; i >= 0; i-- {
+		instance.Tags = append(instance.Tags, &ec2.Tag{Key: aws.String(fmt.Sprintf("tag-%02d", i)), Value: aws.String("value")})
+	}
+	return instance
+}
+
+func TestLimitLabels(t *testing.T) {
+	c := testConfig()
+	c.maxLabels = 6
+	c.priorityLabels = "tag-09,team,tag-07"
+	entity := c.buildEntity(taggedInstance(10))
+
+	expected := map[string]string{
+		managedByLabel:     managedByValue,
+		instanceIdLabel:    "i-0123",
+		instanceStateLabel: "running",
+		regionLabel:        "us-west-2",
+		"tag-09":           "value",
+		"tag-07":           "value",
+	}
+	if !reflect.DeepEqual(entity.Labels, expected) {
+		t.Errorf("unexpected labels %v", entity.Labels)
+	}
+	extra := `{"tag-00":"value","tag-01":"value","tag-02":"value","tag-03":"value","tag-04":"value","tag-05":"value","tag-06":"value","tag-08":"value"}`
+	if entity.Annotations[extraLabelsAnnotation] != extra {
+		t.Errorf("unexpected extra labels %s", entity.Annotations[extraLabelsAnnotation])
+	}
+
+	// Plugin labels are kept beyond the limit.
+	c.maxLabels = 1
+	entity = c.buildEntity(taggedInstance(2))
+	if len(entity.Labels) != 4 || entity.Labels[managedByLabel] != managedByValue {
+		t.Errorf("unexpected labels %v", entity.Labels)
+	}
+
+	// Within the limit, nothing moves.
+	c.maxLabels = 6
+	entity = c.buildEntity(taggedInstance(2))
+	if len(entity.Labels) != 6 {
+		t.Errorf("unexpected labels %v", entity.Labels)
+	}
+	if _, ok := entity.Annotations[extraLabelsAnnotation]; ok {
+		t.Error("unexpected extra labels annotation")
+	}
+}
+
+func TestLimitLabelsUpdates(t *testing.T) {
+	for _, strategy := range []string{writeStrategyUpsert, writeStrategyReplace} {
+		c := testConfig()
+		c.writeStrategy = strategy
+		existing := c.buildEntity(taggedInstance(10))
+
+		// Enabling the limit moves the labels beyond it.
+		c.maxLabels = 6
+		desired := c.buildEntity(taggedInstance(10))
+		updated := c.planUpdate(existing, desired)
+		if updated == nil || !reflect.DeepEqual(updated.Labels, desired.Labels) || updated.Annotations[extraLabelsAnnotation] != desired.Annotations[extraLabelsAnnotation] {
+			t.Fatalf("%s: unexpected update %+v", strategy, updated)
+		}
+
+		// The same labels round-trip without an update.
+		if again := c.planUpdate(updated, c.buildEntity(taggedInstance(10))); again != nil {
+			t.Errorf("%s: spurious update: %v", strategy, diffEntity(updated, again))
+		}
+
+		// Once within the limit, the labels are restored.
+		desired = c.buildEntity(taggedInstance(2))
+		restored := c.planUpdate(updated, desired)
+		if restored == nil || restored.Labels["tag-01"] != "value" {
+			t.Fatalf("%s: unexpected update %+v", strategy, restored)
+		}
+		if _, ok := restored.Annotations[extraLabelsAnnotation]; ok {
+			t.Errorf("%s: the extra labels annotation was kept", strategy)
+		}
+	}
+}
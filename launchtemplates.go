@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+const (
+	// launchTemplateIdTag and launchTemplateVersionTag are set by EC2 on
+	// the instances launched from a launch template.
+	launchTemplateIdTag      = "aws:ec2launchtemplate:id"
+	launchTemplateVersionTag = "aws:ec2launchtemplate:version"
+)
+
+// launchTemplateSelector selects the instances launched from a launch
+// template, by ID or name, optionally within a range of versions.
+type launchTemplateSelector struct {
+	template string
+	operator string
+	version  int
+}
+
+func (s *launchTemplateSelector) String() string {
+	if s.operator == "" {
+		return s.template
+	}
+	return fmt.Sprintf("%s:%s%d", s.template, s.operator, s.version)
+}
+
+// versionOperators are the version constraint operators, longest first so
+// that >= is not read as >.
+var versionOperators = []string{">=", "<=", "=", ">", "<"}
+
+// parseLaunchTemplateSelectors parses comma-separated template[:constraint]
+// selectors, where constraint is a version optionally preceded by one of
+// >=, <=, =, > or <, e.g. lt-0abc:>=42.
+func parseLaunchTemplateSelectors(flag string, spec string) ([]*launchTemplateSelector, error) {
+	var selectors []*launchTemplateSelector
+	for _, entry := range splitList(spec) {
+		selector := &launchTemplateSelector{template: entry}
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			selector.template = strings.TrimSpace(entry[:i])
+			constraint := strings.TrimSpace(entry[i+1:])
+			selector.operator = "="
+			for _, operator := range versionOperators {
+				if strings.HasPrefix(constraint, operator) {
+					selector.operator = operator
+					constraint = strings.TrimSpace(strings.TrimPrefix(constraint, operator))
+					break
+				}
+			}
+			version, err := strconv.Atoi(constraint)
+			if err != nil || version < 1 {
+				return nil, fmt.Errorf("invalid %s version constraint \"%s\", expected a version optionally preceded by >=, <=, =, > or <", flag, entry[i+1:])
+			}
+			selector.version = version
+		}
+		if selector.template == "" {
+			return nil, fmt.Errorf("invalid %s entry \"%s\", expected template[:constraint]", flag, entry)
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+// allows reports whether a launch template version satisfies the version
+// constraint of the selector.
+func (s *launchTemplateSelector) allows(version string) bool {
+	if s.operator == "" {
+		return true
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return false
+	}
+	switch s.operator {
+	case ">=":
+		return v >= s.version
+	case "<=":
+		return v <= s.version
+	case ">":
+		return v > s.version
+	case "<":
+		return v < s.version
+	}
+	return v == s.version
+}
+
+// validateLaunchTemplateArgs parses the launch template selectors and adds
+// the EC2 filters they translate to: the template IDs when selecting by ID
+// only, or any template, since the IDs of named templates differ across
+// regions and accounts and are only checked once resolved.
+func (c *CheckConfig) validateLaunchTemplateArgs() error {
+	var err error
+	if c.launchTemplateIdFilters, err = parseLaunchTemplateSelectors("--ec2-launch-template-ids", c.ec2LaunchTemplateIds); err != nil {
+		return err
+	}
+	if c.launchTemplateNameFilters, err = parseLaunchTemplateSelectors("--ec2-launch-template-names", c.ec2LaunchTemplateNames); err != nil {
+		return err
+	}
+	if !c.filtersLaunchTemplates() {
+		return nil
+	}
+	if c.idsOnly || c.instancesFromStdin {
+		return fmt.Errorf("--ec2-launch-template-ids, --ec2-launch-template-names and --ec2-launch-template-required cannot be combined with --ids-only or --instances-from-stdin, which ignore the filters")
+	}
+	if len(c.launchTemplateIdFilters) > 0 && len(c.launchTemplateNameFilters) == 0 {
+		var ids []string
+		for _, selector := range c.launchTemplateIdFilters {
+			if !stringInSlice(selector.template, ids) {
+				ids = append(ids, selector.template)
+			}
+		}
+		c.ec2Filters = append(c.ec2Filters, &ec2.Filter{
+			Name:   aws.String("tag:" + launchTemplateIdTag),
+			Values: aws.StringSlice(ids),
+		})
+		return nil
+	}
+	c.ec2Filters = append(c.ec2Filters, &ec2.Filter{
+		Name:   aws.String("tag-key"),
+		Values: aws.StringSlice([]string{launchTemplateIdTag}),
+	})
+	return nil
+}
+
+// filtersLaunchTemplates reports whether discovery is restricted to the
+// instances launched from a launch template.
+func (c *CheckConfig) filtersLaunchTemplates() bool {
+	return c.ec2LaunchTemplateRequired || len(c.launchTemplateIdFilters) > 0 || len(c.launchTemplateNameFilters) > 0
+}
+
+// resolveLaunchTemplateNames returns the names of the launch templates of
+// --ec2-launch-template-names in a region, by ID. Names without a template
+// in the region select no instance there.
+func (c *CheckConfig) resolveLaunchTemplateNames(ctx context.Context, svc ec2iface.EC2API, region string) (map[string]string, error) {
+	if len(c.launchTemplateNameFilters) == 0 {
+		return nil, nil
+	}
+	var names []string
+	for _, selector := range c.launchTemplateNameFilters {
+		if !stringInSlice(selector.template, names) {
+			names = append(names, selector.template)
+		}
+	}
+	templates := make(map[string]string)
+	input := &ec2.DescribeLaunchTemplatesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("launch-template-name"), Values: aws.StringSlice(names)}},
+	}
+	err := svc.DescribeLaunchTemplatesPagesWithContext(ctx, input, func(page *ec2.DescribeLaunchTemplatesOutput, lastPage bool) bool {
+		for _, template := range page.LaunchTemplates {
+			templates[aws.StringValue(template.LaunchTemplateId)] = aws.StringValue(template.LaunchTemplateName)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve launch template names: %w", classifyAwsError(err, "ec2:DescribeLaunchTemplates", region))
+	}
+	c.logDebug("resolved %d of %d launch template names in %s", len(templates), len(names), region)
+	return templates, nil
+}
+
+// rejectingLaunchTemplate reports whether an instance was not launched from
+// a selected launch template.
+func (c *CheckConfig) rejectingLaunchTemplate(instance *discoveredInstance) bool {
+	if !c.filtersLaunchTemplates() {
+		return false
+	}
+	id := instanceTag(instance.Instance, launchTemplateIdTag)
+	if id == "" {
+		return true
+	}
+	if len(c.launchTemplateIdFilters) == 0 && len(c.launchTemplateNameFilters) == 0 {
+		return false
+	}
+	version := instanceTag(instance.Instance, launchTemplateVersionTag)
+	for _, selector := range c.launchTemplateIdFilters {
+		if selector.template == id && selector.allows(version) {
+			return false
+		}
+	}
+	for _, selector := range c.launchTemplateNameFilters {
+		if selector.template == instance.LaunchTemplateName && selector.allows(version) {
+			return false
+		}
+	}
+	return true
+}
+
+// instanceTag returns the value of a tag of an instance, "" if missing.
+func instanceTag(instance *ec2.Instance, key string) string {
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeLaunchTemplates serves the launch templates filtered on by name.
+type fakeLaunchTemplates struct {
+	ec2iface.EC2API
+	templates map[string]string
+}
+
+func (f *fakeLaunchTemplates) DescribeLaunchTemplatesPagesWithContext(ctx aws.Context, input *ec2.DescribeLaunchTemplatesInput, fn func(*ec2.DescribeLaunchTemplatesOutput, bool) bool, opts ...request.Option) error {
+	page := &ec2.DescribeLaunchTemplatesOutput{}
+	for _, name := range aws.StringValueSlice(input.Filters[0].Values) {
+		if id, ok := f.templates[name]; ok {
+			page.LaunchTemplates = append(page.LaunchTemplates, &ec2.LaunchTemplate{LaunchTemplateId: aws.String(id), LaunchTemplateName: aws.String(name)})
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+func launchedFrom(instance *discoveredInstance, id string, version string) *discoveredInstance {
+	instance.Tags = append(instance.Tags,
+		&ec2.Tag{Key: aws.String(launchTemplateIdTag), Value: aws.String(id)},
+		&ec2.Tag{Key: aws.String(launchTemplateVersionTag), Value: aws.String(version)})
+	return instance
+}
+
+func TestParseLaunchTemplateSelectors(t *testing.T) {
+	selectors, err := parseLaunchTemplateSelectors("--ec2-launch-template-ids", "lt-0a, lt-0b:>=42, lt-0c:7, lt-0d:<3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed []string
+	for _, selector := range selectors {
+		parsed = append(parsed, selector.String())
+	}
+	if strings.Join(parsed, ",") != "lt-0a,lt-0b:>=42,lt-0c:=7,lt-0d:<3" {
+		t.Errorf("unexpected selectors %v", parsed)
+	}
+	for version, allowed := range map[string]bool{"41": false, "42": true, "43": true, "latest": false} {
+		if selectors[1].allows(version) != allowed {
+			t.Errorf("unexpected constraint result for version %s", version)
+		}
+	}
+	for _, spec := range []string{"lt-0a:>=", "lt-0a:~42", ":3", "lt-0a:0"} {
+		if _, err := parseLaunchTemplateSelectors("--ec2-launch-template-ids", spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestValidateLaunchTemplateArgs(t *testing.T) {
+	c := testConfig()
+	c.ec2LaunchTemplateIds = "lt-0a:>=2,lt-0b,lt-0a:1"
+	if err := c.validateLaunchTemplateArgs(); err != nil {
+		t.Fatal(err)
+	}
+	if describeFilters(c.ec2Filters) != "tag:aws:ec2launchtemplate:id=lt-0a,lt-0b" {
+		t.Errorf("unexpected filters %s", describeFilters(c.ec2Filters))
+	}
+
+	// Named templates are only known once resolved per region.
+	c = testConfig()
+	c.ec2LaunchTemplateIds = "lt-0a"
+	c.ec2LaunchTemplateNames = "web"
+	if err := c.validateLaunchTemplateArgs(); err != nil {
+		t.Fatal(err)
+	}
+	if describeFilters(c.ec2Filters) != "tag-key=aws:ec2launchtemplate:id" {
+		t.Errorf("unexpected filters %s", describeFilters(c.ec2Filters))
+	}
+
+	c = testConfig()
+	c.ec2LaunchTemplateRequired = true
+	c.idsOnly = true
+	if err := c.validateLaunchTemplateArgs(); err == nil {
+		t.Error("expected an error with --ids-only")
+	}
+}
+
+func TestRejectingLaunchTemplate(t *testing.T) {
+	c := testConfig()
+	untemplated := testInstance("i-0", "running")
+	if c.rejectingLaunchTemplate(untemplated) {
+		t.Error("instances are rejected without launch template selectors")
+	}
+	c.ec2LaunchTemplateRequired = true
+	if !c.rejectingLaunchTemplate(untemplated) {
+		t.Error("an instance launched without a template is not rejected")
+	}
+	if c.rejectingLaunchTemplate(launchedFrom(testInstance("i-1", "running"), "lt-0z", "1")) {
+		t.Error("an instance launched from a template is rejected")
+	}
+
+	c.ec2LaunchTemplateIds = "lt-0a:>=42"
+	c.ec2LaunchTemplateNames = "web:<3"
+	if err := c.validateLaunchTemplateArgs(); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := c.resolveLaunchTemplateNames(context.Background(), &fakeLaunchTemplates{templates: map[string]string{"web": "lt-0w"}}, "us-west-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		id       string
+		version  string
+		rejected bool
+	}{
+		{"lt-0a", "42", false},
+		{"lt-0a", "41", true},
+		{"lt-0w", "2", false},
+		{"lt-0w", "3", true},
+		{"lt-0z", "1", true},
+	} {
+		instance := launchedFrom(testInstance("i-2", "running"), test.id, test.version)
+		instance.LaunchTemplateName = templates[test.id]
+		if c.rejectingLaunchTemplate(instance) != test.rejected {
+			t.Errorf("unexpected result for %s version %s", test.id, test.version)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+const (
+	// lockHolderAnnotation and lockExpiresAnnotation record which run holds
+	// the --lock-ttl lock entity, by correlation ID, and until when.
+	lockHolderAnnotation  = "sensu.io/plugins/ec2-discovery/lock-holder"
+	lockExpiresAnnotation = "sensu.io/plugins/ec2-discovery/lock-expires"
+)
+
+// lockHeldError is returned when another run holds a fresh lock.
+type lockHeldError struct {
+	holder  string
+	expires string
+}
+
+func (e *lockHeldError) Error() string {
+	return fmt.Sprintf("another instance holds the lock (correlation ID %s, expires %s)", e.holder, e.expires)
+}
+
+func (c *CheckConfig) newLockEntity(now time.Time) *corev2.Entity {
+	var entity corev2.Entity
+	entity.Name = c.lockEntity
+	entity.Namespace = c.sensuNamespace
+	entity.EntityClass = "proxy"
+	entity.Annotations = map[string]string{
+		lockHolderAnnotation:  c.correlationId,
+		lockExpiresAnnotation: now.Add(c.lockTtlDuration).UTC().Format(time.RFC3339),
+	}
+	return &entity
+}
+
+// acquireLock claims the lock entity, creating it if absent. A lock held by
+// another run is only taken over once it has expired, so that a crashed run
+// does not block discovery. The backend cannot replace an entity
+// conditionally, so a takeover deletes the expired lock and creates it
+// again: of the runs taking it over at once, the one whose create succeeds
+// holds it, the others get a conflict. A run that read the expired lock
+// before another took it over can still delete the fresh lock in the
+// round trip between its read and its delete, which the backend cannot
+// prevent.
+func (c *CheckConfig) acquireLock(now time.Time) error {
+	lock := c.newLockEntity(now)
+	created, err := c.createLock(lock)
+	if err != nil || created {
+		return err
+	}
+
+	held, err := c.getEntity(lock.Namespace, lock.Name)
+	if err != nil {
+		return fmt.Errorf("failed to get the lock entity: %w", err)
+	}
+	if held != nil {
+		expires, err := time.Parse(time.RFC3339, held.Annotations[lockExpiresAnnotation])
+		if err == nil && now.Before(expires) {
+			return &lockHeldError{holder: held.Annotations[lockHolderAnnotation], expires: held.Annotations[lockExpiresAnnotation]}
+		}
+		log.Printf("WARNING: taking over the expired lock of run %s (expired %s)", held.Annotations[lockHolderAnnotation], held.Annotations[lockExpiresAnnotation])
+		// Another run taking it over may have deleted it already.
+		var statusErr *apiStatusError
+		if err := c.deleteEntity(lock.Namespace, lock.Name); err != nil && !(errors.As(err, &statusErr) && statusErr.statusCode == http.StatusNotFound) {
+			return fmt.Errorf("failed to delete the expired lock entity: %w", err)
+		}
+	}
+	if created, err = c.createLock(lock); err != nil || created {
+		return err
+	}
+	holder := &lockHeldError{}
+	if held, err = c.getEntity(lock.Namespace, lock.Name); err == nil && held != nil {
+		holder.holder, holder.expires = held.Annotations[lockHolderAnnotation], held.Annotations[lockExpiresAnnotation]
+	}
+	return holder
+}
+
+// createLock creates the lock entity, reporting whether it was created or
+// already exists.
+func (c *CheckConfig) createLock(lock *corev2.Entity) (bool, error) {
+	b, err := json.Marshal(lock)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.sensuApiRequest("POST", lock.Namespace, entitiesPath(lock.Namespace), bytes.NewReader(b))
+	if err != nil {
+		return false, fmt.Errorf("failed to create the lock entity: %w", err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		c.logDebug("acquired lock entity \"%s\" until %s", lock.Name, lock.Annotations[lockExpiresAnnotation])
+		c.lockHeld = true
+		return true, nil
+	case resp.StatusCode != http.StatusConflict:
+		return false, fmt.Errorf("failed to create the lock entity: %w", c.statusError(resp))
+	}
+	return false, nil
+}
+
+// releaseLock deletes the lock entity, unless another run has taken it over
+// since. It does nothing when the lock is not held.
+func (c *CheckConfig) releaseLock() {
+	if !c.lockHeld {
+		return
+	}
+	c.lockHeld = false
+	held, err := c.getEntity(c.sensuNamespace, c.lockEntity)
+	if err == nil && (held == nil || held.Annotations[lockHolderAnnotation] != c.correlationId) {
+		return
+	}
+	if err == nil {
+		err = c.deleteEntity(c.sensuNamespace, c.lockEntity)
+	}
+	if err != nil {
+		log.Printf("WARNING: failed to release lock entity \"%s\", it expires after --lock-ttl: %s", c.lockEntity, err)
+	}
+}
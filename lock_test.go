@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.lockEntity = "sensu-ec2-discovery-lock"
+	c.lockTtlDuration = 10 * time.Minute
+	now := time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC)
+
+	if err := c.acquireLock(now); err != nil {
+		t.Fatal(err)
+	}
+	lock := backend.entity(c.lockEntity)
+	if lock == nil || lock.Annotations[lockHolderAnnotation] != c.correlationId || lock.Annotations[lockExpiresAnnotation] != "2020-02-10T12:10:00Z" {
+		t.Fatalf("unexpected lock entity: %+v", lock)
+	}
+
+	// A fresh lock held by another run skips the run.
+	lock.Annotations[lockHolderAnnotation] = "other-run"
+	other := backend.checkConfig()
+	other.lockEntity, other.lockTtlDuration = c.lockEntity, c.lockTtlDuration
+	err := other.acquireLock(now.Add(5 * time.Minute))
+	if held, ok := err.(*lockHeldError); !ok || held.holder != "other-run" {
+		t.Errorf("expected the lock to be held by the other run, got %v", err)
+	}
+	if other.lockHeld {
+		t.Error("the lock is not held")
+	}
+
+	// Another run's lock is not released.
+	c.releaseLock()
+	if backend.entity(c.lockEntity) == nil {
+		t.Error("released the lock of another run")
+	}
+
+	// An expired lock is taken over, then released.
+	if err := other.acquireLock(now.Add(11 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if lock := backend.entity(c.lockEntity); lock.Annotations[lockHolderAnnotation] != other.correlationId || lock.Annotations[lockExpiresAnnotation] != "2020-02-10T12:21:00Z" {
+		t.Errorf("expired lock not taken over: %+v", lock.Annotations)
+	}
+	other.releaseLock()
+	if backend.entity(c.lockEntity) != nil {
+		t.Error("lock not released")
+	}
+}
+
+func TestLockConcurrentTakeover(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	// Both runs read the expired lock and delete it before either creates
+	// it again.
+	var deletes sync.WaitGroup
+	deletes.Add(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			deletes.Done()
+			deletes.Wait()
+		}
+		backend.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	now := time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC)
+	expired := testConfig()
+	expired.lockEntity, expired.lockTtlDuration = "sensu-ec2-discovery-lock", 10*time.Minute
+	backend.entities[expired.lockEntity] = expired.newLockEntity(now.Add(-time.Hour))
+
+	runs := []*CheckConfig{testConfig(), testConfig()}
+	errs := make([]error, len(runs))
+	var wg sync.WaitGroup
+	for i, c := range runs {
+		c.sensuApiUrl = server.URL
+		c.lockEntity, c.lockTtlDuration = expired.lockEntity, expired.lockTtlDuration
+		wg.Add(1)
+		go func(i int, c *CheckConfig) {
+			defer wg.Done()
+			errs[i] = c.acquireLock(now)
+		}(i, c)
+	}
+	wg.Wait()
+
+	var holders []string
+	for i, c := range runs {
+		if c.lockHeld {
+			holders = append(holders, c.correlationId)
+		} else if _, ok := errs[i].(*lockHeldError); !ok {
+			t.Errorf("expected the lock to be held by the other run, got %v", errs[i])
+		}
+	}
+	if len(holders) != 1 || backend.entity(expired.lockEntity).Annotations[lockHolderAnnotation] != holders[0] {
+		t.Errorf("expected one run to hold the lock, got %v", holders)
+	}
+}
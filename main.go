@@ -2,21 +2,90 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
 
+	"github.com/google/uuid"
 	corev2 "github.com/sensu/sensu-go/api/core/v2"
 	"github.com/sensu/sensu-plugins-go-library/sensu"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// managedByLabel marks the entities registered by this plugin, so that
+	// prune never touches entities it did not create.
+	managedByLabel = "sensu.io/managed_by"
+	managedByValue = "sensu-ec2-discovery"
+
+	// requestIdHeader is the header the backend, or a proxy in front of it,
+	// identifies its responses with.
+	requestIdHeader = "X-Request-Id"
+
+	instanceIdLabel    = "aws_instance_id"
+	instanceStateLabel = "aws_instance_state"
+	regionLabel        = "aws_region"
+	accountIdLabel     = "aws_account_id"
+	accountAliasLabel  = "aws_account_alias"
+	fqdnLabel          = "fqdn"
+	hostnameLabel      = "hostname"
+
+	// reservationOwnerLabel, requesterLabel and foreignReservationLabel
+	// tell where instances in shared VPCs or launched by services come
+	// from; foreignReservationLabel is "true" when the reservation is
+	// owned by another account than the discovering one.
+	reservationOwnerLabel   = "aws_reservation_owner_id"
+	requesterLabel          = "aws_requester_id"
+	foreignReservationLabel = "aws_foreign_reservation"
+
+	// stateReasonCodeLabel and stateReasonAnnotation say why an instance
+	// that is not running was stopped or terminated.
+	stateReasonCodeLabel  = "aws_state_reason_code"
+	stateReasonAnnotation = "sensu.io/plugins/ec2-discovery/state-reason"
+
+	// lastSeenAnnotation records when discovery last saw the instance of the
+	// entity, refreshed every lastSeenRefreshInterval, or when it first saw
+	// it terminating.
+	lastSeenAnnotation = "sensu.io/plugins/ec2-discovery/last-seen"
+
+	// provenanceAnnotation records the build of the plugin that last wrote
+	// the entity.
+	provenanceAnnotation = "sensu.io/plugins/ec2-discovery/provenance"
+
+	// noAdoptAnnotation opts an existing entity out of --adopt-existing when
+	// set to "true".
+	noAdoptAnnotation = "sensu.io/plugins/ec2-discovery/no-adopt"
+
+	// ignoreAnnotation set to ignoreValue keeps discovery from updating or
+	// deleting an entity, even a managed one, so that operators can tune it
+	// by hand.
+	ignoreAnnotation = "sensu.io/ec2-discovery"
+	ignoreValue      = "ignore"
+)
+
+const (
+	writeStrategyCreateOnly = "create-only"
+	writeStrategyUpsert     = "upsert"
+	writeStrategyReplace    = "replace"
 )
 
 type CheckConfig struct {
@@ -24,31 +93,327 @@ type CheckConfig struct {
 	ec2InstanceStates          string
 	ec2InstanceRegions         string
 	ec2InstanceTags            string
+	ec2FilterTags              string
+	ec2InstanceIds             string
+	ec2InstanceIdList          []string
+	idsOnly                    bool
+	instancesFromStdin         bool
+	stdinInstances             map[string]stdinInstance
+	ec2ExcludeInstanceIds      string
+	excludedInstanceIds        map[string]bool
+	ec2MaxResults              uint64
+	errorExamples              uint64
+	ec2TagRegex                string
+	tagRegexFilters            []*tagRegexFilter
+	ec2LaunchTemplateIds       string
+	ec2LaunchTemplateNames     string
+	ec2LaunchTemplateRequired  bool
+	launchTemplateIdFilters    []*launchTemplateSelector
+	launchTemplateNameFilters  []*launchTemplateSelector
+	filterExpressionSource     string
+	filterExpression           *filterExpression
+	platformSubscriptions      string
+	platformSubscriptionMap    map[string][]string
+	entitySubscriptions        string
+	jsonTags                   string
+	maxLabels                  uint64
+	priorityLabels             string
+	jsonTagSet                 map[string]bool
+	annotationTemplates        string
+	annotationTemplateMap      map[string]*template.Template
 	ec2Filters                 []*ec2.Filter
+	filtersFromEntityLabels    string
+	scopeFromEntity            bool
+	scope                      string
+	includeNotOptedIn          bool
+	awsAccessKeyId             string
+	awsSecretAccessKey         string
+	awsSessionToken            string
+	awsAssumeRoleArns          string
+	resolveAccountAlias        bool
+	awsUseFipsEndpoints        bool
+	allowUnknownRegions        bool
+	awsDebug                   bool
 	sensuNamespace             string
 	sensuApiUrl                string
 	sensuAccessToken           string
+	sensuRefreshToken          string
+	sensuApiKey                string
+	namespaceApiKeys           string
+	namespaceApiKeyMap         map[string]string
+	sensuNamespaceTag          string
+	accountNamespaces          string
+	accountNamespaceMap        map[string]string
 	sensuTrustedCaFile         string
-	sensuInsecureSkipTlsVerify string
+	sensuTlsServerName         string
+	sensuTrustedCaDir          string
+	sensuTrustedCaDirCerts     [][]byte
+	sensuExclusiveCa           bool
+	sensuPinnedCertSha256      string
+	sensuCertPins              [][]byte
+	sensuPinChain              bool
+	sensuPinOnly               bool
+	sensuNoProxy               string
+	sensuNoProxyHosts          []string
+	sensuNoProxyNets           []*net.IPNet
+	sensuInsecureSkipTlsVerify bool
+	debug                      bool
+	outputFormat               string
+	failureWarningThreshold    uint64
+	failureCriticalThreshold   uint64
+	maxReportedFailures        uint64
+	entityLimitWarningPercent  uint64
+	entityLimitOverride        uint64
+	entityLimit                *entityLimit
+	entityLimitRejections      int32
+	quiet                      bool
+	progressEvery              uint64
+	minInstances               uint64
+	minInstancesStatus         string
+	exitPolicy                 string
+	warnOnEmptyRegion          bool
+	regionMinimums             string
+	regionMinimumMap           map[string]int
+	exitPolicyMap              map[string]int
+	stateFile                  string
+	createProxyCheck           bool
+	proxyCheckName             string
+	proxyCheckCommand          string
+	proxyCheckInterval         uint64
+	proxyCheckSubscriptions    string
+	resolveHostnames           bool
+	resolveProtection          bool
+	protectionRecheckAfter     string
+	protectionRecheckDuration  time.Duration
+	protectionCallsPerSecond   uint64
+	minUpdateInterval          string
+	minUpdateDuration          time.Duration
+	significantFields          string
+	significantFieldSet        map[string]bool
+	resolveVolumes             bool
+	annotatePricing            bool
+	resolveAmis                bool
+	consoleLinks               bool
+	hostnameLabelEnabled       bool
+	hostnameStripDomains       string
+	dnsResolver                string
+	route53ZoneId              string
+	dnsLookupTimeout           string
+	dnsLookupTimeoutDuration   time.Duration
+	dnsLookupBudget            string
+	regionTimeout              string
+	regionTimeoutDuration      time.Duration
+	keepPartialRegions         bool
+	shardBy                    string
+	shardIndex                 uint64
+	shardCount                 uint64
+	dnsLookupBudgetDuration    time.Duration
+	maxDeltaPercent            uint64
+	pruneSelectors             string
+	pruneLabelSelectors        map[string]string
+	pruneManagedBy             string
+	pruneMaxDelete             uint64
+	pruneNamespaceList         string
+	pruneYes                   bool
+	prune                      bool
+	deregister                 bool
+	deregisterDryRun           bool
+	pruneStaleAfter            string
+	pruneStaleAfterDuration    time.Duration
+	pruneGracePeriod           string
+	pruneGraceDuration         time.Duration
+	pruneReportFormat          string
+	deleteOnStates             string
+	deleteOnStateSet           map[string]bool
+	treatHibernatedAsRunning   bool
+	dryRun                     bool
+	adoptExisting              bool
+	writeStrategy              string
+	updateExisting             bool
+	labelMergeStrategy         string
+	labelStoppedForSilencing   bool
+	noRenameMigration          bool
+	noFilterDiagnosis          bool
+	printBuildInfo             bool
+	filterDiagnosisOnce        sync.Once
+	filterDiagnosis            string
+	entityNameStyle            string
+	entityNameSource           string
+	entityNameTemplateText     string
+	entityNameTemplate         *template.Template
+	telemetryTextfile          string
+	accountPrefixText          string
+	accountPrefixTemplate      *template.Template
+	workers                    uint64
+	auditLogFile               string
+	auditDryRun                bool
+	timing                     bool
+	simulate                   uint64
+	simulateTags               uint64
+	simulateLabelSize          uint64
+	simulateSink               bool
+	verify                     bool
+	verifySample               uint64
+	verifyRetry                bool
+	written                    *writtenEntities
+	diffFormat                 string
+	mode                       string
+	transport                  string
+	agentApiUrl                string
+	lockTtl                    string
+	lockTtlDuration            time.Duration
+	lockEntity                 string
+	lockHeld                   bool
+	driftWarningThreshold      uint64
+	driftCriticalThreshold     uint64
+	reportS3Bucket             string
+	reportS3Prefix             string
+	reportDryRuns              bool
+	shutdownGracePeriod        string
+	shutdownGraceDuration      time.Duration
+	timeout                    string
+	timeoutDuration            time.Duration
+	checkTimeoutMargin         string
+	checkTimeoutMarginDuration time.Duration
+	awsApiTimeout              string
+	awsApiTimeoutDuration      time.Duration
+	sensuApiTimeout            string
+	sensuApiTimeoutDuration    time.Duration
+
+	// correlationId identifies the run in the requests made to the Sensu
+	// API and in the log, see newCheckConfig.
+	correlationId string
+
+	// ctx cancels the requests in flight once the shutdown grace period
+	// is over.
+	ctx context.Context
+
+	// timings records where the time of a run goes, see --timing.
+	timings *phaseTimer
+
+	// timeouts counts the API calls cut off by --aws-api-timeout or
+	// --sensu-api-timeout.
+	timeouts timeoutCounts
+
+	// errorCategories counts the failures of a run per category, see
+	// --error-examples.
+	errorCategories errorCategoryCounts
+
+	// audit records the write actions of a run, see --audit-log-file.
+	audit *auditLog
+
+	// diff collects the entities a run writes, see --diff.
+	diff *diffReport
+
+	// stdin is where the triggering event and --instances-from-stdin are
+	// read from, os.Stdin when nil.
+	stdin io.Reader
+
+	// dryRunOut is where --dry-run prints the entities it would write,
+	// os.Stdout when nil, guarded by dryRunLock.
+	dryRunOut  io.Writer
+	dryRunLock sync.Mutex
+
+	// dryRunOffline is set on dry-runs without Sensu credentials, which
+	// do not read the existing entities.
+	dryRunOffline bool
+
+	// httpClient is the client of the Sensu API requests, see
+	// sensuHttpClient.
+	httpClientOnce sync.Once
+	httpClient     *http.Client
+	httpClientErr  error
+
+	// proxyDecisionOnce logs whether the Sensu API is proxied once per
+	// run.
+	proxyDecisionOnce sync.Once
+
+	// existingEntities caches the entity listing of each namespace, see
+	// cachedEntities.
+	existingEntitiesMu sync.Mutex
+	existingEntities   map[string][]*corev2.Entity
+
+	// labelSelectors records whether the backend supports the label
+	// selectors of listManagedEntities.
+	labelSelectors int32
+
+	// entityNames maps the entity names given out during the run with
+	// --entity-name-style dns or --entity-name-source name-tag to their
+	// instance IDs, see entityName.
+	entityNamesMu sync.Mutex
+	entityNames   map[string]string
+
+	// failuresLogged counts the failed registrations logged with --quiet.
+	failuresLoggedMu sync.Mutex
+	failuresLogged   uint64
+
+	// protection caches the termination protection of the instances with
+	// --resolve-protection, see resolveInstanceProtection.
+	protection *protectionCache
+
+	// churn defers the updates of recently written entities with
+	// --min-update-interval, see deferUpdate.
+	churn *churnControl
+
+	// volumes caches the EBS volumes described during the run with
+	// --resolve-volumes, see resolveInstanceVolumes.
+	volumes *volumeCache
+
+	// pricing caches the on-demand prices looked up during the run with
+	// --annotate-pricing, see resolveInstancePricing.
+	pricing *pricingCache
+
+	// images caches the AMIs described during the run with --resolve-amis,
+	// see resolveInstanceImages.
+	images *imageCache
+
+	// accessTokenMu guards sensuAccessToken and sensuRefreshToken, which
+	// are replaced when refreshed, and the expiry of the refreshed token.
+	accessTokenMu        sync.Mutex
+	accessTokenExpiresAt time.Time
+
+	// credentialFallback describes the Sensu credential used instead of
+	// the rejected one, once credentialFallbackTried, see sensuApiRequest.
+	credentialFallbackMu    sync.Mutex
+	credentialFallbackTried bool
+	credentialFallback      string
+
+	// awsRequestIds is the ID of the last AWS request of each region, see
+	// trackAwsRequest.
+	awsRequestIdsMu sync.Mutex
+	awsRequestIds   map[string]string
 }
 
 var (
-	config = CheckConfig{
+	// version, commit and date are set at build time, see buildInfo.
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// newCheckConfig returns the configuration of a run, with a correlation ID
+// of its own, for the plugin options to be bound to.
+func newCheckConfig() *CheckConfig {
+	return &CheckConfig{
 		PluginConfig: sensu.PluginConfig{
 			Name:     "sensu-ec2-discovery",
 			Short:    "Auto-discover EC2 instances and update your Sensu Go registry.",
 			Keyspace: "sensu.io/plugins/ec2-discovery",
 		},
+		correlationId: uuid.New().String(),
 	}
+}
 
-	ec2DiscoveryConfigOptions = []*sensu.PluginConfigOption{
+// ec2DiscoveryConfigOptions returns the discovery options, bound to c.
+func ec2DiscoveryConfigOptions(c *CheckConfig) []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
 		{
 			Path:      "ec2-instance-states",
 			Env:       "EC2_INSTANCE_STATES",
 			Argument:  "ec2-instance-states",
 			Shorthand: "s",
 			Usage:     "The AWS EC2 instance states to discover. Can also be set via the $EC2_INSTANCE_STATES environment variable.",
-			Value:     &config.ec2InstanceStates,
+			Value:     &c.ec2InstanceStates,
 			Default:   "pending,running,rebooting",
 		},
 		{
@@ -56,233 +421,2652 @@ var (
 			Env:       "EC2_INSTANCE_REGIONS",
 			Argument:  "ec2-instance-regions",
 			Shorthand: "r",
-			Usage:     "The AWS EC2 region(s) to discover. Can also be set via the $EC2_INSTANCE_REGIONS environment variable. OPTIONAL.",
-			Value:     &config.ec2InstanceRegions,
+			Usage:     "The AWS EC2 region(s) to discover, or \"all\" for every region enabled for the account. Can also be set via the $EC2_INSTANCE_REGIONS environment variable. OPTIONAL.",
+			Value:     &c.ec2InstanceRegions,
 			Default:   "",
 		},
+		{
+			Path:      "allow-unknown-regions",
+			Env:       "ALLOW_UNKNOWN_REGIONS",
+			Argument:  "allow-unknown-regions",
+			Shorthand: "",
+			Usage:     "Accept regions this release does not know, e.g. regions launched since. Can also be set via the $ALLOW_UNKNOWN_REGIONS environment variable.",
+			Value:     &c.allowUnknownRegions,
+			Default:   false,
+		},
+		{
+			Path:      "include-not-opted-in",
+			Env:       "INCLUDE_NOT_OPTED_IN",
+			Argument:  "include-not-opted-in",
+			Shorthand: "",
+			Usage:     "Also discover the opt-in regions the account has not opted into when expanding \"all\", surfacing their errors. Can also be set via the $INCLUDE_NOT_OPTED_IN environment variable.",
+			Value:     &c.includeNotOptedIn,
+			Default:   false,
+		},
 		{
 			Path:      "ec2-instance-tags",
 			Env:       "EC2_INSTANCE_TAGS",
 			Argument:  "ec2-instance-tags",
 			Shorthand: "t",
-			Usage:     "The AWS Cloudwatch metric dimension. Can also be set via the $EC2_INSTANCE_TAGS environment variable. OPTIONAL.",
-			Value:     &config.ec2InstanceTags,
+			Usage:     "Deprecated, use --ec2-filter-tags. Can also be set via the $EC2_INSTANCE_TAGS environment variable. OPTIONAL.",
+			Value:     &c.ec2InstanceTags,
 			Default:   "",
 		},
 		{
-			Path:      "sensu-namespace",
-			Env:       "SENSU_NAMESPACE",
-			Argument:  "sensu-namespace",
+			Path:      "ec2-filter-tags",
+			Env:       "EC2_FILTER_TAGS",
+			Argument:  "ec2-filter-tags",
 			Shorthand: "",
-			Usage:     "The Sensu Go Namespace to register entities in. Can also be set via the $SENSU_NAMESPACE environment variable.",
-			Value:     &config.sensuNamespace,
-			Default:   "default",
+			Usage:     "Comma-separated key=value tags, discovering only the instances with all of them, as DescribeInstances filters in the order given, e.g. Environment=prod,Team=db. Which tags become labels does not depend on it. Can also be set via the $EC2_FILTER_TAGS environment variable. OPTIONAL.",
+			Value:     &c.ec2FilterTags,
+			Default:   "",
 		},
 		{
-			Path:      "sensu-api-url",
-			Env:       "SENSU_API_URL",
-			Argument:  "sensu-api-url",
+			Path:      "ec2-tag-regex",
+			Env:       "EC2_TAG_REGEX",
+			Argument:  "ec2-tag-regex",
 			Shorthand: "",
-			Usage:     "The Sensu Go API URL. Can also be set via the $SENSU_API_URL environment variable.",
-			Value:     &config.sensuApiUrl,
-			Default:   "https://127.0.0.1:8080",
+			Usage:     "key=pattern filters, one per line, discovering only the instances whose tag value matches the regular expression, applied after the EC2 filters, e.g. Environment=^prod-(eu|us)$. Can also be set via the $EC2_TAG_REGEX environment variable. OPTIONAL.",
+			Value:     &c.ec2TagRegex,
+			Default:   "",
 		},
 		{
-			Path:      "sensu-access-token",
-			Env:       "SENSU_ACCESS_TOKEN",
-			Argument:  "sensu-access-token",
+			Path:      "ec2-launch-template-ids",
+			Env:       "EC2_LAUNCH_TEMPLATE_IDS",
+			Argument:  "ec2-launch-template-ids",
 			Shorthand: "",
-			Usage:     "The Sensu Go API access key. Can also be set via the $SENSU_ACCESS_TOKEN environment variable. REQUIRED.",
-			Value:     &config.sensuAccessToken,
+			Usage:     "Comma-separated launch template IDs, each optionally with a version constraint such as lt-0abc:>=42, discovering only the instances launched from them. Can also be set via the $EC2_LAUNCH_TEMPLATE_IDS environment variable. OPTIONAL.",
+			Value:     &c.ec2LaunchTemplateIds,
 			Default:   "",
 		},
 		{
-			Path:      "sensu-trusted-ca-file",
-			Env:       "SENSU_TRUSTED_CA_FILE",
-			Argument:  "sensu-trusted-ca-file",
+			Path:      "ec2-launch-template-names",
+			Env:       "EC2_LAUNCH_TEMPLATE_NAMES",
+			Argument:  "ec2-launch-template-names",
 			Shorthand: "",
-			Usage:     "The Sensu Go API URL. Can also be set via the $SENSU_TRUSTED_CA_FILE environment variable. OPTIONAL.",
-			Value:     &config.sensuTrustedCaFile,
+			Usage:     "Comma-separated launch template names, each optionally with a version constraint such as web:>=42, discovering only the instances launched from them, resolved per region. Can also be set via the $EC2_LAUNCH_TEMPLATE_NAMES environment variable. OPTIONAL.",
+			Value:     &c.ec2LaunchTemplateNames,
 			Default:   "",
 		},
 		{
-			Path:      "sensu-insecure-tls-skip-verify",
-			Env:       "SENSU_INSECURE_SKIP_TLS_VERIFY",
-			Argument:  "sensu-insecure-tls-skip-verify",
+			Path:      "ec2-launch-template-required",
+			Env:       "EC2_LAUNCH_TEMPLATE_REQUIRED",
+			Argument:  "ec2-launch-template-required",
 			Shorthand: "",
-			Usage:     "The Sensu Go API URL. Can also be set via the $SENSU_INSECURE_SKIP_TLS_VERIFY environment variable.",
-			Value:     &config.sensuInsecureSkipTlsVerify,
-			Default:   "false",
+			Usage:     "Discover only the instances launched from a launch template. Can also be set via the $EC2_LAUNCH_TEMPLATE_REQUIRED environment variable.",
+			Value:     &c.ec2LaunchTemplateRequired,
+			Default:   false,
 		},
-	}
-)
-
-func main() {
-	check := sensu.InitCheck(
-		&config.PluginConfig,
-		ec2DiscoveryConfigOptions,
-		validateArgs,
-		discoverInstances,
-	)
-	check.Execute()
-}
-
-func validateArgs(event *corev2.Event) error {
-	if config.sensuAccessToken == "" {
-		log.Fatalf("ERROR: no Sensu API access token provided. Exiting.")
-		return fmt.Errorf("No Sensu API access token provided. Exiting.")
-	}
-
-	err := createFilters()
-	if err != nil {
-		log.Fatalf("ERROR: %s\n", err)
-		return err
-	}
-
-	return nil
-}
-
-func createFilters() error {
-	var states []string
-	var tags []string
-
-	if len(config.ec2InstanceStates) > 0 {
-		states = strings.Split(config.ec2InstanceStates, ",")
-		config.ec2Filters = append(config.ec2Filters, &ec2.Filter{
-			Name:   aws.String("instance-state-name"),
-			Values: aws.StringSlice(states),
-		})
-	}
-
-	if len(config.ec2InstanceTags) > 0 {
-		tags = strings.Split(config.ec2InstanceTags, ",")
-		for _, tag := range tags {
-			tagPair := strings.Split(tag, "=")
-			filter := &ec2.Filter{
-				Name:   aws.String(strings.Join([]string{"tag", tagPair[0]}, ":")),
-				Values: []*string{aws.String(tagPair[1])},
-			}
-			config.ec2Filters = append(config.ec2Filters, filter)
-		}
-	}
-
-	return nil
-}
-
-func LoadCACerts(path string) (*x509.CertPool, error) {
-	rootCAs, err := x509.SystemCertPool()
-	if err != nil {
-		log.Fatalf("ERROR: failed to load system cert pool: %s", err)
-		return nil, err
-	}
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
-	}
-	if path != "" {
-		certs, err := ioutil.ReadFile(path)
-		if err != nil {
-			log.Fatalf("ERROR: failed to read CA file (%s): %s", path, err)
-			return nil, err
-		} else {
-			rootCAs.AppendCertsFromPEM(certs)
-		}
-	}
-	return rootCAs, nil
-}
-
-func initHttpClient() *http.Client {
-	certs, err := LoadCACerts(config.sensuTrustedCaFile)
-	if err != nil {
-		log.Fatalf("ERROR: %s\n", err)
-	}
-	tlsConfig := &tls.Config{
-		RootCAs: certs,
-	}
-	tr := &http.Transport{
-		TLSClientConfig: tlsConfig,
-	}
-	client := &http.Client{
-		Transport: tr,
-	}
-	return client
-}
-
-func registerInstance(instance *ec2.Instance) {
-	var entity corev2.Entity
-	entity.Name = *instance.InstanceId
-	entity.Namespace = config.sensuNamespace
-	entity.EntityClass = "proxy"
-	entity.Labels = make(map[string]string)
-	for _, tag := range instance.Tags {
-		entity.Labels[*tag.Key] = *tag.Value
-	}
-
-	// fmt.Printf("%s\n", entity.Name)
-
-	postBody, err := json.Marshal(entity)
-	if err != nil {
-		log.Fatal("ERROR: ", err)
-	}
-	body := bytes.NewReader(postBody)
-	req, err := http.NewRequest(
-		"POST",
-		fmt.Sprintf("%s/api/core/v2/namespaces/%s/entities",
-			config.sensuApiUrl,
-			entity.Namespace,
-		),
-		body,
-	)
-	if err != nil {
-		log.Fatal("ERROR: ", err)
-	}
-	var httpClient *http.Client = initHttpClient()
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.sensuAccessToken))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		log.Fatalf("ERROR: %s\n", err)
-	} else if resp.StatusCode == 404 {
-		log.Fatalf("ERROR: %v %s (%s)\n", resp.StatusCode, http.StatusText(resp.StatusCode), req.URL)
-	} else if resp.StatusCode == 409 {
-		log.Printf("INFO: entity \"%s\" already exists (%v: %s)\n", entity.Name, resp.StatusCode, http.StatusText(resp.StatusCode))
-	} else if resp.StatusCode >= 300 {
-		log.Fatalf("ERROR: %v %s", resp.StatusCode, http.StatusText(resp.StatusCode))
-	} else if resp.StatusCode == 201 {
-		log.Printf("INFO: registered entity for EC2 instance \"%s\"", entity.Name)
-	} else {
-		defer resp.Body.Close()
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatalf("ERROR: %s\n", err)
-		} else {
-			fmt.Printf("%s\n", string(b))
-		}
-	}
-
-	return
-}
-
-// Usage: instancesByRegion -api <url> -state <value> [-state value...] [-region region...] [-tag key=value...]
-func discoverInstances(event *corev2.Event) error {
-	for _, region := range strings.Split(config.ec2InstanceRegions, ",") {
-		aws_session := session.Must(session.NewSession(&aws.Config{
-			Region: aws.String(region),
-		}))
-
-		svc := ec2.New(aws_session)
-
-		params := &ec2.DescribeInstancesInput{Filters: config.ec2Filters}
-		result, err := svc.DescribeInstances(params)
-		if err != nil {
-			log.Fatalf("ERROR: %s\n", err)
-			return err
-		} else {
-			for _, reservation := range result.Reservations {
-				for _, instance := range reservation.Instances {
-					registerInstance(instance)
-				}
-			}
-		}
-	}
-	return nil
+		{
+			Path:      "filter-expression",
+			Env:       "FILTER_EXPRESSION",
+			Argument:  "filter-expression",
+			Shorthand: "",
+			Usage:     "JavaScript expression discovering only the instances it evaluates to true for, applied after the EC2 filters, over instance_id, region, tags, instance_type, state, launch_time, now (Unix seconds), subnet_id, vpc_id and lifecycle, e.g. instance_type.indexOf(\"m5\") == 0 && now - launch_time > 7 * 86400. Can also be set via the $FILTER_EXPRESSION environment variable. OPTIONAL.",
+			Value:     &c.filterExpressionSource,
+			Default:   "",
+		},
+		{
+			Path:      "ec2-instance-ids",
+			Env:       "EC2_INSTANCE_IDS",
+			Argument:  "ec2-instance-ids",
+			Shorthand: "",
+			Usage:     "Comma-separated IDs of the instances to discover, in addition to the other filters. Can also be set via the $EC2_INSTANCE_IDS environment variable. OPTIONAL.",
+			Value:     &c.ec2InstanceIds,
+			Default:   "",
+		},
+		{
+			Path:      "ids-only",
+			Env:       "IDS_ONLY",
+			Argument:  "ids-only",
+			Shorthand: "",
+			Usage:     "Discover the instances of --ec2-instance-ids regardless of their state and tags, ignoring the other filters. Can also be set via the $IDS_ONLY environment variable.",
+			Value:     &c.idsOnly,
+			Default:   false,
+		},
+		{
+			Path:      "instances-from-stdin",
+			Env:       "",
+			Argument:  "instances-from-stdin",
+			Shorthand: "",
+			Usage:     "Register the instances whose IDs, or id,region pairs, are read from stdin one per line, instead of discovering them with filters.",
+			Value:     &c.instancesFromStdin,
+			Default:   false,
+		},
+		{
+			Path:      "ec2-exclude-instance-ids",
+			Env:       "EC2_EXCLUDE_INSTANCE_IDS",
+			Argument:  "ec2-exclude-instance-ids",
+			Shorthand: "",
+			Usage:     "Comma-separated IDs of instances never to register or prune, or @file to read them from a file with one or more IDs per line. Can also be set via the $EC2_EXCLUDE_INSTANCE_IDS environment variable. OPTIONAL.",
+			Value:     &c.ec2ExcludeInstanceIds,
+			Default:   "",
+		},
+		{
+			Path:      "ec2-max-results",
+			Env:       "EC2_MAX_RESULTS",
+			Argument:  "ec2-max-results",
+			Shorthand: "",
+			Usage:     "The instances per DescribeInstances page, from 5 to 1000, 0 for the EC2 default; every page is read either way. Can also be set via the $EC2_MAX_RESULTS environment variable.",
+			Value:     &c.ec2MaxResults,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "platform-subscriptions",
+			Env:       "PLATFORM_SUBSCRIPTIONS",
+			Argument:  "platform-subscriptions",
+			Shorthand: "",
+			Usage:     "Semicolon-separated platform=subscriptions pairs selecting the subscriptions of entities by instance platform (linux or windows), e.g. linux=linux-proxy,ec2;windows=windows-proxy,ec2. Can also be set via the $PLATFORM_SUBSCRIPTIONS environment variable. OPTIONAL.",
+			Value:     &c.platformSubscriptions,
+			Default:   "",
+		},
+		{
+			Path:      "entity-subscriptions",
+			Env:       "ENTITY_SUBSCRIPTIONS",
+			Argument:  "entity-subscriptions",
+			Shorthand: "",
+			Usage:     "Comma-separated subscriptions of every entity, on top of those of --platform-subscriptions, along with the entity:<name> subscription an agent entity has, e.g. ec2-proxy,ping. Can also be set via the $ENTITY_SUBSCRIPTIONS environment variable. OPTIONAL.",
+			Value:     &c.entitySubscriptions,
+			Default:   "",
+		},
+		{
+			Path:      "json-tag",
+			Env:       "JSON_TAG",
+			Argument:  "json-tag",
+			Shorthand: "",
+			Usage:     "Comma-separated tags whose values are flat JSON objects, expanded into a label per key. Can also be set via the $JSON_TAG environment variable. OPTIONAL.",
+			Value:     &c.jsonTags,
+			Default:   "",
+		},
+		{
+			Path:      "max-labels",
+			Env:       "MAX_LABELS",
+			Argument:  "max-labels",
+			Shorthand: "",
+			Usage:     "The maximum number of labels per entity, the others being moved into the " + extraLabelsAnnotation + " JSON annotation; plugin labels are always kept, then --priority-labels, then the others by key, 0 for no limit. Can also be set via the $MAX_LABELS environment variable. OPTIONAL.",
+			Value:     &c.maxLabels,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "priority-labels",
+			Env:       "PRIORITY_LABELS",
+			Argument:  "priority-labels",
+			Shorthand: "",
+			Usage:     "Comma-separated labels kept ahead of the others under --max-labels, most important first. Can also be set via the $PRIORITY_LABELS environment variable. OPTIONAL.",
+			Value:     &c.priorityLabels,
+			Default:   "",
+		},
+		{
+			Path:      "annotation-template",
+			Env:       "ANNOTATION_TEMPLATE",
+			Argument:  "annotation-template",
+			Shorthand: "",
+			Usage:     "key=template annotations rendered per instance, one per line, e.g. runbook=https://wiki/teams/{{ .Tags.team }}/ec2. Can also be set via the $ANNOTATION_TEMPLATE environment variable. OPTIONAL.",
+			Value:     &c.annotationTemplates,
+			Default:   "",
+		},
+		{
+			Path:      "filters-from-entity-labels",
+			Env:       "FILTERS_FROM_ENTITY_LABELS",
+			Argument:  "filters-from-entity-labels",
+			Shorthand: "",
+			Usage:     "Comma-separated label=role mappings (role is region or tag:<key>) deriving filters from the labels of the entity in the event read from stdin. Can also be set via the $FILTERS_FROM_ENTITY_LABELS environment variable. OPTIONAL.",
+			Value:     &c.filtersFromEntityLabels,
+			Default:   "",
+		},
+		{
+			Path:      "scope-from-entity",
+			Env:       "SCOPE_FROM_ENTITY",
+			Argument:  "scope-from-entity",
+			Shorthand: "",
+			Usage:     "Restrict executions for a proxy entity to the region in its aws_region label, and the account of the role in its aws_role_arn label if any, naming the summary and metrics after the entity. Can also be set via the $SCOPE_FROM_ENTITY environment variable.",
+			Value:     &c.scopeFromEntity,
+			Default:   false,
+		},
+		{
+			Path:      "aws-access-key-id",
+			Env:       "AWS_ACCESS_KEY_ID",
+			Argument:  "aws-access-key-id",
+			Shorthand: "",
+			Usage:     "The AWS access key ID. Can also be set via the $AWS_ACCESS_KEY_ID environment variable. OPTIONAL.",
+			Value:     &c.awsAccessKeyId,
+			Default:   "",
+		},
+		{
+			Path:      "aws-secret-access-key",
+			Env:       "AWS_SECRET_ACCESS_KEY",
+			Argument:  "aws-secret-access-key",
+			Shorthand: "",
+			Usage:     "The AWS secret access key. Can also be set via the $AWS_SECRET_ACCESS_KEY environment variable. OPTIONAL.",
+			Value:     &c.awsSecretAccessKey,
+			Default:   "",
+		},
+		{
+			Path:      "aws-session-token",
+			Env:       "AWS_SESSION_TOKEN",
+			Argument:  "aws-session-token",
+			Shorthand: "",
+			Usage:     "The AWS session token of temporary credentials. Can also be set via the $AWS_SESSION_TOKEN environment variable. OPTIONAL.",
+			Value:     &c.awsSessionToken,
+			Default:   "",
+		},
+		{
+			Path:      "aws-use-fips-endpoints",
+			Env:       "AWS_USE_FIPS_ENDPOINTS",
+			Argument:  "aws-use-fips-endpoints",
+			Shorthand: "",
+			Usage:     "Use the FIPS endpoints of EC2 and STS, failing for regions without one. Can also be set via the $AWS_USE_FIPS_ENDPOINTS environment variable.",
+			Value:     &c.awsUseFipsEndpoints,
+			Default:   false,
+		},
+		{
+			Path:      "aws-assume-role-arns",
+			Env:       "AWS_ASSUME_ROLE_ARNS",
+			Argument:  "aws-assume-role-arns",
+			Shorthand: "",
+			Usage:     "Comma-separated IAM role ARNs to assume, discovering the instances of each role's account. Can also be set via the $AWS_ASSUME_ROLE_ARNS environment variable. OPTIONAL.",
+			Value:     &c.awsAssumeRoleArns,
+			Default:   "",
+		},
+		{
+			Path:      "resolve-account-alias",
+			Env:       "RESOLVE_ACCOUNT_ALIAS",
+			Argument:  "resolve-account-alias",
+			Shorthand: "",
+			Usage:     "Label entities with the AWS account alias, which requires iam:ListAccountAliases. Can also be set via the $RESOLVE_ACCOUNT_ALIAS environment variable.",
+			Value:     &c.resolveAccountAlias,
+			Default:   false,
+		},
+		{
+			Path:      "delete-on-states",
+			Env:       "DELETE_ON_STATES",
+			Argument:  "delete-on-states",
+			Shorthand: "",
+			Usage:     "Delete the managed entity of instances discovered in these states (e.g. stopped,terminated) instead of registering it. Can also be set via the $DELETE_ON_STATES environment variable. OPTIONAL.",
+			Value:     &c.deleteOnStates,
+			Default:   "",
+		},
+		{
+			Path:      "treat-hibernated-as-running",
+			Env:       "TREAT_HIBERNATED_AS_RUNNING",
+			Argument:  "treat-hibernated-as-running",
+			Shorthand: "",
+			Usage:     "Keep the entities of hibernated instances registered like those of running instances, neither deleted by --delete-on-states nor pruned. Can also be set via the $TREAT_HIBERNATED_AS_RUNNING environment variable.",
+			Value:     &c.treatHibernatedAsRunning,
+			Default:   false,
+		},
+		{
+			Path:      "write-strategy",
+			Env:       "WRITE_STRATEGY",
+			Argument:  "write-strategy",
+			Shorthand: "",
+			Usage:     "How existing managed entities are written: create-only leaves them alone, upsert merges the discovered labels, annotations and network into them, replace overwrites them with the discovered entity. Can also be set via the $WRITE_STRATEGY environment variable.",
+			Value:     &c.writeStrategy,
+			Default:   writeStrategyUpsert,
+		},
+		{
+			Path:      "label-merge-strategy",
+			Env:       "LABEL_MERGE_STRATEGY",
+			Argument:  "label-merge-strategy",
+			Shorthand: "",
+			Usage:     "How the upsert write strategy merges the discovered labels and annotations into those of an existing entity: overwrite drops those set by hand, preserve-existing keeps the values already set (a tag removed in EC2 stays), ec2-wins writes the discovered values and removes a tag removed in EC2 while keeping those set by hand. Can also be set via the $LABEL_MERGE_STRATEGY environment variable.",
+			Value:     &c.labelMergeStrategy,
+			Default:   labelMergeEc2Wins,
+		},
+		{
+			Path:      "label-stopped-for-silencing",
+			Env:       "LABEL_STOPPED_FOR_SILENCING",
+			Argument:  "label-stopped-for-silencing",
+			Shorthand: "",
+			Usage:     "Label the entities of instances that are not running alerts=suppressed, and remove the label once they run again, for event filters to drop the alerts of their proxy checks. Can also be set via the $LABEL_STOPPED_FOR_SILENCING environment variable.",
+			Value:     &c.labelStoppedForSilencing,
+			Default:   false,
+		},
+		{
+			Path:      "update-existing",
+			Env:       "UPDATE_EXISTING",
+			Argument:  "update-existing",
+			Shorthand: "",
+			Usage:     "Update the entities that already exist (the entity create returned 409 Conflict) with the discovered labels, annotations and network, --update-existing=false leaves them alone like --write-strategy create-only. Can also be set via the $UPDATE_EXISTING environment variable.",
+			Value:     &c.updateExisting,
+			Default:   true,
+		},
+		{
+			Path:      "adopt-existing",
+			Env:       "ADOPT_EXISTING",
+			Argument:  "adopt-existing",
+			Shorthand: "",
+			Usage:     "Mark existing entities matching a discovered instance by name or aws_instance_id label as managed by this plugin. Can also be set via the $ADOPT_EXISTING environment variable.",
+			Value:     &c.adoptExisting,
+			Default:   false,
+		},
+		{
+			Path:      "no-rename-migration",
+			Env:       "NO_RENAME_MIGRATION",
+			Argument:  "no-rename-migration",
+			Shorthand: "",
+			Usage:     "Keep the managed entities registered for an instance under a previous name instead of deleting them once the entity under its current name exists. Can also be set via the $NO_RENAME_MIGRATION environment variable.",
+			Value:     &c.noRenameMigration,
+			Default:   false,
+		},
+		{
+			Path:      "no-filter-diagnosis",
+			Env:       "NO_FILTER_DIAGNOSIS",
+			Argument:  "no-filter-diagnosis",
+			Shorthand: "",
+			Usage:     "Do not try the filters one at a time to find the one EC2 rejected when it fails a region with InvalidParameterValue. Can also be set via the $NO_FILTER_DIAGNOSIS environment variable.",
+			Value:     &c.noFilterDiagnosis,
+			Default:   false,
+		},
+		{
+			Path:      "print-build-info",
+			Env:       "",
+			Argument:  "print-build-info",
+			Shorthand: "",
+			Usage:     "Print the version, commit and build date of the plugin as JSON and exit; the version subcommand prints them as text.",
+			Value:     &c.printBuildInfo,
+			Default:   false,
+		},
+		{
+			Path:      "entity-name-style",
+			Env:       "ENTITY_NAME_STYLE",
+			Argument:  "entity-name-style",
+			Shorthand: "",
+			Usage:     "How entity names are normalized: raw, or dns for lowercase letters, digits and dashes only, at most 63 characters, recording the original name in the " + originalNameAnnotation + " annotation. Can also be set via the $ENTITY_NAME_STYLE environment variable.",
+			Value:     &c.entityNameStyle,
+			Default:   entityNameStyleRaw,
+		},
+		{
+			Path:      "entity-name-source",
+			Env:       "ENTITY_NAME_SOURCE",
+			Argument:  "entity-name-source",
+			Shorthand: "",
+			Usage:     "What entities are named after: instance-id, or name-tag for the Name tag of the instance, falling back to the instance ID without one, normalized to lowercase letters, digits, underscores, dots and dashes, with the instance ID appended when another instance has the same name. The instance ID is kept in the aws_instance_id label. Can also be set via the $ENTITY_NAME_SOURCE environment variable.",
+			Value:     &c.entityNameSource,
+			Default:   entityNameSourceInstanceId,
+		},
+		{
+			Path:      "entity-name-template",
+			Env:       "ENTITY_NAME_TEMPLATE",
+			Argument:  "entity-name-template",
+			Shorthand: "",
+			Usage:     "A Go template entities are named after, rendered per instance with .InstanceID, .Region, .AvailabilityZone, .PrivateIP, .PublicIP, .AccountID and the .Tag map, e.g. {{ .Region }}-{{ .Tag.Name }}, normalized like --entity-name-source name-tag. An instance it fails on, e.g. for a missing tag, is named after its instance ID. Can also be set via the $ENTITY_NAME_TEMPLATE environment variable. OPTIONAL.",
+			Value:     &c.entityNameTemplateText,
+			Default:   "",
+		},
+		{
+			Path:      "account-prefix-template",
+			Env:       "ACCOUNT_PREFIX_TEMPLATE",
+			Argument:  "account-prefix-template",
+			Shorthand: "",
+			Usage:     "Template of the prefix of entity names when discovering several accounts with --aws-assume-role-arns, rendered with .AccountId and .AccountAlias, empty for no prefix. Can also be set via the $ACCOUNT_PREFIX_TEMPLATE environment variable.",
+			Value:     &c.accountPrefixText,
+			Default:   "{{ .AccountAlias | default .AccountId }}-",
+		},
+		{
+			Path:      "create-proxy-check",
+			Env:       "CREATE_PROXY_CHECK",
+			Argument:  "create-proxy-check",
+			Shorthand: "",
+			Usage:     "Create or update a proxy check running against every entity managed by this plugin, in each namespace instances are registered in. Can also be set via the $CREATE_PROXY_CHECK environment variable.",
+			Value:     &c.createProxyCheck,
+			Default:   false,
+		},
+		{
+			Path:      "proxy-check-name",
+			Env:       "PROXY_CHECK_NAME",
+			Argument:  "proxy-check-name",
+			Shorthand: "",
+			Usage:     "The name of the proxy check. Can also be set via the $PROXY_CHECK_NAME environment variable.",
+			Value:     &c.proxyCheckName,
+			Default:   "ec2-instance",
+		},
+		{
+			Path:      "proxy-check-command",
+			Env:       "PROXY_CHECK_COMMAND",
+			Argument:  "proxy-check-command",
+			Shorthand: "",
+			Usage:     "The command of the proxy check, e.g. check-ping -h {{ .labels.fqdn }}. Can also be set via the $PROXY_CHECK_COMMAND environment variable.",
+			Value:     &c.proxyCheckCommand,
+			Default:   "",
+		},
+		{
+			Path:      "proxy-check-interval",
+			Env:       "PROXY_CHECK_INTERVAL",
+			Argument:  "proxy-check-interval",
+			Shorthand: "",
+			Usage:     "The interval of the proxy check, in seconds. Can also be set via the $PROXY_CHECK_INTERVAL environment variable.",
+			Value:     &c.proxyCheckInterval,
+			Default:   uint64(60),
+		},
+		{
+			Path:      "proxy-check-subscriptions",
+			Env:       "PROXY_CHECK_SUBSCRIPTIONS",
+			Argument:  "proxy-check-subscriptions",
+			Shorthand: "",
+			Usage:     "Comma-separated subscriptions of the agents running the proxy check. Can also be set via the $PROXY_CHECK_SUBSCRIPTIONS environment variable.",
+			Value:     &c.proxyCheckSubscriptions,
+			Default:   "",
+		},
+		{
+			Path:      "hostname-label",
+			Env:       "HOSTNAME_LABEL",
+			Argument:  "hostname-label",
+			Shorthand: "",
+			Usage:     "Label entities with the short hostname of their private DNS name, falling back to the Name tag and then the instance ID. Can also be set via the $HOSTNAME_LABEL environment variable.",
+			Value:     &c.hostnameLabelEnabled,
+			Default:   false,
+		},
+		{
+			Path:      "hostname-strip-domains",
+			Env:       "HOSTNAME_STRIP_DOMAINS",
+			Argument:  "hostname-strip-domains",
+			Shorthand: "",
+			Usage:     "Comma-separated domains stripped from the private DNS name to form the hostname label, instead of keeping only its first label. Can also be set via the $HOSTNAME_STRIP_DOMAINS environment variable. OPTIONAL.",
+			Value:     &c.hostnameStripDomains,
+			Default:   "",
+		},
+		{
+			Path:      "resolve-hostnames",
+			Env:       "RESOLVE_HOSTNAMES",
+			Argument:  "resolve-hostnames",
+			Shorthand: "",
+			Usage:     "Label entities with the fqdn of their private IP address, falling back to the EC2 DNS name. Can also be set via the $RESOLVE_HOSTNAMES environment variable.",
+			Value:     &c.resolveHostnames,
+			Default:   false,
+		},
+		{
+			Path:      "resolve-protection",
+			Env:       "RESOLVE_PROTECTION",
+			Argument:  "resolve-protection",
+			Shorthand: "",
+			Usage:     "Label entities with the termination protection of their instance, calling DescribeInstanceAttribute once per instance and caching the result in --state-file. Can also be set via the $RESOLVE_PROTECTION environment variable.",
+			Value:     &c.resolveProtection,
+			Default:   false,
+		},
+		{
+			Path:      "protection-recheck-after",
+			Env:       "PROTECTION_RECHECK_AFTER",
+			Argument:  "protection-recheck-after",
+			Shorthand: "",
+			Usage:     "How long the cached termination protection of an instance is trusted before it is checked again, e.g. 24h. Can also be set via the $PROTECTION_RECHECK_AFTER environment variable.",
+			Value:     &c.protectionRecheckAfter,
+			Default:   "24h",
+		},
+		{
+			Path:      "protection-calls-per-second",
+			Env:       "PROTECTION_CALLS_PER_SECOND",
+			Argument:  "protection-calls-per-second",
+			Shorthand: "",
+			Usage:     "The pace of the DescribeInstanceAttribute calls of --resolve-protection, across regions. Can also be set via the $PROTECTION_CALLS_PER_SECOND environment variable.",
+			Value:     &c.protectionCallsPerSecond,
+			Default:   uint64(5),
+		},
+		{
+			Path:      "min-update-interval",
+			Env:       "MIN_UPDATE_INTERVAL",
+			Argument:  "min-update-interval",
+			Shorthand: "",
+			Usage:     "Rewrite an existing entity at most once per interval, e.g. 1h, unless one of --significant-fields changed, recording the write times in --state-file. Can also be set via the $MIN_UPDATE_INTERVAL environment variable. OPTIONAL.",
+			Value:     &c.minUpdateInterval,
+			Default:   "",
+		},
+		{
+			Path:      "significant-fields",
+			Env:       "SIGNIFICANT_FIELDS",
+			Argument:  "significant-fields",
+			Shorthand: "",
+			Usage:     "Comma-separated fields whose change updates an entity regardless of --min-update-interval: name, class, subscriptions, state, network, label:<key> and annotation:<key>. Can also be set via the $SIGNIFICANT_FIELDS environment variable.",
+			Value:     &c.significantFields,
+			Default:   "name,class,subscriptions,state",
+		},
+		{
+			Path:      "resolve-volumes",
+			Env:       "RESOLVE_VOLUMES",
+			Argument:  "resolve-volumes",
+			Shorthand: "",
+			Usage:     "Label entities with the type and size of the root EBS volume and the total size of the EBS volumes of their instance, calling DescribeVolumes for each page of instances. Can also be set via the $RESOLVE_VOLUMES environment variable.",
+			Value:     &c.resolveVolumes,
+			Default:   false,
+		},
+		{
+			Path:      "annotate-pricing",
+			Env:       "ANNOTATE_PRICING",
+			Argument:  "annotate-pricing",
+			Shorthand: "",
+			Usage:     "Annotate entities with the on-demand hourly price of their instance type, calling the Pricing API once per instance type, region and operating system. Can also be set via the $ANNOTATE_PRICING environment variable.",
+			Value:     &c.annotatePricing,
+			Default:   false,
+		},
+		{
+			Path:      "resolve-amis",
+			Env:       "RESOLVE_AMIS",
+			Argument:  "resolve-amis",
+			Shorthand: "",
+			Usage:     "Label entities with the name of the AMI of their instance and whether it is current, deprecated or deregistered (missing), calling DescribeImages for each page of instances. Can also be set via the $RESOLVE_AMIS environment variable.",
+			Value:     &c.resolveAmis,
+			Default:   false,
+		},
+		{
+			Path:      "console-links",
+			Env:       "CONSOLE_LINKS",
+			Argument:  "console-links",
+			Shorthand: "",
+			Usage:     "Annotate entities with the EC2 console URL of their instance. Can also be set via the $CONSOLE_LINKS environment variable.",
+			Value:     &c.consoleLinks,
+			Default:   false,
+		},
+		{
+			Path:      "dns-resolver",
+			Env:       "DNS_RESOLVER",
+			Argument:  "dns-resolver",
+			Shorthand: "",
+			Usage:     "The resolver (host:port) to look up the PTR records of private IP addresses with, instead of the system resolver. Can also be set via the $DNS_RESOLVER environment variable. OPTIONAL.",
+			Value:     &c.dnsResolver,
+			Default:   "",
+		},
+		{
+			Path:      "route53-zone-id",
+			Env:       "ROUTE53_ZONE_ID",
+			Argument:  "route53-zone-id",
+			Shorthand: "",
+			Usage:     "The Route 53 hosted zone to look up the A records of private IP addresses in, instead of PTR records. Can also be set via the $ROUTE53_ZONE_ID environment variable. OPTIONAL.",
+			Value:     &c.route53ZoneId,
+			Default:   "",
+		},
+		{
+			Path:      "dns-lookup-timeout",
+			Env:       "DNS_LOOKUP_TIMEOUT",
+			Argument:  "dns-lookup-timeout",
+			Shorthand: "",
+			Usage:     "How long a single hostname lookup may take. Can also be set via the $DNS_LOOKUP_TIMEOUT environment variable.",
+			Value:     &c.dnsLookupTimeout,
+			Default:   "2s",
+		},
+		{
+			Path:      "dns-lookup-budget",
+			Env:       "DNS_LOOKUP_BUDGET",
+			Argument:  "dns-lookup-budget",
+			Shorthand: "",
+			Usage:     "How long the hostname lookups of a region may take altogether. Can also be set via the $DNS_LOOKUP_BUDGET environment variable.",
+			Value:     &c.dnsLookupBudget,
+			Default:   "10s",
+		},
+		{
+			Path:      "region-timeout",
+			Env:       "REGION_TIMEOUT",
+			Argument:  "region-timeout",
+			Shorthand: "",
+			Usage:     "How long describing and enriching the instances of a region may take (e.g. 30s), after which the region is failed and the others carry on. Can also be set via the $REGION_TIMEOUT environment variable. OPTIONAL.",
+			Value:     &c.regionTimeout,
+			Default:   "",
+		},
+		{
+			Path:      "keep-partial-regions",
+			Env:       "KEEP_PARTIAL_REGIONS",
+			Argument:  "keep-partial-regions",
+			Shorthand: "",
+			Usage:     "Keep the instances of the pages received from a region before it timed out. Otherwise, with --region-timeout, the instances of a region are only processed once all of its pages are received. Can also be set via the $KEEP_PARTIAL_REGIONS environment variable.",
+			Value:     &c.keepPartialRegions,
+			Default:   false,
+		},
+		{
+			Path:      "workers",
+			Env:       "WORKERS",
+			Argument:  "workers",
+			Shorthand: "",
+			Usage:     "The number of instances registered concurrently. Can also be set via the $WORKERS environment variable.",
+			Value:     &c.workers,
+			Default:   uint64(4),
+		},
+		{
+			Path:      "shard-by",
+			Env:       "SHARD_BY",
+			Argument:  "shard-by",
+			Shorthand: "",
+			Usage:     "How to split the instances of a region across concurrent queries: az (one query per availability zone) or none. Can also be set via the $SHARD_BY environment variable.",
+			Value:     &c.shardBy,
+			Default:   shardByNone,
+		},
+		{
+			Path:      "shard-index",
+			Env:       "SHARD_INDEX",
+			Argument:  "shard-index",
+			Shorthand: "",
+			Usage:     "The shard of the instances this execution discovers and prunes, from 0 to --shard-count - 1. Can also be set via the $SHARD_INDEX environment variable.",
+			Value:     &c.shardIndex,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "shard-count",
+			Env:       "SHARD_COUNT",
+			Argument:  "shard-count",
+			Shorthand: "",
+			Usage:     "The number of executions splitting the instances between them by a hash of the instance ID, each with its own --shard-index. Can also be set via the $SHARD_COUNT environment variable.",
+			Value:     &c.shardCount,
+			Default:   uint64(1),
+		},
+		{
+			Path:      "timing",
+			Env:       "TIMING",
+			Argument:  "timing",
+			Shorthand: "",
+			Usage:     "Print how long each phase of the run took. Can also be set via the $TIMING environment variable.",
+			Value:     &c.timing,
+			Default:   false,
+		},
+		{
+			Path:      "telemetry-textfile",
+			Env:       "TELEMETRY_TEXTFILE",
+			Argument:  "telemetry-textfile",
+			Shorthand: "",
+			Usage:     "A .prom file replaced after every run with its timestamp, status, counts and phase durations, for the textfile collector of node_exporter. Failing to write it only logs a warning. Can also be set via the $TELEMETRY_TEXTFILE environment variable. OPTIONAL.",
+			Value:     &c.telemetryTextfile,
+			Default:   "",
+		},
+		{
+			Path:      "simulate",
+			Env:       "SIMULATE",
+			Argument:  "simulate",
+			Shorthand: "",
+			Usage:     "Register this many synthetic instances instead of discovering any, without AWS access, to load test the backend; combine with --timing for the phase durations. Can also be set via the $SIMULATE environment variable. OPTIONAL.",
+			Value:     &c.simulate,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "simulate-tags",
+			Env:       "SIMULATE_TAGS",
+			Argument:  "simulate-tags",
+			Shorthand: "",
+			Usage:     "The number of tags, and so labels, of each synthetic instance of --simulate. Can also be set via the $SIMULATE_TAGS environment variable.",
+			Value:     &c.simulateTags,
+			Default:   uint64(10),
+		},
+		{
+			Path:      "simulate-label-size",
+			Env:       "SIMULATE_LABEL_SIZE",
+			Argument:  "simulate-label-size",
+			Shorthand: "",
+			Usage:     "The length of the tag values, and so labels, of the synthetic instances of --simulate. Can also be set via the $SIMULATE_LABEL_SIZE environment variable.",
+			Value:     &c.simulateLabelSize,
+			Default:   uint64(32),
+		},
+		{
+			Path:      "simulate-sink",
+			Env:       "SIMULATE_SINK",
+			Argument:  "simulate-sink",
+			Shorthand: "",
+			Usage:     "Discard the Sensu API requests of --simulate once serialized instead of sending them to the backend. Can also be set via the $SIMULATE_SINK environment variable.",
+			Value:     &c.simulateSink,
+			Default:   false,
+		},
+		{
+			Path:      "verify",
+			Env:       "VERIFY",
+			Argument:  "verify",
+			Shorthand: "",
+			Usage:     "Once registration is done, read back a sample of the entities created or updated and check that they exist with the labels written. Can also be set via the $VERIFY environment variable.",
+			Value:     &c.verify,
+			Default:   false,
+		},
+		{
+			Path:      "verify-sample",
+			Env:       "VERIFY_SAMPLE",
+			Argument:  "verify-sample",
+			Shorthand: "",
+			Usage:     "The number of written entities --verify reads back, picked at random, 0 for all of them. Can also be set via the $VERIFY_SAMPLE environment variable.",
+			Value:     &c.verifySample,
+			Default:   uint64(100),
+		},
+		{
+			Path:      "verify-retry",
+			Env:       "VERIFY_RETRY",
+			Argument:  "verify-retry",
+			Shorthand: "",
+			Usage:     "Write the entities failing --verify once more, and verify them again. Can also be set via the $VERIFY_RETRY environment variable.",
+			Value:     &c.verifyRetry,
+			Default:   false,
+		},
+		{
+			Path:      "diff",
+			Env:       "DIFF",
+			Argument:  "diff",
+			Shorthand: "",
+			Usage:     "Print the entities created, updated (with each changed field) and deleted, or that would be with --dry-run, either as text or json. Can also be set via the $DIFF environment variable. OPTIONAL.",
+			Value:     &c.diffFormat,
+			Default:   "",
+		},
+		{
+			Path:      "mode",
+			Env:       "MODE",
+			Argument:  "mode",
+			Shorthand: "",
+			Usage:     "Either register entities, or monitor the drift between the discovered instances and their entities without writing anything. Can also be set via the $MODE environment variable.",
+			Value:     &c.mode,
+			Default:   modeRegister,
+		},
+		{
+			Path:      "drift-warning-threshold",
+			Env:       "DRIFT_WARNING_THRESHOLD",
+			Argument:  "drift-warning-threshold",
+			Shorthand: "",
+			Usage:     "The number of missing, stale and drifted entities at which --mode monitor turns WARNING, 0 to disable. Can also be set via the $DRIFT_WARNING_THRESHOLD environment variable.",
+			Value:     &c.driftWarningThreshold,
+			Default:   uint64(1),
+		},
+		{
+			Path:      "drift-critical-threshold",
+			Env:       "DRIFT_CRITICAL_THRESHOLD",
+			Argument:  "drift-critical-threshold",
+			Shorthand: "",
+			Usage:     "The number of missing, stale and drifted entities at which --mode monitor turns CRITICAL, 0 to disable. Can also be set via the $DRIFT_CRITICAL_THRESHOLD environment variable.",
+			Value:     &c.driftCriticalThreshold,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "transport",
+			Env:       "TRANSPORT",
+			Argument:  "transport",
+			Shorthand: "",
+			Usage:     "Register entities through the backend-api, or submit them to the events API of the local agent with agent-api, which cannot update, prune or delete entities. Can also be set via the $TRANSPORT environment variable.",
+			Value:     &c.transport,
+			Default:   transportBackendApi,
+		},
+		{
+			Path:      "agent-api-url",
+			Env:       "AGENT_API_URL",
+			Argument:  "agent-api-url",
+			Shorthand: "",
+			Usage:     "The URL of the local agent API used by --transport agent-api. Can also be set via the $AGENT_API_URL environment variable.",
+			Value:     &c.agentApiUrl,
+			Default:   "http://127.0.0.1:3031",
+		},
+		{
+			Path:      "lock-ttl",
+			Env:       "LOCK_TTL",
+			Argument:  "lock-ttl",
+			Shorthand: "",
+			Usage:     "Hold a lock entity for this long (e.g. 10m) while registering, skipping the run when another run holds it. Set it above the longest run, expired locks are taken over. Can also be set via the $LOCK_TTL environment variable. OPTIONAL.",
+			Value:     &c.lockTtl,
+			Default:   "",
+		},
+		{
+			Path:      "lock-entity",
+			Env:       "LOCK_ENTITY",
+			Argument:  "lock-entity",
+			Shorthand: "",
+			Usage:     "The name of the --lock-ttl lock entity, in --sensu-namespace. Can also be set via the $LOCK_ENTITY environment variable.",
+			Value:     &c.lockEntity,
+			Default:   "sensu-ec2-discovery-lock",
+		},
+		{
+			Path:      "report-s3-bucket",
+			Env:       "REPORT_S3_BUCKET",
+			Argument:  "report-s3-bucket",
+			Shorthand: "",
+			Usage:     "Upload the JSON report of each run to this S3 bucket, in the default AWS region. Can also be set via the $REPORT_S3_BUCKET environment variable. OPTIONAL.",
+			Value:     &c.reportS3Bucket,
+			Default:   "",
+		},
+		{
+			Path:      "report-s3-prefix",
+			Env:       "REPORT_S3_PREFIX",
+			Argument:  "report-s3-prefix",
+			Shorthand: "",
+			Usage:     "The key prefix of the reports uploaded to --report-s3-bucket. Can also be set via the $REPORT_S3_PREFIX environment variable. OPTIONAL.",
+			Value:     &c.reportS3Prefix,
+			Default:   "",
+		},
+		{
+			Path:      "report-dry-runs",
+			Env:       "REPORT_DRY_RUNS",
+			Argument:  "report-dry-runs",
+			Shorthand: "",
+			Usage:     "Also upload the report of dry-runs to --report-s3-bucket. Can also be set via the $REPORT_DRY_RUNS environment variable.",
+			Value:     &c.reportDryRuns,
+			Default:   false,
+		},
+		{
+			Path:      "shutdown-grace-period",
+			Env:       "SHUTDOWN_GRACE_PERIOD",
+			Argument:  "shutdown-grace-period",
+			Shorthand: "",
+			Usage:     "How long the registrations in flight may take to complete after SIGTERM or SIGINT before they are cut off. Can also be set via the $SHUTDOWN_GRACE_PERIOD environment variable.",
+			Value:     &c.shutdownGracePeriod,
+			Default:   "5s",
+		},
+		{
+			Path:      "timeout",
+			Env:       "TIMEOUT",
+			Argument:  "timeout",
+			Shorthand: "",
+			Usage:     "How long the whole run may take before the calls in flight are cut off; when empty, the timeout of the check in the event on stdin less --check-timeout-margin, if any, else no limit. Can also be set via the $TIMEOUT environment variable. OPTIONAL.",
+			Value:     &c.timeout,
+			Default:   "",
+		},
+		{
+			Path:      "check-timeout-margin",
+			Env:       "CHECK_TIMEOUT_MARGIN",
+			Argument:  "check-timeout-margin",
+			Shorthand: "",
+			Usage:     "Without --timeout, how long before the timeout of the check in the event read from stdin the run is cut off, so that it reports before the agent kills it. Can also be set via the $CHECK_TIMEOUT_MARGIN environment variable.",
+			Value:     &c.checkTimeoutMargin,
+			Default:   "5s",
+		},
+		{
+			Path:      "error-examples",
+			Env:       "ERROR_EXAMPLES",
+			Argument:  "error-examples",
+			Shorthand: "",
+			Usage:     "How many failures of each error category to give as examples in the error_categories JSON ending the output. Can also be set via the $ERROR_EXAMPLES environment variable.",
+			Value:     &c.errorExamples,
+			Default:   uint64(3),
+		},
+		{
+			Path:      "aws-api-timeout",
+			Env:       "AWS_API_TIMEOUT",
+			Argument:  "aws-api-timeout",
+			Shorthand: "",
+			Usage:     "How long each AWS API call, retries included, may take within --timeout, no limit when empty. Can also be set via the $AWS_API_TIMEOUT environment variable.",
+			Value:     &c.awsApiTimeout,
+			Default:   "5m",
+		},
+		{
+			Path:      "sensu-api-timeout",
+			Env:       "SENSU_API_TIMEOUT",
+			Argument:  "sensu-api-timeout",
+			Shorthand: "",
+			Usage:     "How long each Sensu API request may take within --timeout, no limit when empty. Can also be set via the $SENSU_API_TIMEOUT environment variable.",
+			Value:     &c.sensuApiTimeout,
+			Default:   "5m",
+		},
+		{
+			Path:      "output-format",
+			Env:       "OUTPUT_FORMAT",
+			Argument:  "output-format",
+			Shorthand: "",
+			Usage:     "Write the entities as sensuctl-yaml or sensuctl-json resource definitions to stdout instead of registering them. Can also be set via the $OUTPUT_FORMAT environment variable. OPTIONAL.",
+			Value:     &c.outputFormat,
+			Default:   "",
+		},
+		{
+			Path:      "failure-warning-threshold",
+			Env:       "FAILURE_WARNING_THRESHOLD",
+			Argument:  "failure-warning-threshold",
+			Shorthand: "",
+			Usage:     "The number of failed registrations at which the check turns WARNING, 0 to disable. Can also be set via the $FAILURE_WARNING_THRESHOLD environment variable.",
+			Value:     &c.failureWarningThreshold,
+			Default:   uint64(1),
+		},
+		{
+			Path:      "failure-critical-threshold",
+			Env:       "FAILURE_CRITICAL_THRESHOLD",
+			Argument:  "failure-critical-threshold",
+			Shorthand: "",
+			Usage:     "The number of failed registrations at which the check turns CRITICAL, 0 to disable. Can also be set via the $FAILURE_CRITICAL_THRESHOLD environment variable.",
+			Value:     &c.failureCriticalThreshold,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "max-reported-failures",
+			Env:       "MAX_REPORTED_FAILURES",
+			Argument:  "max-reported-failures",
+			Shorthand: "",
+			Usage:     "The number of failed instances listed in the check output. Can also be set via the $MAX_REPORTED_FAILURES environment variable.",
+			Value:     &c.maxReportedFailures,
+			Default:   uint64(10),
+		},
+		{
+			Path:      "entity-limit-warning-percent",
+			Env:       "ENTITY_LIMIT_WARNING_PERCENT",
+			Argument:  "entity-limit-warning-percent",
+			Shorthand: "",
+			Usage:     "The share of the backend license entity limit, in percent, the entity count after the run may reach before the check turns WARNING, 0 to disable. Can also be set via the $ENTITY_LIMIT_WARNING_PERCENT environment variable.",
+			Value:     &c.entityLimitWarningPercent,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "entity-limit",
+			Env:       "ENTITY_LIMIT",
+			Argument:  "entity-limit",
+			Shorthand: "",
+			Usage:     "The entity limit of the backend license, for backends that do not report it. Can also be set via the $ENTITY_LIMIT environment variable. OPTIONAL.",
+			Value:     &c.entityLimitOverride,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "quiet",
+			Env:       "QUIET",
+			Argument:  "quiet",
+			Shorthand: "",
+			Usage:     "Log per-entity lines at debug only, and only the first --max-reported-failures failures, printing progress every --progress-every instances and every 10 seconds instead. Can also be set via the $QUIET environment variable.",
+			Value:     &c.quiet,
+			Default:   false,
+		},
+		{
+			Path:      "progress-every",
+			Env:       "PROGRESS_EVERY",
+			Argument:  "progress-every",
+			Shorthand: "",
+			Usage:     "The number of instances between progress lines with --quiet, 0 to only print them every 10 seconds. Can also be set via the $PROGRESS_EVERY environment variable.",
+			Value:     &c.progressEvery,
+			Default:   uint64(1000),
+		},
+		{
+			Path:      "min-instances",
+			Env:       "MIN_INSTANCES",
+			Argument:  "min-instances",
+			Shorthand: "",
+			Usage:     "The number of instances discovery is expected to find across all regions, 0 to disable. Can also be set via the $MIN_INSTANCES environment variable.",
+			Value:     &c.minInstances,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "min-instances-status",
+			Env:       "MIN_INSTANCES_STATUS",
+			Argument:  "min-instances-status",
+			Shorthand: "",
+			Usage:     "The status of the check when fewer than --min-instances are discovered, either warning or critical. Can also be set via the $MIN_INSTANCES_STATUS environment variable.",
+			Value:     &c.minInstancesStatus,
+			Default:   "warning",
+		},
+		{
+			Path:      "exit-policy",
+			Env:       "EXIT_POLICY",
+			Argument:  "exit-policy",
+			Shorthand: "",
+			Usage:     "Comma-separated category=status pairs overriding the status (ok, warning or critical) of the partial-region-failure, registration-failures-below-threshold, prune-guard-triggered, throttled, empty-region, entity-limit and verification-failed outcomes. Can also be set via the $EXIT_POLICY environment variable. OPTIONAL.",
+			Value:     &c.exitPolicy,
+			Default:   "",
+		},
+		{
+			Path:      "warn-on-empty-region",
+			Env:       "WARN_ON_EMPTY_REGION",
+			Argument:  "warn-on-empty-region",
+			Shorthand: "",
+			Usage:     "List the regions that yielded no instances in the output, a warning unless --exit-policy sets empty-region otherwise. Can also be set via the $WARN_ON_EMPTY_REGION environment variable.",
+			Value:     &c.warnOnEmptyRegion,
+			Default:   false,
+		},
+		{
+			Path:      "region-minimums",
+			Env:       "REGION_MINIMUMS",
+			Argument:  "region-minimums",
+			Shorthand: "",
+			Usage:     "Comma-separated region=count pairs of the instances regions are expected to yield at least, reported like --warn-on-empty-region; with --state-file, regions the previous run did not describe are exempt. Can also be set via the $REGION_MINIMUMS environment variable. OPTIONAL.",
+			Value:     &c.regionMinimums,
+			Default:   "",
+		},
+		{
+			Path:      "state-file",
+			Env:       "STATE_FILE",
+			Argument:  "state-file",
+			Shorthand: "",
+			Usage:     "A file to keep the results of the previous run in, for comparison with the next. Can also be set via the $STATE_FILE environment variable. OPTIONAL.",
+			Value:     &c.stateFile,
+			Default:   "",
+		},
+		{
+			Path:      "max-delta-percent",
+			Env:       "MAX_DELTA_PERCENT",
+			Argument:  "max-delta-percent",
+			Shorthand: "",
+			Usage:     "The change in the number of discovered instances since the previous run, in percent, at which the check turns WARNING, 0 to disable. Requires --state-file. Can also be set via the $MAX_DELTA_PERCENT environment variable.",
+			Value:     &c.maxDeltaPercent,
+			Default:   uint64(0),
+		},
+		{
+			Path:      "prune",
+			Env:       "PRUNE",
+			Argument:  "prune",
+			Shorthand: "",
+			Usage:     "Delete managed entities whose EC2 instance is no longer discovered. Can also be set via the $PRUNE environment variable.",
+			Value:     &c.prune,
+			Default:   false,
+		},
+		{
+			Path:      "deregister",
+			Env:       "DEREGISTER",
+			Argument:  "deregister",
+			Shorthand: "",
+			Usage:     "Same as --prune: delete the managed proxy entities whose EC2 instance is no longer discovered, never agent entities or entities without the sensu.io/managed_by label. Can also be set via the $DEREGISTER environment variable.",
+			Value:     &c.deregister,
+			Default:   false,
+		},
+		{
+			Path:      "deregister-dry-run",
+			Env:       "DEREGISTER_DRY_RUN",
+			Argument:  "deregister-dry-run",
+			Shorthand: "",
+			Usage:     "Like --deregister, but only log the entities that would be deleted, registering the discovered instances as usual. Can also be set via the $DEREGISTER_DRY_RUN environment variable.",
+			Value:     &c.deregisterDryRun,
+			Default:   false,
+		},
+		{
+			Path:      "prune-stale-after",
+			Env:       "PRUNE_STALE_AFTER",
+			Argument:  "prune-stale-after",
+			Shorthand: "",
+			Usage:     "Only prune undiscovered entities last seen longer ago than this duration (e.g. 24h). Can also be set via the $PRUNE_STALE_AFTER environment variable. OPTIONAL.",
+			Value:     &c.pruneStaleAfter,
+			Default:   "",
+		},
+		{
+			Path:      "prune-grace-period",
+			Env:       "PRUNE_GRACE_PERIOD",
+			Argument:  "prune-grace-period",
+			Shorthand: "",
+			Usage:     "Only prune entities whose instance has been undiscovered or terminated for longer than this duration (e.g. 2h), according to their last-seen timestamp. Can also be set via the $PRUNE_GRACE_PERIOD environment variable. OPTIONAL.",
+			Value:     &c.pruneGracePeriod,
+			Default:   "",
+		},
+	}
+}
+
+// sensuApiConfigOptions returns the Sensu API options, shared by discovery
+// and the prune subcommand, bound to c.
+func sensuApiConfigOptions(c *CheckConfig) []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:      "sensu-namespace",
+			Env:       "SENSU_NAMESPACE",
+			Argument:  "sensu-namespace",
+			Shorthand: "",
+			Usage:     "The Sensu Go Namespace to register entities in, defaulting to the namespace of the triggering event read from stdin, if any. Can also be set via the $SENSU_NAMESPACE environment variable.",
+			Value:     &c.sensuNamespace,
+			Default:   "default",
+		},
+		{
+			Path:      "sensu-namespace-tag",
+			Env:       "SENSU_NAMESPACE_TAG",
+			Argument:  "sensu-namespace-tag",
+			Shorthand: "",
+			Usage:     "The EC2 tag whose value selects the Sensu Go Namespace of an instance, falling back to --sensu-namespace. Can also be set via the $SENSU_NAMESPACE_TAG environment variable. OPTIONAL.",
+			Value:     &c.sensuNamespaceTag,
+			Default:   "",
+		},
+		{
+			Path:      "account-namespace-map",
+			Env:       "ACCOUNT_NAMESPACE_MAP",
+			Argument:  "account-namespace-map",
+			Shorthand: "",
+			Usage:     "Comma-separated account=namespace pairs, or @path to a file of them, routing the instances of each account of --aws-assume-role-arns to a Sensu Go Namespace, falling back to --sensu-namespace. Can also be set via the $ACCOUNT_NAMESPACE_MAP environment variable. OPTIONAL.",
+			Value:     &c.accountNamespaces,
+			Default:   "",
+		},
+		{
+			Path:      "sensu-api-url",
+			Env:       "SENSU_API_URL",
+			Argument:  "sensu-api-url",
+			Shorthand: "",
+			Usage:     "The Sensu Go API URL. Can also be set via the $SENSU_API_URL environment variable.",
+			Value:     &c.sensuApiUrl,
+			Default:   "https://127.0.0.1:8080",
+		},
+		{
+			Path:      "sensu-access-token",
+			Env:       "SENSU_ACCESS_TOKEN",
+			Argument:  "sensu-access-token",
+			Shorthand: "",
+			Usage:     "The Sensu Go API access key. Can also be set via the $SENSU_ACCESS_TOKEN environment variable. REQUIRED.",
+			Value:     &c.sensuAccessToken,
+			Default:   "",
+		},
+		{
+			Path:      "sensu-refresh-token",
+			Env:       "SENSU_REFRESH_TOKEN",
+			Argument:  "sensu-refresh-token",
+			Shorthand: "",
+			Usage:     "The Sensu Go API refresh token issued along with the access token, used to mint a new access token when it expires. Treat it as a secret. Can also be set via the $SENSU_REFRESH_TOKEN environment variable. OPTIONAL.",
+			Value:     &c.sensuRefreshToken,
+			Default:   "",
+		},
+		{
+			Path:      "sensu-api-key",
+			Env:       "SENSU_API_KEY",
+			Argument:  "sensu-api-key",
+			Shorthand: "",
+			Usage:     "The Sensu Go API key, used instead of the access token. Can also be set via the $SENSU_API_KEY environment variable. OPTIONAL.",
+			Value:     &c.sensuApiKey,
+			Default:   "",
+		},
+		{
+			Path:      "namespace-api-keys",
+			Env:       "NAMESPACE_API_KEYS",
+			Argument:  "namespace-api-keys",
+			Shorthand: "",
+			Usage:     "Comma-separated namespace=key pairs selecting the Sensu Go API key per namespace; a key may be given as env:NAME or file:PATH. Can also be set via the $NAMESPACE_API_KEYS environment variable. OPTIONAL.",
+			Value:     &c.namespaceApiKeys,
+			Default:   "",
+		},
+		{
+			Path:      "sensu-trusted-ca-file",
+			Env:       "SENSU_TRUSTED_CA_FILE",
+			Argument:  "sensu-trusted-ca-file",
+			Shorthand: "",
+			Usage:     "The Sensu Go API URL. Can also be set via the $SENSU_TRUSTED_CA_FILE environment variable. OPTIONAL.",
+			Value:     &c.sensuTrustedCaFile,
+			Default:   "",
+		},
+		{
+			Path:      "sensu-trusted-ca-dir",
+			Env:       "SENSU_TRUSTED_CA_DIR",
+			Argument:  "sensu-trusted-ca-dir",
+			Shorthand: "",
+			Usage:     "A directory of *.pem and *.crt CA certificates to trust for the Sensu Go API, besides --sensu-trusted-ca-file. Can also be set via the $SENSU_TRUSTED_CA_DIR environment variable. OPTIONAL.",
+			Value:     &c.sensuTrustedCaDir,
+			Default:   "",
+		},
+		{
+			Path:      "sensu-exclusive-ca",
+			Env:       "SENSU_EXCLUSIVE_CA",
+			Argument:  "sensu-exclusive-ca",
+			Shorthand: "",
+			Usage:     "Trust only the CA certificates of --sensu-trusted-ca-file and --sensu-trusted-ca-dir for the Sensu Go API, not the system ones. Can also be set via the $SENSU_EXCLUSIVE_CA environment variable.",
+			Value:     &c.sensuExclusiveCa,
+			Default:   false,
+		},
+		{
+			Path:      "sensu-pinned-cert-sha256",
+			Env:       "SENSU_PINNED_CERT_SHA256",
+			Argument:  "sensu-pinned-cert-sha256",
+			Shorthand: "",
+			Usage:     "Comma-separated SHA-256 fingerprints, in hex or base64, of the certificates or public keys the Sensu Go API certificate must match. Can also be set via the $SENSU_PINNED_CERT_SHA256 environment variable. OPTIONAL.",
+			Value:     &c.sensuPinnedCertSha256,
+			Default:   "",
+		},
+		{
+			Path:      "sensu-pin-chain",
+			Env:       "SENSU_PIN_CHAIN",
+			Argument:  "sensu-pin-chain",
+			Shorthand: "",
+			Usage:     "Accept a --sensu-pinned-cert-sha256 match on any certificate of the chain the Sensu Go API certificate is signed through, not only its own. Can also be set via the $SENSU_PIN_CHAIN environment variable.",
+			Value:     &c.sensuPinChain,
+			Default:   false,
+		},
+		{
+			Path:      "sensu-pin-only",
+			Env:       "SENSU_PIN_ONLY",
+			Argument:  "sensu-pin-only",
+			Shorthand: "",
+			Usage:     "Verify the Sensu Go API certificate against --sensu-pinned-cert-sha256 only, instead of along with the trusted CA certificates. Can also be set via the $SENSU_PIN_ONLY environment variable.",
+			Value:     &c.sensuPinOnly,
+			Default:   false,
+		},
+		{
+			Path:      "sensu-no-proxy",
+			Env:       "SENSU_NO_PROXY",
+			Argument:  "sensu-no-proxy",
+			Shorthand: "",
+			Usage:     "Comma-separated hostnames (.example.com for subdomains), IP addresses and CIDRs of Sensu API hosts to reach directly rather than through $HTTPS_PROXY or $HTTP_PROXY. Can also be set via the $SENSU_NO_PROXY environment variable. OPTIONAL.",
+			Value:     &c.sensuNoProxy,
+			Default:   "",
+		},
+		{
+			Path:      "sensu-tls-server-name",
+			Env:       "SENSU_TLS_SERVER_NAME",
+			Argument:  "sensu-tls-server-name",
+			Shorthand: "",
+			Usage:     "The hostname the Sensu Go API certificate is verified against, when --sensu-api-url names the backend by another name or IP address. Can also be set via the $SENSU_TLS_SERVER_NAME environment variable. OPTIONAL.",
+			Value:     &c.sensuTlsServerName,
+			Default:   "",
+		},
+		{
+			Path:      "sensu-insecure-tls-skip-verify",
+			Env:       "",
+			Argument:  "sensu-insecure-tls-skip-verify",
+			Shorthand: "",
+			Usage:     "Skip the verification of the Sensu Go API certificate. Can also be set via the $SENSU_INSECURE_SKIP_TLS_VERIFY environment variable (true/false, 1/0 or yes/no).",
+			Value:     &c.sensuInsecureSkipTlsVerify,
+			Default:   false,
+		},
+		{
+			Path:      "debug",
+			Env:       "DEBUG",
+			Argument:  "debug",
+			Shorthand: "",
+			Usage:     "Enable debug logging. Can also be set via the $DEBUG environment variable.",
+			Value:     &c.debug,
+			Default:   false,
+		},
+		{
+			Path:      "aws-debug",
+			Env:       "AWS_DEBUG",
+			Argument:  "aws-debug",
+			Shorthand: "",
+			Usage:     "Log every AWS request attempt with its endpoint, retry count and request ID (never the credentials). Very verbose, for troubleshooting only. Can also be set via the $AWS_DEBUG environment variable.",
+			Value:     &c.awsDebug,
+			Default:   false,
+		},
+	}
+}
+
+func main() {
+	c := newCheckConfig()
+	log.SetPrefix(fmt.Sprintf("[%s] ", c.correlationId))
+
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println(currentBuildInfo())
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		prune := sensu.InitCheck(
+			&sensu.PluginConfig{
+				Name:     "sensu-ec2-discovery prune",
+				Short:    "Delete previously discovered entities matching label selectors, without querying EC2.",
+				Keyspace: "sensu.io/plugins/ec2-discovery/prune",
+			},
+			append(append(pruneConfigOptions(c), pruneGuardConfigOptions(c)...), sensuApiConfigOptions(c)...),
+			c.validatePruneArgs,
+			c.pruneEntities,
+		)
+		prune.Execute()
+		return
+	}
+
+	check := sensu.InitCheck(
+		&c.PluginConfig,
+		append(append(ec2DiscoveryConfigOptions(c), pruneGuardConfigOptions(c)...), sensuApiConfigOptions(c)...),
+		func(event *corev2.Event) error {
+			// Like the version subcommand, --print-build-info only prints,
+			// whatever else is set.
+			if c.printBuildInfo {
+				if err := writeBuildInfo(os.Stdout); err != nil {
+					return err
+				}
+				os.Exit(0)
+			}
+			return c.validateArgs(event)
+		},
+		func(event *corev2.Event) error {
+			// The plugin library only exits with 0 or 1.
+			status, err := c.discoverInstances(event)
+			if err == nil && status != statusOK {
+				os.Exit(status)
+			}
+			return err
+		},
+	)
+	check.Execute()
+}
+
+func (c *CheckConfig) validateArgs(event *corev2.Event) error {
+	c.applyDeregisterArgs()
+	c.applyFilterTagArgs()
+
+	if err := c.validateOutputFormat(); err != nil {
+		return err
+	}
+
+	if err := c.validateSimulateArgs(); err != nil {
+		return err
+	}
+	if err := c.validateVerifyArgs(); err != nil {
+		return err
+	}
+	if err := c.validateAccountNamespaces(); err != nil {
+		return err
+	}
+	// The agent API, and the sink of simulated writes, need no credentials.
+	if c.outputFormat == "" && c.transport != transportAgentApi && !c.simulateSink {
+		if err := c.validateSensuCredentials(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.validateAwsCredentials(); err != nil {
+		return err
+	}
+	if c.awsDebug {
+		log.Printf("WARNING: --aws-debug logs every AWS request, expect very verbose output")
+	}
+
+	needsEvent := c.filtersFromEntityLabels != "" || c.scopeFromEntity
+	wantsEvent := c.timeout == "" || !optionSet(c.namespaceOption(), os.Args[1:])
+	if !c.instancesFromStdin && (needsEvent || wantsEvent && c.stdinPiped()) {
+		var err error
+		if event, err = c.triggeringEvent(event); err != nil {
+			if needsEvent {
+				return err
+			}
+			// Only the check timeout and namespace were looked for.
+			c.logDebug("not deriving --timeout or --sensu-namespace from the event: %s", err)
+		}
+		c.applyEventNamespace(event, os.Args[1:])
+		if c.filtersFromEntityLabels != "" {
+			if err := c.applyEntityLabelFilters(event, c.filtersFromEntityLabels); err != nil {
+				return err
+			}
+		}
+		if c.scopeFromEntity {
+			c.applyEntityScope(event)
+		}
+	}
+	// The regions of "all" and --instances-from-stdin are validated once
+	// resolved, see resolveRegions.
+	if strings.TrimSpace(c.ec2InstanceRegions) != "all" && !c.instancesFromStdin {
+		regions := strings.Split(c.ec2InstanceRegions, ",")
+		if err := c.validateRegionNames(regions); err != nil {
+			return err
+		}
+		if err := c.validateFipsRegions(regions); err != nil {
+			return err
+		}
+	}
+
+	err := c.createFilters()
+	if err != nil {
+		return err
+	}
+
+	if c.tagRegexFilters, err = parseTagRegexFilters(c.ec2TagRegex); err != nil {
+		return err
+	}
+	if len(c.tagRegexFilters) > 0 && (c.idsOnly || c.instancesFromStdin) {
+		return fmt.Errorf("--ec2-tag-regex cannot be combined with --ids-only or --instances-from-stdin, which ignore the filters")
+	}
+	if err := c.validateLaunchTemplateArgs(); err != nil {
+		return err
+	}
+	if strings.TrimSpace(c.filterExpressionSource) != "" {
+		if c.idsOnly || c.instancesFromStdin {
+			return fmt.Errorf("--filter-expression cannot be combined with --ids-only or --instances-from-stdin, which ignore the filters")
+		}
+		if c.filterExpression, err = compileFilterExpression(c.filterExpressionSource); err != nil {
+			return err
+		}
+	}
+
+	if c.instancesFromStdin {
+		if err := c.validateStdinArgs(); err != nil {
+			return err
+		}
+	}
+
+	if c.prune && len(c.ec2InstanceIdList) > 0 {
+		return fmt.Errorf("--prune cannot be combined with --ec2-instance-ids, which only discovers the given instances")
+	}
+
+	if len(c.pruneStaleAfter) > 0 {
+		c.pruneStaleAfterDuration, err = time.ParseDuration(c.pruneStaleAfter)
+		if err != nil {
+			return fmt.Errorf("invalid --prune-stale-after: %s", err)
+		}
+	}
+	if len(c.pruneGracePeriod) > 0 {
+		if c.pruneStaleAfterDuration > 0 {
+			return fmt.Errorf("--prune-grace-period replaces --prune-stale-after, use only one")
+		}
+		c.pruneGraceDuration, err = time.ParseDuration(c.pruneGracePeriod)
+		if err != nil {
+			return fmt.Errorf("invalid --prune-grace-period: %s", err)
+		}
+	}
+
+	switch c.minInstancesStatus {
+	case "warning", "critical":
+	default:
+		return fmt.Errorf("invalid --min-instances-status \"%s\", expected warning or critical", c.minInstancesStatus)
+	}
+
+	if c.regionMinimumMap, err = parseRegionMinimums(c.regionMinimums); err != nil {
+		return err
+	}
+	if c.exitPolicyMap, err = parseExitPolicy(c.exitPolicy); err != nil {
+		return err
+	}
+
+	if c.platformSubscriptionMap, err = parsePlatformSubscriptions(c.platformSubscriptions); err != nil {
+		return err
+	}
+
+	c.jsonTagSet = make(map[string]bool)
+	for _, tag := range splitList(c.jsonTags) {
+		c.jsonTagSet[tag] = true
+	}
+
+	if c.annotationTemplateMap, err = parseAnnotationTemplates(c.annotationTemplates); err != nil {
+		return err
+	}
+
+	switch c.shardBy {
+	case shardByNone, shardByAz:
+	default:
+		return fmt.Errorf("invalid --shard-by \"%s\", expected az or none", c.shardBy)
+	}
+	if err := c.validateExecutionShardArgs(); err != nil {
+		return err
+	}
+	if c.ec2MaxResults != 0 && (c.ec2MaxResults < 5 || c.ec2MaxResults > 1000) {
+		return fmt.Errorf("--ec2-max-results must be between 5 and 1000, or 0 for the EC2 default")
+	}
+	if c.entityLimitWarningPercent > 100 {
+		return fmt.Errorf("--entity-limit-warning-percent must be at most 100")
+	}
+	if c.maxDeltaPercent > 0 && c.stateFile == "" {
+		return fmt.Errorf("--max-delta-percent requires --state-file")
+	}
+
+	switch c.writeStrategy {
+	case writeStrategyCreateOnly, writeStrategyUpsert, writeStrategyReplace:
+	default:
+		return fmt.Errorf("invalid --write-strategy \"%s\", expected %s, %s or %s", c.writeStrategy, writeStrategyCreateOnly, writeStrategyUpsert, writeStrategyReplace)
+	}
+	if err := c.applyUpdateExistingArgs(); err != nil {
+		return err
+	}
+	if err := c.validateLabelMergeStrategy(); err != nil {
+		return err
+	}
+
+	if err := c.validateProxyCheckArgs(); err != nil {
+		return err
+	}
+
+	if len(c.regionTimeout) > 0 {
+		if c.regionTimeoutDuration, err = time.ParseDuration(c.regionTimeout); err != nil {
+			return fmt.Errorf("invalid --region-timeout: %s", err)
+		}
+	}
+	if c.keepPartialRegions && c.regionTimeoutDuration == 0 {
+		return fmt.Errorf("--keep-partial-regions requires --region-timeout")
+	}
+
+	if c.resolveHostnames {
+		if c.dnsLookupTimeoutDuration, err = time.ParseDuration(c.dnsLookupTimeout); err != nil {
+			return fmt.Errorf("invalid --dns-lookup-timeout: %s", err)
+		}
+		if c.dnsLookupBudgetDuration, err = time.ParseDuration(c.dnsLookupBudget); err != nil {
+			return fmt.Errorf("invalid --dns-lookup-budget: %s", err)
+		}
+	}
+
+	if err := c.validateProtectionArgs(); err != nil {
+		return err
+	}
+	if err := c.validateChurnArgs(); err != nil {
+		return err
+	}
+
+	if err := c.validateEntityNameStyle(); err != nil {
+		return err
+	}
+	if err := c.validateEntityNameSource(); err != nil {
+		return err
+	}
+	if c.accountPrefixText != "" {
+		if c.accountPrefixTemplate, err = parseInstanceTemplate("account-prefix-template", c.accountPrefixText); err != nil {
+			return fmt.Errorf("invalid --account-prefix-template: %s", err)
+		}
+	}
+	if err := c.validateMonitorArgs(); err != nil {
+		return err
+	}
+
+	if err := c.validateTransportArgs(); err != nil {
+		return err
+	}
+
+	if len(c.lockTtl) > 0 {
+		if c.lockTtlDuration, err = time.ParseDuration(c.lockTtl); err != nil {
+			return fmt.Errorf("invalid --lock-ttl: %s", err)
+		}
+		if c.lockEntity == "" {
+			return fmt.Errorf("--lock-ttl requires --lock-entity")
+		}
+	}
+
+	switch c.diffFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("invalid --diff \"%s\", expected text or json", c.diffFormat)
+	}
+
+	c.shutdownGraceDuration, err = time.ParseDuration(c.shutdownGracePeriod)
+	if err != nil {
+		return fmt.Errorf("invalid --shutdown-grace-period: %s", err)
+	}
+	if err := c.validateTimeoutArgs(); err != nil {
+		return err
+	}
+	c.applyCheckTimeout(event)
+
+	if err := c.validatePruneGuardArgs(); err != nil {
+		return err
+	}
+
+	// Build the Sensu API client once the TLS and timeout options are
+	// known, failing now rather than on the first request.
+	if c.outputFormat == "" && c.transport != transportAgentApi && !c.dryRunOffline {
+		if _, err := c.sensuHttpClient(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *CheckConfig) createFilters() error {
+	var states []string
+
+	var deleteOnStates []string
+	c.deleteOnStateSet = make(map[string]bool)
+	for _, state := range strings.Split(c.deleteOnStates, ",") {
+		if state = strings.TrimSpace(state); state != "" {
+			deleteOnStates = append(deleteOnStates, state)
+			c.deleteOnStateSet[state] = true
+		}
+	}
+
+	c.ec2InstanceIdList = splitList(c.ec2InstanceIds)
+	excluded, err := parseInstanceIdList(c.ec2ExcludeInstanceIds)
+	if err != nil {
+		return err
+	}
+	c.excludedInstanceIds = make(map[string]bool)
+	for _, id := range excluded {
+		c.excludedInstanceIds[id] = true
+	}
+	if c.instancesFromStdin {
+		return nil
+	}
+	if c.idsOnly {
+		if len(c.ec2InstanceIdList) == 0 {
+			return fmt.Errorf("--ids-only requires --ec2-instance-ids")
+		}
+		return nil
+	}
+
+	if len(c.ec2InstanceStates) > 0 {
+		states = strings.Split(c.ec2InstanceStates, ",")
+		// Instances in the delete-on states must be discovered to be deleted.
+		for _, state := range deleteOnStates {
+			if !stringInSlice(state, states) {
+				states = append(states, state)
+			}
+		}
+		c.ec2Filters = append(c.ec2Filters, &ec2.Filter{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice(states),
+		})
+	}
+
+	filters, err := tagFilters(c.ec2FilterTags)
+	if err != nil {
+		return err
+	}
+	c.ec2Filters = append(c.ec2Filters, filters...)
+
+	return nil
+}
+
+// parseInstanceIdList parses a comma-separated list of instance IDs, where
+// an @path item is replaced by the IDs in that file, separated by commas or
+// whitespace, ignoring # comments.
+func parseInstanceIdList(list string) ([]string, error) {
+	var ids []string
+	for _, item := range splitList(list) {
+		if !strings.HasPrefix(item, "@") {
+			ids = append(ids, item)
+			continue
+		}
+		b, err := ioutil.ReadFile(strings.TrimPrefix(item, "@"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read instance IDs: %s", err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			ids = append(ids, strings.FieldsFunc(line, func(r rune) bool {
+				return r == ',' || unicode.IsSpace(r)
+			})...)
+		}
+	}
+	return ids, nil
+}
+
+// maxFilterValues is the number of values EC2 accepts in a filter.
+const maxFilterValues = 200
+
+// describeInputs returns the DescribeInstances requests covering the
+// filters, one per chunk of instance IDs when given: EC2 ANDs filters, so
+// the IDs cannot be split across filters of a single request.
+func (c *CheckConfig) describeInputs(ids []string) []*ec2.DescribeInstancesInput {
+	var maxResults *int64
+	if c.ec2MaxResults > 0 {
+		maxResults = aws.Int64(int64(c.ec2MaxResults))
+	}
+	if len(ids) == 0 {
+		return []*ec2.DescribeInstancesInput{{Filters: c.ec2Filters, MaxResults: maxResults}}
+	}
+	var inputs []*ec2.DescribeInstancesInput
+	for start := 0; start < len(ids); start += maxFilterValues {
+		end := start + maxFilterValues
+		if end > len(ids) {
+			end = len(ids)
+		}
+		filters := append([]*ec2.Filter{}, c.ec2Filters...)
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("instance-id"),
+			Values: aws.StringSlice(ids[start:end]),
+		})
+		inputs = append(inputs, &ec2.DescribeInstancesInput{Filters: filters, MaxResults: maxResults})
+	}
+	return inputs
+}
+
+// missingInstanceIds returns the --ec2-instance-ids, or the instances read
+// from stdin along with their line, that were not discovered.
+func (c *CheckConfig) missingInstanceIds(discovered map[string]bool) []string {
+	var missing []string
+	for _, id := range c.ec2InstanceIdList {
+		if discovered[id] {
+			continue
+		}
+		if instance, ok := c.stdinInstances[id]; ok {
+			id = fmt.Sprintf("%s (line %d)", id, instance.Line)
+		}
+		missing = append(missing, id)
+	}
+	return missing
+}
+
+// isTerminated reports whether an instance is shutting down or terminated.
+func isTerminated(instance *ec2.Instance) bool {
+	return instance.State != nil && isTerminatedState(aws.StringValue(instance.State.Name))
+}
+
+// expandJsonTag parses a tag value holding a flat JSON object into labels,
+// rendering numbers and booleans as they appear in the JSON.
+func expandJsonTag(value string) (map[string]string, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &object); err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	for key, raw := range object {
+		var field interface{}
+		if err := json.Unmarshal(raw, &field); err != nil {
+			return nil, err
+		}
+		switch field := field.(type) {
+		case string:
+			labels[key] = field
+		case float64, bool:
+			labels[key] = string(raw)
+		default:
+			return nil, fmt.Errorf("the value of \"%s\" is not a string, number or boolean", key)
+		}
+	}
+	return labels, nil
+}
+
+// describeFilters formats the EC2 filters for the log, e.g.
+// "instance-state-name=running tag:env=prod".
+func describeFilters(filters []*ec2.Filter) string {
+	var described []string
+	for _, filter := range filters {
+		described = append(described, fmt.Sprintf("%s=%s", aws.StringValue(filter.Name), strings.Join(aws.StringValueSlice(filter.Values), ",")))
+	}
+	if len(described) == 0 {
+		return "none"
+	}
+	return strings.Join(described, " ")
+}
+
+func (c *CheckConfig) logDebug(format string, v ...interface{}) {
+	if c.debug {
+		log.Printf("DEBUG: "+format, v...)
+	}
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadCACerts(path string) (*x509.CertPool, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load system cert pool: %s", err)
+	}
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if path != "" {
+		certs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file (%s): %s", path, err)
+		}
+		rootCAs.AppendCertsFromPEM(certs)
+	}
+	return rootCAs, nil
+}
+
+// readCACertDir reads the *.pem and *.crt files of a directory that hold
+// certificates, warning about and skipping those that do not.
+func readCACertDir(dir string) ([][]byte, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA directory: %s", err)
+	}
+	var certs [][]byte
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if file.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("WARNING: skipping CA file %s: %s", path, err)
+			continue
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(b) {
+			log.Printf("WARNING: skipping CA file %s: no PEM certificates found", path)
+			continue
+		}
+		certs = append(certs, b)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no CA certificates found in %s", dir)
+	}
+	return certs, nil
+}
+
+// sensuRootCAs returns the CA certificates the Sensu API certificate is
+// verified against: the system ones along with those of
+// --sensu-trusted-ca-file and --sensu-trusted-ca-dir or, with
+// --sensu-exclusive-ca, the latter only.
+func (c *CheckConfig) sensuRootCAs() (*x509.CertPool, error) {
+	if !c.sensuExclusiveCa {
+		certs, err := LoadCACerts(c.sensuTrustedCaFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range c.sensuTrustedCaDirCerts {
+			certs.AppendCertsFromPEM(b)
+		}
+		return certs, nil
+	}
+	certs := x509.NewCertPool()
+	if c.sensuTrustedCaFile != "" {
+		b, err := ioutil.ReadFile(c.sensuTrustedCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file (%s): %s", c.sensuTrustedCaFile, err)
+		}
+		if !certs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no CA certificates found in %s", c.sensuTrustedCaFile)
+		}
+	}
+	for _, b := range c.sensuTrustedCaDirCerts {
+		certs.AppendCertsFromPEM(b)
+	}
+	return certs, nil
+}
+
+// sensuHttpClient returns the client of the Sensu API requests, built once
+// so that every request reuses its connections.
+func (c *CheckConfig) sensuHttpClient() (*http.Client, error) {
+	c.httpClientOnce.Do(func() {
+		c.httpClient, c.httpClientErr = c.newHttpClient()
+	})
+	return c.httpClient, c.httpClientErr
+}
+
+func (c *CheckConfig) newHttpClient() (*http.Client, error) {
+	certs, err := c.sensuRootCAs()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:            certs,
+		ServerName:         c.sensuTlsServerName,
+		InsecureSkipVerify: c.sensuInsecureSkipTlsVerify || c.sensuPinOnly,
+	}
+	if len(c.sensuCertPins) > 0 {
+		tlsConfig.VerifyPeerCertificate = c.verifyPinnedCert
+	}
+	var tr http.RoundTripper = &http.Transport{
+		Proxy:           c.sensuProxy,
+		TLSClientConfig: tlsConfig,
+	}
+	if c.simulateSink {
+		tr = discardTransport{}
+	}
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   c.sensuApiTimeoutDuration,
+	}
+	return client, nil
+}
+
+// discoveredInstance is an EC2 instance along with what discovery learned
+// about it besides its description.
+type discoveredInstance struct {
+	*ec2.Instance
+	Account *awsAccount
+	Region  string
+	Fqdn    string
+	// TerminationProtection is set with --resolve-protection, once
+	// resolved.
+	TerminationProtection *bool
+	// Volumes is set with --resolve-volumes, once resolved.
+	Volumes *instanceVolumes
+	// OnDemandPrice is set with --annotate-pricing, once looked up.
+	OnDemandPrice string
+	// Image and AmiStatus are set with --resolve-amis, once resolved.
+	Image     *imageInfo
+	AmiStatus string
+	// LaunchTemplateName is set with --ec2-launch-template-names when the
+	// instance was launched from one of the named templates.
+	LaunchTemplateName string
+	// OwnerId and RequesterId are those of the reservation of the
+	// instance, RequesterId only when launched on behalf of the owner.
+	OwnerId     string
+	RequesterId string
+}
+
+// buildEntity builds the proxy entity representing an EC2 instance.
+func (c *CheckConfig) buildEntity(instance *discoveredInstance) *corev2.Entity {
+	var entity corev2.Entity
+	name, originalName := c.entityName(instance)
+	entity.Name = name
+	entity.Namespace = c.instanceNamespace(instance)
+	entity.EntityClass = "proxy"
+	entity.Labels = make(map[string]string)
+	entity.Annotations = make(map[string]string)
+	for _, tag := range instance.Tags {
+		if c.jsonTagSet[*tag.Key] {
+			continue
+		}
+		entity.Labels[*tag.Key] = *tag.Value
+	}
+	for _, tag := range instance.Tags {
+		if !c.jsonTagSet[*tag.Key] {
+			continue
+		}
+		labels, err := expandJsonTag(*tag.Value)
+		if err != nil {
+			log.Printf("WARNING: tag \"%s\" of EC2 instance \"%s\" is not a flat JSON object, keeping it as an annotation: %s", *tag.Key, *instance.InstanceId, err)
+			entity.Annotations[*tag.Key] = *tag.Value
+			continue
+		}
+		for key, value := range labels {
+			// Tags of the same name take precedence.
+			if _, ok := entity.Labels[key]; !ok {
+				entity.Labels[key] = value
+			}
+		}
+	}
+	entity.Labels[managedByLabel] = managedByValue
+	entity.Labels[instanceIdLabel] = *instance.InstanceId
+	if instance.State != nil {
+		entity.Labels[instanceStateLabel] = aws.StringValue(instance.State.Name)
+	}
+	c.labelForSilencing(&entity, instance.Instance)
+	if instance.Region != "" {
+		entity.Labels[regionLabel] = instance.Region
+	}
+	if instance.Account.Id != "" {
+		entity.Labels[accountIdLabel] = instance.Account.Id
+	}
+	if instance.Account.Alias != "" {
+		entity.Labels[accountAliasLabel] = instance.Account.Alias
+	}
+	if instance.Fqdn != "" {
+		entity.Labels[fqdnLabel] = instance.Fqdn
+	}
+	if instance.OwnerId != "" {
+		entity.Labels[reservationOwnerLabel] = instance.OwnerId
+		if instance.Account.Id != "" {
+			entity.Labels[foreignReservationLabel] = strconv.FormatBool(instance.OwnerId != instance.Account.Id)
+		}
+	}
+	if instance.RequesterId != "" {
+		entity.Labels[requesterLabel] = instance.RequesterId
+	}
+	if hibernation := instanceHibernation(instance.Instance); hibernation != "" {
+		entity.Labels[hibernationLabel] = hibernation
+	}
+	for key, value := range imageLabels(instance) {
+		entity.Labels[key] = value
+	}
+	for key, value := range volumeLabels(instance) {
+		entity.Labels[key] = value
+	}
+	if protection, ok := protectionLabel(instance); ok {
+		entity.Labels[terminationProtectionLabel] = protection
+	}
+	if c.hostnameLabelEnabled {
+		entity.Labels[hostnameLabel] = c.shortHostname(instance.Instance)
+	}
+	if code, reason := stateReason(instance.Instance); reason != "" {
+		if code != "" {
+			entity.Labels[stateReasonCodeLabel] = code
+		}
+		entity.Annotations[stateReasonAnnotation] = reason
+	}
+	entity.Subscriptions = c.subscriptionsOf(entity.Name, instance.Instance)
+	if c.consoleLinks && instance.Region != "" {
+		entity.Annotations[consoleUrlAnnotation] = consoleUrl(instance)
+	}
+	if instance.OnDemandPrice != "" {
+		entity.Annotations[onDemandPriceAnnotation] = instance.OnDemandPrice
+	}
+	for key, value := range c.renderAnnotations(instance) {
+		entity.Annotations[key] = value
+	}
+	// A terminated instance was last seen before it was terminated.
+	if !isTerminated(instance.Instance) {
+		entity.Annotations[lastSeenAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	}
+	if originalName != "" {
+		entity.Annotations[originalNameAnnotation] = originalName
+	}
+	entity.Annotations[provenanceAnnotation] = userAgent()
+	entity.System.Network = instanceNetwork(instance.Instance)
+	c.limitLabels(&entity)
+	recordDiscoveredKeys(&entity)
+	return &entity
+}
+
+// stateReason returns the state reason code of an instance that is not
+// running, e.g. Client.UserInitiatedShutdown, along with its message and
+// state transition reason.
+func stateReason(instance *ec2.Instance) (string, string) {
+	if instance.State == nil || aws.StringValue(instance.State.Name) == ec2.InstanceStateNameRunning {
+		return "", ""
+	}
+	var code string
+	var reasons []string
+	if instance.StateReason != nil {
+		code = aws.StringValue(instance.StateReason.Code)
+		if message := aws.StringValue(instance.StateReason.Message); message != "" {
+			reasons = append(reasons, message)
+		}
+	}
+	if transition := aws.StringValue(instance.StateTransitionReason); transition != "" {
+		reasons = append(reasons, transition)
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, code)
+	}
+	return code, strings.Join(reasons, "; ")
+}
+
+// instanceNamespace returns the namespace an instance is registered in: the
+// value of its --sensu-namespace-tag tag, else the namespace of its account
+// in --account-namespace-map, else --sensu-namespace.
+func (c *CheckConfig) instanceNamespace(instance *discoveredInstance) string {
+	if c.sensuNamespaceTag != "" {
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) == c.sensuNamespaceTag && aws.StringValue(tag.Value) != "" {
+				return *tag.Value
+			}
+		}
+	}
+	if namespace := c.accountNamespace(instance.Account); namespace != "" {
+		return namespace
+	}
+	return c.sensuNamespace
+}
+
+// instanceNetwork describes the network interfaces of an instance, ordered
+// by device index, each with its private addresses followed by its public
+// address.
+func instanceNetwork(instance *ec2.Instance) corev2.Network {
+	var network corev2.Network
+	interfaces := make([]*ec2.InstanceNetworkInterface, len(instance.NetworkInterfaces))
+	copy(interfaces, instance.NetworkInterfaces)
+	sort.SliceStable(interfaces, func(i, j int) bool {
+		return deviceIndex(interfaces[i]) < deviceIndex(interfaces[j])
+	})
+	for _, iface := range interfaces {
+		networkInterface := corev2.NetworkInterface{
+			Name: aws.StringValue(iface.NetworkInterfaceId),
+			MAC:  aws.StringValue(iface.MacAddress),
+		}
+		for _, address := range iface.PrivateIpAddresses {
+			networkInterface.Addresses = append(networkInterface.Addresses, aws.StringValue(address.PrivateIpAddress))
+		}
+		if iface.Association != nil && iface.Association.PublicIp != nil {
+			networkInterface.Addresses = append(networkInterface.Addresses, *iface.Association.PublicIp)
+		}
+		network.Interfaces = append(network.Interfaces, networkInterface)
+	}
+	if len(network.Interfaces) == 0 && instance.PrivateIpAddress != nil {
+		networkInterface := corev2.NetworkInterface{
+			Name:      "eth0",
+			Addresses: []string{*instance.PrivateIpAddress},
+		}
+		if instance.PublicIpAddress != nil {
+			networkInterface.Addresses = append(networkInterface.Addresses, *instance.PublicIpAddress)
+		}
+		network.Interfaces = append(network.Interfaces, networkInterface)
+	}
+	return network
+}
+
+func deviceIndex(iface *ec2.InstanceNetworkInterface) int64 {
+	if iface.Attachment == nil {
+		return 0
+	}
+	return aws.Int64Value(iface.Attachment.DeviceIndex)
+}
+
+// applyUpdateExistingArgs turns --update-existing=false into the
+// create-only write strategy it stands for.
+func (c *CheckConfig) applyUpdateExistingArgs() error {
+	if c.updateExisting {
+		return nil
+	}
+	if c.writeStrategy == writeStrategyReplace {
+		return fmt.Errorf("--update-existing=false conflicts with --write-strategy %s", writeStrategyReplace)
+	}
+	c.writeStrategy = writeStrategyCreateOnly
+	return nil
+}
+
+// updatedEntity returns what the write strategy writes over an existing
+// managed entity: nothing for create-only, the existing entity with the
+// discovered labels, annotations and network merged in for upsert, and
+// exactly the discovered entity for replace.
+func (c *CheckConfig) updatedEntity(existing *corev2.Entity, desired *corev2.Entity) *corev2.Entity {
+	switch c.writeStrategy {
+	case writeStrategyCreateOnly:
+		return nil
+	case writeStrategyReplace:
+		replaced := *desired
+		replaced.Subscriptions = mergeSubscriptions(existing.Subscriptions, desired.Subscriptions)
+		// Terminated instances keep the time they were last seen, see
+		// --prune-grace-period.
+		if lastSeen, ok := keptLastSeen(existing, time.Now()); ok {
+			if _, ok := desired.Annotations[lastSeenAnnotation]; !ok {
+				replaced.Annotations = make(map[string]string)
+				for key, value := range desired.Annotations {
+					replaced.Annotations[key] = value
+				}
+				replaced.Annotations[lastSeenAnnotation] = lastSeen
+			}
+		}
+		return &replaced
+	}
+
+	updated := *existing
+	updated.Labels = c.mergeLabels(existing, desired)
+	updated.Annotations = c.mergeAnnotations(existing, desired)
+	// The state reason of a previous stop does not apply to a running
+	// instance.
+	if _, ok := desired.Annotations[stateReasonAnnotation]; !ok {
+		delete(updated.Labels, stateReasonCodeLabel)
+		delete(updated.Annotations, stateReasonAnnotation)
+	}
+	c.clearSilencing(&updated, desired)
+	// Labels beyond --max-labels live in the extra labels annotation only.
+	for key := range extraLabels(desired) {
+		delete(updated.Labels, key)
+	}
+	if _, ok := desired.Annotations[extraLabelsAnnotation]; !ok {
+		delete(updated.Annotations, extraLabelsAnnotation)
+	}
+	if len(desired.Subscriptions) > 0 {
+		updated.Subscriptions = mergeSubscriptions(existing.Subscriptions, desired.Subscriptions)
+	}
+	updated.System.Network = desired.System.Network
+	return &updated
+}
+
+// keptLastSeen returns the last-seen timestamp the update of an entity for
+// a terminated instance keeps: the existing one, or now if the instance is
+// first seen terminating, which starts --prune-grace-period.
+func keptLastSeen(existing *corev2.Entity, now time.Time) (string, bool) {
+	if !isTerminatedState(existing.Labels[instanceStateLabel]) {
+		return now.UTC().Format(time.RFC3339), true
+	}
+	lastSeen, ok := existing.Annotations[lastSeenAnnotation]
+	return lastSeen, ok
+}
+
+// lastSeenRefreshInterval returns how old the last-seen timestamp of an
+// otherwise unchanged entity gets before it is written again: a day, or a
+// quarter of --prune-grace-period or --prune-stale-after if shorter, so
+// that they measure the time since the instance was last seen.
+func (c *CheckConfig) lastSeenRefreshInterval() time.Duration {
+	interval := 24 * time.Hour
+	for _, window := range []time.Duration{c.pruneGraceDuration, c.pruneStaleAfterDuration} {
+		if window > 0 && window/4 < interval {
+			interval = window / 4
+		}
+	}
+	return interval
+}
+
+// lastSeenDue reports whether updated refreshes a last-seen timestamp of
+// existing older than lastSeenRefreshInterval, which diffEntity ignores.
+func (c *CheckConfig) lastSeenDue(existing *corev2.Entity, updated *corev2.Entity) bool {
+	seen, err := time.Parse(time.RFC3339, updated.Annotations[lastSeenAnnotation])
+	if err != nil {
+		return false
+	}
+	previous, err := time.Parse(time.RFC3339, existing.Annotations[lastSeenAnnotation])
+	return err != nil || seen.Sub(previous) >= c.lastSeenRefreshInterval()
+}
+
+// entityChanged reports whether writing updated would change the labels,
+// annotations, subscriptions or network data of existing, see diffEntity.
+func entityChanged(existing *corev2.Entity, updated *corev2.Entity) bool {
+	return len(diffEntity(existing, updated)) > 0
+}
+
+func stringSlicesEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// planUpdate returns the entity to write over the existing one per the
+// write strategy, or nil if it is left as it is.
+func (c *CheckConfig) planUpdate(existing *corev2.Entity, desired *corev2.Entity) *corev2.Entity {
+	if existing == nil || !isManaged(existing, managedByValue) {
+		return nil
+	}
+	updated := c.updatedEntity(existing, desired)
+	if updated == nil || !(entityChanged(existing, updated) || c.lastSeenDue(existing, updated)) || c.deferUpdate(existing, updated, time.Now()) {
+		return nil
+	}
+	return updated
+}
+
+// refreshEntity updates an existing managed entity whose instance changed
+// since it was registered, according to the write strategy.
+func (c *CheckConfig) refreshEntity(desired *corev2.Entity) registrationResult {
+	existing, err := c.getEntity(desired.Namespace, desired.Name)
+	if err != nil {
+		return c.failedRegistration(desired, fmt.Errorf("failed to get entity: %w", err))
+	}
+	if isIgnored(existing) {
+		return c.ignoredRegistration(existing)
+	}
+	updated := c.planUpdate(existing, desired)
+	if updated == nil {
+		c.logEntity("entity \"%s\" already exists", desired.Name)
+		return registrationResult{Entity: desired.Name, Outcome: outcomeExists}
+	}
+	err = c.putEntity(updated)
+	c.auditAction(auditUpdate, desired.Namespace, desired.Name, desired.Labels[instanceIdLabel], err)
+	if err != nil {
+		return c.failedRegistration(desired, fmt.Errorf("failed to update entity: %w", err))
+	}
+	c.diff.update(existing, updated)
+	c.written.add(updated)
+	c.entityWritten(updated, time.Now())
+	c.logEntity("updated entity for EC2 instance \"%s\" (state %s)", desired.Name, desired.Labels[instanceStateLabel])
+	return registrationResult{Entity: desired.Name, Outcome: outcomeUpdated}
+}
+
+// dryRunRegistration reports what registering the entity would do, without
+// writing anything.
+func (c *CheckConfig) dryRunRegistration(desired *corev2.Entity) registrationResult {
+	if extra := extraLabels(desired); len(extra) > 0 {
+		var keys []string
+		for key := range extra {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		c.logEntity("dry-run: entity \"%s\" exceeds --max-labels, moving labels %s into %s", desired.Name, strings.Join(keys, ", "), extraLabelsAnnotation)
+	}
+	var existing *corev2.Entity
+	if !c.dryRunOffline {
+		var err error
+		if existing, err = c.getEntity(desired.Namespace, desired.Name); err != nil {
+			return c.failedRegistration(desired, fmt.Errorf("failed to get entity: %w", err))
+		}
+	}
+	updated := c.planUpdate(existing, desired)
+	switch {
+	case isIgnored(existing):
+		return c.ignoredRegistration(existing)
+	case existing == nil:
+		c.auditAction(auditWouldCreate, desired.Namespace, desired.Name, desired.Labels[instanceIdLabel], nil)
+		c.diff.create(desired)
+		c.logEntity("dry-run: would register entity for EC2 instance \"%s\"", desired.Name)
+		c.printDryRunEntity("register", desired)
+		return registrationResult{Entity: desired.Name, Outcome: outcomeDryRun}
+	case updated != nil:
+		c.auditAction(auditWouldUpdate, desired.Namespace, desired.Name, desired.Labels[instanceIdLabel], nil)
+		c.diff.update(existing, updated)
+		c.logEntity("dry-run: would update entity for EC2 instance \"%s\" (%s)", desired.Name, c.writeStrategy)
+		c.printDryRunEntity("update", updated)
+		return registrationResult{Entity: desired.Name, Outcome: outcomeWouldUpdate}
+	default:
+		return registrationResult{Entity: desired.Name, Outcome: outcomeExists}
+	}
+}
+
+// isIgnored reports whether an entity carries the ignore annotation.
+func isIgnored(entity *corev2.Entity) bool {
+	return entity != nil && entity.Annotations[ignoreAnnotation] == ignoreValue
+}
+
+func (c *CheckConfig) ignoredRegistration(existing *corev2.Entity) registrationResult {
+	c.diff.ignore(existing.Namespace, existing.Name, entityInstanceId(existing))
+	c.logEntity("ignoring entity \"%s\", it is annotated %s: %s", existing.Name, ignoreAnnotation, ignoreValue)
+	return registrationResult{Entity: existing.Name, Outcome: outcomeIgnored}
+}
+
+// cachedEntities lists the entities of a namespace once per run, for
+// adoption and rename migration to search. Only the managed entities are
+// listed unless adoption, which looks for unmanaged ones, is enabled.
+func (c *CheckConfig) cachedEntities(namespace string) ([]*corev2.Entity, error) {
+	c.existingEntitiesMu.Lock()
+	defer c.existingEntitiesMu.Unlock()
+	if entities, ok := c.existingEntities[namespace]; ok {
+		return entities, nil
+	}
+	listStart := time.Now()
+	var entities []*corev2.Entity
+	var err error
+	if c.adoptExisting {
+		entities, err = c.listEntities(namespace)
+	} else {
+		entities, err = c.listManagedEntities(namespace, managedByValue)
+	}
+	c.timings.since("sensu-pre-list", listStart)
+	if err != nil {
+		return nil, err
+	}
+	if c.existingEntities == nil {
+		c.existingEntities = make(map[string][]*corev2.Entity)
+	}
+	c.existingEntities[namespace] = entities
+	return entities, nil
+}
+
+// adoptionCandidate returns the unmanaged entity matching the desired entity
+// by name or aws_instance_id label, if there is one that has not opted out.
+func (c *CheckConfig) adoptionCandidate(desired *corev2.Entity) (*corev2.Entity, error) {
+	entities, err := c.cachedEntities(desired.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, entity := range entities {
+		if entity.Name != desired.Name && entity.Labels[instanceIdLabel] != desired.Labels[instanceIdLabel] {
+			continue
+		}
+		if isManaged(entity, managedByValue) || entity.Annotations[noAdoptAnnotation] == "true" || isIgnored(entity) {
+			return nil, nil
+		}
+		return entity, nil
+	}
+	return nil, nil
+}
+
+// adoptEntity stamps the managed-by marker and instance ID onto an entity
+// registered by other means, leaving the rest of it untouched.
+func (c *CheckConfig) adoptEntity(existing *corev2.Entity, desired *corev2.Entity) registrationResult {
+	adopted := *existing
+	adopted.Labels = make(map[string]string)
+	for key, value := range existing.Labels {
+		adopted.Labels[key] = value
+	}
+	adopted.Labels[managedByLabel] = managedByValue
+	adopted.Labels[instanceIdLabel] = desired.Labels[instanceIdLabel]
+
+	err := c.putEntity(&adopted)
+	c.auditAction(auditAdopt, adopted.Namespace, adopted.Name, desired.Labels[instanceIdLabel], err)
+	if err != nil {
+		return c.failedRegistration(desired, fmt.Errorf("failed to adopt entity \"%s\": %w", existing.Name, err))
+	}
+	c.diff.update(existing, &adopted)
+	c.logEntity("adopted entity \"%s\" for EC2 instance \"%s\"", existing.Name, desired.Labels[instanceIdLabel])
+	return registrationResult{Entity: existing.Name, Outcome: outcomeAdopted}
+}
+
+// migrateRenamedEntities deletes the managed entities registered for the
+// same instance under a previous name, once the entity under its current
+// name exists. Failing to delete one is logged but does not fail the
+// registration.
+func (c *CheckConfig) migrateRenamedEntities(current *corev2.Entity) {
+	entities, err := c.cachedEntities(current.Namespace)
+	if err != nil {
+		log.Printf("ERROR: failed to list entities to migrate: %s", err)
+		return
+	}
+	for _, entity := range entities {
+		if entity.Name == current.Name || !isManaged(entity, managedByValue) || entity.Labels[instanceIdLabel] != current.Labels[instanceIdLabel] {
+			continue
+		}
+		if isIgnored(entity) {
+			c.diff.ignore(entity.Namespace, entity.Name, current.Labels[instanceIdLabel])
+			c.logEntity("not migrating entity \"%s\" to \"%s\", it is annotated %s: %s", entity.Name, current.Name, ignoreAnnotation, ignoreValue)
+			continue
+		}
+		err := c.deleteEntity(entity.Namespace, entity.Name)
+		c.auditAction(auditDelete, entity.Namespace, entity.Name, current.Labels[instanceIdLabel], err)
+		if err != nil {
+			log.Printf("ERROR: failed to delete entity \"%s\" renamed to \"%s\": %s", entity.Name, current.Name, err)
+			continue
+		}
+		c.diff.delete(entity.Namespace, entity.Name, current.Labels[instanceIdLabel], fmt.Sprintf("renamed to %s", current.Name))
+		c.logEntity("migrated entity \"%s\" to \"%s\" for EC2 instance \"%s\"", entity.Name, current.Name, current.Labels[instanceIdLabel])
+	}
+}
+
+func (c *CheckConfig) failedRegistration(entity *corev2.Entity, err error) registrationResult {
+	c.recordError(err, fmt.Sprintf("register entity %s: %s", entity.Name, err))
+	if isEntityLimitRejection(err) {
+		c.entityLimitRejected(entity.Name, err)
+		return registrationResult{Entity: entity.Name, Outcome: outcomeFailed, Reason: err.Error(), EntityLimit: true}
+	}
+	c.logFailure("failed to register entity for EC2 instance \"%s\": %s", entity.Name, err)
+	return registrationResult{Entity: entity.Name, Outcome: outcomeFailed, Reason: err.Error(), Throttled: isThrottled(err)}
+}
+
+func (c *CheckConfig) registerInstance(instance *discoveredInstance) registrationResult {
+	entity := c.buildEntity(instance)
+
+	if c.transport == transportAgentApi {
+		return c.submitAgentEvent(entity)
+	}
+
+	if c.dryRun {
+		if len(c.platformSubscriptionMap) > 0 {
+			c.logEntity("dry-run: EC2 instance \"%s\" is a %s instance, subscriptions %s", entity.Name, instancePlatform(instance.Instance), strings.Join(entity.Subscriptions, ","))
+		}
+		return c.dryRunRegistration(entity)
+	}
+
+	if c.adoptExisting {
+		existing, err := c.adoptionCandidate(entity)
+		if err != nil {
+			return c.failedRegistration(entity, fmt.Errorf("failed to list entities to adopt: %w", err))
+		}
+		if existing != nil {
+			return c.adoptEntity(existing, entity)
+		}
+	}
+
+	postBody, err := json.Marshal(entity)
+	if err != nil {
+		return c.failedRegistration(entity, err)
+	}
+	resp, err := c.sensuApiRequest("POST", entity.Namespace, entitiesPath(entity.Namespace), bytes.NewReader(postBody))
+	if err != nil && isAmbiguousWriteError(err) {
+		resp, err = c.resolveAmbiguousCreate(entity, postBody, err)
+	}
+	if err != nil {
+		c.auditAction(auditCreate, entity.Namespace, entity.Name, *instance.InstanceId, err)
+		return c.failedRegistration(entity, err)
+	}
+	defer resp.Body.Close()
+
+	var result registrationResult
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		result = c.refreshEntity(entity)
+	case resp.StatusCode >= 300:
+		err := c.statusError(resp)
+		c.auditAction(auditCreate, entity.Namespace, entity.Name, *instance.InstanceId, err)
+		return c.failedRegistration(entity, err)
+	default:
+		c.auditAction(auditCreate, entity.Namespace, entity.Name, *instance.InstanceId, nil)
+		c.diff.create(entity)
+		c.written.add(entity)
+		c.entityWritten(entity, time.Now())
+		c.logEntity("registered entity for EC2 instance \"%s\"", entity.Name)
+		result = registrationResult{Entity: entity.Name, Outcome: outcomeCreated}
+	}
+	if result.Outcome != outcomeFailed && !c.noRenameMigration {
+		c.migrateRenamedEntities(entity)
+	}
+	return result
+}
+
+// deleteInstanceEntity deletes the managed entity of an instance that entered
+// one of the delete-on states, returning outcomeDeleted if it was deleted
+// and outcomeIgnored if it carries the ignore annotation.
+func (c *CheckConfig) deleteInstanceEntity(instance *discoveredInstance) string {
+	name, _ := c.entityName(instance)
+	id := aws.StringValue(instance.InstanceId)
+	state := aws.StringValue(instance.State.Name)
+	namespace := c.instanceNamespace(instance)
+	if c.dryRunOffline {
+		c.logEntity("dry-run: not deleting entity \"%s\" in state %s, existing entities are not read", name, state)
+		return ""
+	}
+	entity, err := c.getEntity(namespace, name)
+	if err != nil {
+		log.Printf("ERROR: failed to get entity \"%s\": %s", name, err)
+		return ""
+	}
+	if entity == nil {
+		return ""
+	}
+	if !isManaged(entity, managedByValue) {
+		c.logEntity("not deleting entity \"%s\" in state %s, it is not managed by %s", name, state, managedByValue)
+		return ""
+	}
+	if isIgnored(entity) {
+		c.diff.ignore(namespace, name, id)
+		c.logEntity("not deleting entity \"%s\" in state %s, it is annotated %s: %s", name, state, ignoreAnnotation, ignoreValue)
+		return outcomeIgnored
+	}
+	if c.dryRun {
+		c.auditAction(auditWouldDelete, namespace, name, id, nil)
+		c.diff.delete(namespace, name, id, fmt.Sprintf("instance is %s", state))
+		c.logEntity("dry-run: would delete entity \"%s\", instance is %s", name, state)
+		return ""
+	}
+	err = c.deleteEntity(namespace, name)
+	c.auditAction(auditDelete, namespace, name, id, err)
+	if err != nil {
+		log.Printf("ERROR: failed to delete entity \"%s\": %s", name, err)
+		return ""
+	}
+	c.diff.delete(namespace, name, id, fmt.Sprintf("instance is %s", state))
+	c.logEntity("deleted entity \"%s\", instance is %s", name, state)
+	return outcomeDeleted
+}
+
+// archiveReport uploads the report of the run to --report-s3-bucket. A
+// failed upload does not fail the run.
+func (c *CheckConfig) archiveReport(run *discoveryRun) {
+	awsSession, err := c.newAwsSession(defaultRegion(), nil)
+	if err == nil {
+		var key string
+		if key, err = c.uploadReport(c.requestContext(), s3.New(awsSession), run); err == nil {
+			log.Printf("INFO: uploaded the run report to s3://%s/%s", c.reportS3Bucket, key)
+			return
+		}
+	}
+	log.Printf("WARNING: failed to upload the run report to S3 bucket %s: %s", c.reportS3Bucket, err)
+}
+
+// Usage: instancesByRegion -api <url> -state <value> [-state value...] [-region region...] [-tag key=value...]
+//
+// discoverInstances registers the entities of the instances discovered and
+// returns the status of the run. The audit log and the lock are released
+// before it returns, whatever the status.
+func (c *CheckConfig) discoverInstances(event *corev2.Event) (int, error) {
+	parent := context.Background()
+	if c.timeoutDuration > 0 {
+		var cancel context.CancelFunc
+		parent, cancel = context.WithTimeout(parent, c.timeoutDuration)
+		defer cancel()
+	}
+	stopping, abort, release := watchShutdown(parent, c.shutdownGraceDuration)
+	defer release()
+	c.ctx = abort
+	c.timings = newPhaseTimer()
+	// Dry-runs and offline runs do not write, and so need no lock.
+	if c.lockTtlDuration > 0 && !c.dryRun && c.outputFormat == "" {
+		if err := c.acquireLock(time.Now()); err != nil {
+			if _, ok := err.(*lockHeldError); ok {
+				fmt.Printf("OK: skipping discovery, %s (correlation ID %s)\n", err, c.correlationId)
+				return statusOK, nil
+			}
+			return statusOK, err
+		}
+		defer c.releaseLock()
+	}
+	if c.verify {
+		c.written = newWrittenEntities(int(c.verifySample))
+	}
+	if c.resolveVolumes {
+		c.volumes = newVolumeCache()
+	}
+	if c.annotatePricing {
+		c.pricing = newPricingCache()
+	}
+	if c.resolveAmis {
+		c.images = newImageCache()
+	}
+	if c.resolveProtection {
+		if err := c.loadProtectionCache(); err != nil {
+			return statusOK, err
+		}
+		defer c.protection.limiter.Stop()
+	}
+	if c.minUpdateDuration > 0 {
+		if err := c.loadChurnControl(); err != nil {
+			return statusOK, err
+		}
+	}
+	if c.entityLimitWarningPercent > 0 && c.outputFormat == "" && c.transport != transportAgentApi && !c.dryRunOffline {
+		if err := c.loadEntityLimit(); err != nil {
+			log.Printf("WARNING: %s, not checking the entity limit", err)
+		}
+	}
+	c.openAudit()
+	defer c.audit.close()
+	if c.diffFormat != "" || c.reportS3Bucket != "" {
+		c.diff = newDiffReport()
+	}
+	start := time.Now()
+
+	run := c.newDiscoveryRun()
+	summary := run.summary
+	produce := func(emit func(*discoveredInstance) bool) error {
+		return c.produceSimulatedInstances(run, emit)
+	}
+	if c.simulate == 0 {
+		regions, err := c.resolveRegions()
+		if err != nil {
+			return statusOK, err
+		}
+		produce = func(emit func(*discoveredInstance) bool) error {
+			return c.produceInstances(run, regions, emit)
+		}
+	}
+	progress := c.startProgress(run)
+	var err error
+	if c.derivesEntityNames() {
+		err = c.streamReservingNames(stopping, run, produce, progress.instanceDone)
+	} else {
+		handle := func(instance *discoveredInstance) {
+			c.processInstance(run, instance)
+			progress.instanceDone()
+		}
+		err = c.streamInstances(stopping, run, produce, handle)
+	}
+	progress.close()
+	if err != nil {
+		return statusOK, err
+	}
+
+	if c.outputFormat != "" {
+		log.Printf("INFO: wrote %d entity definitions (correlation ID %s)", len(run.offlineEntities), c.correlationId)
+		return statusOK, c.writeResourceDefinitions(os.Stdout, run.offlineEntities)
+	}
+
+	if c.verify && !summary.interrupted {
+		summary.verification = c.verifyEntities()
+	}
+
+	if !summary.interrupted {
+		summary.missingInstanceIds = c.missingInstanceIds(run.discovered)
+		for _, id := range summary.missingInstanceIds {
+			log.Printf("WARNING: instance %s was not found", id)
+		}
+	}
+
+	if c.stateFile != "" && !summary.interrupted && len(summary.regionFailures) == 0 {
+		if err := c.compareWithPreviousRun(summary); err != nil {
+			return statusOK, err
+		}
+	}
+
+	if !summary.interrupted {
+		summary.emptyRegions = c.emptyRegions(summary)
+	}
+
+	if c.createProxyCheck && !summary.interrupted {
+		if err := c.ensureProxyChecks(run.namespaces); err != nil {
+			return statusOK, err
+		}
+	}
+
+	switch {
+	case c.prune && summary.interrupted:
+		log.Printf("WARNING: skipping prune, discovery was interrupted")
+	case c.prune && len(summary.regionFailures) > 0:
+		log.Printf("WARNING: skipping prune, the instances of %d regions could not be described", len(summary.regionFailures))
+	case c.prune:
+		if err := c.pruneOrphans(run); err != nil {
+			guard, ok := err.(*pruneGuardError)
+			if !ok {
+				return statusOK, err
+			}
+			log.Printf("WARNING: %s", guard)
+			summary.pruneGuard = guard.Error()
+		}
+	}
+
+	if c.mode == modeMonitor && !summary.interrupted && len(summary.regionFailures) == 0 {
+		if err := c.recordStaleEntities(run, run.scannedRegions()); err != nil {
+			return statusOK, err
+		}
+	}
+	if c.mode == modeMonitor {
+		summary.drift = c.newDriftCounts()
+	}
+
+	c.audit.close()
+	c.timings.since("total", start)
+	if c.diffFormat != "" {
+		if err := c.diff.print(os.Stdout, c.diffFormat); err != nil {
+			return statusOK, err
+		}
+	}
+	summary.print(os.Stdout, c)
+	if c.timing {
+		c.timings.print(os.Stdout)
+	}
+	c.printRunMetrics(c.metricsWriter(os.Stdout), summary, c.timing)
+	if err := c.errorCategories.print(os.Stdout); err != nil {
+		return statusOK, err
+	}
+	if c.reportS3Bucket != "" && (!c.dryRun || c.reportDryRuns) {
+		c.archiveReport(run)
+	}
+	// Telemetry is best effort, it never fails the check.
+	if c.telemetryTextfile != "" {
+		if err := c.writeTelemetry(summary, time.Now()); err != nil {
+			log.Printf("WARNING: %s", err)
+		}
+	}
+	return summary.status(c), nil
 }
@@ -1,8 +1,499 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 func TestMain(t *testing.T) {
 }
+
+func testInstance(id string, state string) *discoveredInstance {
+	return &discoveredInstance{
+		Instance: &ec2.Instance{
+			InstanceId: aws.String(id),
+			State:      &ec2.InstanceState{Name: aws.String(state)},
+		},
+		Account: &awsAccount{},
+		Region:  "us-west-2",
+	}
+}
+
+func TestDeleteInstanceEntity(t *testing.T) {
+	entities := map[string]*corev2.Entity{
+		"i-managed":   testEntity("i-managed", "proxy", map[string]string{managedByLabel: managedByValue}),
+		"i-unmanaged": testEntity("i-unmanaged", "proxy", nil),
+	}
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/core/v2/namespaces/default/entities/")
+		entity, ok := entities[name]
+		switch {
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "GET":
+			_ = json.NewEncoder(w).Encode(entity)
+		case r.Method == "DELETE":
+			deleted = append(deleted, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+
+	if c.deleteInstanceEntity(testInstance("i-managed", "stopped")) != outcomeDeleted {
+		t.Error("expected the managed entity to be deleted")
+	}
+	if c.deleteInstanceEntity(testInstance("i-unmanaged", "stopped")) != "" {
+		t.Error("deleted an entity without the managed-by marker")
+	}
+	if c.deleteInstanceEntity(testInstance("i-missing", "stopped")) != "" {
+		t.Error("deleted a missing entity")
+	}
+	if strings.Join(deleted, ",") != "i-managed" {
+		t.Errorf("unexpected deletions: %v", deleted)
+	}
+
+	c.dryRun = true
+	if c.deleteInstanceEntity(testInstance("i-managed", "stopped")) != "" || len(deleted) != 1 {
+		t.Error("dry-run deleted an entity")
+	}
+}
+
+func TestBuildEntityAccountLabels(t *testing.T) {
+	c := testConfig()
+	instance := testInstance("i-0123", "running")
+	instance.Account = &awsAccount{Id: "123456789012", Alias: "prod"}
+	entity := c.buildEntity(instance)
+	if entity.Labels[accountIdLabel] != "123456789012" || entity.Labels[accountAliasLabel] != "prod" {
+		t.Errorf("unexpected labels: %v", entity.Labels)
+	}
+
+	entity = c.buildEntity(testInstance("i-0123", "running"))
+	if _, ok := entity.Labels[accountIdLabel]; ok {
+		t.Errorf("unexpected account ID label: %v", entity.Labels)
+	}
+	if _, ok := entity.Labels[accountAliasLabel]; ok {
+		t.Errorf("unexpected account alias label: %v", entity.Labels)
+	}
+}
+
+func TestBuildEntityReservationLabels(t *testing.T) {
+	c := testConfig()
+	instance := testInstance("i-0123", "running")
+	instance.Account = &awsAccount{Id: "123456789012"}
+	instance.OwnerId = "210987654321"
+	instance.RequesterId = "226008221399"
+	entity := c.buildEntity(instance)
+	for key, expected := range map[string]string{reservationOwnerLabel: "210987654321", requesterLabel: "226008221399", foreignReservationLabel: "true"} {
+		if entity.Labels[key] != expected {
+			t.Errorf("unexpected label %s: %q", key, entity.Labels[key])
+		}
+	}
+
+	instance.OwnerId = "123456789012"
+	instance.RequesterId = ""
+	entity = c.buildEntity(instance)
+	if entity.Labels[foreignReservationLabel] != "false" {
+		t.Errorf("unexpected label %s: %q", foreignReservationLabel, entity.Labels[foreignReservationLabel])
+	}
+	if _, ok := entity.Labels[requesterLabel]; ok {
+		t.Errorf("unexpected requester label: %v", entity.Labels)
+	}
+
+	// Without the account ID, whether the reservation is foreign is unknown.
+	instance.Account = &awsAccount{}
+	entity = c.buildEntity(instance)
+	if _, ok := entity.Labels[foreignReservationLabel]; ok || entity.Labels[reservationOwnerLabel] != "123456789012" {
+		t.Errorf("unexpected labels: %v", entity.Labels)
+	}
+}
+
+func TestBuildEntityJsonTags(t *testing.T) {
+	c := testConfig()
+	c.jsonTagSet = map[string]bool{"sensu:meta": true, "broken": true}
+	instance := testInstance("i-0123", "running")
+	instance.Tags = []*ec2.Tag{
+		{Key: aws.String("sensu:meta"), Value: aws.String(`{"tier":"gold","oncall":"team-a","weight":3,"canary":false,"env":"dev"}`)},
+		{Key: aws.String("broken"), Value: aws.String(`{"nested":{"a":1}}`)},
+		{Key: aws.String("env"), Value: aws.String("prod")},
+	}
+	entity := c.buildEntity(instance)
+	for key, expected := range map[string]string{"tier": "gold", "oncall": "team-a", "weight": "3", "canary": "false", "env": "prod"} {
+		if entity.Labels[key] != expected {
+			t.Errorf("unexpected label %s: %q", key, entity.Labels[key])
+		}
+	}
+	if _, ok := entity.Labels["sensu:meta"]; ok {
+		t.Errorf("the JSON tag is kept as a label: %v", entity.Labels)
+	}
+	if _, ok := entity.Labels["broken"]; ok || entity.Annotations["broken"] != `{"nested":{"a":1}}` {
+		t.Errorf("invalid JSON is not kept as an annotation: %v %v", entity.Labels, entity.Annotations)
+	}
+}
+
+func TestBuildEntityCaseDistinctTags(t *testing.T) {
+	c := testConfig()
+	tags := []*ec2.Tag{
+		{Key: aws.String("Env"), Value: aws.String("prod")},
+		{Key: aws.String("env"), Value: aws.String("dev")},
+		{Key: aws.String("ENV"), Value: aws.String("test")},
+	}
+	// Tag keys are not case-normalized, so they cannot collide whatever
+	// order EC2 returns them in.
+	for i := range tags {
+		instance := testInstance("i-0123", "running")
+		instance.Tags = append(append([]*ec2.Tag{}, tags[i:]...), tags[:i]...)
+		entity := c.buildEntity(instance)
+		if entity.Labels["Env"] != "prod" || entity.Labels["env"] != "dev" || entity.Labels["ENV"] != "test" {
+			t.Errorf("unexpected labels for rotation %d: %v", i, entity.Labels)
+		}
+	}
+}
+
+func TestCreateFiltersIncludesDeleteOnStates(t *testing.T) {
+	c := testConfig()
+	c.ec2InstanceStates = "running"
+	c.deleteOnStates = "stopped,running"
+	if err := c.createFilters(); err != nil {
+		t.Fatal(err)
+	}
+	states := aws.StringValueSlice(c.ec2Filters[0].Values)
+	if strings.Join(states, ",") != "running,stopped" {
+		t.Errorf("unexpected state filter: %v", states)
+	}
+}
+
+func TestDescribeInputsInstanceIds(t *testing.T) {
+	var ids []string
+	for i := 0; i < 450; i++ {
+		ids = append(ids, fmt.Sprintf("i-%04d", i))
+	}
+	c := testConfig()
+	c.ec2InstanceStates = "running"
+	c.ec2FilterTags = "env=prod"
+	c.ec2InstanceIds = strings.Join(ids, ",")
+	if err := c.createFilters(); err != nil {
+		t.Fatal(err)
+	}
+	inputs := c.describeInputs(c.ec2InstanceIdList)
+	if len(inputs) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(inputs))
+	}
+	for i, expected := range []int{200, 200, 50} {
+		filters := inputs[i].Filters
+		if len(filters) != 3 || aws.StringValue(filters[2].Name) != "instance-id" || len(filters[2].Values) != expected {
+			t.Errorf("unexpected filters of request %d: %s", i, describeFilters(filters))
+		}
+	}
+
+	c = testConfig()
+	c.ec2InstanceStates = "running"
+	c.ec2InstanceIds = "i-0123, i-0456"
+	c.idsOnly = true
+	if err := c.createFilters(); err != nil {
+		t.Fatal(err)
+	}
+	inputs = c.describeInputs(c.ec2InstanceIdList)
+	if len(inputs) != 1 || describeFilters(inputs[0].Filters) != "instance-id=i-0123,i-0456" {
+		t.Errorf("unexpected --ids-only requests: %v", inputs)
+	}
+	missing := c.missingInstanceIds(map[string]bool{"i-0123": true})
+	if strings.Join(missing, ",") != "i-0456" {
+		t.Errorf("unexpected missing instances: %v", missing)
+	}
+
+	c = testConfig()
+	c.idsOnly = true
+	if err := c.createFilters(); err == nil {
+		t.Error("expected --ids-only without --ec2-instance-ids to be rejected")
+	}
+}
+
+func TestParseInstanceIdList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "excluded")
+	if err := ioutil.WriteFile(file, []byte("# appliances\ni-0aa i-0bb\ni-0cc, i-0dd # legacy\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := parseInstanceIdList("i-0123,@" + file + ", i-0456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ids, ",") != "i-0123,i-0aa,i-0bb,i-0cc,i-0dd,i-0456" {
+		t.Errorf("unexpected instance IDs: %v", ids)
+	}
+	if _, err := parseInstanceIdList("@" + filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestRegisterInstanceRefreshesStateChanges(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+
+	instance := testInstance("i-0123", "running")
+	instance.Tags = []*ec2.Tag{{Key: aws.String("env"), Value: aws.String("prod")}}
+	instance.NetworkInterfaces = []*ec2.InstanceNetworkInterface{{
+		NetworkInterfaceId: aws.String("eni-1"),
+		MacAddress:         aws.String("0a:00:00:00:00:01"),
+		PrivateIpAddresses: []*ec2.InstancePrivateIpAddress{{PrivateIpAddress: aws.String("10.0.0.5")}},
+		Association:        &ec2.InstanceNetworkInterfaceAssociation{PublicIp: aws.String("203.0.113.10")},
+	}}
+	c.registerInstance(instance)
+
+	// Stop: the public address is released.
+	instance.State.Name = aws.String("stopped")
+	instance.StateReason = &ec2.StateReason{Code: aws.String("Client.UserInitiatedShutdown"), Message: aws.String("Client.UserInitiatedShutdown: User initiated shutdown")}
+	instance.StateTransitionReason = aws.String("User initiated (2020-02-10 12:00:00 GMT)")
+	instance.NetworkInterfaces[0].Association = nil
+	c.registerInstance(instance)
+	entity := backend.entity("i-0123")
+	if entity.Labels[instanceStateLabel] != "stopped" || entity.Labels[stateReasonCodeLabel] != "Client.UserInitiatedShutdown" {
+		t.Errorf("state labels not refreshed after stop: %v", entity.Labels)
+	}
+	if reason := entity.Annotations[stateReasonAnnotation]; reason != "Client.UserInitiatedShutdown: User initiated shutdown; User initiated (2020-02-10 12:00:00 GMT)" {
+		t.Errorf("unexpected state reason after stop: %q", reason)
+	}
+	if addresses := entity.System.Network.Interfaces[0].Addresses; strings.Join(addresses, ",") != "10.0.0.5" {
+		t.Errorf("network not refreshed after stop: %v", addresses)
+	}
+
+	// Start: a new public address is assigned. Labels set by operators
+	// in the meantime are kept.
+	entity.Labels["contact"] = "team-db"
+	instance.State.Name = aws.String("running")
+	instance.NetworkInterfaces[0].Association = &ec2.InstanceNetworkInterfaceAssociation{PublicIp: aws.String("203.0.113.20")}
+	c.registerInstance(instance)
+	entity = backend.entity("i-0123")
+	if entity.Labels[instanceStateLabel] != "running" || entity.Labels["contact"] != "team-db" || entity.Labels["env"] != "prod" {
+		t.Errorf("unexpected labels after start: %v", entity.Labels)
+	}
+	if _, ok := entity.Labels[stateReasonCodeLabel]; ok || entity.Annotations[stateReasonAnnotation] != "" {
+		t.Errorf("stale state reason after start: %v, %v", entity.Labels, entity.Annotations)
+	}
+	if addresses := entity.System.Network.Interfaces[0].Addresses; strings.Join(addresses, ",") != "10.0.0.5,203.0.113.20" {
+		t.Errorf("network not refreshed after start: %v", addresses)
+	}
+
+	// No change: no write.
+	backend.requests = nil
+	c.registerInstance(instance)
+	for _, request := range backend.requests {
+		if strings.HasPrefix(request, "PUT") {
+			t.Errorf("unexpected update of an unchanged entity: %v", backend.requests)
+		}
+	}
+}
+
+func TestRegisterInstanceWriteStrategies(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	existing := testEntity("i-0123", "proxy", map[string]string{managedByLabel: managedByValue, instanceIdLabel: "i-0123", "retired-tag": "x"})
+	instance := testInstance("i-0123", "running")
+
+	c.writeStrategy = writeStrategyCreateOnly
+	backend.entities[existing.Name] = existing
+	if result := c.registerInstance(instance); result.Outcome != outcomeExists {
+		t.Errorf("create-only touched an existing entity: %+v", result)
+	}
+
+	c.writeStrategy = writeStrategyReplace
+	c.dryRun = true
+	if result := c.registerInstance(instance); result.Outcome != outcomeWouldUpdate {
+		t.Errorf("unexpected dry-run result: %+v", result)
+	}
+	if _, ok := backend.entity("i-0123").Labels["retired-tag"]; !ok {
+		t.Error("dry-run wrote the entity")
+	}
+
+	c.dryRun = false
+	if result := c.registerInstance(instance); result.Outcome != outcomeUpdated {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	entity := backend.entity("i-0123")
+	if _, ok := entity.Labels["retired-tag"]; ok || entity.Labels[instanceStateLabel] != "running" {
+		t.Errorf("replace did not write the discovered labels only: %v", entity.Labels)
+	}
+	if result := c.registerInstance(instance); result.Outcome != outcomeExists {
+		t.Errorf("replaced an unchanged entity: %+v", result)
+	}
+
+	// A terminated instance keeps the time it was last seen.
+	lastSeen := entity.Annotations[lastSeenAnnotation]
+	if result := c.registerInstance(testInstance("i-0123", "terminated")); result.Outcome != outcomeUpdated {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if entity = backend.entity("i-0123"); lastSeen == "" || entity.Annotations[lastSeenAnnotation] != lastSeen {
+		t.Errorf("replace dropped the last-seen timestamp: %v", entity.Annotations)
+	}
+}
+
+func TestRegisterInstanceUpdatesOnConflict(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	backend.entities["i-0123"] = testEntity("i-0123", "proxy", map[string]string{managedByLabel: managedByValue, instanceIdLabel: "i-0123", "env": "staging"})
+	instance := testInstance("i-0123", "running")
+	instance.Tags = []*ec2.Tag{{Key: aws.String("env"), Value: aws.String("prod")}}
+
+	backend.requests = nil
+	if result := c.registerInstance(instance); result.Outcome != outcomeUpdated {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	want := []string{
+		"POST /api/core/v2/namespaces/default/entities",
+		"GET /api/core/v2/namespaces/default/entities/i-0123",
+		"PUT /api/core/v2/namespaces/default/entities/i-0123",
+	}
+	// The rename migration lists the entities afterwards.
+	if len(backend.requests) < len(want) || strings.Join(backend.requests[:len(want)], "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected requests %v, got %v", want, backend.requests)
+	}
+	if env := backend.entity("i-0123").Labels["env"]; env != "prod" {
+		t.Errorf("tag change not propagated: env=%q", env)
+	}
+
+	// --update-existing=false leaves existing entities alone.
+	c = backend.checkConfig()
+	c.updateExisting = false
+	if err := c.applyUpdateExistingArgs(); err != nil {
+		t.Fatal(err)
+	}
+	instance.Tags[0].Value = aws.String("dev")
+	if result := c.registerInstance(instance); result.Outcome != outcomeExists {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if env := backend.entity("i-0123").Labels["env"]; env != "prod" {
+		t.Errorf("--update-existing=false updated the entity: env=%q", env)
+	}
+
+	c.writeStrategy = writeStrategyReplace
+	if err := c.applyUpdateExistingArgs(); err == nil {
+		t.Error("expected --update-existing=false to conflict with --write-strategy replace")
+	}
+}
+
+func TestRegisterInstanceToleratesFailures(t *testing.T) {
+	backend := newFakeBackend()
+	backend.Close()
+	c := backend.checkConfig()
+
+	result := c.registerInstance(testInstance("i-0123", "running"))
+	if result.Outcome != outcomeFailed || result.Reason == "" {
+		t.Errorf("unexpected result for an unreachable backend: %+v", result)
+	}
+}
+
+func TestRegisterInstanceAdoptsExistingEntities(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.adoptExisting = true
+
+	byName := testEntity("i-0123", "proxy", map[string]string{"team": "web"})
+	byLabel := testEntity("legacy-db", "proxy", map[string]string{instanceIdLabel: "i-0456"})
+	optedOut := testEntity("i-0789", "proxy", nil)
+	optedOut.Annotations = map[string]string{noAdoptAnnotation: "true"}
+	for _, entity := range []*corev2.Entity{byName, byLabel, optedOut} {
+		backend.entities[entity.Name] = entity
+	}
+
+	for _, id := range []string{"i-0123", "i-0456"} {
+		if result := c.registerInstance(testInstance(id, "running")); result.Outcome != outcomeAdopted {
+			t.Errorf("unexpected result for %s: %+v", id, result)
+		}
+	}
+	if entity := backend.entity("i-0123"); !isManaged(entity, managedByValue) || entity.Labels["team"] != "web" {
+		t.Errorf("unexpected adopted entity: %+v", entity.Labels)
+	}
+	if entity := backend.entity("legacy-db"); !isManaged(entity, managedByValue) {
+		t.Errorf("entity matched by instance ID was not adopted: %+v", entity.Labels)
+	}
+	if backend.entity("i-0456") != nil {
+		t.Error("registered a new entity for an adopted instance")
+	}
+
+	if result := c.registerInstance(testInstance("i-0789", "running")); result.Outcome != outcomeExists {
+		t.Errorf("unexpected result for an opted-out entity: %+v", result)
+	}
+	if isManaged(backend.entity("i-0789"), managedByValue) {
+		t.Error("adopted an entity that opted out")
+	}
+}
+
+func TestRegisterInstanceMigratesRenamedEntities(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	previous := testEntity("web-old", "proxy", map[string]string{managedByLabel: managedByValue, instanceIdLabel: "i-0123"})
+	backend.entities[previous.Name] = previous
+
+	if result := c.registerInstance(testInstance("i-0123", "running")); result.Outcome != outcomeCreated {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if backend.entity("i-0123") == nil || backend.entity("web-old") != nil {
+		t.Error("renamed entity was not migrated")
+	}
+	requests := strings.Join(backend.requests, ",")
+	if strings.Index(requests, "POST") > strings.Index(requests, "DELETE") {
+		t.Errorf("deleted the previous entity before creating the new one: %s", requests)
+	}
+
+	backend = newFakeBackend()
+	defer backend.Close()
+	c = backend.checkConfig()
+	c.noRenameMigration = true
+	backend.entities[previous.Name] = previous
+	c.registerInstance(testInstance("i-0123", "running"))
+	if backend.entity("web-old") == nil {
+		t.Error("migrated a renamed entity with --no-rename-migration")
+	}
+}
+
+func TestRegisterInstanceConcurrently(t *testing.T) {
+	t.Parallel()
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.adoptExisting = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if result := c.registerInstance(testInstance(id, "running")); result.Outcome != outcomeCreated {
+				t.Errorf("unexpected result for %s: %+v", id, result)
+			}
+		}(fmt.Sprintf("i-%04d", i))
+	}
+	wg.Wait()
+	backend.Lock()
+	defer backend.Unlock()
+	if len(backend.entities) != 8 {
+		t.Errorf("unexpected number of entities: %d", len(backend.entities))
+	}
+}
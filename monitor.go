@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+)
+
+const (
+	modeRegister = "register"
+	modeMonitor  = "monitor"
+)
+
+// driftCounts is how far the Sensu registry is from the discovered
+// instances in --mode monitor: the entities missing for discovered
+// instances, the stale entities of instances no longer discovered, and the
+// entities whose labels, annotations, subscriptions or network data drifted.
+type driftCounts struct {
+	missing int
+	stale   int
+	drifted int
+}
+
+func (d *driftCounts) total() int {
+	return d.missing + d.stale + d.drifted
+}
+
+// validateMonitorArgs turns --mode monitor into a dry-run collecting the
+// diff, which the drift is computed from.
+func (c *CheckConfig) validateMonitorArgs() error {
+	switch c.mode {
+	case "", modeRegister:
+		return nil
+	case modeMonitor:
+	default:
+		return fmt.Errorf("invalid --mode \"%s\", expected %s or %s", c.mode, modeRegister, modeMonitor)
+	}
+	if c.prune {
+		return fmt.Errorf("--mode monitor performs no writes and cannot be combined with --prune, stale entities are reported as drift")
+	}
+	if c.driftCriticalThreshold > 0 && c.driftWarningThreshold > c.driftCriticalThreshold {
+		return fmt.Errorf("--drift-warning-threshold must not be above --drift-critical-threshold")
+	}
+	c.dryRun = true
+	if c.diffFormat == "" {
+		c.diffFormat = "text"
+	}
+	return nil
+}
+
+// recordStaleEntities adds the managed entities whose instance was not
+// discovered to the diff, as prune would delete them, in every namespace
+// prune covers. This is only meaningful when every instance was
+// discovered, so it is skipped when discovering a list of instances, and
+// limited to the regions scanned. A namespace failing to be read does not
+// keep the others from being looked at; the first failure is returned.
+func (c *CheckConfig) recordStaleEntities(run *discoveryRun, regions map[string]bool) error {
+	if len(c.ec2InstanceIdList) > 0 {
+		c.logDebug("not looking for stale entities, only a list of instances was discovered")
+		return nil
+	}
+	run.Lock()
+	namespaces := c.pruneNamespaces(run.namespaces)
+	run.Unlock()
+	var failure error
+	for _, namespace := range namespaces {
+		report, err := c.planOrphans(namespace, run.discovered, regions)
+		if err != nil {
+			if failure == nil {
+				failure = fmt.Errorf("failed to look for stale entities in namespace \"%s\": %s", namespace, err)
+			} else {
+				log.Printf("ERROR: failed to look for stale entities in namespace \"%s\": %s", namespace, err)
+			}
+			continue
+		}
+		for _, decision := range report.Delete {
+			c.diff.delete(report.Namespace, decision.Entity, decision.InstanceId, decision.Reason)
+		}
+		for _, decision := range report.Ignored {
+			c.diff.ignore(report.Namespace, decision.Entity, decision.InstanceId)
+		}
+	}
+	return failure
+}
+
+// newDriftCounts counts the drift in the diff of the run.
+func (c *CheckConfig) newDriftCounts() *driftCounts {
+	c.diff.Lock()
+	defer c.diff.Unlock()
+	return &driftCounts{missing: len(c.diff.Create), stale: len(c.diff.Delete), drifted: len(c.diff.Update)}
+}
+
+// printMetrics writes the drift counts in the Prometheus text format.
+func (d *driftCounts) printMetrics(w io.Writer) {
+	if d == nil {
+		return
+	}
+	for _, count := range []struct {
+		kind  string
+		value int
+	}{{"missing", d.missing}, {"stale", d.stale}, {"drifted", d.drifted}} {
+		fmt.Fprintf(w, "sensu_ec2_discovery_drift_entities{kind=\"%s\"} %d\n", count.kind, count.value)
+	}
+}
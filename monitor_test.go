@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestMonitorMode(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.mode = modeMonitor
+	c.driftWarningThreshold, c.driftCriticalThreshold = 1, 3
+	if err := c.validateMonitorArgs(); err != nil {
+		t.Fatal(err)
+	}
+	c.diff = newDiffReport()
+
+	backend.entities["i-0456"] = c.buildEntity(testInstance("i-0456", "running"))
+	backend.entities["i-0789"] = c.buildEntity(testInstance("i-0789", "running"))
+	run := c.newDiscoveryRun()
+	c.processInstance(run, testInstance("i-0123", "running"))
+	c.processInstance(run, testInstance("i-0456", "stopped"))
+	if err := c.recordStaleEntities(run, nil); err != nil {
+		t.Fatal(err)
+	}
+	run.summary.drift = c.newDriftCounts()
+
+	for _, request := range backend.requests {
+		if !strings.HasPrefix(request, "GET ") {
+			t.Errorf("unexpected write in monitor mode: %s", request)
+		}
+	}
+	if drift := run.summary.drift; drift.missing != 1 || drift.stale != 1 || drift.drifted != 1 {
+		t.Errorf("unexpected drift: %+v", drift)
+	}
+	if status, category := run.summary.statusCause(c); status != statusCritical || category != "drift" {
+		t.Errorf("unexpected status %d (%s)", status, category)
+	}
+	c.driftCriticalThreshold = 0
+	if status := run.summary.status(c); status != statusWarning {
+		t.Errorf("unexpected status %d without a critical threshold", status)
+	}
+
+	var output bytes.Buffer
+	run.summary.print(&output, c)
+	if !strings.Contains(output.String(), "drift: 1 entities missing, 1 stale, 1 drifted") {
+		t.Errorf("unexpected summary:\n%s", output.String())
+	}
+	output.Reset()
+	run.summary.drift.printMetrics(&output)
+	expected := `sensu_ec2_discovery_drift_entities{kind="missing"} 1
+sensu_ec2_discovery_drift_entities{kind="stale"} 1
+sensu_ec2_discovery_drift_entities{kind="drifted"} 1
+`
+	if output.String() != expected {
+		t.Errorf("unexpected metrics:\n%s", output.String())
+	}
+}
+
+func TestMonitorModeNamespaces(t *testing.T) {
+	managed := func(name string) *corev2.Entity {
+		return testEntity(name, "proxy", map[string]string{managedByLabel: managedByValue, instanceIdLabel: name, regionLabel: "us-west-2"})
+	}
+	namespaces := map[string][]*corev2.Entity{
+		"default": {managed("i-discovered"), managed("i-gone")},
+		"team-a":  {managed("i-routed"), managed("i-a1")},
+		"team-b":  {managed("i-b1")},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/core/v2/namespaces/"), "/")
+		_ = json.NewEncoder(w).Encode(namespaces[parts[0]])
+	}))
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.namespaceApiKeyMap = map[string]string{"team-b": "key"}
+	c.diff = newDiffReport()
+	run := c.newDiscoveryRun()
+	run.discovered = map[string]bool{"i-discovered": true, "i-routed": true}
+	run.namespaces["team-a"] = true
+
+	// Stale entities are looked for in every namespace prune covers.
+	if err := c.recordStaleEntities(run, map[string]bool{"us-west-2": true}); err != nil {
+		t.Fatal(err)
+	}
+	var stale []string
+	for _, diff := range c.diff.Delete {
+		stale = append(stale, diff.Namespace+"/"+diff.Entity)
+	}
+	sort.Strings(stale)
+	if strings.Join(stale, ",") != "default/i-gone,team-a/i-a1,team-b/i-b1" {
+		t.Errorf("unexpected stale entities %v", stale)
+	}
+}
+
+func TestValidateMonitorArgs(t *testing.T) {
+	c := testConfig()
+	c.mode = modeMonitor
+	c.prune = true
+	if err := c.validateMonitorArgs(); err == nil {
+		t.Error("expected --prune to be rejected in monitor mode")
+	}
+	c = testConfig()
+	c.mode = "audit"
+	if err := c.validateMonitorArgs(); err == nil {
+		t.Error("expected an invalid mode to be rejected")
+	}
+	c = testConfig()
+	c.mode = modeMonitor
+	if err := c.validateMonitorArgs(); err != nil || !c.dryRun || c.diffFormat != "text" {
+		t.Errorf("monitor mode is not a dry-run printing the diff: %v", err)
+	}
+}
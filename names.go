@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	entityNameStyleRaw = "raw"
+	entityNameStyleDns = "dns"
+)
+
+const (
+	entityNameSourceInstanceId = "instance-id"
+	entityNameSourceNameTag    = "name-tag"
+)
+
+// originalNameAnnotation records the name of an entity before
+// --entity-name-style normalized it.
+const originalNameAnnotation = "sensu.io/plugins/ec2-discovery/original-name"
+
+// maxDnsLabelLength is the longest a DNS label may be.
+const maxDnsLabelLength = 63
+
+var nonDnsCharacters = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// dnsName normalizes a name to a single DNS label: lowercase letters,
+// digits and dashes, runs of other characters replaced by a dash, without
+// leading or trailing dashes, at most 63 characters long.
+func dnsName(name string) string {
+	name = nonDnsCharacters.ReplaceAllString(strings.ToLower(name), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > maxDnsLabelLength {
+		name = strings.TrimRight(name[:maxDnsLabelLength], "-")
+	}
+	return name
+}
+
+var nonSensuNameCharacters = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// sensuName normalizes a name to lowercase letters, digits, underscores,
+// dots and dashes, runs of other characters replaced by a dash, without
+// leading or trailing dashes.
+func sensuName(name string) string {
+	return strings.Trim(nonSensuNameCharacters.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func (c *CheckConfig) validateEntityNameStyle() error {
+	switch c.entityNameStyle {
+	case "", entityNameStyleRaw, entityNameStyleDns:
+		return nil
+	default:
+		return fmt.Errorf("invalid --entity-name-style \"%s\", expected %s or %s", c.entityNameStyle, entityNameStyleRaw, entityNameStyleDns)
+	}
+}
+
+func (c *CheckConfig) validateEntityNameSource() error {
+	switch c.entityNameSource {
+	case "", entityNameSourceInstanceId:
+	case entityNameSourceNameTag:
+		if c.entityNameTemplateText != "" {
+			return fmt.Errorf("--entity-name-source %s cannot be combined with --entity-name-template, use {{ .Tag.Name }}", entityNameSourceNameTag)
+		}
+	default:
+		return fmt.Errorf("invalid --entity-name-source \"%s\", expected %s or %s", c.entityNameSource, entityNameSourceInstanceId, entityNameSourceNameTag)
+	}
+	if c.entityNameTemplateText != "" {
+		var err error
+		if c.entityNameTemplate, err = parseInstanceTemplate("entity-name-template", c.entityNameTemplateText); err != nil {
+			return fmt.Errorf("invalid --entity-name-template: %s", err)
+		}
+	}
+	return nil
+}
+
+// entityNameBase returns what the entity of an instance is named after:
+// --entity-name-template rendered for it, or its Name tag with
+// --entity-name-source name-tag, when set, else its instance ID. An
+// instance the template fails on is named after its instance ID.
+func (c *CheckConfig) entityNameBase(instance *discoveredInstance) string {
+	if c.entityNameTemplate != nil {
+		data := newInstanceTemplateData(instance)
+		name, err := renderInstanceTemplate(c.entityNameTemplate, data)
+		if err != nil {
+			log.Printf("WARNING: failed to render --entity-name-template for EC2 instance \"%s\", using the instance ID: %s", data.InstanceId, err)
+			return data.InstanceId
+		}
+		if name = strings.TrimSpace(name); name != "" {
+			return name
+		}
+	}
+	if c.entityNameSource == entityNameSourceNameTag {
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) == "Name" {
+				if name := strings.TrimSpace(aws.StringValue(tag.Value)); name != "" {
+					return name
+				}
+			}
+		}
+	}
+	return aws.StringValue(instance.InstanceId)
+}
+
+// derivesEntityNames reports whether the entity names are derived from the
+// instances with --entity-name-style dns, --entity-name-source name-tag or
+// --entity-name-template, so that several instances can share one.
+func (c *CheckConfig) derivesEntityNames() bool {
+	return c.entityNameStyle == entityNameStyleDns || c.entityNameSource == entityNameSourceNameTag || c.entityNameTemplate != nil
+}
+
+// reserveEntityNames gives out the entity names of the instances of a run
+// lowest instance ID first, so that the instance keeping a shared name does
+// not depend on the order the instances are processed in.
+func (c *CheckConfig) reserveEntityNames(instances []*discoveredInstance) {
+	sorted := make([]*discoveredInstance, len(instances))
+	copy(sorted, instances)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return aws.StringValue(sorted[i].InstanceId) < aws.StringValue(sorted[j].InstanceId)
+	})
+	for _, instance := range sorted {
+		c.entityName(instance)
+	}
+}
+
+// entityName returns the name of the entity of an instance and, when
+// --entity-name-style, --entity-name-source or --entity-name-template
+// changed it, its original name. A normalized name already taken by
+// another instance during the run gets the instance ID appended, so the
+// instance the name was reserved for first, see reserveEntityNames, keeps
+// it. An instance whose name normalizes to nothing falls back to its
+// instance ID, which is always DNS-safe.
+func (c *CheckConfig) entityName(instance *discoveredInstance) (string, string) {
+	id := aws.StringValue(instance.InstanceId)
+	original := c.accountPrefix(instance.Account) + c.entityNameBase(instance)
+	var name string
+	switch {
+	case c.entityNameStyle == entityNameStyleDns:
+		name = dnsName(original)
+		if name == "" {
+			log.Printf("WARNING: entity name \"%s\" of EC2 instance \"%s\" has no DNS-safe characters, using the instance ID", original, id)
+			name = id
+		}
+	case c.entityNameSource == entityNameSourceNameTag || c.entityNameTemplate != nil:
+		name = sensuName(original)
+		if name == "" {
+			log.Printf("WARNING: entity name \"%s\" of EC2 instance \"%s\" has no characters valid in Sensu names, using the instance ID", original, id)
+			name = id
+		}
+	default:
+		return original, ""
+	}
+
+	c.entityNamesMu.Lock()
+	defer c.entityNamesMu.Unlock()
+	if c.entityNames == nil {
+		c.entityNames = make(map[string]string)
+	}
+	if owner, ok := c.entityNames[name]; ok && owner != id {
+		var deduplicated string
+		if c.entityNameStyle == entityNameStyleDns {
+			prefix := name
+			if keep := maxDnsLabelLength - len(id) - 1; len(prefix) > keep {
+				prefix = prefix[:keep]
+			}
+			deduplicated = dnsName(fmt.Sprintf("%s-%s", prefix, id))
+		} else {
+			deduplicated = sensuName(fmt.Sprintf("%s-%s", name, id))
+		}
+		if c.entityNames[deduplicated] != id {
+			log.Printf("WARNING: entity name \"%s\" of EC2 instance \"%s\" is taken by EC2 instance \"%s\", using \"%s\"", name, id, owner, deduplicated)
+		}
+		name = deduplicated
+	}
+	c.entityNames[name] = id
+	if name == original {
+		return name, ""
+	}
+	return name, original
+}
+
+// multiAccount reports whether several accounts are discovered, whose
+// entity names --account-prefix-template tells apart.
+func (c *CheckConfig) multiAccount() bool {
+	return len(c.awsAccounts()) > 1
+}
+
+// accountPrefix returns the prefix of the entity names of an account in
+// multi-account mode, rendered once per run and logged when first used. An
+// account the template fails on is prefixed with its ID.
+func (c *CheckConfig) accountPrefix(account *awsAccount) string {
+	if c.accountPrefixTemplate == nil || account == nil || !c.multiAccount() {
+		return ""
+	}
+	account.prefixOnce.Do(func() {
+		data := &instanceTemplateData{AccountId: account.Id, AccountAlias: account.Alias}
+		prefix, err := renderInstanceTemplate(c.accountPrefixTemplate, data)
+		if err != nil || prefix == "" {
+			log.Printf("WARNING: failed to render --account-prefix-template for AWS account %s, prefixing its entity names with its ID: %v", account.Id, err)
+			prefix = account.Id + "-"
+		}
+		account.prefix = prefix
+		log.Printf("INFO: prefixing the entity names of AWS account %s with \"%s\"", account.Id, prefix)
+	})
+	return account.prefix
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestDnsName(t *testing.T) {
+	tests := map[string]string{
+		"i-0123":                       "i-0123",
+		"Web_Server.prod":              "web-server-prod",
+		"--api  (EU)--":                "api-eu",
+		"!!!":                          "",
+		strings.Repeat("a", 62) + "-b": strings.Repeat("a", 62),
+	}
+	for name, expected := range tests {
+		if normalized := dnsName(name); normalized != expected {
+			t.Errorf("%q: expected %q, got %q", name, expected, normalized)
+		}
+	}
+}
+
+func TestEntityNameDns(t *testing.T) {
+	c := testConfig()
+	c.entityNameStyle = entityNameStyleDns
+
+	instance := testInstance("i-0123", "running")
+	entity := c.buildEntity(instance)
+	if entity.Name != "i-0123" {
+		t.Errorf("unexpected name %q", entity.Name)
+	}
+	if _, ok := entity.Annotations[originalNameAnnotation]; ok {
+		t.Error("unexpected original name annotation for a DNS-safe name")
+	}
+
+	instance = testInstance("I-0123", "running")
+	entity = c.buildEntity(instance)
+	if entity.Name != "i-0123-i-0123" || entity.Annotations[originalNameAnnotation] != "I-0123" {
+		t.Errorf("unexpected deduplicated name %q (%v)", entity.Name, entity.Annotations)
+	}
+
+	// The same instance keeps its name across lookups.
+	if name, _ := c.entityName(testInstance("i-0123", "running")); name != "i-0123" {
+		t.Errorf("unexpected name %q", name)
+	}
+	if name, original := c.entityName(instance); name != "i-0123-i-0123" || original != "I-0123" {
+		t.Errorf("unexpected name %q (%q)", name, original)
+	}
+
+	c.entityNameStyle = entityNameStyleRaw
+	if name, original := c.entityName(instance); name != "I-0123" || original != "" {
+		t.Errorf("unexpected raw name %q (%q)", name, original)
+	}
+}
+
+func TestEntityNameSourceNameTag(t *testing.T) {
+	c := testConfig()
+	c.entityNameSource = entityNameSourceNameTag
+	named := func(id string, name string) *discoveredInstance {
+		instance := testInstance(id, "running")
+		instance.Tags = []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}}
+		return instance
+	}
+
+	entity := c.buildEntity(named("i-0123", "Web Server #1"))
+	if entity.Name != "web-server-1" || entity.Labels[instanceIdLabel] != "i-0123" || entity.Annotations[originalNameAnnotation] != "Web Server #1" {
+		t.Errorf("unexpected entity %q (%v, %v)", entity.Name, entity.Labels, entity.Annotations)
+	}
+	if name, original := c.entityName(named("i-0456", "db_01.prod")); name != "db_01.prod" || original != "" {
+		t.Errorf("unexpected name %q (%q)", name, original)
+	}
+
+	// Another instance of the same name gets its instance ID appended.
+	if name, _ := c.entityName(named("i-0789", "web server 1")); name != "web-server-1-i-0789" {
+		t.Errorf("unexpected deduplicated name %q", name)
+	}
+
+	// Without a usable Name tag, the instance ID.
+	for _, instance := range []*discoveredInstance{testInstance("i-0abc", "running"), named("i-0def", " "), named("i-0fed", "###")} {
+		if name, _ := c.entityName(instance); name != aws.StringValue(instance.InstanceId) {
+			t.Errorf("expected the instance ID, got %q", name)
+		}
+	}
+
+	c.entityNameSource = "hostname"
+	if err := c.validateEntityNameSource(); err == nil {
+		t.Error("expected an invalid --entity-name-source to be rejected")
+	}
+}
+
+func TestEntityNameCollisionOrder(t *testing.T) {
+	named := func(id string) *discoveredInstance {
+		instance := testInstance(id, "running")
+		instance.Tags = []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("web")}}
+		return instance
+	}
+	names := func(ids ...string) map[string]string {
+		c := testConfig()
+		c.entityNameSource = entityNameSourceNameTag
+		c.outputFormat = "json"
+		c.workers = 4
+		run := c.newDiscoveryRun()
+		produce := func(emit func(*discoveredInstance) bool) error {
+			for _, id := range ids {
+				emit(named(id))
+			}
+			return nil
+		}
+		if err := c.streamReservingNames(context.Background(), run, produce, func() {}); err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]string)
+		for _, entity := range run.offlineEntities {
+			names[entity.Labels[instanceIdLabel]] = entity.Name
+		}
+		return names
+	}
+
+	// The lowest instance ID keeps the name whichever is processed first.
+	expected := map[string]string{"i-0123": "web", "i-0456": "web-i-0456", "i-0789": "web-i-0789"}
+	for _, ids := range [][]string{{"i-0123", "i-0456", "i-0789"}, {"i-0789", "i-0456", "i-0123"}} {
+		if got := names(ids...); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%v: expected %v, got %v", ids, expected, got)
+		}
+	}
+}
+
+func TestEntityNameTemplate(t *testing.T) {
+	c := testConfig()
+	c.entityNameTemplateText = "{{ .Region }}-{{ .Tag.Name }}"
+	if err := c.validateEntityNameSource(); err != nil {
+		t.Fatal(err)
+	}
+	instance := testInstance("i-0123", "running")
+	instance.Tags = []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("Web 1")}}
+	if name, original := c.entityName(instance); name != "us-west-2-web-1" || original != "us-west-2-Web 1" {
+		t.Errorf("unexpected name %q (%q)", name, original)
+	}
+
+	// A missing tag falls back to the instance ID.
+	if name, _ := c.entityName(testInstance("i-0456", "running")); name != "i-0456" {
+		t.Errorf("expected the instance ID for a missing tag, got %q", name)
+	}
+
+	c = testConfig()
+	c.entityNameTemplateText = "{{ .AccountID }}-{{ .InstanceID }}-{{ .PrivateIP }}"
+	if err := c.validateEntityNameSource(); err != nil {
+		t.Fatal(err)
+	}
+	instance = testInstance("i-0123", "running")
+	instance.Account = &awsAccount{Id: "123456789012"}
+	instance.PrivateIpAddress = aws.String("10.0.0.5")
+	if name, _ := c.entityName(instance); name != "123456789012-i-0123-10.0.0.5" {
+		t.Errorf("unexpected name %q", name)
+	}
+
+	for _, text := range []string{"{{ .Region", "{{ .Hostname }}"} {
+		c = testConfig()
+		c.entityNameTemplateText = text
+		if err := c.validateEntityNameSource(); err == nil || !strings.Contains(err.Error(), "--entity-name-template") {
+			t.Errorf("%q: expected an invalid --entity-name-template error, got %v", text, err)
+		}
+	}
+	c = testConfig()
+	c.entityNameTemplateText = "{{ .Tag.Name }}"
+	c.entityNameSource = entityNameSourceNameTag
+	if err := c.validateEntityNameSource(); err == nil {
+		t.Error("expected --entity-name-source name-tag and --entity-name-template to conflict")
+	}
+}
+
+func TestAccountPrefix(t *testing.T) {
+	c := testConfig()
+	var err error
+	if c.accountPrefixTemplate, err = parseInstanceTemplate("account-prefix-template", "{{ .AccountAlias | default .AccountId }}-"); err != nil {
+		t.Fatal(err)
+	}
+	instance := testInstance("i-0123", "running")
+	instance.Account = &awsAccount{Id: "123456789012", Alias: "prod"}
+
+	// A single account keeps unprefixed names.
+	if name, _ := c.entityName(instance); name != "i-0123" {
+		t.Errorf("unexpected single-account name %q", name)
+	}
+
+	c.awsAssumeRoleArns = "arn:aws:iam::123456789012:role/discovery,arn:aws:iam::210987654321:role/discovery"
+	if name, _ := c.entityName(instance); name != "prod-i-0123" {
+		t.Errorf("unexpected name %q", name)
+	}
+	other := testInstance("i-0123", "running")
+	other.Account = &awsAccount{Id: "210987654321"}
+	if name, _ := c.entityName(other); name != "210987654321-i-0123" {
+		t.Errorf("unexpected name without an alias %q", name)
+	}
+
+	// The prefix is rendered once per account.
+	instance.Account.Alias = "renamed"
+	if entity := c.buildEntity(instance); entity.Name != "prod-i-0123" || entity.Labels[instanceIdLabel] != "i-0123" {
+		t.Errorf("unexpected entity %s: %v", entity.Name, entity.Labels)
+	}
+
+	c.accountPrefixTemplate = nil
+	other.Account = &awsAccount{Id: "210987654321"}
+	if name, _ := c.entityName(other); name != "i-0123" {
+		t.Errorf("unexpected name without a prefix template %q", name)
+	}
+}
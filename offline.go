@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-go/types"
+)
+
+const (
+	outputFormatSensuctlYaml = "sensuctl-yaml"
+	outputFormatSensuctlJson = "sensuctl-json"
+)
+
+// validateOutputFormat rejects unknown formats, and the options that write to
+// the Sensu API, which offline mode never talks to.
+func (c *CheckConfig) validateOutputFormat() error {
+	switch c.outputFormat {
+	case "":
+		return nil
+	case outputFormatSensuctlYaml, outputFormatSensuctlJson:
+	default:
+		return fmt.Errorf("invalid --output-format \"%s\", expected %s or %s", c.outputFormat, outputFormatSensuctlYaml, outputFormatSensuctlJson)
+	}
+	if c.prune {
+		return fmt.Errorf("--prune cannot be used with --output-format")
+	}
+	if c.deleteOnStates != "" {
+		return fmt.Errorf("--delete-on-states cannot be used with --output-format")
+	}
+	if c.createProxyCheck {
+		return fmt.Errorf("--create-proxy-check cannot be used with --output-format")
+	}
+	return nil
+}
+
+// writeResourceDefinitions writes the entities as resource definitions for
+// `sensuctl create -f`, ordered by namespace and name. Timestamps that
+// change with every run are left out so the output is deterministic.
+func (c *CheckConfig) writeResourceDefinitions(w io.Writer, entities []*corev2.Entity) error {
+	sort.Slice(entities, func(i, j int) bool {
+		if entities[i].Namespace != entities[j].Namespace {
+			return entities[i].Namespace < entities[j].Namespace
+		}
+		return entities[i].Name < entities[j].Name
+	})
+	for i, entity := range entities {
+		delete(entity.Annotations, lastSeenAnnotation)
+		b, err := json.Marshal(types.WrapResource(entity))
+		if err != nil {
+			return err
+		}
+		if c.outputFormat == outputFormatSensuctlJson {
+			fmt.Fprintf(w, "%s\n", b)
+			continue
+		}
+		b, err = yaml.JSONToYAML(b)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintf(w, "---\n")
+		}
+		fmt.Fprintf(w, "%s", b)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestWriteResourceDefinitions(t *testing.T) {
+	c := testConfig()
+	entities := func() []*corev2.Entity {
+		a := testEntity("i-b", "proxy", map[string]string{"env": "prod"})
+		a.Annotations = map[string]string{lastSeenAnnotation: "2020-02-10T12:00:00Z"}
+		b := testEntity("i-a", "proxy", map[string]string{"env": "dev"})
+		return []*corev2.Entity{a, b}
+	}
+
+	c.outputFormat = outputFormatSensuctlYaml
+	var first, second bytes.Buffer
+	if err := c.writeResourceDefinitions(&first, entities()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeResourceDefinitions(&second, entities()); err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("output is not deterministic:\n%s\n%s", first.String(), second.String())
+	}
+	documents := bytes.Split(first.Bytes(), []byte("---\n"))
+	if len(documents) != 2 {
+		t.Fatalf("expected 2 YAML documents:\n%s", first.String())
+	}
+	for _, expected := range []string{"type: Entity\n", "api_version: core/v2\n", "  name: i-a\n", "  entity_class: proxy\n"} {
+		if !bytes.Contains(documents[0], []byte(expected)) {
+			t.Errorf("first document is missing %q:\n%s", expected, documents[0])
+		}
+	}
+	if bytes.Contains(first.Bytes(), []byte(lastSeenAnnotation)) {
+		t.Errorf("output includes the last-seen timestamp:\n%s", first.String())
+	}
+
+	c.outputFormat = outputFormatSensuctlJson
+	var output bytes.Buffer
+	if err := c.writeResourceDefinitions(&output, entities()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(output.Bytes(), []byte("\n")); lines != 2 {
+		t.Errorf("expected one JSON resource per line:\n%s", output.String())
+	}
+}
+
+func TestValidateOutputFormat(t *testing.T) {
+	c := testConfig()
+	c.outputFormat = "yaml"
+	if err := c.validateOutputFormat(); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	c.outputFormat = outputFormatSensuctlYaml
+	c.prune = true
+	if err := c.validateOutputFormat(); err == nil {
+		t.Error("expected --prune to be rejected in offline mode")
+	}
+}
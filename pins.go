@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// parseCertPins parses the comma-separated SHA-256 fingerprints of
+// --sensu-pinned-cert-sha256, each in hex, colons allowed, or base64.
+func parseCertPins(list string) ([][]byte, error) {
+	var pins [][]byte
+	for _, item := range splitList(list) {
+		pin, err := parseCertPin(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --sensu-pinned-cert-sha256 fingerprint \"%s\": %s", item, err)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+func parseCertPin(item string) ([]byte, error) {
+	if pin, err := hex.DecodeString(strings.Replace(item, ":", "", -1)); err == nil {
+		if len(pin) != sha256.Size {
+			return nil, fmt.Errorf("expected %d bytes, got %d", sha256.Size, len(pin))
+		}
+		return pin, nil
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if pin, err := encoding.DecodeString(item); err == nil {
+			if len(pin) != sha256.Size {
+				return nil, fmt.Errorf("expected %d bytes, got %d", sha256.Size, len(pin))
+			}
+			return pin, nil
+		}
+	}
+	return nil, fmt.Errorf("neither hex nor base64")
+}
+
+// certPinned tells whether the fingerprint of a certificate, or of its
+// public key, is among the pins.
+func certPinned(cert *x509.Certificate, pins [][]byte) bool {
+	certSum := sha256.Sum256(cert.Raw)
+	keySum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(pin, certSum[:]) || bytes.Equal(pin, keySum[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPinnedCert checks the certificate the Sensu API presents against
+// --sensu-pinned-cert-sha256: the leaf, or with --sensu-pin-chain a
+// certificate of the chain it was verified through, must be pinned. It
+// fails closed, naming the fingerprints presented so that a rotation can be
+// told from an attack.
+func (c *CheckConfig) verifyPinnedCert(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("the Sensu API presented no certificate to check against --sensu-pinned-cert-sha256")
+	}
+	var presented []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse the Sensu API certificate: %s", err)
+		}
+		presented = append(presented, cert)
+	}
+	leaf := presented[0]
+	if certPinned(leaf, c.sensuCertPins) {
+		return nil
+	}
+	if c.sensuPinChain {
+		// Any certificate can be presented along with the leaf, only those
+		// it is signed through count.
+		if len(verifiedChains) > 0 {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain[1:] {
+					if certPinned(cert, c.sensuCertPins) {
+						return nil
+					}
+				}
+			}
+		} else if signedByPinnedCert(presented, c.sensuCertPins) {
+			return nil
+		}
+	}
+	certSum := sha256.Sum256(leaf.Raw)
+	keySum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return fmt.Errorf("the Sensu API certificate matches no --sensu-pinned-cert-sha256 fingerprint: presented certificate sha256 %s, public key sha256 %s (%s)",
+		hex.EncodeToString(certSum[:]), hex.EncodeToString(keySum[:]), leaf.Subject)
+}
+
+// signedByPinnedCert tells whether the presented chain, not verified
+// against CAs with --sensu-pin-only, is signed from the leaf up to a pinned
+// certificate, each certificate by the next.
+func signedByPinnedCert(presented []*x509.Certificate, pins [][]byte) bool {
+	for i := 1; i < len(presented); i++ {
+		if presented[i-1].CheckSignatureFrom(presented[i]) != nil {
+			return false
+		}
+		if certPinned(presented[i], pins) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCertPins(t *testing.T) {
+	sum := sha256.Sum256([]byte("certificate"))
+	hexSum := hex.EncodeToString(sum[:])
+	list := hexSum + ", " + strings.ToUpper(hexSum[:2]+":"+hexSum[2:4]+":"+hexSum[4:]) + "," + base64.StdEncoding.EncodeToString(sum[:]) + "," + base64.RawURLEncoding.EncodeToString(sum[:])
+	pins, err := parseCertPins(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 4 {
+		t.Fatalf("unexpected pins %x", pins)
+	}
+	for _, pin := range pins {
+		if string(pin) != string(sum[:]) {
+			t.Errorf("unexpected pin %x", pin)
+		}
+	}
+
+	for _, invalid := range []string{"abcd", "not a fingerprint", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := parseCertPins(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestSensuPinnedCert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	certSum := sha256.Sum256(server.Certificate().Raw)
+	keySum := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	otherSum := sha256.Sum256([]byte("another certificate"))
+
+	for _, test := range []struct {
+		name    string
+		pins    string
+		pinOnly bool
+		problem string
+	}{
+		{"certificate pin", hex.EncodeToString(certSum[:]), true, ""},
+		{"public key pin", base64.StdEncoding.EncodeToString(keySum[:]), true, ""},
+		{"rotated pins", hex.EncodeToString(otherSum[:]) + "," + hex.EncodeToString(keySum[:]), true, ""},
+		{"pin mismatch", hex.EncodeToString(otherSum[:]), true, "presented certificate sha256 " + hex.EncodeToString(certSum[:])},
+		// A pin does not replace the CA verification unless --sensu-pin-only.
+		{"untrusted CA", hex.EncodeToString(certSum[:]), false, "certificate"},
+	} {
+		c := testConfig()
+		c.sensuApiUrl = server.URL
+		c.sensuPinnedCertSha256 = test.pins
+		c.sensuPinOnly = test.pinOnly
+		if err := c.validateSensuCredentials(); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if test.problem == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)) {
+			t.Errorf("%s: expected an error about %q, got %v", test.name, test.problem, err)
+		}
+	}
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuPinOnly = true
+	if err := c.validateSensuCredentials(); err == nil {
+		t.Error("expected an error for --sensu-pin-only without pins")
+	}
+}
+
+// testCert issues a certificate, a CA if no IP is given, signed by parent
+// or self-signed.
+func testCert(t *testing.T, serial int64, ip net.IP, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(serial), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), BasicConstraintsValid: true}
+	if ip == nil {
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.IPAddresses = []net.IP{ip}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestSensuPinnedChain(t *testing.T) {
+	localhost := net.ParseIP("127.0.0.1")
+	pinnedCa, pinnedKey := testCert(t, 1, nil, nil, nil)
+	otherCa, otherKey := testCert(t, 2, nil, nil, nil)
+	issued, issuedKey := testCert(t, 3, localhost, pinnedCa, pinnedKey)
+	otherIssued, otherIssuedKey := testCert(t, 4, localhost, otherCa, otherKey)
+	selfSigned, selfSignedKey := testCert(t, 5, localhost, nil, nil)
+
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	cas := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pinnedCa.Raw}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCa.Raw})...)
+	if err := ioutil.WriteFile(caFile, cas, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pinSum := sha256.Sum256(pinnedCa.Raw)
+
+	for _, test := range []struct {
+		name    string
+		leaf    *x509.Certificate
+		key     *ecdsa.PrivateKey
+		pinOnly bool
+		trusted bool
+	}{
+		{"issued by the pinned CA", issued, issuedKey, false, true},
+		{"issued by the pinned CA, pin only", issued, issuedKey, true, true},
+		// The pinned CA is presented along with a leaf it did not sign.
+		{"issued by another CA", otherIssued, otherIssuedKey, false, false},
+		{"self-signed, pin only", selfSigned, selfSignedKey, true, false},
+	} {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{test.leaf.Raw, pinnedCa.Raw}, PrivateKey: test.key}}}
+		server.StartTLS()
+
+		c := testConfig()
+		c.sensuApiUrl = server.URL
+		c.sensuTrustedCaFile = caFile
+		c.sensuPinnedCertSha256 = hex.EncodeToString(pinSum[:])
+		c.sensuPinChain = true
+		c.sensuPinOnly = test.pinOnly
+		if err := c.validateSensuCredentials(); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if test.trusted && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if !test.trusted && (err == nil || !strings.Contains(err.Error(), "matches no --sensu-pinned-cert-sha256")) {
+			t.Errorf("%s: expected the certificate to be rejected, got %v", test.name, err)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// discoveryRun collects what the registration workers of a run did.
+type discoveryRun struct {
+	sync.Mutex
+	summary         *runSummary
+	discovered      map[string]bool
+	namespaces      map[string]bool
+	offlineEntities []*corev2.Entity
+	accountIds      []string
+}
+
+func (c *CheckConfig) newDiscoveryRun() *discoveryRun {
+	return &discoveryRun{
+		summary:    newRunSummary(),
+		discovered: make(map[string]bool),
+		namespaces: map[string]bool{c.sensuNamespace: true},
+	}
+}
+
+// scannedRegions returns the regions the run described the instances of.
+func (run *discoveryRun) scannedRegions() map[string]bool {
+	run.Lock()
+	defer run.Unlock()
+	regions := make(map[string]bool)
+	for region := range run.summary.regions {
+		regions[region] = true
+	}
+	return regions
+}
+
+// streamInstances hands the instances produced to --workers workers through
+// a bounded channel as each page of results arrives, so that only a page and
+// the instances in the channel are held in memory at once. It stops early,
+// and reports the run as interrupted, once stopping is done.
+func (c *CheckConfig) streamInstances(stopping context.Context, run *discoveryRun, produce func(emit func(*discoveredInstance) bool) error, handle func(*discoveredInstance)) error {
+	workers := c.workers
+	if workers == 0 {
+		workers = 1
+	}
+	instances := make(chan *discoveredInstance, workers)
+	var wg sync.WaitGroup
+	for i := uint64(0); i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for instance := range instances {
+				handle(instance)
+			}
+		}()
+	}
+
+	err := produce(func(instance *discoveredInstance) bool {
+		if stopping.Err() != nil {
+			return false
+		}
+		select {
+		case instances <- instance:
+			return true
+		case <-stopping.Done():
+			return false
+		}
+	})
+	close(instances)
+	wg.Wait()
+
+	if stopping.Err() != nil {
+		run.summary.interrupted = true
+	}
+	return err
+}
+
+// produceInstances describes the instances of every account and region. A
+// region failing to be described is recorded in the summary and the others
+// carry on, unless every region fails.
+func (c *CheckConfig) produceInstances(run *discoveryRun, regions []string, emit func(*discoveredInstance) bool) error {
+	attempted, failed := 0, 0
+	var lastErr error
+	for _, account := range c.awsAccounts() {
+		if err := c.resolveAccount(account); err != nil {
+			return err
+		}
+		if account.Id != "" {
+			run.Lock()
+			run.accountIds = append(run.accountIds, account.Id)
+			run.Unlock()
+		}
+		for _, region := range regions {
+			awsSession, err := c.newAwsSession(region, account)
+			if err != nil {
+				return err
+			}
+			run.Lock()
+			run.summary.regions[region] += 0
+			run.Unlock()
+			attempted++
+			c.forgetAwsRequestId(region)
+			svc := ec2.New(awsSession)
+			stopped, err := c.describeRegion(c.requestContext(), svc, awsSession, account, region, emit)
+			if err != nil {
+				lastErr = classifyAwsError(err, "ec2:DescribeInstances", region)
+				if diagnosis := c.diagnoseFilters(c.requestContext(), svc, c.ec2Filters, err); diagnosis != "" {
+					lastErr = fmt.Errorf("%w; %s", lastErr, diagnosis)
+				}
+				if requestId := c.lastAwsRequestId(region); requestId != "" {
+					lastErr = fmt.Errorf("%w (last AWS request ID %s)", lastErr, requestId)
+				}
+				log.Printf("ERROR: failed to describe instances in region %s: %s", region, lastErr)
+				c.recordError(err, fmt.Sprintf("region %s: %s", region, lastErr))
+				run.Lock()
+				run.summary.regionFailures = append(run.summary.regionFailures, fmt.Sprintf("region %s: %s", region, lastErr))
+				run.summary.failedRegions[region] = true
+				if isThrottled(err) {
+					run.summary.throttled++
+				}
+				run.Unlock()
+				failed++
+				continue
+			}
+			if stopped {
+				return nil
+			}
+		}
+	}
+	if attempted > 0 && failed == attempted {
+		return lastErr
+	}
+	return nil
+}
+
+// regionTimeoutError is a region failed by --region-timeout.
+type regionTimeoutError struct {
+	timeout time.Duration
+	kept    int
+}
+
+func (e *regionTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s, %d instances kept", e.timeout, e.kept)
+}
+
+// describeRegion describes the instances of a region within
+// --region-timeout, if set. The region only times out while ctx is not done,
+// so whichever of the two comes first applies. Unless --keep-partial-regions
+// is set, the instances of the region are held until all of its pages are
+// received, and discarded if it times out.
+func (c *CheckConfig) describeRegion(ctx context.Context, svc ec2iface.EC2API, awsSession *session.Session, account *awsAccount, region string, emit func(*discoveredInstance) bool) (bool, error) {
+	if c.regionTimeoutDuration == 0 {
+		return c.describeInstances(ctx, svc, awsSession, account, region, emit)
+	}
+	regionCtx, cancel := context.WithTimeout(ctx, c.regionTimeoutDuration)
+	defer cancel()
+	kept := 0
+	var held []*discoveredInstance
+	stopped, err := c.describeInstances(regionCtx, svc, awsSession, account, region, func(instance *discoveredInstance) bool {
+		if !c.keepPartialRegions {
+			held = append(held, instance)
+			return true
+		}
+		kept++
+		return emit(instance)
+	})
+	if regionCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return stopped, &regionTimeoutError{timeout: c.regionTimeoutDuration, kept: kept}
+	}
+	if err != nil || stopped {
+		return stopped, err
+	}
+	for _, instance := range held {
+		if !emit(instance) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// describeInstances pages through the instances of a region, emitting each
+// page as soon as it arrives. It returns whether emit asked to stop.
+func (c *CheckConfig) describeInstances(ctx context.Context, svc ec2iface.EC2API, awsSession *session.Session, account *awsAccount, region string, emit func(*discoveredInstance) bool) (bool, error) {
+	ids := c.instanceIdsFor(region)
+	if c.instancesFromStdin && len(ids) == 0 {
+		return false, nil
+	}
+	stopped := false
+	pricingSvc := c.pricingClient(awsSession, region)
+	launchTemplates, err := c.resolveLaunchTemplateNames(ctx, svc, region)
+	if err != nil {
+		return false, err
+	}
+	handle := func(page *ec2.DescribeInstancesOutput) bool {
+		var instances []*discoveredInstance
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				instances = append(instances, &discoveredInstance{
+					Instance:           instance,
+					Account:            account,
+					Region:             region,
+					OwnerId:            aws.StringValue(reservation.OwnerId),
+					RequesterId:        aws.StringValue(reservation.RequesterId),
+					LaunchTemplateName: launchTemplates[instanceTag(instance, launchTemplateIdTag)],
+				})
+			}
+		}
+		if c.resolveHostnames {
+			c.resolveInstanceHostnames(ctx, awsSession, instances)
+		}
+		c.resolveInstanceProtection(ctx, svc, region, instances, time.Now())
+		c.resolveInstanceVolumes(ctx, svc, region, instances)
+		c.resolveInstanceImages(ctx, svc, region, instances, time.Now())
+		c.resolveInstancePricing(ctx, pricingSvc, region, instances)
+		for _, instance := range instances {
+			if !emit(instance) {
+				stopped = true
+				return false
+			}
+		}
+		return true
+	}
+	for _, input := range c.describeInputs(ids) {
+		var err error
+		if c.shardBy == shardByAz {
+			err = c.describeShardedPages(ctx, svc, region, input, handle)
+		} else {
+			err = c.describeInstancePages(ctx, svc, region, input, handle)
+		}
+		if err != nil || stopped {
+			return stopped, err
+		}
+	}
+	return false, nil
+}
+
+// describeInstancePages hands each page of a DescribeInstances query to
+// handle as it arrives, until handle returns false.
+func (c *CheckConfig) describeInstancePages(ctx context.Context, svc ec2iface.EC2API, region string, input *ec2.DescribeInstancesInput, handle func(*ec2.DescribeInstancesOutput) bool) error {
+	phase := "describe " + region
+	requested := time.Now()
+	return svc.DescribeInstancesPagesWithContext(ctx, input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		// Only the time waiting for pages counts, not their processing.
+		c.timings.since(phase, requested)
+		defer func() { requested = time.Now() }()
+		return handle(page)
+	})
+}
+
+// processInstance registers, deletes or, in offline mode, collects the
+// entity of a discovered instance, unless it is excluded or rejected by
+// --ec2-tag-regex, the launch template selectors or --filter-expression.
+func (c *CheckConfig) processInstance(run *discoveryRun, instance *discoveredInstance) {
+	if c.selectInstance(run, instance) {
+		c.writeInstance(run, instance)
+	}
+}
+
+// streamReservingNames streams the instances like streamInstances, but
+// writes none of them until every instance is selected and their entity
+// names are reserved, so that a derived name several instances share goes
+// to the same instance whatever order the workers take them in.
+func (c *CheckConfig) streamReservingNames(stopping context.Context, run *discoveryRun, produce func(emit func(*discoveredInstance) bool) error, done func()) error {
+	var selected []*discoveredInstance
+	err := c.streamInstances(stopping, run, produce, func(instance *discoveredInstance) {
+		if !c.selectInstance(run, instance) {
+			done()
+			return
+		}
+		run.Lock()
+		selected = append(selected, instance)
+		run.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+	c.reserveEntityNames(selected)
+	emitSelected := func(emit func(*discoveredInstance) bool) error {
+		for _, instance := range selected {
+			if !emit(instance) {
+				break
+			}
+		}
+		return nil
+	}
+	return c.streamInstances(stopping, run, emitSelected, func(instance *discoveredInstance) {
+		c.writeInstance(run, instance)
+		done()
+	})
+}
+
+// selectInstance counts an instance examined and reports whether it is
+// discovered, that is neither in another shard, excluded nor rejected.
+func (c *CheckConfig) selectInstance(run *discoveryRun, instance *discoveredInstance) bool {
+	run.Lock()
+	run.summary.examined[instance.Region]++
+	run.Unlock()
+	if !c.inShard(*instance.InstanceId) {
+		run.Lock()
+		run.summary.otherShards++
+		run.Unlock()
+		return false
+	}
+	if c.excludedInstanceIds[*instance.InstanceId] {
+		c.logDebug("skipping excluded instance \"%s\"", *instance.InstanceId)
+		run.Lock()
+		run.summary.excluded++
+		run.Unlock()
+		return false
+	}
+	if rejecting := c.rejectingTagRegexFilters(instance.Instance); len(rejecting) > 0 {
+		c.logDebug("skipping instance \"%s\" not matching --ec2-tag-regex %s", *instance.InstanceId, rejecting[0])
+		run.Lock()
+		for _, filter := range rejecting {
+			run.summary.tagRegexRejected[filter.String()]++
+		}
+		run.Unlock()
+		return false
+	}
+	if c.rejectingLaunchTemplate(instance) {
+		c.logDebug("skipping instance \"%s\" not launched from a selected launch template", *instance.InstanceId)
+		run.Lock()
+		run.summary.launchTemplateRejected++
+		run.Unlock()
+		return false
+	}
+	if c.filterExpression != nil {
+		matched, err := c.filterExpression.matches(instance, time.Now())
+		if err != nil {
+			log.Printf("WARNING: skipping instance \"%s\", --filter-expression failed: %s", *instance.InstanceId, err)
+		} else if !matched {
+			c.logDebug("skipping instance \"%s\" not matching --filter-expression", *instance.InstanceId)
+		}
+		if err != nil || !matched {
+			run.Lock()
+			if err != nil {
+				run.summary.filterExpressionErrors++
+			} else {
+				run.summary.filterExpressionRejected++
+			}
+			run.Unlock()
+			return false
+		}
+	}
+	run.Lock()
+	run.summary.discovered++
+	run.summary.regions[instance.Region]++
+	run.discovered[*instance.InstanceId] = true
+	run.Unlock()
+	return true
+}
+
+// writeInstance registers, deletes or, in offline mode, collects the entity
+// of a selected instance.
+func (c *CheckConfig) writeInstance(run *discoveryRun, instance *discoveredInstance) {
+	if c.outputFormat != "" {
+		entity := c.buildEntity(instance)
+		run.Lock()
+		run.offlineEntities = append(run.offlineEntities, entity)
+		run.Unlock()
+		return
+	}
+	if instance.State != nil && c.deleteOnStateSet[aws.StringValue(instance.State.Name)] && !c.keepsHibernatedInstance(instance.Instance) {
+		outcome := c.deleteInstanceEntity(instance)
+		run.Lock()
+		switch outcome {
+		case outcomeDeleted:
+			run.summary.deletedDueToState++
+		case outcomeIgnored:
+			run.summary.ignored++
+		}
+		run.Unlock()
+		return
+	}
+
+	namespace := c.instanceNamespace(instance)
+	start := time.Now()
+	result := c.registerInstance(instance)
+	c.timings.since("registration", start)
+	result.InstanceId = *instance.InstanceId
+	run.Lock()
+	run.namespaces[namespace] = true
+	run.summary.accountNamespaces[accountNamespaceCount{account: instance.Account.Id, namespace: namespace}]++
+	run.summary.add(result)
+	run.Unlock()
+}
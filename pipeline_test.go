@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeInstancePages generates total instances, pageSize per page, counting
+// the instances generated but not yet handled in live.
+type fakeInstancePages struct {
+	ec2iface.EC2API
+	total    int
+	pageSize int
+	live     *int64
+}
+
+func (f *fakeInstancePages) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	for start := 0; start < f.total; start += f.pageSize {
+		reservation := &ec2.Reservation{}
+		for i := start; i < start+f.pageSize && i < f.total; i++ {
+			reservation.Instances = append(reservation.Instances, &ec2.Instance{InstanceId: aws.String(fmt.Sprintf("i-%08d", i))})
+			atomic.AddInt64(f.live, 1)
+		}
+		page := &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}
+		if !fn(page, start+f.pageSize >= f.total) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestStreamInstancesSoak(t *testing.T) {
+	const total, pageSize = 100000, 1000
+	c := testConfig()
+	c.workers = 8
+	run := c.newDiscoveryRun()
+	var live, maxLive, handled int64
+	svc := &fakeInstancePages{total: total, pageSize: pageSize, live: &live}
+
+	produce := func(emit func(*discoveredInstance) bool) error {
+		_, err := c.describeInstances(context.Background(), svc, nil, &awsAccount{}, "us-east-1", emit)
+		return err
+	}
+	handle := func(instance *discoveredInstance) {
+		current := atomic.LoadInt64(&live)
+		for {
+			max := atomic.LoadInt64(&maxLive)
+			if current <= max || atomic.CompareAndSwapInt64(&maxLive, max, current) {
+				break
+			}
+		}
+		atomic.AddInt64(&handled, 1)
+		atomic.AddInt64(&live, -1)
+	}
+	if err := c.streamInstances(context.Background(), run, produce, handle); err != nil {
+		t.Fatal(err)
+	}
+
+	if handled != total {
+		t.Errorf("handled %d instances, expected %d", handled, total)
+	}
+	// At most a page, the channel buffer and an instance per worker are
+	// held at once.
+	if bound := int64(pageSize + 2*c.workers); maxLive > bound {
+		t.Errorf("%d instances held at once, expected at most %d", maxLive, bound)
+	}
+}
+
+func TestDescribeInstancesPaginates(t *testing.T) {
+	c := testConfig()
+	c.workers = 2
+	c.outputFormat = "json"
+	c.ec2MaxResults = 5
+	run := c.newDiscoveryRun()
+	var live int64
+	svc := &fakePagesMaxResults{fakeInstancePages: fakeInstancePages{total: 12, pageSize: 5, live: &live}}
+
+	produce := func(emit func(*discoveredInstance) bool) error {
+		_, err := c.describeInstances(context.Background(), svc, nil, &awsAccount{}, "us-east-1", emit)
+		return err
+	}
+	handle := func(instance *discoveredInstance) {
+		c.processInstance(run, instance)
+	}
+	if err := c.streamInstances(context.Background(), run, produce, handle); err != nil {
+		t.Fatal(err)
+	}
+	if svc.maxResults != 5 {
+		t.Errorf("unexpected MaxResults %d", svc.maxResults)
+	}
+	if len(run.offlineEntities) != 12 {
+		t.Errorf("%d instances of the 3 pages discovered", len(run.offlineEntities))
+	}
+	var summary bytes.Buffer
+	run.summary.printRegions(&summary)
+	if summary.String() != "region us-east-1: 12 instances examined, 12 discovered\n" {
+		t.Errorf("unexpected summary %q", summary.String())
+	}
+}
+
+// fakePagesMaxResults records the MaxResults of the request.
+type fakePagesMaxResults struct {
+	fakeInstancePages
+	maxResults int64
+}
+
+func (f *fakePagesMaxResults) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	f.maxResults = aws.Int64Value(input.MaxResults)
+	return f.fakeInstancePages.DescribeInstancesPagesWithContext(ctx, input, fn, opts...)
+}
+
+func TestStreamInstancesStops(t *testing.T) {
+	c := testConfig()
+	c.workers = 2
+	run := c.newDiscoveryRun()
+	stopping, stop := context.WithCancel(context.Background())
+	var live, handled int64
+	svc := &fakeInstancePages{total: 1000, pageSize: 100, live: &live}
+
+	produce := func(emit func(*discoveredInstance) bool) error {
+		_, err := c.describeInstances(context.Background(), svc, nil, &awsAccount{}, "us-east-1", emit)
+		return err
+	}
+	handle := func(instance *discoveredInstance) {
+		if atomic.AddInt64(&handled, 1) == 10 {
+			stop()
+		}
+	}
+	if err := c.streamInstances(stopping, run, produce, handle); err != nil {
+		t.Fatal(err)
+	}
+	if !run.summary.interrupted || handled >= 1000 {
+		t.Errorf("discovery did not stop: %d instances handled", handled)
+	}
+}
+
+// fakeSlowRegion returns a page of instances, then blocks until the request
+// context is done.
+type fakeSlowRegion struct {
+	ec2iface.EC2API
+}
+
+func (f *fakeSlowRegion) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	page := &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{
+		{InstanceId: aws.String("i-0123")},
+		{InstanceId: aws.String("i-0456")},
+	}}}}
+	if !fn(page, false) {
+		return nil
+	}
+	<-ctx.Done()
+	return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+}
+
+func TestDescribeRegionTimeout(t *testing.T) {
+	cases := []struct {
+		name          string
+		regionTimeout time.Duration
+		globalTimeout time.Duration
+		keepPartial   bool
+		timedOut      bool
+		emitted       int
+	}{
+		{"region timeout first", 20 * time.Millisecond, time.Minute, false, true, 0},
+		{"region timeout first, keeping partial results", 20 * time.Millisecond, time.Minute, true, true, 2},
+		{"global timeout first", time.Minute, 20 * time.Millisecond, false, false, 0},
+		{"global timeout first, keeping partial results", time.Minute, 20 * time.Millisecond, true, false, 2},
+	}
+	for _, tc := range cases {
+		c := testConfig()
+		c.regionTimeoutDuration = tc.regionTimeout
+		c.keepPartialRegions = tc.keepPartial
+		ctx, cancel := context.WithTimeout(context.Background(), tc.globalTimeout)
+		emitted := 0
+		_, err := c.describeRegion(ctx, &fakeSlowRegion{}, nil, &awsAccount{}, "us-east-1", func(instance *discoveredInstance) bool {
+			emitted++
+			return true
+		})
+		cancel()
+
+		var timeout *regionTimeoutError
+		if timedOut := errors.As(err, &timeout); timedOut != tc.timedOut || err == nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if timeout != nil && timeout.kept != tc.emitted {
+			t.Errorf("%s: %d instances reported kept, expected %d", tc.name, timeout.kept, tc.emitted)
+		}
+		if emitted != tc.emitted {
+			t.Errorf("%s: %d instances emitted, expected %d", tc.name, emitted, tc.emitted)
+		}
+	}
+}
+
+func TestDescribeRegionWithinTimeout(t *testing.T) {
+	c := testConfig()
+	c.regionTimeoutDuration = time.Minute
+	var live int64
+	svc := &fakeInstancePages{total: 250, pageSize: 100, live: &live}
+	emitted := 0
+	stopped, err := c.describeRegion(context.Background(), svc, nil, &awsAccount{}, "us-east-1", func(instance *discoveredInstance) bool {
+		emitted++
+		return true
+	})
+	if err != nil || stopped || emitted != 250 {
+		t.Errorf("unexpected result: %d instances emitted, stopped %t, error %v", emitted, stopped, err)
+	}
+}
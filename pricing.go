@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/pricing"
+	"github.com/aws/aws-sdk-go/service/pricing/pricingiface"
+)
+
+// onDemandPriceAnnotation is the on-demand hourly price, in USD, of the
+// instance type of an entity, with --annotate-pricing.
+const onDemandPriceAnnotation = "aws_on_demand_usd_per_hour"
+
+const (
+	// pricingRegion is where the Pricing API lives in the aws partition,
+	// the only one it prices.
+	pricingRegion    = "us-east-1"
+	pricingPartition = "aws"
+
+	// pricingLookupTimeout bounds each price lookup, so that a slow
+	// Pricing API never holds discovery up for long.
+	pricingLookupTimeout = 10 * time.Second
+)
+
+// priceLookup is the price of an (instance type, region, OS) combination,
+// looked up once per run.
+type priceLookup struct {
+	once  sync.Once
+	price string
+}
+
+// pricingCache holds the prices looked up during the run. Once a lookup
+// fails, the others are skipped, since a missing permission or an
+// unreachable API fails them all alike.
+type pricingCache struct {
+	sync.Mutex
+	prices   map[string]*priceLookup
+	disabled bool
+	lookups  int
+	failed   int
+}
+
+func newPricingCache() *pricingCache {
+	return &pricingCache{prices: make(map[string]*priceLookup)}
+}
+
+// pricingClient returns the Pricing API client for the instances of a
+// region, nil when its partition is not priced.
+func (c *CheckConfig) pricingClient(awsSession *session.Session, region string) pricingiface.PricingAPI {
+	if c.pricing == nil || awsSession == nil {
+		return nil
+	}
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok || partition.ID() != pricingPartition {
+		c.logDebug("not annotating the prices of the instances in %s, the Pricing API does not cover its partition", region)
+		return nil
+	}
+	return pricing.New(awsSession, aws.NewConfig().WithRegion(pricingRegion))
+}
+
+// pricingOperatingSystem returns the Pricing API operatingSystem and
+// licenseModel of an instance.
+func pricingOperatingSystem(instance *discoveredInstance) (string, string) {
+	if instancePlatform(instance.Instance) == "windows" {
+		return "Windows", "License included"
+	}
+	return "Linux", "No License required"
+}
+
+// resolveInstancePricing sets the on-demand price of the instances of a
+// region page. Lookups that fail leave the price unset.
+func (c *CheckConfig) resolveInstancePricing(ctx context.Context, svc pricingiface.PricingAPI, region string, instances []*discoveredInstance) {
+	if c.pricing == nil || svc == nil || len(instances) == 0 {
+		return
+	}
+	defer c.timings.since("enrichment", time.Now())
+	for _, instance := range instances {
+		instanceType := aws.StringValue(instance.InstanceType)
+		if instanceType == "" {
+			continue
+		}
+		system, license := pricingOperatingSystem(instance)
+		key := instanceType + " " + region + " " + system
+		c.pricing.Lock()
+		lookup, ok := c.pricing.prices[key]
+		if !ok {
+			lookup = &priceLookup{}
+			c.pricing.prices[key] = lookup
+		}
+		c.pricing.Unlock()
+		lookup.once.Do(func() {
+			lookup.price = c.lookUpPrice(ctx, svc, instanceType, region, system, license)
+		})
+		instance.OnDemandPrice = lookup.price
+	}
+}
+
+func (c *CheckConfig) lookUpPrice(ctx context.Context, svc pricingiface.PricingAPI, instanceType string, region string, system string, license string) string {
+	c.pricing.Lock()
+	if c.pricing.disabled {
+		c.pricing.Unlock()
+		return ""
+	}
+	c.pricing.lookups++
+	c.pricing.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, pricingLookupTimeout)
+	defer cancel()
+	var filters []*pricing.Filter
+	for _, filter := range [][2]string{
+		{"instanceType", instanceType},
+		{"regionCode", region},
+		{"operatingSystem", system},
+		{"licenseModel", license},
+		{"tenancy", "Shared"},
+		{"preInstalledSw", "NA"},
+		{"capacitystatus", "Used"},
+	} {
+		filters = append(filters, &pricing.Filter{Type: aws.String(pricing.FilterTypeTermMatch), Field: aws.String(filter[0]), Value: aws.String(filter[1])})
+	}
+	output, err := svc.GetProductsWithContext(ctx, &pricing.GetProductsInput{
+		ServiceCode:   aws.String("AmazonEC2"),
+		FormatVersion: aws.String("aws_v1"),
+		Filters:       filters,
+	})
+	if err == nil {
+		var price string
+		if price, err = onDemandPrice(output.PriceList); err == nil {
+			return price
+		}
+	}
+	c.pricing.Lock()
+	c.pricing.failed++
+	c.pricing.disabled = true
+	c.pricing.Unlock()
+	log.Printf("WARNING: failed to look up the on-demand price of %s %s instances in %s, skipping the price annotations for the rest of the run: %s",
+		system, instanceType, region, classifyAwsError(err, "pricing:GetProducts", pricingRegion))
+	return ""
+}
+
+// onDemandPrice returns the hourly on-demand USD price of the first
+// product of a price list.
+func onDemandPrice(priceList []aws.JSONValue) (string, error) {
+	for _, product := range priceList {
+		terms, _ := product["terms"].(map[string]interface{})
+		onDemand, _ := terms["OnDemand"].(map[string]interface{})
+		for _, term := range onDemand {
+			term, _ := term.(map[string]interface{})
+			dimensions, _ := term["priceDimensions"].(map[string]interface{})
+			for _, dimension := range dimensions {
+				dimension, _ := dimension.(map[string]interface{})
+				perUnit, _ := dimension["pricePerUnit"].(map[string]interface{})
+				usd, _ := perUnit["USD"].(string)
+				value, err := strconv.ParseFloat(usd, 64)
+				if err != nil {
+					continue
+				}
+				return strconv.FormatFloat(value, 'f', -1, 64), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no on-demand USD price among %d products", len(priceList))
+}
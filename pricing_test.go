@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/pricing"
+	"github.com/aws/aws-sdk-go/service/pricing/pricingiface"
+)
+
+// fakePricing answers GetProducts with the prices of the instance types,
+// failing for the others.
+type fakePricing struct {
+	pricingiface.PricingAPI
+	prices map[string]string
+	calls  []string
+}
+
+func (f *fakePricing) GetProductsWithContext(ctx aws.Context, input *pricing.GetProductsInput, opts ...request.Option) (*pricing.GetProductsOutput, error) {
+	fields := make(map[string]string)
+	for _, filter := range input.Filters {
+		fields[aws.StringValue(filter.Field)] = aws.StringValue(filter.Value)
+	}
+	f.calls = append(f.calls, fields["instanceType"]+" "+fields["regionCode"]+" "+fields["operatingSystem"])
+	price, ok := f.prices[fields["instanceType"]]
+	if !ok {
+		return nil, awserr.New("AccessDeniedException", "not authorized", nil)
+	}
+	product := aws.JSONValue{"terms": map[string]interface{}{"OnDemand": map[string]interface{}{
+		"SKU.JRTCKXETXF": map[string]interface{}{"priceDimensions": map[string]interface{}{
+			"SKU.JRTCKXETXF.6YS6EN2CT7": map[string]interface{}{"unit": "Hrs", "pricePerUnit": map[string]interface{}{"USD": price}},
+		}},
+	}}}
+	return &pricing.GetProductsOutput{PriceList: []aws.JSONValue{product}}, nil
+}
+
+func pricedInstance(id string, instanceType string, platform string) *discoveredInstance {
+	instance := testInstance(id, "running")
+	instance.InstanceType = aws.String(instanceType)
+	if platform != "" {
+		instance.Platform = aws.String(platform)
+	}
+	return instance
+}
+
+func TestResolveInstancePricing(t *testing.T) {
+	c := testConfig()
+	c.pricing = newPricingCache()
+	svc := &fakePricing{prices: map[string]string{"m5.large": "0.0960000000"}}
+	instances := []*discoveredInstance{
+		pricedInstance("i-1", "m5.large", ""),
+		pricedInstance("i-2", "m5.large", ""),
+		pricedInstance("i-3", "m5.large", "windows"),
+	}
+	c.resolveInstancePricing(context.Background(), svc, "us-west-2", instances)
+
+	if strings.Join(svc.calls, ",") != "m5.large us-west-2 Linux,m5.large us-west-2 Windows" {
+		t.Errorf("unexpected calls %v", svc.calls)
+	}
+	if price := c.buildEntity(instances[1]).Annotations[onDemandPriceAnnotation]; price != "0.096" {
+		t.Errorf("unexpected price %q", price)
+	}
+}
+
+func TestResolveInstancePricingFailure(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	c := testConfig()
+	c.pricing = newPricingCache()
+	svc := &fakePricing{prices: map[string]string{"m5.large": "0.096"}}
+	instances := []*discoveredInstance{
+		pricedInstance("i-1", "t3.micro", ""),
+		pricedInstance("i-2", "m5.large", ""),
+	}
+	c.resolveInstancePricing(context.Background(), svc, "us-west-2", instances)
+
+	// The first failure skips the lookups for the rest of the run.
+	if len(svc.calls) != 1 || c.pricing.failed != 1 {
+		t.Errorf("unexpected calls %v", svc.calls)
+	}
+	for _, instance := range instances {
+		if _, ok := c.buildEntity(instance).Annotations[onDemandPriceAnnotation]; ok {
+			t.Errorf("%s: unexpected price annotation", aws.StringValue(instance.InstanceId))
+		}
+	}
+	if !strings.Contains(logged.String(), "WARNING: failed to look up the on-demand price of Linux t3.micro instances in us-west-2") {
+		t.Errorf("unexpected log output: %s", logged.String())
+	}
+}
+
+func TestPricingClient(t *testing.T) {
+	c := testConfig()
+	c.pricing = newPricingCache()
+	awsSession, err := session.NewSession(aws.NewConfig().WithRegion("us-west-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.pricingClient(awsSession, "us-west-2") == nil {
+		t.Error("expected a Pricing API client for us-west-2")
+	}
+	for _, region := range []string{"cn-north-1", "us-gov-west-1"} {
+		if c.pricingClient(awsSession, region) != nil {
+			t.Errorf("unexpected Pricing API client for %s", region)
+		}
+	}
+}
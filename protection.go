@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// terminationProtectionLabel is "true" on the entities of instances with
+// DisableApiTermination set, with --resolve-protection. The vendored AWS
+// SDK predates DisableApiStop, so stop protection is not resolved.
+const terminationProtectionLabel = "aws_termination_protection"
+
+// protectionState is what --resolve-protection last found out about an
+// instance, kept in --state-file so that instances are only checked again
+// once --protection-recheck-after has passed.
+type protectionState struct {
+	DisableApiTermination bool      `json:"disable_api_termination"`
+	CheckedAt             time.Time `json:"checked_at"`
+}
+
+// protectionCache holds the protection of the instances, loaded from the
+// state file, along with what this run checked.
+type protectionCache struct {
+	sync.Mutex
+	states  map[string]protectionState
+	used    map[string]bool
+	checked int
+	cached  int
+	failed  int
+	// limiter paces the DescribeInstanceAttribute calls of every region.
+	limiter *time.Ticker
+}
+
+func (c *CheckConfig) validateProtectionArgs() error {
+	if !c.resolveProtection {
+		return nil
+	}
+	if c.stateFile == "" {
+		return fmt.Errorf("--resolve-protection requires --state-file, which caches the protection of the instances")
+	}
+	var err error
+	if c.protectionRecheckDuration, err = time.ParseDuration(c.protectionRecheckAfter); err != nil {
+		return fmt.Errorf("invalid --protection-recheck-after: %s", err)
+	}
+	if c.protectionCallsPerSecond == 0 {
+		return fmt.Errorf("--protection-calls-per-second must be at least 1")
+	}
+	return nil
+}
+
+// loadProtectionCache loads the protection found by previous runs.
+func (c *CheckConfig) loadProtectionCache() error {
+	state, err := loadState(c.stateFile)
+	if err != nil {
+		return err
+	}
+	c.protection = &protectionCache{
+		states:  make(map[string]protectionState),
+		used:    make(map[string]bool),
+		limiter: time.NewTicker(time.Second / time.Duration(c.protectionCallsPerSecond)),
+	}
+	if state != nil && state.Protection != nil {
+		c.protection.states = state.Protection
+	}
+	return nil
+}
+
+// protectionSnapshot returns the protection of the instances seen during
+// the run, for the state file to cache.
+func (c *CheckConfig) protectionSnapshot() map[string]protectionState {
+	if c.protection == nil {
+		return nil
+	}
+	c.protection.Lock()
+	defer c.protection.Unlock()
+	snapshot := make(map[string]protectionState)
+	for id := range c.protection.used {
+		snapshot[id] = c.protection.states[id]
+	}
+	return snapshot
+}
+
+// resolveInstanceProtection sets the termination protection of the
+// instances of a region page, from the cache when it was checked less than
+// --protection-recheck-after ago and with DescribeInstanceAttribute,
+// paced by --protection-calls-per-second, otherwise. Instances that fail
+// to be checked keep their previous state, if any.
+func (c *CheckConfig) resolveInstanceProtection(ctx context.Context, svc ec2iface.EC2API, region string, instances []*discoveredInstance, now time.Time) {
+	if c.protection == nil || len(instances) == 0 {
+		return
+	}
+	defer c.timings.since("enrichment", time.Now())
+	for _, instance := range instances {
+		id := aws.StringValue(instance.InstanceId)
+		c.protection.Lock()
+		state, ok := c.protection.states[id]
+		c.protection.Unlock()
+		if ok && now.Sub(state.CheckedAt) < c.protectionRecheckDuration {
+			c.setProtection(instance, state, true)
+			continue
+		}
+
+		select {
+		case <-c.protection.limiter.C:
+		case <-ctx.Done():
+			return
+		}
+		attribute, err := svc.DescribeInstanceAttributeWithContext(ctx, &ec2.DescribeInstanceAttributeInput{
+			InstanceId: instance.InstanceId,
+			Attribute:  aws.String(ec2.InstanceAttributeNameDisableApiTermination),
+		})
+		if err != nil {
+			c.protectionFailed(id, classifyAwsError(err, "ec2:DescribeInstanceAttribute", region))
+			if ok {
+				c.setProtection(instance, state, true)
+			}
+			continue
+		}
+		state = protectionState{CheckedAt: now}
+		if attribute.DisableApiTermination != nil {
+			state.DisableApiTermination = aws.BoolValue(attribute.DisableApiTermination.Value)
+		}
+		c.setProtection(instance, state, false)
+	}
+}
+
+func (c *CheckConfig) setProtection(instance *discoveredInstance, state protectionState, cached bool) {
+	id := aws.StringValue(instance.InstanceId)
+	instance.TerminationProtection = aws.Bool(state.DisableApiTermination)
+	c.protection.Lock()
+	defer c.protection.Unlock()
+	c.protection.states[id] = state
+	c.protection.used[id] = true
+	if cached {
+		c.protection.cached++
+	} else {
+		c.protection.checked++
+	}
+}
+
+// protectionFailed logs the first failure of the run as a warning, since a
+// missing permission fails every instance alike, and the others at debug.
+func (c *CheckConfig) protectionFailed(id string, err error) {
+	c.protection.Lock()
+	c.protection.failed++
+	first := c.protection.failed == 1
+	c.protection.Unlock()
+	if first {
+		log.Printf("WARNING: failed to resolve the termination protection of EC2 instance \"%s\": %s", id, err)
+		return
+	}
+	c.logDebug("failed to resolve the termination protection of EC2 instance \"%s\": %s", id, err)
+}
+
+// protectionLabel returns the termination protection label of an
+// instance, if it was resolved.
+func protectionLabel(instance *discoveredInstance) (string, bool) {
+	if instance.TerminationProtection == nil {
+		return "", false
+	}
+	return strconv.FormatBool(*instance.TerminationProtection), true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeInstanceAttributes answers DescribeInstanceAttribute with the
+// termination protection of the instances, failing for the others.
+type fakeInstanceAttributes struct {
+	ec2iface.EC2API
+	protected map[string]bool
+	calls     []string
+}
+
+func (f *fakeInstanceAttributes) DescribeInstanceAttributeWithContext(ctx aws.Context, input *ec2.DescribeInstanceAttributeInput, opts ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error) {
+	id := aws.StringValue(input.InstanceId)
+	f.calls = append(f.calls, id+" "+aws.StringValue(input.Attribute))
+	protected, ok := f.protected[id]
+	if !ok {
+		return nil, awserr.New("UnauthorizedOperation", "not authorized", nil)
+	}
+	return &ec2.DescribeInstanceAttributeOutput{
+		InstanceId:            input.InstanceId,
+		DisableApiTermination: &ec2.AttributeBooleanValue{Value: aws.Bool(protected)},
+	}, nil
+}
+
+func TestResolveInstanceProtection(t *testing.T) {
+	c := testConfig()
+	c.resolveProtection = true
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c.stateFile = filepath.Join(dir, "state.json")
+	c.protectionRecheckAfter = "24h"
+	c.protectionCallsPerSecond = 1000
+	if err := c.validateProtectionArgs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.loadProtectionCache(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.protection.limiter.Stop()
+
+	now := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	c.protection.states["i-cached"] = protectionState{DisableApiTermination: true, CheckedAt: now.Add(-time.Hour)}
+	c.protection.states["i-expired"] = protectionState{DisableApiTermination: true, CheckedAt: now.Add(-48 * time.Hour)}
+	svc := &fakeInstanceAttributes{protected: map[string]bool{"i-protected": true, "i-expired": false, "i-open": false}}
+	instances := []*discoveredInstance{
+		testInstance("i-protected", "running"),
+		testInstance("i-open", "running"),
+		testInstance("i-cached", "running"),
+		testInstance("i-expired", "running"),
+		testInstance("i-denied", "running"),
+	}
+	c.resolveInstanceProtection(context.Background(), svc, "us-west-2", instances, now)
+
+	if len(svc.calls) != 4 || svc.calls[0] != "i-protected disableApiTermination" {
+		t.Errorf("unexpected calls %v", svc.calls)
+	}
+	for i, expected := range []string{"true", "false", "true", "false", ""} {
+		label := c.buildEntity(instances[i]).Labels[terminationProtectionLabel]
+		if label != expected {
+			t.Errorf("%s: unexpected label %q", aws.StringValue(instances[i].InstanceId), label)
+		}
+	}
+	if c.protection.checked != 3 || c.protection.cached != 1 || c.protection.failed != 1 {
+		t.Errorf("unexpected counts %+v", c.protection)
+	}
+
+	// The state file caches what the run saw, for the next run.
+	if err := c.compareWithPreviousRun(newRunSummary()); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(c.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Protection) != 4 || !state.Protection["i-protected"].DisableApiTermination || state.Protection["i-expired"].CheckedAt != now {
+		t.Errorf("unexpected cached protection %+v", state.Protection)
+	}
+}
+
+func TestValidateProtectionArgs(t *testing.T) {
+	c := testConfig()
+	c.resolveProtection = true
+	c.protectionRecheckAfter = "24h"
+	c.protectionCallsPerSecond = 5
+	if err := c.validateProtectionArgs(); err == nil {
+		t.Error("expected an error without --state-file")
+	}
+	c.stateFile = "state.json"
+	c.protectionRecheckAfter = "daily"
+	if err := c.validateProtectionArgs(); err == nil {
+		t.Error("expected an error for an invalid --protection-recheck-after")
+	}
+}
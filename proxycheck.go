@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// proxyCheckEntityAttributes selects the entities managed by this plugin.
+var proxyCheckEntityAttributes = []string{
+	"entity.entity_class == 'proxy'",
+	fmt.Sprintf("entity.labels['%s'] == '%s'", managedByLabel, managedByValue),
+}
+
+func (c *CheckConfig) validateProxyCheckArgs() error {
+	if !c.createProxyCheck {
+		return nil
+	}
+	if c.proxyCheckName == "" || c.proxyCheckCommand == "" {
+		return fmt.Errorf("--create-proxy-check requires --proxy-check-name and --proxy-check-command")
+	}
+	if len(splitList(c.proxyCheckSubscriptions)) == 0 {
+		return fmt.Errorf("--create-proxy-check requires --proxy-check-subscriptions")
+	}
+	if c.proxyCheckInterval == 0 {
+		return fmt.Errorf("--proxy-check-interval must be greater than 0")
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// buildProxyCheck returns the check definition requesting a proxy check
+// for every entity managed by this plugin in the namespace.
+func (c *CheckConfig) buildProxyCheck(namespace string) *corev2.CheckConfig {
+	check := corev2.NewCheckConfig(corev2.NewObjectMeta(c.proxyCheckName, namespace))
+	check.Labels = map[string]string{managedByLabel: managedByValue}
+	check.Command = c.proxyCheckCommand
+	check.Interval = uint32(c.proxyCheckInterval)
+	check.Subscriptions = splitList(c.proxyCheckSubscriptions)
+	check.Publish = true
+	check.RoundRobin = true
+	check.ProxyRequests = &corev2.ProxyRequests{EntityAttributes: proxyCheckEntityAttributes}
+	return check
+}
+
+// ensureProxyChecks creates or updates the proxy check in every namespace
+// instances were registered in. Updates replace the whole definition, so
+// running it again changes nothing.
+func (c *CheckConfig) ensureProxyChecks(namespaces map[string]bool) error {
+	var sorted []string
+	for namespace := range namespaces {
+		sorted = append(sorted, namespace)
+	}
+	sort.Strings(sorted)
+
+	failed := 0
+	for _, namespace := range sorted {
+		check := c.buildProxyCheck(namespace)
+		if c.dryRun {
+			fmt.Printf("dry-run: would create or update proxy check \"%s\" in namespace \"%s\"\n", check.Name, namespace)
+			continue
+		}
+		exists, err := c.checkExists(namespace, check.Name)
+		if err == nil {
+			err = c.putCheck(check)
+		}
+		if err != nil {
+			log.Printf("ERROR: failed to create or update proxy check \"%s\" in namespace \"%s\": %s", check.Name, namespace, err)
+			failed++
+			continue
+		}
+		verb := "created"
+		if exists {
+			verb = "updated"
+		}
+		fmt.Printf("%s proxy check \"%s\" in namespace \"%s\"\n", verb, check.Name, namespace)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to create or update the proxy check in %d namespaces", failed)
+	}
+	return nil
+}
+
+func checkPath(namespace string, name string) string {
+	return fmt.Sprintf("/api/core/v2/namespaces/%s/checks/%s", url.PathEscape(namespace), url.PathEscape(name))
+}
+
+func (c *CheckConfig) checkExists(namespace string, name string) (bool, error) {
+	resp, err := c.sensuApiRequest("GET", namespace, checkPath(namespace, name), nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, c.statusError(resp)
+	}
+}
+
+// putCheck creates or replaces a check.
+func (c *CheckConfig) putCheck(check *corev2.CheckConfig) error {
+	b, err := json.Marshal(check)
+	if err != nil {
+		return err
+	}
+	resp, err := c.sensuApiRequest("PUT", check.Namespace, checkPath(check.Namespace, check.Name), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return c.statusError(resp)
+	}
+	return nil
+}
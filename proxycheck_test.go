@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestEnsureProxyChecks(t *testing.T) {
+	var mu sync.Mutex
+	checks := make(map[string]*corev2.CheckConfig)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "GET":
+			if _, ok := checks[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(checks[r.URL.Path])
+		case "PUT":
+			var check corev2.CheckConfig
+			if err := json.NewDecoder(r.Body).Decode(&check); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			checks[r.URL.Path] = &check
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.createProxyCheck = true
+	c.proxyCheckName = "ec2-ping"
+	c.proxyCheckCommand = "check-ping -h {{ .labels.fqdn }}"
+	c.proxyCheckInterval = 30
+	c.proxyCheckSubscriptions = "proxy, ping"
+	if err := c.validateProxyCheckArgs(); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces := map[string]bool{"default": true, "payments": true}
+	for i := 0; i < 2; i++ {
+		if err := c.ensureProxyChecks(namespaces); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(checks) != 2 {
+		t.Fatalf("unexpected checks: %v", checks)
+	}
+	check := checks["/api/core/v2/namespaces/payments/checks/ec2-ping"]
+	if check == nil || check.Namespace != "payments" || check.Interval != 30 || strings.Join(check.Subscriptions, ",") != "proxy,ping" {
+		t.Fatalf("unexpected check: %+v", check)
+	}
+	if strings.Join(check.ProxyRequests.EntityAttributes, " && ") != "entity.entity_class == 'proxy' && entity.labels['sensu.io/managed_by'] == 'sensu-ec2-discovery'" {
+		t.Errorf("unexpected entity attributes: %v", check.ProxyRequests.EntityAttributes)
+	}
+
+	c.proxyCheckSubscriptions = ""
+	if err := c.validateProxyCheckArgs(); err == nil {
+		t.Error("expected an error without subscriptions")
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugins-go-library/sensu"
+)
+
+const (
+	pruneReasonNotDiscovered = "not in discovery results"
+	pruneReasonTerminated    = "instance terminated"
+	pruneReasonStale         = "stale timestamp"
+	pruneReasonGracePeriod   = "within the grace period"
+	pruneReasonIgnored       = "annotated " + ignoreAnnotation + ": " + ignoreValue
+	pruneReasonSelector      = "matches selectors"
+)
+
+// pruneConfigOptions returns the options of the prune subcommand, bound to
+// c.
+func pruneConfigOptions(c *CheckConfig) []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:      "selector",
+			Env:       "PRUNE_SELECTOR",
+			Argument:  "selector",
+			Shorthand: "l",
+			Usage:     "Comma-separated label selectors (key=value) the entities to prune must match. Can also be set via the $PRUNE_SELECTOR environment variable. REQUIRED.",
+			Value:     &c.pruneSelectors,
+			Default:   "",
+		},
+		{
+			Path:      "managed-by",
+			Env:       "PRUNE_MANAGED_BY",
+			Argument:  "managed-by",
+			Shorthand: "",
+			Usage:     "The value of the sensu.io/managed_by label the entities to prune must carry. Can also be set via the $PRUNE_MANAGED_BY environment variable.",
+			Value:     &c.pruneManagedBy,
+			Default:   managedByValue,
+		},
+		{
+			Path:      "yes",
+			Env:       "",
+			Argument:  "yes",
+			Shorthand: "y",
+			Usage:     "Confirm the deletion of the matching entities. Either --yes or --dry-run is required.",
+			Value:     &c.pruneYes,
+			Default:   false,
+		},
+	}
+}
+
+// pruneGuardConfigOptions returns the options shared by discovery and the
+// prune subcommand, bound to c.
+func pruneGuardConfigOptions(c *CheckConfig) []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:      "max-delete",
+			Env:       "PRUNE_MAX_DELETE",
+			Argument:  "max-delete",
+			Shorthand: "",
+			Usage:     "Refuse to prune anything when more than this many entities would be deleted. Can also be set via the $PRUNE_MAX_DELETE environment variable.",
+			Value:     &c.pruneMaxDelete,
+			Default:   uint64(100),
+		},
+		{
+			Path:      "dry-run",
+			Env:       "",
+			Argument:  "dry-run",
+			Shorthand: "",
+			Usage:     "Report what would be written to or deleted from Sensu without doing it, printing each entity that would be written. Without Sensu credentials, existing entities are not read and every entity is reported as one to register.",
+			Value:     &c.dryRun,
+			Default:   false,
+		},
+		{
+			Path:      "audit-log-file",
+			Env:       "AUDIT_LOG_FILE",
+			Argument:  "audit-log-file",
+			Shorthand: "",
+			Usage:     "Append a JSON line per entity created, updated, adopted or deleted to this file. Can also be set via the $AUDIT_LOG_FILE environment variable. OPTIONAL.",
+			Value:     &c.auditLogFile,
+			Default:   "",
+		},
+		{
+			Path:      "audit-dry-run",
+			Env:       "AUDIT_DRY_RUN",
+			Argument:  "audit-dry-run",
+			Shorthand: "",
+			Usage:     "Also record the would-create, would-update and would-delete actions of --dry-run in --audit-log-file. Can also be set via the $AUDIT_DRY_RUN environment variable.",
+			Value:     &c.auditDryRun,
+			Default:   false,
+		},
+		{
+			Path:      "prune-namespaces",
+			Env:       "PRUNE_NAMESPACES",
+			Argument:  "prune-namespaces",
+			Shorthand: "",
+			Usage:     "Comma-separated namespaces to prune, instead of every namespace discovery could have registered entities in: --sensu-namespace, those of --namespace-api-keys and those --sensu-namespace-tag routed instances to. Can also be set via the $PRUNE_NAMESPACES environment variable. OPTIONAL.",
+			Value:     &c.pruneNamespaceList,
+			Default:   "",
+		},
+		{
+			Path:      "prune-report-format",
+			Env:       "PRUNE_REPORT_FORMAT",
+			Argument:  "prune-report-format",
+			Shorthand: "",
+			Usage:     "The format of the prune report, either text or json. Can also be set via the $PRUNE_REPORT_FORMAT environment variable.",
+			Value:     &c.pruneReportFormat,
+			Default:   "text",
+		},
+	}
+}
+
+// pruneDecision records what prune does with a single managed entity and why.
+type pruneDecision struct {
+	Entity     string `json:"entity"`
+	InstanceId string `json:"aws_instance_id"`
+	LastSeen   string `json:"last_seen,omitempty"`
+	Reason     string `json:"reason"`
+	Remaining  string `json:"remaining,omitempty"`
+}
+
+type pruneReport struct {
+	Namespace string          `json:"namespace"`
+	DryRun    bool            `json:"dry_run"`
+	Delete    []pruneDecision `json:"delete"`
+	Pending   []pruneDecision `json:"pending,omitempty"`
+	Ignored   []pruneDecision `json:"ignored,omitempty"`
+	Retained  int             `json:"retained"`
+
+	// deleted counts the entities executePrune deleted, or would have
+	// deleted in a dry-run.
+	deleted int
+	// unlabeled counts the entities left alone for want of a region label
+	// by a region-scoped prune.
+	unlabeled int
+}
+
+// pruneGuardError reports that the max-delete guard refused to prune.
+type pruneGuardError struct {
+	namespace string
+	count     int
+	max       uint64
+}
+
+func (e *pruneGuardError) Error() string {
+	return fmt.Sprintf("%d entities would be deleted in namespace \"%s\", refusing to delete more than %d (see --max-delete)", e.count, e.namespace, e.max)
+}
+
+func (c *CheckConfig) validatePruneGuardArgs() error {
+	switch c.pruneReportFormat {
+	case "text", "json":
+		return nil
+	default:
+		return fmt.Errorf("invalid --prune-report-format \"%s\", expected text or json", c.pruneReportFormat)
+	}
+}
+
+func (c *CheckConfig) validatePruneArgs(event *corev2.Event) error {
+	if err := c.validateSensuCredentials(); err != nil {
+		return err
+	}
+	if err := c.validateAccountNamespaces(); err != nil {
+		return err
+	}
+	if !c.pruneYes && !c.dryRun {
+		return fmt.Errorf("refusing to prune without --yes or --dry-run")
+	}
+	if c.pruneManagedBy == "" {
+		return fmt.Errorf("--managed-by must not be empty")
+	}
+
+	selectors, err := parseLabelSelectors(c.pruneSelectors)
+	if err != nil {
+		return err
+	}
+	if len(selectors) == 0 {
+		return fmt.Errorf("at least one --selector is required")
+	}
+	c.pruneLabelSelectors = selectors
+
+	return c.validatePruneGuardArgs()
+}
+
+// applyDeregisterArgs turns --deregister and --deregister-dry-run into the
+// prune they stand for, before anything validates --prune.
+func (c *CheckConfig) applyDeregisterArgs() {
+	if c.deregister || c.deregisterDryRun {
+		c.prune = true
+	}
+}
+
+// pruneDryRun reports whether prune only reports the entities it would
+// delete, with --dry-run or --deregister-dry-run.
+func (c *CheckConfig) pruneDryRun() bool {
+	return c.dryRun || c.deregisterDryRun
+}
+
+// parseLabelSelectors parses a comma-separated list of key=value pairs.
+func parseLabelSelectors(selectors string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, selector := range strings.Split(selectors, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		pair := strings.SplitN(selector, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("invalid label selector \"%s\", expected key=value", selector)
+		}
+		parsed[pair[0]] = pair[1]
+	}
+	return parsed, nil
+}
+
+// isManaged reports whether the entity is a proxy entity carrying the given
+// managed-by marker.
+func isManaged(entity *corev2.Entity, managedBy string) bool {
+	return entity.EntityClass == corev2.EntityProxyClass && entity.Labels[managedByLabel] == managedBy
+}
+
+func entityInstanceId(entity *corev2.Entity) string {
+	if id := entity.Labels[instanceIdLabel]; id != "" {
+		return id
+	}
+	return entity.Name
+}
+
+func newPruneDecision(entity *corev2.Entity, reason string) pruneDecision {
+	return pruneDecision{
+		Entity:     entity.Name,
+		InstanceId: entityInstanceId(entity),
+		LastSeen:   entity.Annotations[lastSeenAnnotation],
+		Reason:     reason,
+	}
+}
+
+// planSelectorPrune selects the managed entities matching every selector.
+func (c *CheckConfig) planSelectorPrune(entities []*corev2.Entity, selectors map[string]string, managedBy string) *pruneReport {
+	report := &pruneReport{Namespace: c.sensuNamespace, DryRun: c.pruneDryRun()}
+	for _, entity := range entities {
+		if !isManaged(entity, managedBy) {
+			continue
+		}
+		matches := true
+		for key, value := range selectors {
+			if entity.Labels[key] != value {
+				matches = false
+				break
+			}
+		}
+		if matches && isIgnored(entity) {
+			report.Ignored = append(report.Ignored, newPruneDecision(entity, pruneReasonIgnored))
+		} else if matches {
+			report.Delete = append(report.Delete, newPruneDecision(entity, pruneReasonSelector))
+		} else {
+			report.Retained++
+		}
+	}
+	return report
+}
+
+// planOrphanPrune selects the managed entities whose instance was not part
+// of the discovery results, other than excluded instances. Unless regions
+// is nil, only the entities labeled with one of those regions are
+// considered, so that runs scanning other regions keep theirs; entities
+// registered before the region label existed are left alone until they
+// are rediscovered. When staleAfter
+// is set, undiscovered entities are only selected once their last-seen
+// timestamp is older than that, and are listed as pending until then. With
+// --prune-grace-period, entities of terminated instances count as
+// undiscovered.
+func (c *CheckConfig) planOrphanPrune(entities []*corev2.Entity, discovered map[string]bool, regions map[string]bool, staleAfter time.Duration, now time.Time) *pruneReport {
+	report := &pruneReport{Namespace: c.sensuNamespace, DryRun: c.pruneDryRun()}
+	for _, entity := range entities {
+		if !isManaged(entity, managedByValue) {
+			continue
+		}
+		if regions != nil {
+			if region := entity.Labels[regionLabel]; region == "" {
+				report.unlabeled++
+				continue
+			} else if !regions[region] {
+				continue
+			}
+		}
+		reason := pruneReasonNotDiscovered
+		if id := entityInstanceId(entity); !c.inShard(id) {
+			// The entities of the other shards are theirs to prune.
+			continue
+		} else if c.excludedInstanceIds[id] || c.keepsHibernatedEntity(entity) {
+			report.Retained++
+			continue
+		} else if discovered[id] {
+			if c.pruneGraceDuration == 0 || !isTerminatedState(entity.Labels[instanceStateLabel]) {
+				report.Retained++
+				continue
+			}
+			reason = pruneReasonTerminated
+		}
+		if isIgnored(entity) {
+			report.Ignored = append(report.Ignored, newPruneDecision(entity, pruneReasonIgnored))
+			continue
+		}
+		if staleAfter == 0 {
+			report.Delete = append(report.Delete, newPruneDecision(entity, reason))
+			continue
+		}
+		lastSeen, err := time.Parse(time.RFC3339, entity.Annotations[lastSeenAnnotation])
+		if err == nil && now.Sub(lastSeen) <= staleAfter {
+			decision := newPruneDecision(entity, pruneReasonGracePeriod)
+			decision.Remaining = (staleAfter - now.Sub(lastSeen)).Round(time.Second).String()
+			report.Pending = append(report.Pending, decision)
+			report.Retained++
+			continue
+		}
+		if reason == pruneReasonNotDiscovered {
+			reason = pruneReasonStale
+		}
+		report.Delete = append(report.Delete, newPruneDecision(entity, reason))
+	}
+	return report
+}
+
+// isTerminatedState reports whether an aws_instance_state label value is a
+// terminated or shutting down instance.
+func isTerminatedState(state string) bool {
+	return state == ec2.InstanceStateNameShuttingDown || state == ec2.InstanceStateNameTerminated
+}
+
+func (c *CheckConfig) printPruneReport(report *pruneReport) error {
+	if c.pruneReportFormat == "json" {
+		b, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", b)
+		return nil
+	}
+
+	verb := "delete"
+	if report.DryRun {
+		verb = "would delete"
+	}
+	for _, decision := range report.Delete {
+		lastSeen := decision.LastSeen
+		if lastSeen == "" {
+			lastSeen = "unknown"
+		}
+		fmt.Printf("%s entity \"%s\" (aws_instance_id=%s, last_seen=%s): %s\n", verb, decision.Entity, decision.InstanceId, lastSeen, decision.Reason)
+	}
+	for _, decision := range report.Ignored {
+		fmt.Printf("ignore entity \"%s\" (aws_instance_id=%s): %s\n", decision.Entity, decision.InstanceId, decision.Reason)
+	}
+	for _, decision := range report.Pending {
+		fmt.Printf("pending entity \"%s\" (aws_instance_id=%s, last_seen=%s): %s, %s remaining\n", decision.Entity, decision.InstanceId, decision.LastSeen, decision.Reason, decision.Remaining)
+	}
+	fmt.Printf("prune: %d entities to delete, %d retained in namespace \"%s\" (correlation ID %s)\n", len(report.Delete), report.Retained, report.Namespace, c.correlationId)
+	return nil
+}
+
+// executePrune reports the planned deletions and, unless this is a dry-run,
+// carries them out subject to the max-delete guard.
+func (c *CheckConfig) executePrune(report *pruneReport) error {
+	if err := c.printPruneReport(report); err != nil {
+		return err
+	}
+	for _, decision := range report.Ignored {
+		c.diff.ignore(report.Namespace, decision.Entity, decision.InstanceId)
+	}
+	if uint64(len(report.Delete)) > c.pruneMaxDelete {
+		return &pruneGuardError{namespace: report.Namespace, count: len(report.Delete), max: c.pruneMaxDelete}
+	}
+	if report.DryRun {
+		for _, decision := range report.Delete {
+			c.auditAction(auditWouldDelete, report.Namespace, decision.Entity, decision.InstanceId, nil)
+			c.diff.delete(report.Namespace, decision.Entity, decision.InstanceId, decision.Reason)
+		}
+		report.deleted = len(report.Delete)
+		return nil
+	}
+
+	failed := 0
+	for _, decision := range report.Delete {
+		err := c.deleteEntity(report.Namespace, decision.Entity)
+		c.auditAction(auditDelete, report.Namespace, decision.Entity, decision.InstanceId, err)
+		if err != nil {
+			log.Printf("ERROR: failed to delete entity \"%s\": %s", decision.Entity, err)
+			c.recordError(err, fmt.Sprintf("delete entity %s: %s", decision.Entity, err))
+			failed++
+			continue
+		}
+		c.diff.delete(report.Namespace, decision.Entity, decision.InstanceId, decision.Reason)
+		c.logEntity("deleted entity \"%s\"", decision.Entity)
+		report.deleted++
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d entities", failed)
+	}
+	return nil
+}
+
+// pruneNamespaces returns the namespaces to prune: --prune-namespaces or,
+// by default, --sensu-namespace along with the namespaces of
+// --namespace-api-keys and, for discovery, those it routed instances to.
+func (c *CheckConfig) pruneNamespaces(routed map[string]bool) []string {
+	if c.pruneNamespaceList != "" {
+		return splitList(c.pruneNamespaceList)
+	}
+	set := map[string]bool{c.sensuNamespace: true}
+	for namespace := range c.namespaceApiKeyMap {
+		set[namespace] = true
+	}
+	for _, namespace := range c.accountNamespaceMap {
+		set[namespace] = true
+	}
+	for namespace := range routed {
+		set[namespace] = true
+	}
+	namespaces := make([]string, 0, len(set))
+	for namespace := range set {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// pruneOrphans prunes the entities of undiscovered instances namespace by
+// namespace, each under its own max-delete guard. A namespace failing to be
+// pruned does not keep the others from being pruned; the first failure,
+// else the first guard triggered, is returned.
+func (c *CheckConfig) pruneOrphans(run *discoveryRun) error {
+	defer c.timings.since("prune", time.Now())
+	run.Lock()
+	namespaces := c.pruneNamespaces(run.namespaces)
+	run.Unlock()
+	regions := run.scannedRegions()
+	var failure error
+	var guard *pruneGuardError
+	for _, namespace := range namespaces {
+		report, err := c.planOrphans(namespace, run.discovered, regions)
+		if err == nil {
+			if report.unlabeled > 0 {
+				log.Printf("WARNING: not pruning %d entities in namespace \"%s\" without the %s label, they are labeled once rediscovered", report.unlabeled, namespace, regionLabel)
+			}
+			run.Lock()
+			run.summary.ignored += len(report.Ignored)
+			run.Unlock()
+			err = c.executePrune(report)
+			if report.deleted > 0 {
+				run.Lock()
+				run.summary.pruned[namespace] += report.deleted
+				run.Unlock()
+			}
+		}
+		if triggered, ok := err.(*pruneGuardError); ok {
+			if guard == nil {
+				guard = triggered
+			}
+		} else if err != nil {
+			failure = c.pruneFailure(failure, namespace, err)
+		}
+	}
+	if failure != nil {
+		return failure
+	}
+	if guard != nil {
+		return guard
+	}
+	return nil
+}
+
+// planOrphans lists the entities of a namespace and plans the deletion of
+// those of the regions scanned whose instance was not discovered.
+func (c *CheckConfig) planOrphans(namespace string, discovered map[string]bool, regions map[string]bool) (*pruneReport, error) {
+	entities, err := c.listManagedEntities(namespace, managedByValue)
+	if err != nil {
+		return nil, err
+	}
+	staleAfter := c.pruneStaleAfterDuration
+	if c.pruneGraceDuration > 0 {
+		staleAfter = c.pruneGraceDuration
+	}
+	report := c.planOrphanPrune(entities, discovered, regions, staleAfter, time.Now())
+	report.Namespace = namespace
+	return report, nil
+}
+
+func (c *CheckConfig) pruneEntities(event *corev2.Event) error {
+	c.openAudit()
+	defer c.audit.close()
+	var failure error
+	for _, namespace := range c.pruneNamespaces(nil) {
+		entities, err := c.listManagedEntities(namespace, c.pruneManagedBy)
+		if err == nil {
+			report := c.planSelectorPrune(entities, c.pruneLabelSelectors, c.pruneManagedBy)
+			report.Namespace = namespace
+			err = c.executePrune(report)
+		}
+		if err != nil {
+			failure = c.pruneFailure(failure, namespace, err)
+		}
+	}
+	return failure
+}
+
+// pruneFailure returns the first failure to prune a namespace, which is
+// reported by the caller, logging the later ones.
+func (c *CheckConfig) pruneFailure(first error, namespace string, err error) error {
+	if _, ok := err.(*pruneGuardError); ok && first == nil {
+		return err
+	}
+	if first == nil {
+		return fmt.Errorf("failed to prune namespace \"%s\": %s", namespace, err)
+	}
+	log.Printf("ERROR: failed to prune namespace \"%s\": %s", namespace, err)
+	return first
+}
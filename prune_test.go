@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func testEntity(name string, class string, labels map[string]string) *corev2.Entity {
+	entity := corev2.FixtureEntity(name)
+	entity.EntityClass = class
+	entity.Labels = labels
+	return entity
+}
+
+// newTestSensuApi serves the given entities two per page and records the
+// names of the deleted entities.
+func newTestSensuApi(t *testing.T, entities []*corev2.Entity, deleted *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := "/api/core/v2/namespaces/default/entities"
+		switch {
+		case r.Method == "GET" && r.URL.Path == prefix:
+			start := 0
+			if token := r.URL.Query().Get("continue"); token != "" {
+				for i, entity := range entities {
+					if entity.Name == token {
+						start = i
+					}
+				}
+			}
+			end := start + 2
+			if end < len(entities) {
+				w.Header().Set("Sensu-Continue", entities[end].Name)
+			} else {
+				end = len(entities)
+			}
+			_ = json.NewEncoder(w).Encode(entities[start:end])
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, prefix+"/"):
+			*deleted = append(*deleted, strings.TrimPrefix(r.URL.Path, prefix+"/"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestParseLabelSelectors(t *testing.T) {
+	selectors, err := parseLabelSelectors("aws_account_id=123456789012, env=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selectors) != 2 || selectors["aws_account_id"] != "123456789012" || selectors["env"] != "prod" {
+		t.Errorf("unexpected selectors: %v", selectors)
+	}
+
+	if _, err := parseLabelSelectors("env"); err == nil {
+		t.Error("expected an error for a selector without a value")
+	}
+}
+
+func TestPruneEntities(t *testing.T) {
+	managed := map[string]string{managedByLabel: managedByValue, "env": "prod"}
+	entities := []*corev2.Entity{
+		testEntity("i-1", "proxy", managed),
+		testEntity("i-2", "proxy", map[string]string{"env": "prod"}),
+		testEntity("i-3", "agent", managed),
+		testEntity("i-4", "proxy", map[string]string{managedByLabel: managedByValue, "env": "dev"}),
+		testEntity("i-5", "proxy", managed),
+		testEntity("i-6", "proxy", managed),
+	}
+	// The ignore annotation is honored on managed entities.
+	entities[5].Annotations = map[string]string{ignoreAnnotation: ignoreValue}
+	var deleted []string
+	server := newTestSensuApi(t, entities, &deleted)
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.pruneManagedBy = managedByValue
+	c.pruneLabelSelectors = map[string]string{"env": "prod"}
+	c.pruneMaxDelete = 10
+
+	if err := c.pruneEntities(nil); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(deleted)
+	if strings.Join(deleted, ",") != "i-1,i-5" {
+		t.Errorf("unexpected deletions: %v", deleted)
+	}
+
+	deleted = nil
+	c.dryRun = true
+	if err := c.pruneEntities(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("dry-run deleted entities: %v", deleted)
+	}
+
+	c.dryRun = false
+	c.pruneMaxDelete = 1
+	if err := c.pruneEntities(nil); err == nil {
+		t.Error("expected the max-delete guard to refuse the deletion")
+	}
+	if len(deleted) != 0 {
+		t.Errorf("max-delete guard deleted entities: %v", deleted)
+	}
+}
+
+func TestPlanOrphanPrune(t *testing.T) {
+	now := time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC)
+	managed := func(name string, lastSeen time.Time) *corev2.Entity {
+		entity := testEntity(name, "proxy", map[string]string{managedByLabel: managedByValue, instanceIdLabel: name})
+		entity.Annotations = map[string]string{lastSeenAnnotation: lastSeen.Format(time.RFC3339)}
+		return entity
+	}
+	entities := []*corev2.Entity{
+		managed("i-discovered", now.Add(-48*time.Hour)),
+		managed("i-recent", now.Add(-time.Hour)),
+		managed("i-old", now.Add(-48*time.Hour)),
+		testEntity("i-unmanaged", "proxy", nil),
+	}
+	discovered := map[string]bool{"i-discovered": true}
+	c := testConfig()
+
+	report := c.planOrphanPrune(entities, discovered, nil, 0, now)
+	if len(report.Delete) != 2 || report.Retained != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	for _, decision := range report.Delete {
+		if decision.Reason != pruneReasonNotDiscovered {
+			t.Errorf("unexpected reason for %s: %s", decision.Entity, decision.Reason)
+		}
+	}
+
+	report = c.planOrphanPrune(entities, discovered, nil, 24*time.Hour, now)
+	if len(report.Delete) != 1 || report.Retained != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	decision := report.Delete[0]
+	if decision.Entity != "i-old" || decision.InstanceId != "i-old" || decision.Reason != pruneReasonStale || decision.LastSeen != "2020-02-08T12:00:00Z" {
+		t.Errorf("unexpected decision: %+v", decision)
+	}
+
+	c.excludedInstanceIds = map[string]bool{"i-old": true}
+	report = c.planOrphanPrune(entities, discovered, nil, 0, now)
+	if len(report.Delete) != 1 || report.Delete[0].Entity != "i-recent" || report.Retained != 2 {
+		t.Errorf("unexpected report with an excluded instance: %+v", report)
+	}
+	c.excludedInstanceIds = nil
+	report = c.planOrphanPrune(entities, discovered, nil, 24*time.Hour, now)
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"namespace":"default","dry_run":false,"delete":[{"entity":"i-old","aws_instance_id":"i-old","last_seen":"2020-02-08T12:00:00Z","reason":"stale timestamp"}],"pending":[{"entity":"i-recent","aws_instance_id":"i-recent","last_seen":"2020-02-10T11:00:00Z","reason":"within the grace period","remaining":"23h0m0s"}],"retained":2}`
+	if string(b) != expected {
+		t.Errorf("unexpected JSON report:\n%s", b)
+	}
+}
+
+func TestPlanOrphanPruneGracePeriod(t *testing.T) {
+	now := time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC)
+	terminated := func(name string, lastSeen time.Time) *corev2.Entity {
+		entity := testEntity(name, "proxy", map[string]string{managedByLabel: managedByValue, instanceStateLabel: "terminated"})
+		entity.Annotations = map[string]string{lastSeenAnnotation: lastSeen.Format(time.RFC3339)}
+		return entity
+	}
+	entities := []*corev2.Entity{
+		terminated("i-terminated", now.Add(-3*time.Hour)),
+		terminated("i-terminating", now.Add(-30*time.Minute)),
+	}
+	discovered := map[string]bool{"i-terminated": true, "i-terminating": true}
+	c := testConfig()
+
+	// Without a grace period, discovered instances are kept whatever their
+	// state.
+	report := c.planOrphanPrune(entities, discovered, nil, 2*time.Hour, now)
+	if len(report.Delete) != 0 || len(report.Pending) != 0 || report.Retained != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	c.pruneGraceDuration = 2 * time.Hour
+	report = c.planOrphanPrune(entities, discovered, nil, c.pruneGraceDuration, now)
+	if len(report.Delete) != 1 || report.Delete[0].Entity != "i-terminated" || report.Delete[0].Reason != pruneReasonTerminated {
+		t.Errorf("unexpected deletions: %+v", report.Delete)
+	}
+	if len(report.Pending) != 1 || report.Pending[0].Entity != "i-terminating" || report.Pending[0].Remaining != "1h30m0s" || report.Retained != 1 {
+		t.Errorf("unexpected pending entities: %+v", report)
+	}
+}
+
+func TestPruneGracePeriodLastSeen(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.pruneGraceDuration = 2 * time.Hour
+	discover := func(state string) {
+		run := c.newDiscoveryRun()
+		c.processInstance(run, testInstance("i-0123", state))
+	}
+	lastSeen := func() string {
+		backend.Lock()
+		defer backend.Unlock()
+		return backend.entities["i-0123"].Annotations[lastSeenAnnotation]
+	}
+	age := func(ago time.Duration) {
+		backend.Lock()
+		defer backend.Unlock()
+		backend.entities["i-0123"].Annotations[lastSeenAnnotation] = time.Now().Add(-ago).UTC().Format(time.RFC3339)
+	}
+
+	// The last-seen timestamp of an unchanged entity is refreshed once
+	// older than a quarter of the grace period, not on every run.
+	discover("running")
+	age(10 * time.Minute)
+	stamped := lastSeen()
+	discover("running")
+	if lastSeen() != stamped {
+		t.Errorf("last-seen refreshed after 10 minutes: %s", lastSeen())
+	}
+	age(24 * time.Hour)
+	discover("running")
+	if seen, err := time.Parse(time.RFC3339, lastSeen()); err != nil || time.Since(seen) > time.Minute {
+		t.Errorf("stale last-seen not refreshed: %s", lastSeen())
+	}
+
+	// An instance unchanged for longer than the grace period that then
+	// terminates is pending, its grace period starting now.
+	age(24 * time.Hour)
+	discover("terminated")
+	report, err := c.planOrphans("default", map[string]bool{"i-0123": true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Delete) != 0 || len(report.Pending) != 1 || report.Pending[0].Entity != "i-0123" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	// Later runs keep the time it was first seen terminating.
+	age(3 * time.Hour)
+	discover("terminated")
+	report, err = c.planOrphans("default", map[string]bool{"i-0123": true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Delete) != 1 || report.Delete[0].Reason != pruneReasonTerminated {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestPruneOrphansNamespaces(t *testing.T) {
+	managed := func(name string) *corev2.Entity {
+		return testEntity(name, "proxy", map[string]string{managedByLabel: managedByValue, instanceIdLabel: name, regionLabel: "us-west-2"})
+	}
+	namespaces := map[string][]*corev2.Entity{
+		"default": {managed("i-discovered"), managed("i-gone")},
+		"team-a":  {managed("i-routed"), managed("i-a1"), managed("i-a2")},
+		"team-b":  {managed("i-b1")},
+	}
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/core/v2/namespaces/"), "/")
+		switch r.Method {
+		case "GET":
+			_ = json.NewEncoder(w).Encode(namespaces[parts[0]])
+		case "DELETE":
+			deleted = append(deleted, parts[0]+"/"+parts[2])
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.pruneMaxDelete = 1
+	c.namespaceApiKeyMap = map[string]string{"team-b": "key"}
+	run := c.newDiscoveryRun()
+	run.discovered = map[string]bool{"i-discovered": true, "i-routed": true}
+	run.namespaces["team-a"] = true
+	run.summary.regions["us-west-2"] = 2
+
+	// The guard of team-a does not keep the other namespaces from being
+	// pruned.
+	err := c.pruneOrphans(run)
+	if guard, ok := err.(*pruneGuardError); !ok || guard.namespace != "team-a" {
+		t.Errorf("expected the guard of team-a to trigger, got %v", err)
+	}
+	sort.Strings(deleted)
+	if strings.Join(deleted, ",") != "default/i-gone,team-b/i-b1" {
+		t.Errorf("unexpected deletions %v", deleted)
+	}
+	if run.summary.pruned["default"] != 1 || run.summary.pruned["team-b"] != 1 || run.summary.pruned["team-a"] != 0 {
+		t.Errorf("unexpected pruned counts %v", run.summary.pruned)
+	}
+
+	// --prune-namespaces replaces the namespaces of the run.
+	c.pruneNamespaceList = "team-b, team-c"
+	if namespaces := c.pruneNamespaces(run.namespaces); strings.Join(namespaces, ",") != "team-b,team-c" {
+		t.Errorf("unexpected namespaces %v", namespaces)
+	}
+}
+
+func TestPruneOrphansRegionScoped(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	instance := func(id string, region string) *discoveredInstance {
+		instance := testInstance(id, "running")
+		instance.Region = region
+		return instance
+	}
+	// discover runs a check scoped to a region over the instances given,
+	// then prunes.
+	discover := func(region string, instances ...*discoveredInstance) {
+		c := backend.checkConfig()
+		c.pruneMaxDelete = 10
+		run := c.newDiscoveryRun()
+		run.summary.regions[region] = 0
+		for _, instance := range instances {
+			c.processInstance(run, instance)
+		}
+		if err := c.pruneOrphans(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entities := func() string {
+		backend.Lock()
+		defer backend.Unlock()
+		var names []string
+		for name := range backend.entities {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	discover("us-west-2", instance("i-w1", "us-west-2"), instance("i-w2", "us-west-2"))
+	discover("us-east-1", instance("i-e1", "us-east-1"), instance("i-e2", "us-east-1"))
+	if entities() != "i-e1,i-e2,i-w1,i-w2" {
+		t.Fatalf("the runs deleted each other's entities: %s", entities())
+	}
+
+	// An entity registered before the region label existed is left alone.
+	backend.Lock()
+	backend.entities["i-legacy"] = testEntity("i-legacy", "proxy", map[string]string{managedByLabel: managedByValue, instanceIdLabel: "i-legacy"})
+	backend.Unlock()
+
+	// Each run only prunes the instances gone from its own region.
+	discover("us-west-2", instance("i-w1", "us-west-2"))
+	if entities() != "i-e1,i-e2,i-legacy,i-w1" {
+		t.Errorf("unexpected entities after pruning us-west-2: %s", entities())
+	}
+	discover("us-east-1")
+	if entities() != "i-legacy,i-w1" {
+		t.Errorf("unexpected entities after pruning us-east-1: %s", entities())
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	labels := map[string]string{managedByLabel: managedByValue, regionLabel: "us-west-2"}
+	backend.entities["i-gone"] = testEntity("i-gone", "proxy", labels)
+	backend.entities["agent-01"] = testEntity("agent-01", "agent", labels)
+	backend.entities["i-unowned"] = testEntity("i-unowned", "proxy", map[string]string{regionLabel: "us-west-2"})
+
+	deregister := func(c *CheckConfig) *runSummary {
+		c.pruneMaxDelete = 10
+		c.applyDeregisterArgs()
+		if !c.prune {
+			t.Fatal("--deregister does not prune")
+		}
+		run := c.newDiscoveryRun()
+		run.summary.regions["us-west-2"] = 0
+		if err := c.pruneOrphans(run); err != nil {
+			t.Fatal(err)
+		}
+		return run.summary
+	}
+
+	c := backend.checkConfig()
+	c.deregisterDryRun = true
+	summary := deregister(c)
+	var out bytes.Buffer
+	summary.print(&out, c)
+	if !strings.Contains(out.String(), "would prune 1 entities in namespace \"default\"") {
+		t.Errorf("unexpected summary %q", out.String())
+	}
+	if backend.entity("i-gone") == nil {
+		t.Error("--deregister-dry-run deleted an entity")
+	}
+
+	c = backend.checkConfig()
+	c.deregister = true
+	if summary := deregister(c); summary.pruned["default"] != 1 {
+		t.Errorf("unexpected pruned counts %v", summary.pruned)
+	}
+	if backend.entity("i-gone") != nil || backend.entity("agent-01") == nil || backend.entity("i-unowned") == nil {
+		t.Errorf("unexpected entities left %v", backend.entities)
+	}
+}
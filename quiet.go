@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often --quiet prints progress, whatever the
+// number of instances processed.
+const progressInterval = 10 * time.Second
+
+// logEntity logs a per-entity INFO line, demoted to debug with --quiet.
+func (c *CheckConfig) logEntity(format string, v ...interface{}) {
+	if c.quiet {
+		c.logDebug(format, v...)
+		return
+	}
+	log.Printf("INFO: "+format, v...)
+}
+
+// logFailure logs a failed registration. With --quiet, only the first
+// --max-reported-failures are logged as errors, the others at debug.
+func (c *CheckConfig) logFailure(format string, v ...interface{}) {
+	if c.quiet {
+		c.failuresLoggedMu.Lock()
+		c.failuresLogged++
+		logged := c.failuresLogged
+		c.failuresLoggedMu.Unlock()
+		if logged > c.maxReportedFailures {
+			c.logDebug(format, v...)
+			return
+		}
+	}
+	log.Printf("ERROR: "+format, v...)
+}
+
+// progressReporter prints the counts of a run so far every
+// --progress-every instances and every progressInterval.
+type progressReporter struct {
+	sync.Mutex
+	c         *CheckConfig
+	run       *discoveryRun
+	start     time.Time
+	processed uint64
+	stop      chan struct{}
+	stopped   sync.WaitGroup
+}
+
+// startProgress starts reporting progress with --quiet, returning nil
+// otherwise. A nil progressReporter does nothing.
+func (c *CheckConfig) startProgress(run *discoveryRun) *progressReporter {
+	if !c.quiet {
+		return nil
+	}
+	p := &progressReporter{c: c, run: run, start: time.Now(), stop: make(chan struct{})}
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// instanceDone counts a processed instance.
+func (p *progressReporter) instanceDone() {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	p.processed++
+	due := p.c.progressEvery > 0 && p.processed%p.c.progressEvery == 0
+	p.Unlock()
+	if due {
+		p.print()
+	}
+}
+
+func (p *progressReporter) print() {
+	p.Lock()
+	processed := p.processed
+	p.Unlock()
+	log.Printf("INFO: %s", p.line(processed, time.Since(p.start)))
+}
+
+func (p *progressReporter) line(processed uint64, elapsed time.Duration) string {
+	p.run.Lock()
+	defer p.run.Unlock()
+	s := p.run.summary
+	return fmt.Sprintf("progress: %d instances processed in %s, %d created, %d updated, %d already existed, %d failed",
+		processed, elapsed.Round(time.Second), s.outcomes[outcomeCreated], s.outcomes[outcomeUpdated], s.outcomes[outcomeExists], s.outcomes[outcomeFailed])
+}
+
+// close stops reporting progress.
+func (p *progressReporter) close() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.stopped.Wait()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietLogging(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.quiet = true
+	c.maxReportedFailures = 2
+	c.progressEvery = 2
+
+	run := c.newDiscoveryRun()
+	progress := c.startProgress(run)
+	for _, id := range []string{"i-1", "i-2", "i-3"} {
+		c.processInstance(run, testInstance(id, "running"))
+		progress.instanceDone()
+	}
+	progress.close()
+	for i := 0; i < 3; i++ {
+		c.failedRegistration(c.buildEntity(testInstance("i-4", "running")), errors.New("boom"))
+	}
+
+	output := logged.String()
+	if strings.Contains(output, "registered entity") {
+		t.Errorf("per-entity lines are logged with --quiet:\n%s", output)
+	}
+	if strings.Count(output, "ERROR: failed to register") != 2 {
+		t.Errorf("expected the first 2 failures to be logged:\n%s", output)
+	}
+	if strings.Count(output, "INFO: progress: 2 instances processed") != 1 || strings.Contains(output, "progress: 3") {
+		t.Errorf("expected a progress line every 2 instances:\n%s", output)
+	}
+
+	// Without --quiet, progress is not reported.
+	c.quiet = false
+	if p := c.startProgress(run); p != nil {
+		t.Error("unexpected progress reporter without --quiet")
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	c := testConfig()
+	run := c.newDiscoveryRun()
+	run.summary.add(registrationResult{Outcome: outcomeCreated})
+	run.summary.add(registrationResult{Outcome: outcomeFailed})
+	p := &progressReporter{c: c, run: run}
+	expected := "progress: 2 instances processed in 1m5s, 1 created, 0 updated, 0 already existed, 1 failed"
+	if line := p.line(2, 65*time.Second+300*time.Millisecond); line != expected {
+		t.Errorf("unexpected line %q", line)
+	}
+}
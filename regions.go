@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// maxRegionSuggestionDistance is the largest edit distance a region name
+// may be from a known region for it to be suggested.
+const maxRegionSuggestionDistance = 3
+
+// validateRegionNames checks the configured regions against the regions
+// the SDK knows in the partition of the default region, suggesting the
+// closest known region for a typo, unless --allow-unknown-regions.
+func (c *CheckConfig) validateRegionNames(regions []string) error {
+	if c.allowUnknownRegions {
+		return nil
+	}
+	partitions := endpoints.DefaultPartitions()
+	partition, ok := endpoints.PartitionForRegion(partitions, defaultRegion())
+	if !ok {
+		partition = partitions[0]
+	}
+	known := partition.Regions()
+	for _, region := range regions {
+		region = strings.TrimSpace(region)
+		if region == "" {
+			continue
+		}
+		if _, ok := known[region]; ok {
+			continue
+		}
+		for _, other := range partitions {
+			if _, ok := other.Regions()[region]; ok {
+				return fmt.Errorf("region %s is in the %s partition, not %s of the default region %s", region, other.ID(), partition.ID(), defaultRegion())
+			}
+		}
+		if suggestion := suggestRegion(region, known); suggestion != "" {
+			return fmt.Errorf("unknown region %s, did you mean %s? (--allow-unknown-regions accepts regions this release does not know yet)", region, suggestion)
+		}
+		return fmt.Errorf("unknown region %s in the %s partition (--allow-unknown-regions accepts regions this release does not know yet)", region, partition.ID())
+	}
+	return nil
+}
+
+// suggestRegion returns the known region closest to a name, the first
+// alphabetically on a tie, or "" if none is close.
+func suggestRegion(name string, known map[string]endpoints.Region) string {
+	var ids []string
+	for id := range known {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	best, bestDistance := "", maxRegionSuggestionDistance+1
+	for _, id := range ids {
+		if distance := editDistance(name, id); distance < bestDistance {
+			best, bestDistance = id, distance
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	min := values[0]
+	for _, value := range values[1:] {
+		if value < min {
+			min = value
+		}
+	}
+	return min
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRegionNames(t *testing.T) {
+	c := testConfig()
+	if err := c.validateRegionNames([]string{"us-east-1", " eu-west-1", ""}); err != nil {
+		t.Errorf("unexpected error for known regions: %s", err)
+	}
+
+	tests := map[string]string{
+		"us-east1":     "unknown region us-east1, did you mean us-east-1?",
+		"eu-west-9":    "unknown region eu-west-9, did you mean eu-west-1?",
+		"mars-north-1": "unknown region mars-north-1 in the aws partition",
+		"cn-north-1":   "region cn-north-1 is in the aws-cn partition, not aws",
+	}
+	for region, expected := range tests {
+		err := c.validateRegionNames([]string{"us-east-1", region})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected %q, got %v", region, expected, err)
+		}
+	}
+
+	c.allowUnknownRegions = true
+	if err := c.validateRegionNames([]string{"us-east1"}); err != nil {
+		t.Errorf("unexpected error with --allow-unknown-regions: %s", err)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"us-east1", "us-east-1", 1},
+		{"us-east-1", "us-east-1", 0},
+		{"", "abc", 3},
+		{"eu-west-1", "us-west-2", 3},
+	}
+	for _, test := range tests {
+		if distance := editDistance(test.a, test.b); distance != test.distance {
+			t.Errorf("%s/%s: expected %d, got %d", test.a, test.b, test.distance, distance)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// runReport is the report of a run archived by --report-s3-bucket.
+type runReport struct {
+	CorrelationId     string          `json:"correlation_id"`
+	Timestamp         string          `json:"timestamp"`
+	AccountIds        []string        `json:"account_ids"`
+	DryRun            bool            `json:"dry_run"`
+	Status            string          `json:"status"`
+	StatusCause       string          `json:"status_cause,omitempty"`
+	Discovered        int             `json:"discovered"`
+	Regions           map[string]int  `json:"regions"`
+	RegionFailures    []string        `json:"region_failures,omitempty"`
+	Outcomes          map[string]int  `json:"outcomes"`
+	Failures          []reportFailure `json:"failures,omitempty"`
+	DeletedDueToState int             `json:"deleted_due_to_state"`
+	Interrupted       bool            `json:"interrupted"`
+	Entities          *diffReport     `json:"entities"`
+}
+
+type reportFailure struct {
+	InstanceId string `json:"aws_instance_id"`
+	Reason     string `json:"reason"`
+}
+
+// newRunReport builds the report of a run from its summary and the
+// entities it created, updated and deleted.
+func (c *CheckConfig) newRunReport(run *discoveryRun, now time.Time) *runReport {
+	s := run.summary
+	status, cause := s.statusCause(c)
+	report := &runReport{
+		CorrelationId:     c.correlationId,
+		Timestamp:         now.UTC().Format(time.RFC3339),
+		AccountIds:        append([]string{}, run.accountIds...),
+		DryRun:            c.dryRun,
+		Status:            statusNames[status],
+		StatusCause:       cause,
+		Discovered:        s.discovered,
+		Regions:           s.regions,
+		RegionFailures:    s.regionFailures,
+		Outcomes:          s.outcomes,
+		DeletedDueToState: s.deletedDueToState,
+		Interrupted:       s.interrupted,
+		Entities:          c.diff,
+	}
+	sort.Strings(report.AccountIds)
+	for _, failure := range s.failures {
+		report.Failures = append(report.Failures, reportFailure{InstanceId: failure.InstanceId, Reason: failure.Reason})
+	}
+	return report
+}
+
+// reportKey is the object key of a report: the --report-s3-prefix, the
+// accounts discovered and the time and correlation ID of the run.
+func (c *CheckConfig) reportKey(report *runReport, now time.Time) string {
+	accounts := strings.Join(report.AccountIds, "+")
+	if accounts == "" {
+		accounts = "unknown-account"
+	}
+	name := fmt.Sprintf("%s-%s.json", now.UTC().Format("20060102T150405Z"), report.CorrelationId)
+	return path.Join(c.reportS3Prefix, accounts, now.UTC().Format("2006/01/02"), name)
+}
+
+// uploadReport archives the report of a run in --report-s3-bucket. The
+// object is encrypted per the default encryption of the bucket.
+func (c *CheckConfig) uploadReport(ctx context.Context, svc s3iface.S3API, run *discoveryRun) (string, error) {
+	now := time.Now()
+	report := c.newRunReport(run, now)
+	if report.Entities != nil {
+		report.Entities.Lock()
+		defer report.Entities.Unlock()
+		for _, diffs := range [][]entityDiff{report.Entities.Create, report.Entities.Update, report.Entities.Delete, report.Entities.Ignore} {
+			sortEntityDiffs(diffs)
+		}
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	key := c.reportKey(report, now)
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(c.reportS3Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return "", classifyAwsError(err, "s3:PutObject", defaultRegion())
+	}
+	return key, nil
+}
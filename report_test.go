@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 records the objects put; calling any other method panics.
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+	err     error
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestUploadReport(t *testing.T) {
+	c := testConfig()
+	c.reportS3Bucket = "audit"
+	c.reportS3Prefix = "discovery/"
+	c.diff = newDiffReport()
+	run := c.newDiscoveryRun()
+	run.accountIds = []string{"210987654321", "123456789012"}
+	instance := testInstance("i-0123", "running")
+	c.processInstance(run, instance)
+	c.diff.create(c.buildEntity(instance))
+	run.summary.regionFailures = []string{"region eu-west-1: timed out after 30s, 0 instances kept"}
+
+	svc := &fakeS3{objects: make(map[string][]byte)}
+	key, err := c.uploadReport(context.Background(), svc, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "discovery/123456789012+210987654321/" + time.Now().UTC().Format("2006/01/02") + "/"
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, "-"+c.correlationId+".json") {
+		t.Errorf("unexpected key %s", key)
+	}
+
+	var report runReport
+	if err := json.Unmarshal(svc.objects["audit/"+key], &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.CorrelationId != c.correlationId || report.Discovered != 1 || report.Regions["us-west-2"] != 1 || len(report.RegionFailures) != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if report.Status != "warning" || report.StatusCause != categoryPartialRegionFailure {
+		t.Errorf("unexpected status: %s (%s)", report.Status, report.StatusCause)
+	}
+	if len(report.Entities.Create) != 1 || report.Entities.Create[0].InstanceId != "i-0123" {
+		t.Errorf("unexpected entities: %+v", report.Entities)
+	}
+
+	svc.err = errors.New("AccessDenied")
+	if _, err := c.uploadReport(context.Background(), svc, run); err == nil {
+		t.Error("expected the upload to fail")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+const (
+	// scopeRegionLabel and scopeRoleArnLabel are read from the proxy entity
+	// a check was executed for with --scope-from-entity.
+	scopeRegionLabel  = "aws_region"
+	scopeRoleArnLabel = "aws_role_arn"
+)
+
+// applyEntityScope restricts the execution to the region, and the account
+// of the role if any, labeled on the proxy entity of the triggering event,
+// so that proxy_requests can fan discovery out to one execution per scope
+// entity. Executions for entities that are not proxies or have no region
+// label are left as they are.
+func (c *CheckConfig) applyEntityScope(event *corev2.Event) {
+	if event == nil || event.Entity == nil || event.Entity.EntityClass != corev2.EntityProxyClass {
+		return
+	}
+	region := event.Entity.Labels[scopeRegionLabel]
+	if region == "" {
+		return
+	}
+	c.scope = event.Entity.Name
+	c.ec2InstanceRegions = region
+	if roleArn := event.Entity.Labels[scopeRoleArnLabel]; roleArn != "" {
+		c.awsAssumeRoleArns = roleArn
+	}
+	log.Printf("INFO: scope %s: regions=%s roles=%s", c.scope, c.ec2InstanceRegions, c.awsAssumeRoleArns)
+}
+
+// metricsWriter returns where to write the metrics of the run, adding the
+// scope of the execution to every metric so that the metrics of the
+// executions of a proxy check do not collide.
+func (c *CheckConfig) metricsWriter(w io.Writer) io.Writer {
+	if c.scope == "" {
+		return w
+	}
+	return &scopedMetricsWriter{w: w, label: fmt.Sprintf("scope=\"%s\"", c.scope)}
+}
+
+// scopedMetricsWriter adds a label to the Prometheus text format metrics
+// written to it, a line at a time.
+type scopedMetricsWriter struct {
+	w     io.Writer
+	label string
+	line  []byte
+}
+
+func (s *scopedMetricsWriter) Write(p []byte) (int, error) {
+	s.line = append(s.line, p...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(s.line[:i+1])
+		s.line = s.line[i+1:]
+		if j := bytes.IndexAny([]byte(line), "{ "); j >= 0 {
+			if line[j] == '{' {
+				line = line[:j+1] + s.label + "," + line[j+1:]
+			} else {
+				line = line[:j] + "{" + s.label + "}" + line[j:]
+			}
+		}
+		if _, err := io.WriteString(s.w, line); err != nil {
+			return len(p), err
+		}
+	}
+}
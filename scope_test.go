@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestApplyEntityScope(t *testing.T) {
+	c := testConfig()
+	c.ec2InstanceRegions = "us-west-2,eu-west-1"
+	c.awsAssumeRoleArns = "arn:aws:iam::111111111111:role/discovery"
+
+	// Agent entities, and proxies without a region, run as configured.
+	for _, stdin := range []string{
+		`{"entity":{"entity_class":"agent","metadata":{"name":"agent-1","labels":{"aws_region":"us-east-1"}}}}`,
+		`{"entity":{"entity_class":"proxy","metadata":{"name":"db-1"}}}`,
+	} {
+		c.stdin = strings.NewReader(stdin)
+		event, err := c.triggeringEvent(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.applyEntityScope(event)
+		if c.scope != "" || c.ec2InstanceRegions != "us-west-2,eu-west-1" {
+			t.Errorf("unexpected scope %q with regions %s", c.scope, c.ec2InstanceRegions)
+		}
+	}
+
+	c.stdin = strings.NewReader(`{"entity":{"entity_class":"proxy","metadata":{"name":"scope-use1","labels":{"aws_region":"us-east-1","aws_role_arn":"arn:aws:iam::222222222222:role/discovery"}}}}`)
+	event, err := c.triggeringEvent(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.applyEntityScope(event)
+	if c.scope != "scope-use1" || c.ec2InstanceRegions != "us-east-1" || c.awsAssumeRoleArns != "arn:aws:iam::222222222222:role/discovery" {
+		t.Errorf("unexpected scope %q with regions %s and roles %s", c.scope, c.ec2InstanceRegions, c.awsAssumeRoleArns)
+	}
+
+	var output bytes.Buffer
+	newRunSummary().print(&output, c)
+	if !strings.HasPrefix(output.String(), "scope scope-use1: discovered 0 instances") {
+		t.Errorf("summary is not named after the scope:\n%s", output.String())
+	}
+}
+
+func TestScopedMetrics(t *testing.T) {
+	c := testConfig()
+	var output bytes.Buffer
+	if c.metricsWriter(&output) != &output {
+		t.Error("metrics without a scope are not written as they are")
+	}
+
+	c.scope = "scope-use1"
+	metrics := c.metricsWriter(&output)
+	(&driftCounts{missing: 1}).printMetrics(metrics)
+	fmt.Fprint(metrics, "sensu_ec2_discovery_")
+	fmt.Fprint(metrics, "runs 1\n")
+	expected := "sensu_ec2_discovery_drift_entities{scope=\"scope-use1\",kind=\"missing\"} 1\n" +
+		"sensu_ec2_discovery_drift_entities{scope=\"scope-use1\",kind=\"stale\"} 0\n" +
+		"sensu_ec2_discovery_drift_entities{scope=\"scope-use1\",kind=\"drifted\"} 0\n" +
+		"sensu_ec2_discovery_runs{scope=\"scope-use1\"} 1\n"
+	if output.String() != expected {
+		t.Errorf("unexpected metrics %q", output.String())
+	}
+}
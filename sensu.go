@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// entityListPageSize is the number of entities requested per page when
+// listing the entities of a namespace.
+const entityListPageSize = 500
+
+// validateSensuCredentials checks the Sensu API URL and TLS settings and
+// that some Sensu API credentials are configured, and resolves the
+// per-namespace API keys.
+func (c *CheckConfig) validateSensuCredentials() error {
+	apiUrl, err := normalizeSensuApiUrl(c.sensuApiUrl)
+	if err != nil {
+		return err
+	}
+	c.sensuApiUrl = apiUrl
+
+	// The environment variable predates the boolean option, which the
+	// plugin library would silently read as false when not a Go boolean.
+	if value, ok := os.LookupEnv(insecureSkipTlsVerifyEnv); ok && !c.sensuInsecureSkipTlsVerify {
+		skip, err := parseBoolValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid $%s: %s", insecureSkipTlsVerifyEnv, err)
+		}
+		c.sensuInsecureSkipTlsVerify = skip
+	}
+	if c.sensuNoProxyHosts, c.sensuNoProxyNets, err = parseNoProxy(c.sensuNoProxy); err != nil {
+		return err
+	}
+	if c.sensuTrustedCaDir != "" {
+		if c.sensuTrustedCaDirCerts, err = readCACertDir(c.sensuTrustedCaDir); err != nil {
+			return err
+		}
+	}
+	if err := c.validateSensuTrust(); err != nil {
+		return err
+	}
+	if c.sensuCertPins, err = parseCertPins(c.sensuPinnedCertSha256); err != nil {
+		return err
+	}
+	if (c.sensuPinChain || c.sensuPinOnly) && len(c.sensuCertPins) == 0 {
+		return fmt.Errorf("--sensu-pin-chain and --sensu-pin-only require --sensu-pinned-cert-sha256")
+	}
+	if c.sensuInsecureSkipTlsVerify {
+		log.Printf("WARNING: the Sensu API certificate is not verified (--sensu-insecure-tls-skip-verify)")
+	}
+
+	keys, err := parseNamespaceApiKeys(c.namespaceApiKeys)
+	if err != nil {
+		return err
+	}
+	c.namespaceApiKeyMap = keys
+	if c.sensuAccessToken == "" && c.sensuApiKey == "" && len(keys) == 0 {
+		if !c.dryRun {
+			return fmt.Errorf("no Sensu API access token or API key provided")
+		}
+		if c.prune {
+			return fmt.Errorf("--prune needs a Sensu API access token or API key, even with --dry-run")
+		}
+		// A dry-run can do without the Sensu API, reporting every entity
+		// as one to register.
+		log.Printf("INFO: dry-run without a Sensu API access token or API key, existing entities are not read")
+		c.dryRunOffline = true
+	}
+	if c.sensuRefreshToken != "" && c.sensuAccessToken == "" {
+		return fmt.Errorf("--sensu-refresh-token requires --sensu-access-token")
+	}
+	return nil
+}
+
+// validateSensuTrust checks that --sensu-exclusive-ca has CA certificates
+// to trust, and logs which ones the Sensu API certificate is verified
+// against.
+func (c *CheckConfig) validateSensuTrust() error {
+	var sources []string
+	if c.sensuTrustedCaFile != "" {
+		sources = append(sources, c.sensuTrustedCaFile)
+	}
+	if c.sensuTrustedCaDir != "" {
+		sources = append(sources, c.sensuTrustedCaDir)
+	}
+	if !c.sensuExclusiveCa {
+		if len(sources) == 0 {
+			c.logDebug("verifying the Sensu API certificate against the system CA certificates")
+		} else {
+			c.logDebug("verifying the Sensu API certificate against the system CA certificates and those of %s", strings.Join(sources, ", "))
+		}
+		return nil
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("--sensu-exclusive-ca requires --sensu-trusted-ca-file or --sensu-trusted-ca-dir")
+	}
+	// Fail now rather than on the first request.
+	if _, err := c.sensuRootCAs(); err != nil {
+		return err
+	}
+	c.logDebug("verifying the Sensu API certificate against the CA certificates of %s only (--sensu-exclusive-ca)", strings.Join(sources, ", "))
+	return nil
+}
+
+// insecureSkipTlsVerifyEnv sets --sensu-insecure-tls-skip-verify.
+const insecureSkipTlsVerifyEnv = "SENSU_INSECURE_SKIP_TLS_VERIFY"
+
+// parseBoolValue parses true/false, 1/0 and yes/no, in any case.
+func parseBoolValue(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "1", "yes":
+		return true, nil
+	case "false", "0", "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("\"%s\" is not a boolean, expected true/false, 1/0 or yes/no", value)
+	}
+}
+
+// parseNoProxy parses a comma-separated list of hostnames, IP addresses and
+// CIDRs.
+func parseNoProxy(list string) ([]string, []*net.IPNet, error) {
+	var hosts []string
+	var nets []*net.IPNet
+	for _, item := range splitList(list) {
+		if strings.Contains(item, "/") {
+			_, ipNet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid --sensu-no-proxy CIDR \"%s\": %s", item, err)
+			}
+			nets = append(nets, ipNet)
+			continue
+		}
+		hosts = append(hosts, strings.ToLower(item))
+	}
+	return hosts, nets, nil
+}
+
+// noProxy reports whether a Sensu API host matches --sensu-no-proxy.
+func (c *CheckConfig) noProxy(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range c.sensuNoProxyHosts {
+		if host == pattern || (strings.HasPrefix(pattern, ".") && strings.HasSuffix(host, pattern)) {
+			return true
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range c.sensuNoProxyNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sensuProxy selects the proxy of a Sensu API request: none for the hosts
+// of --sensu-no-proxy, otherwise the one of the environment. AWS requests
+// keep using the environment regardless.
+func (c *CheckConfig) sensuProxy(req *http.Request) (*url.URL, error) {
+	proxy, err := http.ProxyFromEnvironment(req)
+	if err == nil && proxy != nil && c.noProxy(req.URL.Hostname()) {
+		proxy = nil
+	}
+	c.proxyDecisionOnce.Do(func() {
+		if proxy != nil {
+			c.logDebug("reaching the Sensu API at %s through proxy %s", req.URL.Host, proxy.Host)
+		} else {
+			c.logDebug("reaching the Sensu API at %s directly", req.URL.Host)
+		}
+	})
+	return proxy, err
+}
+
+// defaultSensuApiPort is the port of the Sensu API when --sensu-api-url
+// does not name one.
+const defaultSensuApiPort = "8080"
+
+// normalizeSensuApiUrl validates a Sensu API URL and returns it with its
+// default port and without trailing slashes, which the API paths are
+// appended to.
+func normalizeSensuApiUrl(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		return "", fmt.Errorf("invalid --sensu-api-url \"%s\": missing scheme, expected http:// or https://", raw)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid --sensu-api-url: %s", err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid --sensu-api-url \"%s\": unsupported scheme \"%s\", expected http or https", raw, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid --sensu-api-url \"%s\": missing host", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid --sensu-api-url \"%s\": unexpected query or fragment", raw)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	if strings.HasSuffix(u.Path, "/api/core/v2") {
+		return "", fmt.Errorf("invalid --sensu-api-url \"%s\": expected the base URL of the API, without /api/core/v2", raw)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultSensuApiPort)
+	}
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// parseNamespaceApiKeys parses comma-separated namespace=key pairs, where
+// the key is either inline or read from an environment variable (env:NAME)
+// or a file (file:PATH). Errors never include the key itself.
+func parseNamespaceApiKeys(spec string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid --namespace-api-keys entry, expected namespace=key")
+		}
+		namespace, key := parts[0], parts[1]
+		switch {
+		case strings.HasPrefix(key, "env:"):
+			key = os.Getenv(strings.TrimPrefix(key, "env:"))
+		case strings.HasPrefix(key, "file:"):
+			b, err := ioutil.ReadFile(strings.TrimPrefix(key, "file:"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the API key of namespace \"%s\": %s", namespace, err)
+			}
+			key = strings.TrimSpace(string(b))
+		}
+		if key == "" {
+			return nil, fmt.Errorf("empty API key for namespace \"%s\"", namespace)
+		}
+		keys[namespace] = key
+	}
+	return keys, nil
+}
+
+// sensuCredential is a credential the Sensu API requests of a namespace can
+// be authenticated with.
+type sensuCredential struct {
+	name   string
+	header string
+	// token is the access token in header, if refreshable.
+	token       string
+	refreshable bool
+}
+
+// sensuCredentials lists the credentials for a namespace, most preferred
+// first: its own API key, then the global API key, then the global access
+// token. A namespace API key has no fallback.
+func (c *CheckConfig) sensuCredentials(namespace string) ([]sensuCredential, error) {
+	if key, ok := c.namespaceApiKeyMap[namespace]; ok {
+		return []sensuCredential{{name: fmt.Sprintf("API key of namespace \"%s\"", namespace), header: fmt.Sprintf("Key %s", key)}}, nil
+	}
+	var credentials []sensuCredential
+	if c.sensuApiKey != "" {
+		credentials = append(credentials, sensuCredential{name: "API key", header: fmt.Sprintf("Key %s", c.sensuApiKey)})
+	}
+	if token := c.accessToken(); token != "" {
+		credentials = append(credentials, c.accessTokenCredential(token))
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("no Sensu API credentials configured for namespace \"%s\"", namespace)
+	}
+	return credentials, nil
+}
+
+// authorizationHeader returns the preferred credentials for a namespace.
+func (c *CheckConfig) authorizationHeader(namespace string) (string, error) {
+	credentials, err := c.sensuCredentials(namespace)
+	if err != nil {
+		return "", err
+	}
+	return credentials[0].header, nil
+}
+
+// sensuApiRequest performs a request against the Sensu API, authenticated
+// with the credentials of the namespace it targets. When both the API key
+// and the access token are configured and the first request rejected with
+// 401 or 403 succeeds with the other one, the other one is used for the rest
+// of the run. The fallback is only tried once per run, so that an outage of
+// authentication does not double the requests.
+func (c *CheckConfig) sensuApiRequest(method string, namespace string, path string, body io.Reader) (*http.Response, error) {
+	credentials, err := c.sensuCredentials(namespace)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	if body != nil {
+		if payload, err = ioutil.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+	c.credentialFallbackMu.Lock()
+	tried, useFallback := c.credentialFallbackTried, c.credentialFallback != ""
+	c.credentialFallbackMu.Unlock()
+	if len(credentials) == 1 {
+		return c.doSensuApiRequest(method, path, payload, credentials[0])
+	}
+	primary, fallback := credentials[0], credentials[1]
+	if useFallback {
+		return c.doSensuApiRequest(method, path, payload, fallback)
+	}
+	resp, err := c.doSensuApiRequest(method, path, payload, primary)
+	if err != nil || tried || !isAuthRejection(resp.StatusCode) {
+		return resp, err
+	}
+
+	c.credentialFallbackMu.Lock()
+	if c.credentialFallbackTried {
+		c.credentialFallbackMu.Unlock()
+		return resp, nil
+	}
+	c.credentialFallbackTried = true
+	c.credentialFallbackMu.Unlock()
+	resp.Body.Close()
+	log.Printf("WARNING: the Sensu %s was rejected with %d %s, retrying with the %s", primary.name, resp.StatusCode, http.StatusText(resp.StatusCode), fallback.name)
+	resp, err = c.doSensuApiRequest(method, path, payload, fallback)
+	if err != nil || isAuthRejection(resp.StatusCode) {
+		log.Printf("WARNING: the Sensu %s did not help either, keeping the %s for the rest of the run", fallback.name, primary.name)
+		return resp, err
+	}
+	c.credentialFallbackMu.Lock()
+	c.credentialFallback = fmt.Sprintf("the Sensu %s was rejected, the %s was used instead", primary.name, fallback.name)
+	c.credentialFallbackMu.Unlock()
+	log.Printf("INFO: using the Sensu %s for the rest of the run", fallback.name)
+	return resp, nil
+}
+
+func isAuthRejection(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// credentialFallbackWarning describes the credential fallback of the run,
+// if any.
+func (c *CheckConfig) credentialFallbackWarning() string {
+	c.credentialFallbackMu.Lock()
+	defer c.credentialFallbackMu.Unlock()
+	return c.credentialFallback
+}
+
+func (c *CheckConfig) sendSensuApiRequest(method string, path string, payload []byte, credential sensuCredential) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(c.requestContext(), method, c.sensuApiUrl+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", credential.header)
+	req.Header.Set("X-Correlation-ID", c.correlationId)
+	req.Header.Set("User-Agent", userAgent())
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client, err := c.sensuHttpClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, c.sensuTimeoutError(method, path, err)
+	}
+	return resp, nil
+}
+
+// maxErrorBodySize caps how much of an error response body is reported.
+const maxErrorBodySize = 512
+
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`),
+	regexp.MustCompile(`(?i)(key\s+)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`),
+	regexp.MustCompile(`(?i)("[a-z_]*(?:token|password|secret|api_key)"\s*:\s*")[^"]*`),
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+}
+
+// redactSecrets masks anything in s that looks like a credential.
+func redactSecrets(s string) string {
+	for _, pattern := range secretPatterns {
+		if pattern.NumSubexp() > 0 {
+			s = pattern.ReplaceAllString(s, "${1}REDACTED")
+		} else {
+			s = pattern.ReplaceAllString(s, "REDACTED")
+		}
+	}
+	return s
+}
+
+// statusError describes an unsuccessful response, including the request ID
+// the backend tagged it with and the start of the response body, if any.
+func (c *CheckConfig) statusError(resp *http.Response) error {
+	message := fmt.Sprintf("%v %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	if requestId := resp.Header.Get(requestIdHeader); requestId != "" {
+		message = fmt.Sprintf("%s (request ID %s)", message, requestId)
+	}
+
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize+1))
+	body := strings.TrimSpace(redactSecrets(string(b)))
+	c.logDebug("%s %s responded %s: %s", resp.Request.Method, resp.Request.URL.Path, message, body)
+	if len(body) > maxErrorBodySize {
+		body = body[:maxErrorBodySize] + "..."
+	}
+	if body != "" {
+		message = fmt.Sprintf("%s: %s", message, body)
+	}
+	return &apiStatusError{statusCode: resp.StatusCode, message: message}
+}
+
+// apiStatusError is an unsuccessful Sensu API response.
+type apiStatusError struct {
+	statusCode int
+	message    string
+}
+
+func (e *apiStatusError) Error() string {
+	return e.message
+}
+
+// isThrottled reports whether err is a rate limited AWS or Sensu API
+// request.
+func isThrottled(err error) bool {
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusTooManyRequests
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return request.IsErrorThrottle(awsErr)
+	}
+	return request.IsErrorThrottle(err)
+}
+
+func entitiesPath(namespace string) string {
+	return fmt.Sprintf("/api/core/v2/namespaces/%s/entities", url.PathEscape(namespace))
+}
+
+func entityPath(namespace string, name string) string {
+	return fmt.Sprintf("%s/%s", entitiesPath(namespace), url.PathEscape(name))
+}
+
+// listEntities returns every entity in the namespace, following the
+// Sensu-Continue header until the last page has been read.
+func (c *CheckConfig) listEntities(namespace string) ([]*corev2.Entity, error) {
+	return c.listEntityPages(namespace, "")
+}
+
+// The values of labelSelectors: whether the backend filters entity
+// listings by labelSelector, once a listing found out.
+const (
+	labelSelectorsUnknown int32 = iota
+	labelSelectorsSupported
+	labelSelectorsUnsupported
+)
+
+// listManagedEntities returns the managed entities in the namespace
+// carrying the managed-by marker, having the backend select them with a
+// labelSelector so that the agent entities sharing the namespace are not
+// transferred. Backends without selector support either reject the
+// selector, and every entity is listed instead, or ignore it, which the
+// entities not carrying the marker give away; either way the entities are
+// filtered here, and the selector is not sent again for the rest of the
+// run.
+func (c *CheckConfig) listManagedEntities(namespace string, managedBy string) ([]*corev2.Entity, error) {
+	var entities []*corev2.Entity
+	var err error
+	switch atomic.LoadInt32(&c.labelSelectors) {
+	case labelSelectorsUnsupported:
+		c.logDebug("listing every entity in namespace \"%s\", the backend does not support label selectors", namespace)
+		entities, err = c.listEntityPages(namespace, "")
+	default:
+		selector := fmt.Sprintf("%s == %s", managedByLabel, managedBy)
+		entities, err = c.listEntityPages(namespace, selector)
+		var statusErr *apiStatusError
+		if errors.As(err, &statusErr) && statusErr.statusCode == http.StatusBadRequest {
+			atomic.StoreInt32(&c.labelSelectors, labelSelectorsUnsupported)
+			c.logDebug("the backend rejected labelSelector %q, listing every entity in namespace \"%s\": %s", selector, namespace, err)
+			entities, err = c.listEntityPages(namespace, "")
+			break
+		}
+		if err != nil {
+			break
+		}
+		ignored := false
+		for _, entity := range entities {
+			if !isManaged(entity, managedBy) {
+				ignored = true
+				break
+			}
+		}
+		if ignored {
+			atomic.StoreInt32(&c.labelSelectors, labelSelectorsUnsupported)
+			c.logDebug("the backend ignored labelSelector %q, listed every entity in namespace \"%s\"", selector, namespace)
+		} else {
+			atomic.StoreInt32(&c.labelSelectors, labelSelectorsSupported)
+			c.logDebug("listed the entities in namespace \"%s\" with labelSelector %q", namespace, selector)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	managed := entities[:0]
+	for _, entity := range entities {
+		if isManaged(entity, managedBy) {
+			managed = append(managed, entity)
+		}
+	}
+	return managed, nil
+}
+
+// listEntityPages lists the entities in the namespace matching the label
+// selector, if any, page by page.
+func (c *CheckConfig) listEntityPages(namespace string, selector string) ([]*corev2.Entity, error) {
+	var entities []*corev2.Entity
+	continueToken := ""
+	for {
+		query := url.Values{}
+		query.Set("limit", fmt.Sprintf("%d", entityListPageSize))
+		if selector != "" {
+			query.Set("labelSelector", selector)
+		}
+		if continueToken != "" {
+			query.Set("continue", continueToken)
+		}
+		resp, err := c.sensuApiRequest("GET", namespace, entitiesPath(namespace)+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to list entities in namespace \"%s\": %w", namespace, c.statusError(resp))
+		}
+		var page []*corev2.Entity
+		if err := json.Unmarshal(b, &page); err != nil {
+			return nil, fmt.Errorf("failed to decode entity list: %s", err)
+		}
+		entities = append(entities, page...)
+		continueToken = resp.Header.Get("Sensu-Continue")
+		if continueToken == "" {
+			return entities, nil
+		}
+	}
+}
+
+// getEntity returns the named entity, or nil if it does not exist.
+func (c *CheckConfig) getEntity(namespace string, name string) (*corev2.Entity, error) {
+	resp, err := c.sensuApiRequest("GET", namespace, entityPath(namespace, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, c.statusError(resp)
+	}
+	var entity corev2.Entity
+	if err := json.NewDecoder(resp.Body).Decode(&entity); err != nil {
+		return nil, fmt.Errorf("failed to decode entity: %s", err)
+	}
+	return &entity, nil
+}
+
+// putEntity creates or replaces an entity.
+func (c *CheckConfig) putEntity(entity *corev2.Entity) error {
+	b, err := json.Marshal(entity)
+	if err != nil {
+		return err
+	}
+	resp, err := c.sensuApiRequest("PUT", entity.Namespace, entityPath(entity.Namespace, entity.Name), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return c.statusError(resp)
+	}
+	return nil
+}
+
+func (c *CheckConfig) deleteEntity(namespace string, name string) error {
+	resp, err := c.sensuApiRequest("DELETE", namespace, entityPath(namespace, name), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return c.statusError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/google/uuid"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// testConfig returns a configuration authenticated with a test access
+// token against the default namespace.
+func testConfig() *CheckConfig {
+	return &CheckConfig{
+		correlationId:      uuid.New().String(),
+		sensuNamespace:     "default",
+		sensuAccessToken:   "test-token",
+		writeStrategy:      writeStrategyUpsert,
+		updateExisting:     true,
+		labelMergeStrategy: labelMergeEc2Wins,
+	}
+}
+
+// fakeBackend is an in-memory stand-in for the Sensu entities API.
+type fakeBackend struct {
+	sync.Mutex
+	*httptest.Server
+	entities map[string]*corev2.Entity
+	requests []string
+}
+
+func newFakeBackend() *fakeBackend {
+	backend := &fakeBackend{entities: make(map[string]*corev2.Entity)}
+	backend.Server = httptest.NewServer(http.HandlerFunc(backend.serveHTTP))
+	return backend
+}
+
+// checkConfig returns a test configuration pointed at the backend.
+func (b *fakeBackend) checkConfig() *CheckConfig {
+	c := testConfig()
+	c.sensuApiUrl = b.URL
+	return c
+}
+
+func (b *fakeBackend) entity(name string) *corev2.Entity {
+	b.Lock()
+	defer b.Unlock()
+	return b.entities[name]
+}
+
+func (b *fakeBackend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Lock()
+	defer b.Unlock()
+	b.requests = append(b.requests, r.Method+" "+r.URL.Path)
+
+	prefix := "/api/core/v2/namespaces/default/entities"
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	switch {
+	case r.Method == "GET" && name == "":
+		var names []string
+		for name := range b.entities {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		entities := []*corev2.Entity{}
+		for _, name := range names {
+			entities = append(entities, b.entities[name])
+		}
+		_ = json.NewEncoder(w).Encode(entities)
+	case r.Method == "GET":
+		entity, ok := b.entities[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(entity)
+	case r.Method == "POST" || r.Method == "PUT":
+		var entity corev2.Entity
+		if err := json.NewDecoder(r.Body).Decode(&entity); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Method == "POST" {
+			if _, ok := b.entities[entity.Name]; ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		}
+		b.entities[entity.Name] = &entity
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "DELETE":
+		if _, ok := b.entities[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(b.entities, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSensuApiRequestHeaders(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		w.Header().Set(requestIdHeader, "req-42")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer server.Close()
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+
+	resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if headers.Get("X-Correlation-ID") != c.correlationId {
+		t.Errorf("unexpected correlation ID header: %q", headers.Get("X-Correlation-ID"))
+	}
+	if headers.Get("User-Agent") != "sensu-ec2-discovery/"+version {
+		t.Errorf("unexpected User-Agent: %q", headers.Get("User-Agent"))
+	}
+	if err := c.statusError(resp); err.Error() != "422 Unprocessable Entity (request ID req-42)" {
+		t.Errorf("unexpected status error: %s", err)
+	}
+}
+
+func TestStatusErrorIncludesRedactedBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"message":"label key invalid","access_token":"s3cr3t"} Bearer abc.def ` + strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+
+	resp, err := c.sensuApiRequest("POST", "default", entitiesPath("default"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	message := c.statusError(resp).Error()
+	if !strings.HasPrefix(message, `400 Bad Request: {"message":"label key invalid","access_token":"REDACTED"} Bearer REDACTED xxx`) {
+		t.Errorf("unexpected status error: %s", message)
+	}
+	if strings.Contains(message, "s3cr3t") || strings.Contains(message, "abc.def") {
+		t.Errorf("status error leaks a secret: %s", message)
+	}
+	if len(message) > maxErrorBodySize+100 {
+		t.Errorf("status error body is not capped: %d bytes", len(message))
+	}
+}
+
+func TestParseNamespaceApiKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "web.key")
+	if err := ioutil.WriteFile(keyFile, []byte("key-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TEST_PAYMENTS_KEY", "key-from-env")
+	defer os.Unsetenv("TEST_PAYMENTS_KEY")
+
+	keys, err := parseNamespaceApiKeys("payments=env:TEST_PAYMENTS_KEY,web=file:" + keyFile + ",ops=inline-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys["payments"] != "key-from-env" || keys["web"] != "key-from-file" || keys["ops"] != "inline-key" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+
+	_, err = parseNamespaceApiKeys("payments=env:TEST_UNSET_KEY")
+	if err == nil || !strings.Contains(err.Error(), "payments") {
+		t.Errorf("expected an error naming the namespace, got %v", err)
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	c := &CheckConfig{namespaceApiKeyMap: map[string]string{"payments": "payments-key"}}
+
+	if header, err := c.authorizationHeader("payments"); err != nil || header != "Key payments-key" {
+		t.Errorf("unexpected header for a mapped namespace: %q, %v", header, err)
+	}
+	if _, err := c.authorizationHeader("web"); err == nil {
+		t.Error("expected an error for a namespace without credentials")
+	}
+	c.sensuApiKey = "global-key"
+	if header, _ := c.authorizationHeader("web"); header != "Key global-key" {
+		t.Errorf("unexpected fallback header: %q", header)
+	}
+}
+
+func TestSensuApiRequestCredentialFallback(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		seen = append(seen, r.Header.Get("Authorization")+" "+string(body))
+		if r.Header.Get("Authorization") == "Key revoked-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuApiKey = "revoked-key"
+	for i := 0; i < 2; i++ {
+		resp, err := c.sensuApiRequest("PUT", "default", "/api/core/v2/namespaces/default/entities/web", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("request %d: unexpected status %d", i, resp.StatusCode)
+		}
+	}
+	expected := []string{"Key revoked-key {}", "Bearer test-token {}", "Bearer test-token {}"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("unexpected requests %q", seen)
+	}
+	if warning := c.credentialFallbackWarning(); !strings.Contains(warning, "API key was rejected") {
+		t.Errorf("unexpected fallback warning %q", warning)
+	}
+
+	// With both credentials rejected, the fallback is only tried once.
+	seen = nil
+	c = testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuApiKey = "revoked-key"
+	c.sensuAccessToken = "revoked"
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusForbidden)
+	})
+	for i := 0; i < 2; i++ {
+		resp, err := c.sensuApiRequest("GET", "default", "/api/core/v2/namespaces/default/entities", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	expected = []string{"Key revoked-key", "Bearer revoked", "Key revoked-key"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("unexpected requests %q", seen)
+	}
+	if warning := c.credentialFallbackWarning(); warning != "" {
+		t.Errorf("unexpected fallback warning %q", warning)
+	}
+}
+
+func TestIsThrottled(t *testing.T) {
+	throttled := &apiStatusError{statusCode: http.StatusTooManyRequests, message: "429 Too Many Requests"}
+	if !isThrottled(fmt.Errorf("failed to get entity: %w", throttled)) {
+		t.Error("a wrapped 429 response is not throttled")
+	}
+	if isThrottled(&apiStatusError{statusCode: http.StatusBadRequest}) {
+		t.Error("a 400 response is throttled")
+	}
+	if !isThrottled(awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)) {
+		t.Error("RequestLimitExceeded is not throttled")
+	}
+}
+
+func TestSensuTlsServerName(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test certificate is issued to example.com, not the address dialed.
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuTrustedCaFile = caFile
+	c.sensuTlsServerName = "example.com"
+	resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The client is built once per config, so the mismatch needs its own.
+	c = testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuTrustedCaFile = caFile
+	c.sensuTlsServerName = "sensu.example.org"
+	if _, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil); err == nil {
+		t.Error("expected the certificate to be verified against the server name")
+	}
+}
+
+func TestNormalizeSensuApiUrl(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"https://127.0.0.1:8080":          "https://127.0.0.1:8080",
+		"https://sensu.example.com:8080/": "https://sensu.example.com:8080",
+		" HTTP://sensu.example.com ":      "http://sensu.example.com:8080",
+		"https://[::1]":                   "https://[::1]:8080",
+		"https://lb.example.com/sensu//":  "https://lb.example.com:8080/sensu",
+	} {
+		normalized, err := normalizeSensuApiUrl(raw)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", raw, err)
+		} else if normalized != expected {
+			t.Errorf("%q normalized to %q, expected %q", raw, normalized, expected)
+		}
+	}
+
+	for raw, problem := range map[string]string{
+		"sensu.example.com:8080":                     "missing scheme",
+		"127.0.0.1":                                  "missing scheme",
+		"ftp://sensu.example.com":                    "unsupported scheme",
+		"https://:8080":                              "missing host",
+		"https://sensu.example.com:80a":              "invalid port",
+		"https://sensu.example.com/?x=1":             "unexpected query",
+		"https://sensu.example.com:8080/api/core/v2": "without /api/core/v2",
+	} {
+		if _, err := normalizeSensuApiUrl(raw); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected an error about %q for %q, got %v", problem, raw, err)
+		}
+	}
+}
+
+func TestSensuInsecureSkipTlsVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer os.Unsetenv(insecureSkipTlsVerifyEnv)
+
+	for value, expected := range map[string]bool{"yes": true, "1": true, "TRUE": true, "no": false, "0": false} {
+		os.Setenv(insecureSkipTlsVerifyEnv, value)
+		c := testConfig()
+		c.sensuApiUrl = server.URL
+		if err := c.validateSensuCredentials(); err != nil {
+			t.Fatal(err)
+		}
+		if c.sensuInsecureSkipTlsVerify != expected {
+			t.Errorf("$%s=%s parsed as %v", insecureSkipTlsVerifyEnv, value, c.sensuInsecureSkipTlsVerify)
+		}
+		resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+		if expected && err != nil {
+			t.Errorf("unexpected error skipping verification: %s", err)
+		} else if !expected && err == nil {
+			t.Error("expected the self-signed certificate to be rejected")
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+
+	os.Setenv(insecureSkipTlsVerifyEnv, "enabled")
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	if err := c.validateSensuCredentials(); err == nil || !strings.Contains(err.Error(), insecureSkipTlsVerifyEnv) {
+		t.Errorf("expected an error naming the environment variable, got %v", err)
+	}
+}
+
+func TestSensuTrustedCaDir(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuTrustedCaDir = dir
+	if err := c.validateSensuCredentials(); err == nil {
+		t.Error("expected an error for an empty CA directory")
+	}
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	for name, content := range map[string][]byte{"internal.crt": ca, "broken.pem": []byte("not a certificate"), "README": []byte("ignored")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.validateSensuCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.sensuTrustedCaDirCerts) != 1 {
+		t.Errorf("expected the one valid certificate file to be loaded, got %d", len(c.sensuTrustedCaDirCerts))
+	}
+	resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestSensuExclusiveCa(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	// httptest servers share their certificate, so the untrusted CA is a
+	// fresh one.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour), IsCA: true, BasicConstraintsValid: true}
+	otherCa, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuExclusiveCa = true
+	if err := c.validateSensuCredentials(); err == nil || !strings.Contains(err.Error(), "--sensu-exclusive-ca") {
+		t.Errorf("expected an error without CA certificates, got %v", err)
+	}
+	c.sensuTrustedCaFile = filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(c.sensuTrustedCaFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validateSensuCredentials(); err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+
+	for _, test := range []struct {
+		cert    []byte
+		trusted bool
+	}{
+		{server.Certificate().Raw, true},
+		{otherCa, false},
+	} {
+		c := testConfig()
+		c.sensuApiUrl = server.URL
+		c.sensuExclusiveCa = true
+		c.sensuTrustedCaFile = filepath.Join(dir, "ca.pem")
+		if err := ioutil.WriteFile(c.sensuTrustedCaFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: test.cert}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.validateSensuCredentials(); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+		if test.trusted && err != nil {
+			t.Errorf("unexpected error with the server CA: %s", err)
+		} else if !test.trusted && err == nil {
+			t.Error("expected the server certificate to be rejected")
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+func TestSensuNoProxy(t *testing.T) {
+	c := testConfig()
+	var err error
+	c.sensuNoProxyHosts, c.sensuNoProxyNets, err = parseNoProxy("sensu.internal, .vpc.example.com,10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]bool{
+		"sensu.internal":          true,
+		"SENSU.internal":          true,
+		"backend.vpc.example.com": true,
+		"vpc.example.com":         false,
+		"10.1.2.3":                true,
+		"192.168.1.1":             false,
+		"sensu.example.com":       false,
+	} {
+		if c.noProxy(host) != expected {
+			t.Errorf("unexpected proxy bypass for %s: %v", host, !expected)
+		}
+	}
+
+	if _, _, err := parseNoProxy("10.0.0.0/33"); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+}
+
+func TestListManagedEntities(t *testing.T) {
+	entities := []*corev2.Entity{
+		testEntity("i-managed", "proxy", map[string]string{managedByLabel: managedByValue}),
+		testEntity("agent-01", "agent", nil),
+	}
+	for _, backendSupport := range []string{"supported", "ignored", "rejected"} {
+		var selectors []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			selector := r.URL.Query().Get("labelSelector")
+			selectors = append(selectors, selector)
+			switch {
+			case selector != "" && backendSupport == "rejected":
+				w.WriteHeader(http.StatusBadRequest)
+			case selector != "" && backendSupport == "supported":
+				_ = json.NewEncoder(w).Encode(entities[:1])
+			default:
+				_ = json.NewEncoder(w).Encode(entities)
+			}
+		}))
+
+		c := testConfig()
+		c.sensuApiUrl = server.URL
+		for i := 0; i < 2; i++ {
+			managed, err := c.listManagedEntities("default", managedByValue)
+			if err != nil {
+				t.Fatalf("%s: %s", backendSupport, err)
+			}
+			if len(managed) != 1 || managed[0].Name != "i-managed" {
+				t.Errorf("%s: unexpected entities %v", backendSupport, managed)
+			}
+		}
+		server.Close()
+
+		expected := map[string]string{
+			"supported": "sensu.io/managed_by == sensu-ec2-discovery,sensu.io/managed_by == sensu-ec2-discovery",
+			// Once the backend is found not to support selectors, they
+			// are no longer sent.
+			"ignored":  "sensu.io/managed_by == sensu-ec2-discovery,",
+			"rejected": "sensu.io/managed_by == sensu-ec2-discovery,,",
+		}[backendSupport]
+		if strings.Join(selectors, ",") != expected {
+			t.Errorf("%s: unexpected selectors %q", backendSupport, selectors)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+const (
+	shardByNone = "none"
+	shardByAz   = "az"
+)
+
+// availabilityZones returns the availability zones of the region of svc
+// that are available to the account.
+func (c *CheckConfig) availabilityZones(ctx context.Context, svc ec2iface.EC2API, region string) ([]string, error) {
+	output, err := svc.DescribeAvailabilityZonesWithContext(ctx, &ec2.DescribeAvailabilityZonesInput{})
+	if err != nil {
+		return nil, classifyAwsError(err, "ec2:DescribeAvailabilityZones", region)
+	}
+	var zones []string
+	for _, zone := range output.AvailabilityZones {
+		zones = append(zones, aws.StringValue(zone.ZoneName))
+	}
+	return zones, nil
+}
+
+// describeShardedPages runs a DescribeInstances query concurrently, one
+// paginated query per availability zone of the region, since the pages of
+// a single query can only be fetched one after the other. The pages are
+// handed to handle one at a time, without the instances another shard
+// already returned. A failing shard, throttled beyond the retries of the
+// SDK for instance, does not stop the others: its error is returned once
+// they are done, failing the region as a whole.
+func (c *CheckConfig) describeShardedPages(ctx context.Context, svc ec2iface.EC2API, region string, input *ec2.DescribeInstancesInput, handle func(*ec2.DescribeInstancesOutput) bool) error {
+	zones, err := c.availabilityZones(ctx, svc, region)
+	if err != nil {
+		return err
+	}
+	c.logDebug("describing the instances of %s in %d availability zone shards", region, len(zones))
+	shardCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	stopped := false
+	errs := make([]error, len(zones))
+	var wg sync.WaitGroup
+	for i, zone := range zones {
+		shard := &ec2.DescribeInstancesInput{
+			Filters: append(append([]*ec2.Filter{}, input.Filters...), &ec2.Filter{
+				Name:   aws.String("availability-zone"),
+				Values: aws.StringSlice([]string{zone}),
+			}),
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.describeInstancePages(shardCtx, svc, region, shard, func(page *ec2.DescribeInstancesOutput) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				if stopped {
+					return false
+				}
+				if !handle(unseenInstances(page, seen)) {
+					stopped = true
+					cancel()
+					return false
+				}
+				return true
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	if stopped {
+		return nil
+	}
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("availability zone %s: %w", zones[i], err)
+		}
+	}
+	return nil
+}
+
+// unseenInstances returns the page without the instances in seen, adding
+// the others to it.
+func unseenInstances(page *ec2.DescribeInstancesOutput, seen map[string]bool) *ec2.DescribeInstancesOutput {
+	unseen := &ec2.DescribeInstancesOutput{}
+	for _, reservation := range page.Reservations {
+		var instances []*ec2.Instance
+		for _, instance := range reservation.Instances {
+			id := aws.StringValue(instance.InstanceId)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			instances = append(instances, instance)
+		}
+		if len(instances) > 0 {
+			copied := *reservation
+			copied.Instances = instances
+			unseen.Reservations = append(unseen.Reservations, &copied)
+		}
+	}
+	return unseen
+}
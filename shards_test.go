@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeZones serves perZone instances in each zone, pageSize per page,
+// failing the zones in throttled. The first instance of every zone is
+// also returned by the next zone, like an instance seen by two shards.
+type fakeZones struct {
+	ec2iface.EC2API
+	zones     []string
+	perZone   int
+	pageSize  int
+	throttled map[string]bool
+	mu        sync.Mutex
+	queried   []string
+}
+
+func (f *fakeZones) DescribeAvailabilityZonesWithContext(ctx aws.Context, input *ec2.DescribeAvailabilityZonesInput, opts ...request.Option) (*ec2.DescribeAvailabilityZonesOutput, error) {
+	output := &ec2.DescribeAvailabilityZonesOutput{}
+	for _, zone := range f.zones {
+		output.AvailabilityZones = append(output.AvailabilityZones, &ec2.AvailabilityZone{ZoneName: aws.String(zone)})
+	}
+	return output, nil
+}
+
+func (f *fakeZones) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	var zone string
+	for _, filter := range input.Filters {
+		if aws.StringValue(filter.Name) == "availability-zone" {
+			zone = aws.StringValue(filter.Values[0])
+		}
+	}
+	f.mu.Lock()
+	f.queried = append(f.queried, zone)
+	f.mu.Unlock()
+	if f.throttled[zone] {
+		return awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+	}
+	var ids []string
+	for i := 0; i < f.perZone; i++ {
+		ids = append(ids, fmt.Sprintf("i-%s-%d", zone, i))
+	}
+	for i, other := range f.zones {
+		if other == zone && i > 0 {
+			ids = append(ids, fmt.Sprintf("i-%s-0", f.zones[i-1]))
+		}
+	}
+	for start := 0; start < len(ids); start += f.pageSize {
+		end := start + f.pageSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		reservation := &ec2.Reservation{}
+		for _, id := range ids[start:end] {
+			reservation.Instances = append(reservation.Instances, &ec2.Instance{InstanceId: aws.String(id)})
+		}
+		if !fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, end == len(ids)) {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func describeShardedInstances(c *CheckConfig, svc ec2iface.EC2API, stopAfter int) ([]string, bool, error) {
+	var ids []string
+	stopped, err := c.describeInstances(context.Background(), svc, nil, &awsAccount{}, "us-east-1", func(instance *discoveredInstance) bool {
+		ids = append(ids, *instance.InstanceId)
+		return stopAfter == 0 || len(ids) < stopAfter
+	})
+	sort.Strings(ids)
+	return ids, stopped, err
+}
+
+func TestDescribeShardedPages(t *testing.T) {
+	c := testConfig()
+	c.shardBy = shardByAz
+	svc := &fakeZones{zones: []string{"us-east-1a", "us-east-1b", "us-east-1c"}, perZone: 25, pageSize: 10}
+	ids, _, err := describeShardedInstances(c, svc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 75 {
+		t.Fatalf("described %d instances, expected 75", len(ids))
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] == ids[i-1] {
+			t.Errorf("instance %s was described twice", ids[i])
+		}
+	}
+	if len(svc.queried) != 3 {
+		t.Errorf("unexpected shards %v", svc.queried)
+	}
+}
+
+func TestDescribeShardedPagesThrottled(t *testing.T) {
+	c := testConfig()
+	c.shardBy = shardByAz
+	svc := &fakeZones{zones: []string{"us-east-1a", "us-east-1b", "us-east-1c"}, perZone: 25, pageSize: 10, throttled: map[string]bool{"us-east-1b": true}}
+	ids, _, err := describeShardedInstances(c, svc, 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "availability zone us-east-1b: RequestLimitExceeded") || !isThrottled(err) {
+		t.Errorf("unexpected error %v", err)
+	}
+	// The other shards are described in full.
+	// The other shards are described in full, along with the instance of
+	// the throttled shard another shard returned.
+	if len(ids) != 51 {
+		t.Errorf("described %d instances, expected 51", len(ids))
+	}
+}
+
+func TestDescribeShardedPagesStops(t *testing.T) {
+	c := testConfig()
+	c.shardBy = shardByAz
+	svc := &fakeZones{zones: []string{"us-east-1a", "us-east-1b", "us-east-1c"}, perZone: 25, pageSize: 10}
+	ids, stopped, err := describeShardedInstances(c, svc, 5)
+	if err != nil || !stopped || len(ids) != 5 {
+		t.Errorf("unexpected result: %d instances, stopped %t, error %v", len(ids), stopped, err)
+	}
+}
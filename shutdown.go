@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchShutdown returns a context that is done once SIGTERM or SIGINT is
+// received, telling discovery to stop taking on new instances, and one that
+// is done the grace period after that, cutting off the requests still in
+// flight. Both derive from parent, so a deadline set on it applies to them
+// as well.
+func watchShutdown(parent context.Context, grace time.Duration) (context.Context, context.Context, func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	stopping, abort, release := shutdownContexts(parent, signals, grace)
+	return stopping, abort, func() {
+		signal.Stop(signals)
+		release()
+	}
+}
+
+func shutdownContexts(parent context.Context, signals <-chan os.Signal, grace time.Duration) (context.Context, context.Context, func()) {
+	stopping, stop := context.WithCancel(parent)
+	abort, cancelAbort := context.WithCancel(parent)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("WARNING: received %s, finishing the registrations in flight within %s", sig, grace)
+			stop()
+		case <-done:
+			return
+		}
+		select {
+		case <-time.After(grace):
+			cancelAbort()
+		case <-done:
+		}
+	}()
+	return stopping, abort, func() {
+		close(done)
+		stop()
+		cancelAbort()
+	}
+}
+
+// requestContext is the context the AWS and Sensu API requests of a run
+// are made with.
+func (c *CheckConfig) requestContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownContexts(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	stopping, abort, release := shutdownContexts(context.Background(), signals, 50*time.Millisecond)
+	defer release()
+
+	if stopping.Err() != nil || abort.Err() != nil {
+		t.Fatal("contexts are done before any signal")
+	}
+	signals <- syscall.SIGTERM
+	select {
+	case <-stopping.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stopping context not done after the signal")
+	}
+	if abort.Err() != nil {
+		t.Error("requests in flight were cut off before the grace period")
+	}
+	select {
+	case <-abort.Done():
+	case <-time.After(time.Second):
+		t.Fatal("abort context not done after the grace period")
+	}
+}
+
+func TestShutdownContextsFollowParent(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	stopping, abort, release := shutdownContexts(parent, make(chan os.Signal), time.Minute)
+	defer release()
+
+	cancel()
+	if stopping.Err() == nil || abort.Err() == nil {
+		t.Error("contexts not done once the parent is")
+	}
+}
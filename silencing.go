@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// With --label-stopped-for-silencing, the entities of instances that are
+// not running carry the silencing label, for event filters to drop the
+// alerts of their proxy checks with the expression
+// entity.labels.alerts != 'suppressed'.
+const (
+	silencingLabel      = "alerts"
+	silencingLabelValue = "suppressed"
+)
+
+// labelForSilencing sets the silencing label on the entity of an instance
+// that is not running.
+func (c *CheckConfig) labelForSilencing(entity *corev2.Entity, instance *ec2.Instance) {
+	if !c.labelStoppedForSilencing || instance.State == nil {
+		return
+	}
+	if aws.StringValue(instance.State.Name) != ec2.InstanceStateNameRunning {
+		entity.Labels[silencingLabel] = silencingLabelValue
+	}
+}
+
+// clearSilencing removes the silencing label from the updated entity of an
+// instance back running, whatever --label-merge-strategy keeps.
+func (c *CheckConfig) clearSilencing(updated *corev2.Entity, desired *corev2.Entity) {
+	if !c.labelStoppedForSilencing {
+		return
+	}
+	if _, ok := desired.Labels[silencingLabel]; !ok && updated.Labels[silencingLabel] == silencingLabelValue {
+		delete(updated.Labels, silencingLabel)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestLabelStoppedForSilencing(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.labelStoppedForSilencing = true
+	c.diff = newDiffReport()
+
+	instance := testInstance("i-0123", "running")
+	c.registerInstance(instance)
+	if _, ok := backend.entity("i-0123").Labels[silencingLabel]; ok {
+		t.Error("the entity of a running instance is silenced")
+	}
+
+	// Stop: the label is set, as an update of the reconciliation report.
+	instance.State.Name = aws.String("stopped")
+	if result := c.registerInstance(instance); result.Outcome != outcomeUpdated {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if value := backend.entity("i-0123").Labels[silencingLabel]; value != silencingLabelValue {
+		t.Errorf("expected the silencing label on a stopped instance, got %q", value)
+	}
+	if !hasChange(c.diff.Update, entityChange{Field: "label:alerts", Before: "", After: "suppressed"}) {
+		t.Errorf("silencing not in the report: %+v", c.diff.Update)
+	}
+
+	// Start: the label is cleared, whatever the label merge strategy.
+	c.labelMergeStrategy = labelMergePreserveExisting
+	instance.State.Name = aws.String("running")
+	c.registerInstance(instance)
+	if _, ok := backend.entity("i-0123").Labels[silencingLabel]; ok {
+		t.Error("the silencing label is not cleared once the instance runs")
+	}
+	if !hasChange(c.diff.Update, entityChange{Field: "label:alerts", Before: "suppressed", After: ""}) {
+		t.Errorf("clearing not in the report: %+v", c.diff.Update)
+	}
+
+	// A label set by hand to another value is left alone.
+	backend.entity("i-0123").Labels[silencingLabel] = "paged"
+	c.registerInstance(instance)
+	if value := backend.entity("i-0123").Labels[silencingLabel]; value != "paged" {
+		t.Errorf("expected the hand-set label kept, got %q", value)
+	}
+}
+
+func hasChange(diffs []entityDiff, change entityChange) bool {
+	for _, diff := range diffs {
+		for _, c := range diff.Changes {
+			if c == change {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// simulatedLaunchTime is the launch time of every simulated instance, so
+// that their entities only differ by what is derived from their number.
+var simulatedLaunchTime = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func (c *CheckConfig) validateSimulateArgs() error {
+	if c.simulate == 0 {
+		if c.simulateSink {
+			return fmt.Errorf("--simulate-sink requires --simulate")
+		}
+		return nil
+	}
+	if c.prune || c.stateFile != "" || c.instancesFromStdin || c.idsOnly {
+		return fmt.Errorf("--simulate cannot be combined with --prune, --state-file, --instances-from-stdin or --ids-only, which expect real instances")
+	}
+	if c.simulateLabelSize == 0 {
+		return fmt.Errorf("--simulate-label-size must be at least 1")
+	}
+	return nil
+}
+
+// simulatedRegion is the region of the simulated instances, the first one
+// configured.
+func (c *CheckConfig) simulatedRegion() string {
+	region := strings.TrimSpace(strings.Split(c.ec2InstanceRegions, ",")[0])
+	if region == "" || region == "all" {
+		return defaultRegion()
+	}
+	return region
+}
+
+// produceSimulatedInstances emits --simulate synthetic instances instead of
+// describing any, so that entity construction and registration can be load
+// tested without AWS.
+func (c *CheckConfig) produceSimulatedInstances(run *discoveryRun, emit func(*discoveredInstance) bool) error {
+	region := c.simulatedRegion()
+	run.Lock()
+	run.summary.regions[region] += 0
+	run.Unlock()
+	account := &awsAccount{}
+	for n := uint64(0); n < c.simulate; n++ {
+		if !emit(c.simulatedInstance(account, region, n)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// simulatedInstance returns the nth synthetic instance, which has a
+// deterministic ID and --simulate-tags tags whose values are
+// --simulate-label-size characters long.
+func (c *CheckConfig) simulatedInstance(account *awsAccount, region string, n uint64) *discoveredInstance {
+	address := fmt.Sprintf("10.%d.%d.%d", (n>>16)&0xff, (n>>8)&0xff, n&0xff)
+	instance := &ec2.Instance{
+		InstanceId:       aws.String(fmt.Sprintf("i-%017x", n)),
+		InstanceType:     aws.String(ec2.InstanceTypeT3Micro),
+		ImageId:          aws.String("ami-00000000000000000"),
+		LaunchTime:       aws.Time(simulatedLaunchTime),
+		State:            &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+		Placement:        &ec2.Placement{AvailabilityZone: aws.String(region + "a")},
+		PrivateIpAddress: aws.String(address),
+		PrivateDnsName:   aws.String(fmt.Sprintf("ip-%s.%s.compute.internal", strings.Replace(address, ".", "-", -1), region)),
+		Tags:             []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("simulated-%d", n))}},
+	}
+	for i := uint64(0); i < c.simulateTags; i++ {
+		instance.Tags = append(instance.Tags, &ec2.Tag{
+			Key:   aws.String(fmt.Sprintf("simulated-tag-%d", i)),
+			Value: aws.String(simulatedValue(n, i, c.simulateLabelSize)),
+		})
+	}
+	return &discoveredInstance{Instance: instance, Account: account, Region: region}
+}
+
+// simulatedValue returns a tag value of the given size derived from the
+// instance and tag numbers.
+func simulatedValue(n uint64, i uint64, size uint64) string {
+	seed := fmt.Sprintf("%x-%x-", n, i)
+	return strings.Repeat(seed, int(size)/len(seed)+1)[:size]
+}
+
+// discardTransport answers the Sensu API requests of --simulate-sink
+// without sending them, reading the request bodies so that they are still
+// serialized: entities are created and written successfully, and never
+// found.
+type discardTransport struct{}
+
+func (discardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_, _ = io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+	}
+	status, body := http.StatusOK, ""
+	switch req.Method {
+	case "GET":
+		status = http.StatusNotFound
+		if strings.HasSuffix(req.URL.Path, "/entities") {
+			status, body = http.StatusOK, "[]"
+		}
+	case "POST":
+		status = http.StatusCreated
+	case "DELETE":
+		status = http.StatusNoContent
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func simulateRun(c *CheckConfig) (*discoveryRun, error) {
+	run := c.newDiscoveryRun()
+	produce := func(emit func(*discoveredInstance) bool) error {
+		return c.produceSimulatedInstances(run, emit)
+	}
+	handle := func(instance *discoveredInstance) {
+		c.processInstance(run, instance)
+	}
+	return run, c.streamInstances(context.Background(), run, produce, handle)
+}
+
+func TestSimulate(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.ec2InstanceRegions = "eu-west-1"
+	c.simulate = 3
+	c.simulateTags = 2
+	c.simulateLabelSize = 40
+	c.workers = 2
+	if err := c.validateSimulateArgs(); err != nil {
+		t.Fatal(err)
+	}
+	run, err := simulateRun(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.summary.outcomes[outcomeCreated] != 3 || run.summary.regions["eu-west-1"] != 3 {
+		t.Fatalf("unexpected outcomes %v in regions %v", run.summary.outcomes, run.summary.regions)
+	}
+	entity := backend.entity("i-00000000000000002")
+	if entity == nil {
+		t.Fatal("the entity of the third synthetic instance was not registered")
+	}
+	if value := entity.Labels["simulated-tag-1"]; len(value) != 40 || value != simulatedValue(2, 1, 40) {
+		t.Errorf("unexpected label value %q", value)
+	}
+
+	c.prune = true
+	if err := c.validateSimulateArgs(); err == nil {
+		t.Error("expected an error with --prune")
+	}
+}
+
+func TestSimulateSink(t *testing.T) {
+	c := testConfig()
+	c.sensuApiUrl = "https://sensu.invalid:8080"
+	c.simulate = 50
+	c.simulateTags = 5
+	c.simulateLabelSize = 8
+	c.simulateSink = true
+	c.workers = 4
+	run, err := simulateRun(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.summary.outcomes[outcomeCreated] != 50 || len(run.summary.failures) != 0 {
+		t.Errorf("unexpected outcomes %v: %v", run.summary.outcomes, run.summary.failures)
+	}
+
+	var output bytes.Buffer
+	run.summary.print(&output, c)
+	if !strings.Contains(output.String(), "simulated: 50 synthetic instances with 5 tags of 8 characters, writes discarded (--simulate-sink)\n") {
+		t.Errorf("summary does not report the simulation:\n%s", output.String())
+	}
+}
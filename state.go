@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// runState is what a run leaves behind in --state-file for the next one.
+type runState struct {
+	Discovered int                        `json:"discovered"`
+	Regions    map[string]int             `json:"regions"`
+	Protection map[string]protectionState `json:"protection,omitempty"`
+	Updates    map[string]time.Time       `json:"updates,omitempty"`
+}
+
+// loadState reads the state of the previous run, or returns nil if there
+// was none.
+func loadState(path string) (*runState, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the state file: %s", err)
+	}
+	state := &runState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("failed to decode the state file: %s", err)
+	}
+	return state, nil
+}
+
+// saveState replaces the state file, so that a run killed halfway never
+// leaves a truncated one behind.
+func saveState(path string, state *runState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("failed to write the state file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write the state file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write the state file: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write the state file: %s", err)
+	}
+	return nil
+}
+
+// countDeltas describes the totals, overall and per region, that deviate
+// from the previous run by more than maxPercent. Regions without a previous
+// count are not compared.
+func countDeltas(previous *runState, current *runState, maxPercent uint64) []string {
+	if previous == nil || maxPercent == 0 {
+		return nil
+	}
+	var deltas []string
+	if delta, ok := countDelta(previous.Discovered, current.Discovered, maxPercent); ok {
+		deltas = append(deltas, fmt.Sprintf("discovered %d instances, %d in the previous run (%s)", current.Discovered, previous.Discovered, delta))
+	}
+	var regions []string
+	for region := range current.Regions {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		before, ok := previous.Regions[region]
+		if !ok {
+			continue
+		}
+		if delta, ok := countDelta(before, current.Regions[region], maxPercent); ok {
+			deltas = append(deltas, fmt.Sprintf("region %s: discovered %d instances, %d in the previous run (%s)", region, current.Regions[region], before, delta))
+		}
+	}
+	return deltas
+}
+
+func countDelta(before int, after int, maxPercent uint64) (string, bool) {
+	if before == 0 {
+		return "", false
+	}
+	percent := float64(after-before) * 100 / float64(before)
+	if math.Abs(percent) <= float64(maxPercent) {
+		return "", false
+	}
+	return fmt.Sprintf("%+.0f%%", percent), true
+}
+
+// compareWithPreviousRun checks the discovered instance counts against those
+// of the previous run, then records them for the next.
+func (c *CheckConfig) compareWithPreviousRun(summary *runSummary) error {
+	previous, err := loadState(c.stateFile)
+	if err != nil {
+		return err
+	}
+	if previous != nil && previous.Regions != nil {
+		summary.previousRegions = previous.Regions
+	} else {
+		// No history at all: every region is new.
+		summary.previousRegions = map[string]int{}
+	}
+	current := &runState{Discovered: summary.discovered, Regions: summary.regions, Protection: c.protectionSnapshot(), Updates: c.churnSnapshot(time.Now())}
+	summary.countDeltas = countDeltas(previous, current, c.maxDeltaPercent)
+	return saveState(c.stateFile, current)
+}
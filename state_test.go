@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCountDeltas(t *testing.T) {
+	previous := &runState{Discovered: 100, Regions: map[string]int{"us-east-1": 80, "us-west-2": 20}}
+	current := &runState{Discovered: 90, Regions: map[string]int{"us-east-1": 80, "us-west-2": 10, "eu-west-1": 0}}
+
+	deltas := countDeltas(previous, current, 20)
+	if len(deltas) != 1 || deltas[0] != "region us-west-2: discovered 10 instances, 20 in the previous run (-50%)" {
+		t.Errorf("unexpected deltas: %q", deltas)
+	}
+
+	current = &runState{Discovered: 150, Regions: map[string]int{"us-east-1": 130, "us-west-2": 20}}
+	deltas = countDeltas(previous, current, 20)
+	if strings.Join(deltas, "\n") != "discovered 150 instances, 100 in the previous run (+50%)\nregion us-east-1: discovered 130 instances, 80 in the previous run (+62%)" {
+		t.Errorf("unexpected deltas: %q", deltas)
+	}
+
+	if deltas := countDeltas(nil, current, 20); len(deltas) != 0 {
+		t.Errorf("first run reported deltas: %q", deltas)
+	}
+}
+
+func TestCompareWithPreviousRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := testConfig()
+	c.stateFile = filepath.Join(dir, "state.json")
+	c.maxDeltaPercent = 25
+
+	summary := newRunSummary()
+	summary.discovered = 100
+	summary.regions["us-east-1"] = 100
+	if err := c.compareWithPreviousRun(summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.countDeltas) != 0 || summary.status(c) != statusOK {
+		t.Errorf("first run reported deltas: %q", summary.countDeltas)
+	}
+
+	summary = newRunSummary()
+	summary.discovered = 60
+	summary.regions["us-east-1"] = 60
+	if err := c.compareWithPreviousRun(summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.countDeltas) != 2 || summary.status(c) != statusWarning {
+		t.Errorf("unexpected deltas after a 40%% drop: %q", summary.countDeltas)
+	}
+
+	state, err := loadState(c.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Discovered != 60 || state.Regions["us-east-1"] != 60 {
+		t.Errorf("unexpected saved state: %+v", state)
+	}
+}
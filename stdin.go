@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// stdinInstance is an instance read by --instances-from-stdin, with the
+// region it is in, if given, and the line it was read from.
+type stdinInstance struct {
+	Id     string
+	Region string
+	Line   int
+}
+
+func (c *CheckConfig) stdinReader() io.Reader {
+	if c.stdin != nil {
+		return c.stdin
+	}
+	return os.Stdin
+}
+
+// stdinPiped reports whether stdin is a pipe or a file, as for checks
+// configured with stdin: true, rather than a terminal or /dev/null.
+func (c *CheckConfig) stdinPiped() bool {
+	if c.stdin != nil {
+		return true
+	}
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice == 0
+}
+
+// parseStdinInstances reads newline-delimited instance IDs, or id,region
+// pairs, ignoring blank lines and # comments. Every malformed line is
+// reported.
+func parseStdinInstances(r io.Reader) ([]stdinInstance, error) {
+	var instances []stdinInstance
+	var problems []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		instance := stdinInstance{Id: strings.TrimSpace(fields[0]), Line: line}
+		if len(fields) == 2 {
+			instance.Region = strings.TrimSpace(fields[1])
+		}
+		if len(fields) > 2 || !strings.HasPrefix(instance.Id, "i-") || (len(fields) == 2 && instance.Region == "") {
+			problems = append(problems, fmt.Sprintf("line %d: expected an instance ID or id,region, got \"%s\"", line, text))
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read instances from stdin: %s", err)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid --instances-from-stdin input: %s", strings.Join(problems, "; "))
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instances read from stdin")
+	}
+	return instances, nil
+}
+
+// validateStdinArgs rejects the filters that --instances-from-stdin
+// replaces, then reads the instances.
+func (c *CheckConfig) validateStdinArgs() error {
+	switch {
+	case c.ec2FilterTags != "" || c.ec2InstanceTags != "":
+		return fmt.Errorf("--instances-from-stdin cannot be combined with --ec2-filter-tags or --ec2-instance-tags")
+	case c.ec2InstanceIds != "" || c.idsOnly:
+		return fmt.Errorf("--instances-from-stdin cannot be combined with --ec2-instance-ids or --ids-only")
+	case c.filtersFromEntityLabels != "":
+		return fmt.Errorf("--instances-from-stdin cannot be combined with --filters-from-entity-labels")
+	case c.prune:
+		return fmt.Errorf("--instances-from-stdin cannot be combined with --prune, which would delete every other entity")
+	}
+	instances, err := parseStdinInstances(c.stdinReader())
+	if err != nil {
+		return err
+	}
+	c.stdinInstances = make(map[string]stdinInstance)
+	for _, instance := range instances {
+		if _, ok := c.stdinInstances[instance.Id]; !ok {
+			c.ec2InstanceIdList = append(c.ec2InstanceIdList, instance.Id)
+		}
+		c.stdinInstances[instance.Id] = instance
+	}
+	return nil
+}
+
+// stdinRegions returns the regions named by the instances read from stdin,
+// along with the configured ones when some instances do not name one.
+func (c *CheckConfig) stdinRegions(configured []string) []string {
+	var regions []string
+	anyRegion := false
+	for _, id := range c.ec2InstanceIdList {
+		region := c.stdinInstances[id].Region
+		if region == "" {
+			anyRegion = true
+		} else if !stringInSlice(region, regions) {
+			regions = append(regions, region)
+		}
+	}
+	if anyRegion {
+		for _, region := range configured {
+			if !stringInSlice(region, regions) {
+				regions = append(regions, region)
+			}
+		}
+	}
+	return regions
+}
+
+// instanceIdsFor returns the --ec2-instance-ids or, with
+// --instances-from-stdin, the instances to look for in a region.
+func (c *CheckConfig) instanceIdsFor(region string) []string {
+	if c.stdinInstances == nil {
+		return c.ec2InstanceIdList
+	}
+	var ids []string
+	for _, id := range c.ec2InstanceIdList {
+		if instanceRegion := c.stdinInstances[id].Region; instanceRegion == "" || instanceRegion == region {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateStdinArgs(t *testing.T) {
+	c := testConfig()
+	c.instancesFromStdin = true
+	c.stdin = strings.NewReader("# from the CMDB\ni-0aa\n\ni-0bb,eu-west-1\ni-0cc, us-east-1\ni-0aa\n")
+	if err := c.validateStdinArgs(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(c.ec2InstanceIdList, ",") != "i-0aa,i-0bb,i-0cc" {
+		t.Errorf("unexpected instances: %v", c.ec2InstanceIdList)
+	}
+
+	regions := c.stdinRegions([]string{"us-west-2", "eu-west-1"})
+	if strings.Join(regions, ",") != "eu-west-1,us-east-1,us-west-2" {
+		t.Errorf("unexpected regions: %v", regions)
+	}
+	if ids := c.instanceIdsFor("eu-west-1"); strings.Join(ids, ",") != "i-0aa,i-0bb" {
+		t.Errorf("unexpected instances of eu-west-1: %v", ids)
+	}
+	if ids := c.instanceIdsFor("us-west-2"); strings.Join(ids, ",") != "i-0aa" {
+		t.Errorf("unexpected instances of us-west-2: %v", ids)
+	}
+
+	missing := c.missingInstanceIds(map[string]bool{"i-0aa": true, "i-0cc": true})
+	if strings.Join(missing, ",") != "i-0bb (line 4)" {
+		t.Errorf("unexpected missing instances: %v", missing)
+	}
+}
+
+func TestValidateStdinArgsRejectsFilters(t *testing.T) {
+	c := testConfig()
+	c.instancesFromStdin = true
+	c.ec2InstanceTags = "env=prod"
+	c.stdin = strings.NewReader("i-0aa\n")
+	if err := c.validateStdinArgs(); err == nil || !strings.Contains(err.Error(), "--ec2-instance-tags") {
+		t.Errorf("expected the tag filters to be rejected, got %v", err)
+	}
+
+	c = testConfig()
+	c.stdin = strings.NewReader("i-0aa\nweb-1\ni-0bb,eu-west-1,extra\n")
+	err := c.validateStdinArgs()
+	if err == nil || !strings.Contains(err.Error(), "line 2:") || !strings.Contains(err.Error(), "line 3:") {
+		t.Errorf("expected every malformed line to be reported, got %v", err)
+	}
+
+	c = testConfig()
+	c.stdin = strings.NewReader("\n# nothing\n")
+	if err := c.validateStdinArgs(); err == nil {
+		t.Error("expected an error without instances")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// entitySubscriptionPrefix marks the subscription the backend gives every
+// entity to be targeted by name.
+const entitySubscriptionPrefix = "entity:"
+
+// parsePlatformSubscriptions parses semicolon-separated
+// platform=subscription,... pairs.
+func parsePlatformSubscriptions(spec string) (map[string][]string, error) {
+	platforms := make(map[string][]string)
+	for _, pair := range strings.Split(spec, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		platform := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || platform == "" {
+			return nil, fmt.Errorf("invalid --platform-subscriptions entry \"%s\", expected platform=subscription,...", pair)
+		}
+		if platform != "linux" && platform != "windows" {
+			return nil, fmt.Errorf("unknown --platform-subscriptions platform \"%s\", expected linux or windows", platform)
+		}
+		platforms[platform] = splitList(parts[1])
+	}
+	return platforms, nil
+}
+
+// instancePlatform returns "windows" for Windows instances, according to
+// their Platform, and "linux" for any other. The PlatformDetails field is
+// not available in the version of the AWS SDK in use.
+func instancePlatform(instance *ec2.Instance) string {
+	if strings.Contains(strings.ToLower(aws.StringValue(instance.Platform)), "windows") {
+		return "windows"
+	}
+	return "linux"
+}
+
+// subscriptionsOf returns the subscriptions of the entity of an
+// instance: those of --platform-subscriptions for its platform, then those
+// of --entity-subscriptions along with the entity subscription of its
+// name, like an agent entity has.
+func (c *CheckConfig) subscriptionsOf(name string, instance *ec2.Instance) []string {
+	subscriptions := c.platformSubscriptionMap[instancePlatform(instance)]
+	extra := splitList(c.entitySubscriptions)
+	if len(extra) == 0 {
+		return subscriptions
+	}
+	merged := append([]string{}, subscriptions...)
+	for _, subscription := range append(extra, entitySubscriptionPrefix+name) {
+		if !stringInSlice(subscription, merged) {
+			merged = append(merged, subscription)
+		}
+	}
+	return merged
+}
+
+// mergeSubscriptions returns the desired subscriptions along with the
+// entity subscription the backend added to the existing entity, so that
+// writing them neither drops it nor counts as a change.
+func mergeSubscriptions(existing []string, desired []string) []string {
+	merged := append([]string{}, desired...)
+	for _, subscription := range existing {
+		if strings.HasPrefix(subscription, entitySubscriptionPrefix) && !stringInSlice(subscription, merged) {
+			merged = append(merged, subscription)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestPlatformSubscriptions(t *testing.T) {
+	c := testConfig()
+	var err error
+	c.platformSubscriptionMap, err = parsePlatformSubscriptions("linux=linux-proxy,ec2; windows=windows-proxy,ec2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linux := testInstance("i-0123", "running")
+	windows := testInstance("i-0456", "running")
+	windows.Platform = aws.String("windows")
+	if subscriptions := c.buildEntity(linux).Subscriptions; strings.Join(subscriptions, ",") != "linux-proxy,ec2" {
+		t.Errorf("unexpected Linux subscriptions: %v", subscriptions)
+	}
+	entity := c.buildEntity(windows)
+	if strings.Join(entity.Subscriptions, ",") != "windows-proxy,ec2" {
+		t.Errorf("unexpected Windows subscriptions: %v", entity.Subscriptions)
+	}
+
+	// The backend's entity subscription is kept and does not count as a
+	// change.
+	existing := c.buildEntity(windows)
+	existing.Subscriptions = append(existing.Subscriptions, "entity:i-0456")
+	if updated := c.planUpdate(existing, entity); updated != nil {
+		t.Errorf("unexpected update: %v", updated.Subscriptions)
+	}
+	existing.Subscriptions = []string{"linux-proxy", "entity:i-0456"}
+	updated := c.planUpdate(existing, entity)
+	if updated == nil || strings.Join(updated.Subscriptions, ",") != "windows-proxy,ec2,entity:i-0456" {
+		t.Errorf("unexpected update: %v", updated)
+	}
+
+	for _, spec := range []string{"linux", "macos=mac-proxy"} {
+		if _, err := parsePlatformSubscriptions(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestEntitySubscriptions(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.platformSubscriptionMap, _ = parsePlatformSubscriptions("linux=linux-proxy,ec2")
+
+	// Without --entity-subscriptions, nothing changes.
+	instance := testInstance("i-0123", "running")
+	if subscriptions := c.buildEntity(instance).Subscriptions; strings.Join(subscriptions, ",") != "linux-proxy,ec2" {
+		t.Errorf("unexpected subscriptions: %v", subscriptions)
+	}
+	c.registerInstance(instance)
+
+	c.entitySubscriptions = "ec2, ping"
+	if subscriptions := c.buildEntity(instance).Subscriptions; strings.Join(subscriptions, ",") != "linux-proxy,ec2,ping,entity:i-0123" {
+		t.Errorf("unexpected subscriptions: %v", subscriptions)
+	}
+
+	// Existing entities get them through the update path.
+	if result := c.registerInstance(instance); result.Outcome != outcomeUpdated {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if subscriptions := backend.entity("i-0123").Subscriptions; strings.Join(subscriptions, ",") != "linux-proxy,ec2,ping,entity:i-0123" {
+		t.Errorf("unexpected subscriptions: %v", subscriptions)
+	}
+	if result := c.registerInstance(instance); result.Outcome != outcomeExists {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	statusOK       = 0
+	statusWarning  = 1
+	statusCritical = 2
+)
+
+// statusNames are the names of the check statuses in --exit-policy and in
+// the summary.
+var statusNames = map[int]string{
+	statusOK:       "ok",
+	statusWarning:  "warning",
+	statusCritical: "critical",
+}
+
+// The outcome categories whose status --exit-policy configures.
+const (
+	categoryPartialRegionFailure   = "partial-region-failure"
+	categoryFailuresBelowThreshold = "registration-failures-below-threshold"
+	categoryPruneGuard             = "prune-guard-triggered"
+	categoryThrottled              = "throttled"
+	categoryEmptyRegion            = "empty-region"
+	categoryEntityLimit            = "entity-limit"
+	categoryVerificationFailed     = "verification-failed"
+)
+
+// exitPolicyCategories lists the configurable categories in the order they
+// are reported.
+var exitPolicyCategories = []string{
+	categoryPartialRegionFailure,
+	categoryFailuresBelowThreshold,
+	categoryPruneGuard,
+	categoryThrottled,
+	categoryEmptyRegion,
+	categoryEntityLimit,
+	categoryVerificationFailed,
+}
+
+// defaultExitPolicy preserves the statuses these outcomes had before they
+// were configurable.
+var defaultExitPolicy = map[string]int{
+	categoryPartialRegionFailure:   statusWarning,
+	categoryFailuresBelowThreshold: statusOK,
+	categoryPruneGuard:             statusWarning,
+	categoryThrottled:              statusOK,
+	categoryEmptyRegion:            statusWarning,
+	categoryEntityLimit:            statusWarning,
+	categoryVerificationFailed:     statusWarning,
+}
+
+// parseExitPolicy parses comma-separated category=status pairs.
+func parseExitPolicy(spec string) (map[string]int, error) {
+	policy := make(map[string]int)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --exit-policy entry \"%s\", expected category=status", pair)
+		}
+		category, name := strings.TrimSpace(parts[0]), strings.ToLower(strings.TrimSpace(parts[1]))
+		if _, ok := defaultExitPolicy[category]; !ok {
+			return nil, fmt.Errorf("unknown --exit-policy category \"%s\", expected one of %s", category, strings.Join(exitPolicyCategories, ", "))
+		}
+		status := -1
+		for value, statusName := range statusNames {
+			if statusName == name {
+				status = value
+			}
+		}
+		if status < 0 {
+			return nil, fmt.Errorf("invalid --exit-policy status \"%s\" for %s, expected ok, warning or critical", parts[1], category)
+		}
+		policy[category] = status
+	}
+	return policy, nil
+}
+
+// exitPolicyStatus returns the status of an outcome category, as overridden
+// by --exit-policy.
+func (c *CheckConfig) exitPolicyStatus(category string) int {
+	if status, ok := c.exitPolicyMap[category]; ok {
+		return status
+	}
+	return defaultExitPolicy[category]
+}
+
+// effectiveExitPolicy describes the status of every configurable category.
+func (c *CheckConfig) effectiveExitPolicy() string {
+	var pairs []string
+	for _, category := range exitPolicyCategories {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", category, statusNames[c.exitPolicyStatus(category)]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+const (
+	outcomeCreated     = "created"
+	outcomeExists      = "exists"
+	outcomeUpdated     = "updated"
+	outcomeFailed      = "failed"
+	outcomeDryRun      = "would-register"
+	outcomeWouldUpdate = "would-update"
+	outcomeAdopted     = "adopted"
+	outcomeSubmitted   = "submitted"
+	outcomeIgnored     = "ignored"
+	outcomeDeleted     = "deleted"
+)
+
+// registrationResult is the outcome of registering a single instance.
+type registrationResult struct {
+	InstanceId  string
+	Entity      string
+	Outcome     string
+	Reason      string
+	Throttled   bool
+	EntityLimit bool
+}
+
+// runSummary accumulates the results of a discovery run.
+type runSummary struct {
+	discovered               int
+	regions                  map[string]int
+	examined                 map[string]int
+	deletedDueToState        int
+	excluded                 int
+	otherShards              int
+	tagRegexRejected         map[string]int
+	launchTemplateRejected   int
+	filterExpressionRejected int
+	filterExpressionErrors   int
+	ignored                  int
+	outcomes                 map[string]int
+	failures                 []registrationResult
+	interrupted              bool
+	countDeltas              []string
+	regionFailures           []string
+	failedRegions            map[string]bool
+	previousRegions          map[string]int
+	emptyRegions             []string
+	missingInstanceIds       []string
+	pruneGuard               string
+	pruned                   map[string]int
+	throttled                int
+	entityLimitRejected      int
+	drift                    *driftCounts
+	verification             *verificationReport
+	accountNamespaces        map[accountNamespaceCount]int
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{outcomes: make(map[string]int), regions: make(map[string]int), examined: make(map[string]int), tagRegexRejected: make(map[string]int), pruned: make(map[string]int), failedRegions: make(map[string]bool), accountNamespaces: make(map[accountNamespaceCount]int)}
+}
+
+func (s *runSummary) add(result registrationResult) {
+	s.outcomes[result.Outcome]++
+	if result.EntityLimit {
+		s.entityLimitRejected++
+	} else if result.Outcome == outcomeFailed {
+		s.failures = append(s.failures, result)
+	}
+	if result.Throttled {
+		s.throttled++
+	}
+}
+
+// belowMinimum reports whether fewer instances were discovered than
+// --min-instances expects.
+func (s *runSummary) belowMinimum(c *CheckConfig) bool {
+	return uint64(s.discovered) < c.minInstances
+}
+
+// status computes the check status, see statusCause.
+func (s *runSummary) status(c *CheckConfig) int {
+	status, _ := s.statusCause(c)
+	return status
+}
+
+// statusCause computes the check status from the failure and minimum
+// instances thresholds, and the exit policy of the other outcomes. An
+// interrupted run, or one whose instance count changed too much since the
+// previous run, is at least a warning. It also returns the category that
+// drove the status, the first of the most severe ones, or "" when OK.
+func (s *runSummary) statusCause(c *CheckConfig) (int, string) {
+	failed := uint64(len(s.failures) + s.entityLimitRejected)
+	causes := []struct {
+		category string
+		status   int
+		applies  bool
+	}{
+		{"registration-failures", statusCritical, c.failureCriticalThreshold > 0 && failed >= c.failureCriticalThreshold},
+		{"min-instances", statusWarning, s.belowMinimum(c) && c.minInstancesStatus != "critical"},
+		{"min-instances", statusCritical, s.belowMinimum(c) && c.minInstancesStatus == "critical"},
+		{"registration-failures", statusWarning, c.failureWarningThreshold > 0 && failed >= c.failureWarningThreshold},
+		{"interrupted", statusWarning, s.interrupted},
+		{"max-delta-percent", statusWarning, len(s.countDeltas) > 0},
+		{categoryPartialRegionFailure, c.exitPolicyStatus(categoryPartialRegionFailure), len(s.regionFailures) > 0},
+		{categoryFailuresBelowThreshold, c.exitPolicyStatus(categoryFailuresBelowThreshold), failed > 0 && (c.failureWarningThreshold == 0 || failed < c.failureWarningThreshold)},
+		{categoryPruneGuard, c.exitPolicyStatus(categoryPruneGuard), s.pruneGuard != ""},
+		{categoryThrottled, c.exitPolicyStatus(categoryThrottled), s.throttled > 0},
+		{categoryEmptyRegion, c.exitPolicyStatus(categoryEmptyRegion), len(s.emptyRegions) > 0},
+		{categoryEntityLimit, c.exitPolicyStatus(categoryEntityLimit), s.entityLimitRejected > 0 || s.entityLimitApproaching(c)},
+		{categoryVerificationFailed, c.exitPolicyStatus(categoryVerificationFailed), s.verification != nil && len(s.verification.failures) > 0},
+		{"credential-fallback", statusWarning, c.credentialFallbackWarning() != ""},
+		{"drift", statusCritical, s.drift != nil && c.driftCriticalThreshold > 0 && uint64(s.drift.total()) >= c.driftCriticalThreshold},
+		{"drift", statusWarning, s.drift != nil && c.driftWarningThreshold > 0 && uint64(s.drift.total()) >= c.driftWarningThreshold},
+	}
+	status, category := statusOK, ""
+	for _, cause := range causes {
+		if cause.applies && cause.status > status {
+			status, category = cause.status, cause.category
+		}
+	}
+	return status, category
+}
+
+// printRegions writes a line per region with the instances DescribeInstances
+// returned, every page of them, before the filters applied here.
+func (s *runSummary) printRegions(w io.Writer) {
+	var regions []string
+	for region := range s.examined {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		fmt.Fprintf(w, "region %s: %d instances examined, %d discovered\n", region, s.examined[region], s.regions[region])
+	}
+}
+
+func (s *runSummary) print(w io.Writer, c *CheckConfig) {
+	if c.scope != "" {
+		fmt.Fprintf(w, "scope %s: ", c.scope)
+	}
+	fmt.Fprintf(w, "discovered %d instances: %d created, %d updated, %d already existed, %d failed, %d deleted due to state (%s, correlation ID %s)\n",
+		s.discovered, s.outcomes[outcomeCreated], s.outcomes[outcomeUpdated], s.outcomes[outcomeExists], s.outcomes[outcomeFailed], s.deletedDueToState, userAgent(), c.correlationId)
+	if c.simulate > 0 {
+		writes := "sent to " + c.sensuApiUrl
+		if c.simulateSink {
+			writes = "discarded (--simulate-sink)"
+		}
+		fmt.Fprintf(w, "simulated: %d synthetic instances with %d tags of %d characters, writes %s\n", c.simulate, c.simulateTags, c.simulateLabelSize, writes)
+	}
+	s.printRegions(w)
+	if s.belowMinimum(c) {
+		fmt.Fprintf(w, "discovered fewer instances than the expected minimum of %d with regions=%s filters: %s\n", c.minInstances, c.ec2InstanceRegions, describeFilters(c.ec2Filters))
+	}
+	for _, delta := range s.countDeltas {
+		fmt.Fprintf(w, "instance count changed beyond --max-delta-percent: %s\n", delta)
+	}
+	if s.interrupted {
+		fmt.Fprintf(w, "interrupted: discovery stopped early, the counts above cover the work done so far\n")
+	}
+	if s.excluded > 0 {
+		fmt.Fprintf(w, "excluded %d instances (--ec2-exclude-instance-ids)\n", s.excluded)
+	}
+	for _, filter := range c.tagRegexFilters {
+		if rejected := s.tagRegexRejected[filter.String()]; rejected > 0 {
+			fmt.Fprintf(w, "--ec2-tag-regex %s rejected %d instances\n", filter, rejected)
+		}
+	}
+	if c.shardCount > 1 {
+		fmt.Fprintf(w, "shard %d of %d: %d instances left to the other shards\n", c.shardIndex, c.shardCount, s.otherShards)
+	}
+	if s.launchTemplateRejected > 0 {
+		fmt.Fprintf(w, "launch template selectors rejected %d instances\n", s.launchTemplateRejected)
+	}
+	if s.filterExpressionRejected > 0 || s.filterExpressionErrors > 0 {
+		fmt.Fprintf(w, "--filter-expression rejected %d instances, failed on %d\n", s.filterExpressionRejected, s.filterExpressionErrors)
+	}
+	if c.protection != nil {
+		c.protection.Lock()
+		fmt.Fprintf(w, "termination protection: %d instances checked, %d from the cache, %d failed\n", c.protection.checked, c.protection.cached, c.protection.failed)
+		c.protection.Unlock()
+	}
+	if c.churn != nil {
+		c.churn.Lock()
+		fmt.Fprintf(w, "churn control: %d updates deferred by --min-update-interval\n", c.churn.deferred)
+		c.churn.Unlock()
+	}
+	if c.volumes != nil {
+		c.volumes.Lock()
+		fmt.Fprintf(w, "EBS volumes: %d described, %d gone or detached, %d failed\n", c.volumes.described, c.volumes.missing, c.volumes.failed)
+		c.volumes.Unlock()
+	}
+	if c.pricing != nil {
+		c.pricing.Lock()
+		fmt.Fprintf(w, "on-demand prices: %d looked up, %d failed\n", c.pricing.lookups, c.pricing.failed)
+		c.pricing.Unlock()
+	}
+	c.timeouts.print(w)
+	for _, id := range s.missingInstanceIds {
+		fmt.Fprintf(w, "not found: instance %s is not among the discovered instances\n", id)
+	}
+	s.printAccountNamespaces(w, c)
+	for _, failure := range s.regionFailures {
+		fmt.Fprintf(w, "failed to describe instances in %s\n", failure)
+	}
+	for _, empty := range s.emptyRegions {
+		fmt.Fprintf(w, "empty region: %s\n", empty)
+	}
+	if len(s.pruned) > 0 {
+		verb := "pruned"
+		if c.pruneDryRun() {
+			verb = "would prune"
+		}
+		namespaces := make([]string, 0, len(s.pruned))
+		for namespace := range s.pruned {
+			namespaces = append(namespaces, namespace)
+		}
+		sort.Strings(namespaces)
+		for _, namespace := range namespaces {
+			fmt.Fprintf(w, "%s %d entities in namespace \"%s\"\n", verb, s.pruned[namespace], namespace)
+		}
+	}
+	if s.pruneGuard != "" {
+		fmt.Fprintf(w, "prune guard triggered: %s\n", s.pruneGuard)
+	}
+	if s.throttled > 0 {
+		fmt.Fprintf(w, "throttled: %d requests were rate limited\n", s.throttled)
+	}
+	if warning := c.credentialFallbackWarning(); warning != "" {
+		fmt.Fprintf(w, "WARNING: %s, check the credentials\n", warning)
+	}
+	if c.transport == transportAgentApi {
+		fmt.Fprintf(w, "transport: %s, %d entities submitted to the agent at %s, entities are neither updated nor deleted\n", transportAgentApi, s.outcomes[outcomeSubmitted], c.agentApiUrl)
+	}
+	if ignored := s.outcomes[outcomeIgnored] + s.ignored; ignored > 0 {
+		fmt.Fprintf(w, "ignored %d entities annotated %s: %s\n", ignored, ignoreAnnotation, ignoreValue)
+	}
+	if s.outcomes[outcomeAdopted] > 0 {
+		fmt.Fprintf(w, "adopted %d existing entities\n", s.outcomes[outcomeAdopted])
+	}
+	if s.outcomes[outcomeDryRun] > 0 || s.outcomes[outcomeWouldUpdate] > 0 {
+		fmt.Fprintf(w, "dry-run: %d entities would be registered, %d updated across %d regions (write strategy %s)\n", s.outcomes[outcomeDryRun], s.outcomes[outcomeWouldUpdate], len(s.regions), c.writeStrategy)
+	}
+	if s.drift != nil {
+		fmt.Fprintf(w, "drift: %d entities missing, %d stale, %d drifted (monitor mode, no writes)\n", s.drift.missing, s.drift.stale, s.drift.drifted)
+	}
+	s.printEntityLimit(w, c)
+	if s.verification != nil {
+		fmt.Fprintf(w, "verification: %d of %d written entities read back, %d failed, %d rewritten\n", s.verification.verified, s.verification.written, len(s.verification.failures), s.verification.rewritten)
+		for i, failure := range s.verification.failures {
+			if uint64(i) >= c.maxReportedFailures {
+				fmt.Fprintf(w, "... and %d more failed verifications\n", len(s.verification.failures)-i)
+				break
+			}
+			fmt.Fprintf(w, "verification failed: %s/%s: %s\n", failure.namespace, failure.name, failure.reason)
+		}
+	}
+	printFailureGroups(w, s.failures)
+	for i, failure := range s.failures {
+		if uint64(i) >= c.maxReportedFailures {
+			fmt.Fprintf(w, "... and %d more failed instances\n", len(s.failures)-i)
+			break
+		}
+		fmt.Fprintf(w, "failed: %s: %s\n", failure.InstanceId, failure.Reason)
+	}
+	status, category := s.statusCause(c)
+	if category == "" {
+		category = "no outcome above ok"
+	}
+	fmt.Fprintf(w, "status: %s (%s), exit policy: %s\n", strings.ToUpper(statusNames[status]), category, c.effectiveExitPolicy())
+}
+
+// printFailureGroups summarizes identical failure reasons on a single line
+// each, most frequent first.
+func printFailureGroups(w io.Writer, failures []registrationResult) {
+	counts := make(map[string]int)
+	var reasons []string
+	for _, failure := range failures {
+		if counts[failure.Reason] == 0 {
+			reasons = append(reasons, failure.Reason)
+		}
+		counts[failure.Reason]++
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if counts[reasons[i]] != counts[reasons[j]] {
+			return counts[reasons[i]] > counts[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "%d instances failed with: %s\n", counts[reason], reason)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestRunSummary(t *testing.T) {
+	c := testConfig()
+	c.failureWarningThreshold = 1
+	c.failureCriticalThreshold = 3
+	c.maxReportedFailures = 2
+
+	summary := newRunSummary()
+	summary.discovered = 4
+	summary.add(registrationResult{InstanceId: "i-0", Outcome: outcomeCreated})
+	if status := summary.status(c); status != statusOK {
+		t.Errorf("unexpected status without failures: %d", status)
+	}
+	for i := 1; i <= 3; i++ {
+		summary.add(registrationResult{InstanceId: fmt.Sprintf("i-%d", i), Outcome: outcomeFailed, Reason: "400 Bad Request: label key invalid"})
+		expected := statusWarning
+		if i == 3 {
+			expected = statusCritical
+		}
+		if status := summary.status(c); status != expected {
+			t.Errorf("unexpected status with %d failures: %d", i, status)
+		}
+	}
+
+	var output bytes.Buffer
+	summary.print(&output, c)
+	for _, expected := range []string{
+		"1 created, 0 updated, 0 already existed, 3 failed",
+		"3 instances failed with: 400 Bad Request: label key invalid\n",
+		"failed: i-1: 400 Bad Request: label key invalid\n",
+		"failed: i-2: 400 Bad Request: label key invalid\n",
+		"... and 1 more failed instances\n",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("summary is missing %q:\n%s", expected, output.String())
+		}
+	}
+}
+
+func TestRunSummaryInterrupted(t *testing.T) {
+	c := testConfig()
+	c.failureWarningThreshold = 1
+
+	summary := newRunSummary()
+	summary.discovered = 2
+	summary.add(registrationResult{InstanceId: "i-0", Outcome: outcomeCreated})
+	summary.interrupted = true
+	if status := summary.status(c); status != statusWarning {
+		t.Errorf("unexpected status of an interrupted run: %d", status)
+	}
+
+	var output bytes.Buffer
+	summary.print(&output, c)
+	if !strings.Contains(output.String(), "interrupted: ") {
+		t.Errorf("summary does not mention the interruption:\n%s", output.String())
+	}
+}
+
+func TestRunSummaryMinInstances(t *testing.T) {
+	c := testConfig()
+	c.minInstances = 1
+	c.minInstancesStatus = "warning"
+	c.ec2InstanceRegions = "us-west-2"
+	c.ec2Filters = []*ec2.Filter{{Name: aws.String("tag:env"), Values: aws.StringSlice([]string{"prod"})}}
+
+	summary := newRunSummary()
+	summary.add(registrationResult{InstanceId: "i-0", Outcome: outcomeDryRun})
+	if status := summary.status(c); status != statusWarning {
+		t.Errorf("unexpected status below the minimum: %d", status)
+	}
+	c.minInstancesStatus = "critical"
+	if status := summary.status(c); status != statusCritical {
+		t.Errorf("unexpected status below the minimum: %d", status)
+	}
+
+	var output bytes.Buffer
+	summary.print(&output, c)
+	if !strings.Contains(output.String(), "minimum of 1 with regions=us-west-2 filters: tag:env=prod\n") {
+		t.Errorf("summary does not report the effective filters:\n%s", output.String())
+	}
+
+	summary.discovered = 1
+	if status := summary.status(c); status != statusOK {
+		t.Errorf("unexpected status at the minimum: %d", status)
+	}
+}
+
+func TestExitPolicy(t *testing.T) {
+	c := testConfig()
+	c.failureWarningThreshold = 5
+
+	summary := newRunSummary()
+	summary.discovered = 3
+	summary.add(registrationResult{InstanceId: "i-0", Outcome: outcomeFailed, Reason: "429 Too Many Requests", Throttled: true})
+	if status, category := summary.statusCause(c); status != statusOK || category != "" {
+		t.Errorf("unexpected default status: %d (%s)", status, category)
+	}
+	summary.regionFailures = []string{"region eu-west-1: RequestLimitExceeded"}
+	summary.pruneGuard = "3 entities would be deleted"
+	if status, category := summary.statusCause(c); status != statusWarning || category != categoryPartialRegionFailure {
+		t.Errorf("unexpected default status: %d (%s)", status, category)
+	}
+
+	policy, err := parseExitPolicy("throttled=critical, prune-guard-triggered=ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.exitPolicyMap = policy
+	if status, category := summary.statusCause(c); status != statusCritical || category != categoryThrottled {
+		t.Errorf("unexpected status: %d (%s)", status, category)
+	}
+
+	var output bytes.Buffer
+	summary.print(&output, c)
+	expected := "status: CRITICAL (throttled), exit policy: partial-region-failure=warning,registration-failures-below-threshold=ok,prune-guard-triggered=ok,throttled=critical,empty-region=warning,entity-limit=warning,verification-failed=warning\n"
+	if !strings.Contains(output.String(), expected) {
+		t.Errorf("summary does not state the policy:\n%s", output.String())
+	}
+
+	for _, spec := range []string{"throttled", "unknown=ok", "throttled=fatal"} {
+		if _, err := parseExitPolicy(spec); err == nil {
+			t.Errorf("expected an error for --exit-policy %q", spec)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// tagRegexFilter matches the value of a tag against a regular expression,
+// client-side, since EC2 filters only support exact values and wildcards.
+type tagRegexFilter struct {
+	key     string
+	pattern *regexp.Regexp
+}
+
+func (f *tagRegexFilter) String() string {
+	return fmt.Sprintf("%s=%s", f.key, f.pattern)
+}
+
+// parseTagRegexFilters parses key=pattern filters, one per line, since
+// patterns may contain commas.
+func parseTagRegexFilters(spec string) ([]*tagRegexFilter, error) {
+	var filters []*tagRegexFilter
+	for _, entry := range strings.Split(spec, "\n") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid --ec2-tag-regex \"%s\", expected key=pattern", entry)
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --ec2-tag-regex for \"%s\": %s", key, err)
+		}
+		filters = append(filters, &tagRegexFilter{key: key, pattern: pattern})
+	}
+	return filters, nil
+}
+
+// rejectingTagRegexFilters returns the filters an instance does not match.
+// An instance without the tag matches no filter on it.
+func (c *CheckConfig) rejectingTagRegexFilters(instance *ec2.Instance) []*tagRegexFilter {
+	var rejecting []*tagRegexFilter
+	for _, filter := range c.tagRegexFilters {
+		matched := false
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) == filter.key {
+				matched = filter.pattern.MatchString(aws.StringValue(tag.Value))
+				break
+			}
+		}
+		if !matched {
+			rejecting = append(rejecting, filter)
+		}
+	}
+	return rejecting
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestParseTagRegexFilters(t *testing.T) {
+	filters, err := parseTagRegexFilters("Environment=^prod-(eu|us)$\n\n team = ^(web,api)$ \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 2 || filters[0].String() != "Environment=^prod-(eu|us)$" || filters[1].String() != "team=^(web,api)$" {
+		t.Errorf("unexpected filters %v", filters)
+	}
+
+	for _, spec := range []string{"Environment", "=^prod$", "Environment=", "Environment=^prod-(eu$"} {
+		if _, err := parseTagRegexFilters(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestTagRegexFilters(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	var err error
+	if c.tagRegexFilters, err = parseTagRegexFilters("Environment=^prod-(eu|us)$\nteam=^web$"); err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := func(id string, tags map[string]string) *discoveredInstance {
+		instance := testInstance(id, "running")
+		for key, value := range tags {
+			instance.Tags = append(instance.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		return instance
+	}
+	run := c.newDiscoveryRun()
+	c.processInstance(run, tagged("i-1", map[string]string{"Environment": "prod-eu", "team": "web"}))
+	c.processInstance(run, tagged("i-2", map[string]string{"Environment": "prod-ap", "team": "web"}))
+	c.processInstance(run, tagged("i-3", map[string]string{"Environment": "prod-us-2", "team": "api"}))
+	c.processInstance(run, tagged("i-4", map[string]string{"team": "web"}))
+
+	if run.summary.discovered != 1 || !run.discovered["i-1"] || backend.entity("i-1") == nil {
+		t.Errorf("expected only i-1 to be discovered: %v", run.discovered)
+	}
+	var output bytes.Buffer
+	run.summary.print(&output, c)
+	for _, line := range []string{
+		"--ec2-tag-regex Environment=^prod-(eu|us)$ rejected 3 instances",
+		"--ec2-tag-regex team=^web$ rejected 1 instances",
+	} {
+		if !strings.Contains(output.String(), line) {
+			t.Errorf("missing %q in summary:\n%s", line, output.String())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// printRunMetrics writes the metrics of the run in the Prometheus text
+// format, the phase durations only with timings.
+func (c *CheckConfig) printRunMetrics(w io.Writer, summary *runSummary, timings bool) {
+	if timings {
+		c.timings.printMetrics(w)
+	}
+	summary.drift.printMetrics(w)
+	c.timeouts.printMetrics(w)
+	c.images.printMetrics(w)
+}
+
+// printTelemetry writes the metrics of the run along with its timestamp,
+// status and counts, for --telemetry-textfile.
+func (c *CheckConfig) printTelemetry(w io.Writer, summary *runSummary, now time.Time) {
+	fmt.Fprintf(w, "sensu_ec2_discovery_last_run_timestamp_seconds %d\n", now.Unix())
+	fmt.Fprintf(w, "sensu_ec2_discovery_last_run_status %d\n", summary.status(c))
+	fmt.Fprintf(w, "sensu_ec2_discovery_instances_discovered %d\n", summary.discovered)
+	var regions []string
+	for region := range summary.regions {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		fmt.Fprintf(w, "sensu_ec2_discovery_region_instances{region=\"%s\",failed=\"%t\"} %d\n", region, summary.failedRegions[region], summary.regions[region])
+	}
+	var outcomes []string
+	for outcome := range summary.outcomes {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+	for _, outcome := range outcomes {
+		fmt.Fprintf(w, "sensu_ec2_discovery_entities{outcome=\"%s\"} %d\n", outcome, summary.outcomes[outcome])
+	}
+	counts := c.errorCategories.snapshot()
+	var categories []string
+	for category := range counts {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		fmt.Fprintf(w, "sensu_ec2_discovery_errors{category=\"%s\"} %d\n", category, counts[category].Count)
+	}
+	c.printRunMetrics(w, summary, true)
+}
+
+// writeTelemetry replaces --telemetry-textfile with the metrics of the run,
+// for the textfile collector of node_exporter. The temporary file written
+// first does not end in .prom, so the collector never reads a partial
+// file.
+func (c *CheckConfig) writeTelemetry(summary *runSummary, now time.Time) error {
+	var b bytes.Buffer
+	c.printTelemetry(c.metricsWriter(&b), summary, now)
+	path := c.telemetryTextfile
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("failed to write the telemetry textfile: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write the telemetry textfile: %s", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write the telemetry textfile: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write the telemetry textfile: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write the telemetry textfile: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTelemetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-ec2-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := testConfig()
+	c.telemetryTextfile = filepath.Join(dir, "sensu_ec2_discovery.prom")
+	c.timings = newPhaseTimer()
+	c.timings.since("total", time.Now().Add(-2*time.Second))
+	run := c.newDiscoveryRun()
+	run.summary.discovered = 3
+	run.summary.regions["us-west-2"] = 3
+	run.summary.outcomes[outcomeCreated] = 2
+	run.summary.outcomes[outcomeFailed] = 1
+	c.recordError(&apiStatusError{statusCode: 503}, "register entity i-0123: unavailable")
+
+	now := time.Unix(1700000000, 0)
+	if err := c.writeTelemetry(run.summary, now); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(c.telemetryTextfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"sensu_ec2_discovery_last_run_timestamp_seconds 1700000000\n",
+		"sensu_ec2_discovery_instances_discovered 3\n",
+		"sensu_ec2_discovery_region_instances{region=\"us-west-2\",failed=\"false\"} 3\n",
+		"sensu_ec2_discovery_entities{outcome=\"created\"} 2\n",
+		"sensu_ec2_discovery_errors{category=\"sensu-5xx\"} 1\n",
+		"sensu_ec2_discovery_phase_duration_seconds{phase=\"total\"} 2.",
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("expected %q in %s", line, b)
+		}
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Mode().Perm() != 0644 {
+		t.Errorf("expected the textfile only, readable by the collector, got %v", files)
+	}
+
+	c.telemetryTextfile = filepath.Join(dir, "missing", "sensu_ec2_discovery.prom")
+	if err := c.writeTelemetry(run.summary, now); err == nil {
+		t.Error("expected an error writing to a missing directory")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// instanceTemplateData is what templates rendered per instance can refer
+// to, e.g. {{ .Region }} or {{ .Tags.team }}.
+type instanceTemplateData struct {
+	InstanceId       string
+	InstanceType     string
+	State            string
+	Region           string
+	AvailabilityZone string
+	AccountId        string
+	AccountAlias     string
+	PrivateIp        string
+	PublicIp         string
+	Fqdn             string
+	Tags             map[string]string
+}
+
+func newInstanceTemplateData(instance *discoveredInstance) *instanceTemplateData {
+	data := &instanceTemplateData{
+		InstanceId:   aws.StringValue(instance.InstanceId),
+		InstanceType: aws.StringValue(instance.InstanceType),
+		Region:       instance.Region,
+		PrivateIp:    aws.StringValue(instance.PrivateIpAddress),
+		PublicIp:     aws.StringValue(instance.PublicIpAddress),
+		Fqdn:         instance.Fqdn,
+		Tags:         make(map[string]string),
+	}
+	if instance.State != nil {
+		data.State = aws.StringValue(instance.State.Name)
+	}
+	if instance.Placement != nil {
+		data.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+	if instance.Account != nil {
+		data.AccountId = instance.Account.Id
+		data.AccountAlias = instance.Account.Alias
+	}
+	for _, tag := range instance.Tags {
+		data.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return data
+}
+
+// InstanceID, AccountID, PrivateIP, PublicIP and Tag spell the fields with
+// Go initialisms, e.g. {{ .AccountID }}-{{ .Tag.Name }}.
+func (d *instanceTemplateData) InstanceID() string     { return d.InstanceId }
+func (d *instanceTemplateData) AccountID() string      { return d.AccountId }
+func (d *instanceTemplateData) PrivateIP() string      { return d.PrivateIp }
+func (d *instanceTemplateData) PublicIP() string       { return d.PublicIp }
+func (d *instanceTemplateData) Tag() map[string]string { return d.Tags }
+
+// instanceTemplateFuncs are the functions templates rendered per instance
+// can use besides the builtin ones:
+//
+//	default  the piped value, or the fallback when it is empty, e.g.
+//	         {{ .AccountAlias | default .AccountId }}
+var instanceTemplateFuncs = template.FuncMap{
+	"default": func(fallback string, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// parseInstanceTemplate parses a template rendered per instance. Syntax
+// errors and references to fields instances do not have are reported here;
+// a tag missing on an instance only fails rendering for that instance.
+func parseInstanceTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(instanceTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	check, err := tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if err := check.Option("missingkey=zero").Execute(&bytes.Buffer{}, &instanceTemplateData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func renderInstanceTemplate(tmpl *template.Template, data *instanceTemplateData) (string, error) {
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// parseAnnotationTemplates parses key=template entries, one per line.
+func parseAnnotationTemplates(spec string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	for _, entry := range strings.Split(spec, "\n") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid --annotation-template \"%s\", expected key=template", entry)
+		}
+		tmpl, err := parseInstanceTemplate(key, parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --annotation-template for \"%s\": %s", key, err)
+		}
+		templates[key] = tmpl
+	}
+	return templates, nil
+}
+
+// renderAnnotations renders the annotation templates for an instance,
+// leaving out, with a warning, those that fail for it.
+func (c *CheckConfig) renderAnnotations(instance *discoveredInstance) map[string]string {
+	if len(c.annotationTemplateMap) == 0 {
+		return nil
+	}
+	data := newInstanceTemplateData(instance)
+	annotations := make(map[string]string)
+	for key, tmpl := range c.annotationTemplateMap {
+		value, err := renderInstanceTemplate(tmpl, data)
+		if err != nil {
+			log.Printf("WARNING: failed to render annotation \"%s\" for EC2 instance \"%s\": %s", key, data.InstanceId, err)
+			continue
+		}
+		annotations[key] = value
+	}
+	return annotations
+}
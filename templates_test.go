@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestParseAnnotationTemplates(t *testing.T) {
+	templates, err := parseAnnotationTemplates("runbook=https://wiki/teams/{{ .Tags.team }}/ec2\n\n console = https://{{ .Region }}.console.aws.amazon.com/ec2/home?region={{ .Region }}#InstanceDetails:instanceId={{ .InstanceId }}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) != 2 || templates["runbook"] == nil || templates["console"] == nil {
+		t.Errorf("unexpected templates: %v", templates)
+	}
+
+	for spec, problem := range map[string]string{
+		"runbook":                       "expected key=template",
+		"runbook=https://wiki/{{ .Tags": "unclosed action",
+		"runbook={{ .Team }}":           "can't evaluate field Team",
+	} {
+		if _, err := parseAnnotationTemplates(spec); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected an error about %q for %q, got %v", problem, spec, err)
+		}
+	}
+}
+
+func TestBuildEntityAnnotationTemplates(t *testing.T) {
+	c := testConfig()
+	var err error
+	c.annotationTemplateMap, err = parseAnnotationTemplates("runbook=https://wiki/teams/{{ .Tags.team }}/ec2\nconsole=https://{{ .Region }}.console.aws.amazon.com/ec2/home#InstanceDetails:instanceId={{ .InstanceId }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := testInstance("i-0123", "running")
+	instance.Tags = []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("payments")}}
+
+	entity := c.buildEntity(instance)
+	if entity.Annotations["runbook"] != "https://wiki/teams/payments/ec2" {
+		t.Errorf("unexpected runbook annotation: %q", entity.Annotations["runbook"])
+	}
+	if entity.Annotations["console"] != "https://us-west-2.console.aws.amazon.com/ec2/home#InstanceDetails:instanceId=i-0123" {
+		t.Errorf("unexpected console annotation: %q", entity.Annotations["console"])
+	}
+
+	// An instance without the tag gets the other annotations.
+	entity = c.buildEntity(testInstance("i-0456", "running"))
+	if _, ok := entity.Annotations["runbook"]; ok {
+		t.Errorf("unexpected runbook annotation: %q", entity.Annotations["runbook"])
+	}
+	if entity.Annotations["console"] == "" {
+		t.Error("missing console annotation")
+	}
+
+	existing := c.buildEntity(instance)
+	existing.Labels[managedByLabel] = managedByValue
+	instance.Tags[0].Value = aws.String("billing")
+	if c.planUpdate(existing, c.buildEntity(instance)) == nil {
+		t.Error("a changed annotation does not update the entity")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+const (
+	timeoutSideAws   = "aws"
+	timeoutSideSensu = "sensu"
+)
+
+// apiTimeoutError is an AWS or Sensu API call cut off by --aws-api-timeout
+// or --sensu-api-timeout, as opposed to the overall --timeout.
+type apiTimeoutError struct {
+	side      string
+	operation string
+	timeout   time.Duration
+	err       error
+}
+
+func (e *apiTimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout %s after %s: %s", e.side, e.operation, e.timeout, e.err)
+}
+
+func (e *apiTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// apiTimeout is an AWS or Sensu API call cut off by its timeout, region
+// being empty for Sensu.
+type apiTimeout struct {
+	side      string
+	region    string
+	operation string
+}
+
+// timeoutCounts counts the API calls of a run cut off by their timeout.
+type timeoutCounts struct {
+	sync.Mutex
+	calls  []apiTimeout
+	counts map[apiTimeout]int
+}
+
+func (t *timeoutCounts) add(timeout apiTimeout) {
+	t.Lock()
+	defer t.Unlock()
+	if t.counts == nil {
+		t.counts = make(map[apiTimeout]int)
+	}
+	if t.counts[timeout] == 0 {
+		t.calls = append(t.calls, timeout)
+	}
+	t.counts[timeout]++
+}
+
+// print writes a line per timed out call, in the order they first timed
+// out.
+func (t *timeoutCounts) print(w io.Writer) {
+	t.Lock()
+	defer t.Unlock()
+	for _, timeout := range t.calls {
+		operation := timeout.operation
+		if timeout.region != "" {
+			operation = "in " + timeout.region + " " + operation
+		}
+		fmt.Fprintf(w, "%s timeout %s: %d calls\n", timeout.side, operation, t.counts[timeout])
+	}
+}
+
+// printMetrics writes the timed out calls in the Prometheus text format.
+func (t *timeoutCounts) printMetrics(w io.Writer) {
+	t.Lock()
+	defer t.Unlock()
+	for _, timeout := range t.calls {
+		labels := fmt.Sprintf("side=\"%s\",operation=\"%s\"", timeout.side, timeout.operation)
+		if timeout.region != "" {
+			labels += fmt.Sprintf(",region=\"%s\"", timeout.region)
+		}
+		fmt.Fprintf(w, "sensu_ec2_discovery_api_timeouts_total{%s} %d\n", labels, t.counts[timeout])
+	}
+}
+
+func (c *CheckConfig) validateTimeoutArgs() error {
+	var err error
+	for _, timeout := range []struct {
+		name     string
+		value    string
+		duration *time.Duration
+	}{
+		{"--timeout", c.timeout, &c.timeoutDuration},
+		{"--check-timeout-margin", c.checkTimeoutMargin, &c.checkTimeoutMarginDuration},
+		{"--aws-api-timeout", c.awsApiTimeout, &c.awsApiTimeoutDuration},
+		{"--sensu-api-timeout", c.sensuApiTimeout, &c.sensuApiTimeoutDuration},
+	} {
+		if timeout.value == "" {
+			continue
+		}
+		if *timeout.duration, err = time.ParseDuration(timeout.value); err != nil {
+			return fmt.Errorf("invalid %s: %s", timeout.name, err)
+		}
+	}
+	return nil
+}
+
+// applyCheckTimeout derives the overall timeout from the timeout of the
+// check that triggered the run, less --check-timeout-margin, or half of it
+// when the margin leaves no time, unless --timeout is set.
+func (c *CheckConfig) applyCheckTimeout(event *corev2.Event) {
+	if c.timeout != "" || event == nil || event.Check == nil || event.Check.Timeout == 0 {
+		return
+	}
+	timeout := time.Duration(event.Check.Timeout) * time.Second
+	c.timeoutDuration = timeout - c.checkTimeoutMarginDuration
+	if c.timeoutDuration <= 0 {
+		c.timeoutDuration = timeout / 2
+		log.Printf("WARNING: --check-timeout-margin %s leaves no time within the check timeout of %s, using a timeout of %s", c.checkTimeoutMarginDuration, timeout, c.timeoutDuration)
+		return
+	}
+	log.Printf("INFO: using a timeout of %s, the check timeout of %s less --check-timeout-margin", c.timeoutDuration, timeout)
+}
+
+// awsTimeoutHandlers bounds each AWS API call, retries included, by
+// --aws-api-timeout, and attributes the calls it cuts off to the operation
+// and region they were for. Calls cut off by the overall --timeout or a
+// shutdown are left as they are.
+func (c *CheckConfig) awsTimeoutHandlers(handlers *request.Handlers) {
+	if c.awsApiTimeoutDuration == 0 {
+		return
+	}
+	var mu sync.Mutex
+	cancels := make(map[*request.Request]context.CancelFunc)
+	handlers.Validate.PushFront(func(r *request.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), c.awsApiTimeoutDuration)
+		r.SetContext(ctx)
+		mu.Lock()
+		cancels[r] = cancel
+		mu.Unlock()
+	})
+	// Send returns the error of the attempt before the Complete handlers
+	// run, so the error is rewritten once the attempt it cut off is over.
+	handlers.AfterRetry.PushBack(func(r *request.Request) {
+		if r.Error == nil || r.Context().Err() != context.DeadlineExceeded || c.requestContext().Err() != nil {
+			return
+		}
+		if _, ok := r.Error.(*apiTimeoutError); ok {
+			return
+		}
+		region := aws.StringValue(r.Config.Region)
+		c.timeouts.add(apiTimeout{side: timeoutSideAws, region: region, operation: r.Operation.Name})
+		r.Error = &apiTimeoutError{
+			side:      timeoutSideAws,
+			operation: "in " + region + " " + r.Operation.Name,
+			timeout:   c.awsApiTimeoutDuration,
+			err:       r.Error,
+		}
+	})
+	handlers.Complete.PushBack(func(r *request.Request) {
+		mu.Lock()
+		cancel, ok := cancels[r]
+		delete(cancels, r)
+		mu.Unlock()
+		if ok {
+			cancel()
+		}
+	})
+}
+
+// sensuTimeoutError attributes a Sensu API request error to
+// --sensu-api-timeout, unless the overall --timeout or a shutdown cut the
+// request off.
+func (c *CheckConfig) sensuTimeoutError(method string, path string, err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok || !urlErr.Timeout() || c.sensuApiTimeoutDuration == 0 || c.requestContext().Err() != nil {
+		return err
+	}
+	operation := method + " " + path
+	if i := strings.Index(operation, "?"); i > 0 {
+		operation = operation[:i]
+	}
+	c.timeouts.add(apiTimeout{side: timeoutSideSensu, operation: operation})
+	return &apiTimeoutError{side: timeoutSideSensu, operation: operation, timeout: c.sensuApiTimeoutDuration, err: urlErr.Err}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestAwsApiTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := testConfig()
+	c.awsAccessKeyId, c.awsSecretAccessKey = "AKIAEXAMPLE", "very-secret"
+	c.awsApiTimeout = "50ms"
+	if err := c.validateTimeoutArgs(); err != nil {
+		t.Fatal(err)
+	}
+	awsSession, err := c.newAwsSession("us-east-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := ec2.New(awsSession, &aws.Config{Endpoint: aws.String(server.URL)})
+	_, err = svc.DescribeInstanceStatus(&ec2.DescribeInstanceStatusInput{})
+	if err == nil || !strings.HasPrefix(err.Error(), "aws timeout in us-east-1 DescribeInstanceStatus after 50ms: ") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var metrics bytes.Buffer
+	c.timeouts.printMetrics(&metrics)
+	if metrics.String() != "sensu_ec2_discovery_api_timeouts_total{side=\"aws\",operation=\"DescribeInstanceStatus\",region=\"us-east-1\"} 1\n" {
+		t.Errorf("unexpected metrics %q", metrics.String())
+	}
+
+	// Calls cut off by the overall timeout are not attributed to the AWS
+	// API timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.ctx = ctx
+	_, err = svc.DescribeInstanceStatusWithContext(ctx, &ec2.DescribeInstanceStatusInput{})
+	if err == nil || strings.Contains(err.Error(), "aws timeout") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSensuApiTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuApiTimeout = "50ms"
+	if err := c.validateTimeoutArgs(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.sensuApiRequest("POST", "default", entitiesPath("default")+"?limit=1", strings.NewReader("{}"))
+	if err == nil || !strings.HasPrefix(err.Error(), "sensu timeout POST /api/core/v2/namespaces/default/entities after 50ms: ") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var summary bytes.Buffer
+	c.timeouts.print(&summary)
+	if summary.String() != "sensu timeout POST /api/core/v2/namespaces/default/entities: 1 calls\n" {
+		t.Errorf("unexpected summary %q", summary.String())
+	}
+}
+
+func TestValidateTimeoutArgs(t *testing.T) {
+	c := testConfig()
+	c.timeout = "10m"
+	c.sensuApiTimeout = "soon"
+	if err := c.validateTimeoutArgs(); err == nil || !strings.Contains(err.Error(), "--sensu-api-timeout") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if c.timeoutDuration != 10*time.Minute {
+		t.Errorf("unexpected --timeout %s", c.timeoutDuration)
+	}
+}
+
+func TestApplyCheckTimeout(t *testing.T) {
+	c := testConfig()
+	c.stdin = strings.NewReader(`{"check":{"metadata":{"name":"ec2-discovery"},"timeout":60}}`)
+	if err := c.validateTimeoutArgs(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.stdinPiped() {
+		t.Fatal("stdin is not piped")
+	}
+	event, err := c.triggeringEvent(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.checkTimeoutMarginDuration = 5 * time.Second
+	c.applyCheckTimeout(event)
+	if c.timeoutDuration != 55*time.Second {
+		t.Errorf("unexpected timeout %s", c.timeoutDuration)
+	}
+
+	c.checkTimeoutMarginDuration = time.Minute
+	c.applyCheckTimeout(event)
+	if c.timeoutDuration != 30*time.Second {
+		t.Errorf("unexpected timeout %s with a margin beyond the check timeout", c.timeoutDuration)
+	}
+
+	// An explicit --timeout wins.
+	c.timeout = "10m"
+	if err := c.validateTimeoutArgs(); err != nil {
+		t.Fatal(err)
+	}
+	c.applyCheckTimeout(event)
+	if c.timeoutDuration != 10*time.Minute {
+		t.Errorf("unexpected timeout %s with --timeout", c.timeoutDuration)
+	}
+}
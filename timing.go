@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// phaseTimer accumulates the time spent in each phase of a run. Its
+// methods do nothing on a nil timer.
+type phaseTimer struct {
+	sync.Mutex
+	phases    []string
+	durations map[string]time.Duration
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{durations: make(map[string]time.Duration)}
+}
+
+// add records time spent in a phase. Phases are reported in the order they
+// were first recorded.
+func (t *phaseTimer) add(phase string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.durations[phase]; !ok {
+		t.phases = append(t.phases, phase)
+	}
+	t.durations[phase] += d
+}
+
+// since records the time spent in a phase that started at start, e.g.
+// defer c.timings.since("prune", time.Now()).
+func (t *phaseTimer) since(phase string, start time.Time) {
+	t.add(phase, time.Since(start))
+}
+
+// print writes the breakdown table. Registration runs in several workers,
+// so its time is the sum over all of them and can exceed the total.
+func (t *phaseTimer) print(w io.Writer) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "phase\tduration\n")
+	for _, phase := range t.phases {
+		fmt.Fprintf(table, "%s\t%s\n", phase, t.durations[phase].Round(time.Millisecond))
+	}
+	table.Flush()
+}
+
+// printMetrics writes the phase durations in the Prometheus text format.
+func (t *phaseTimer) printMetrics(w io.Writer) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, phase := range t.phases {
+		name, region := phase, ""
+		if i := strings.Index(phase, " "); i > 0 {
+			name, region = phase[:i], phase[i+1:]
+		}
+		labels := fmt.Sprintf("phase=\"%s\"", name)
+		if region != "" {
+			labels += fmt.Sprintf(",region=\"%s\"", region)
+		}
+		fmt.Fprintf(w, "sensu_ec2_discovery_phase_duration_seconds{%s} %.3f\n", labels, t.durations[phase].Seconds())
+	}
+}
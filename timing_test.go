@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseTimer(t *testing.T) {
+	timings := newPhaseTimer()
+	timings.add("credentials", 120*time.Millisecond)
+	timings.add("describe us-east-1", time.Second)
+	timings.add("registration", 2*time.Second)
+	timings.add("registration", 500*time.Millisecond)
+
+	var table bytes.Buffer
+	timings.print(&table)
+	expected := "phase               duration\n" +
+		"credentials         120ms\n" +
+		"describe us-east-1  1s\n" +
+		"registration        2.5s\n"
+	if table.String() != expected {
+		t.Errorf("unexpected table:\n%s", table.String())
+	}
+
+	var metrics bytes.Buffer
+	timings.printMetrics(&metrics)
+	if !strings.Contains(metrics.String(), "sensu_ec2_discovery_phase_duration_seconds{phase=\"describe\",region=\"us-east-1\"} 1.000\n") {
+		t.Errorf("unexpected metrics:\n%s", metrics.String())
+	}
+
+	var none *phaseTimer
+	none.add("prune", time.Second)
+	none.print(&table)
+}
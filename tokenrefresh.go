@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// tokenRefreshPath mints a new access token from a refresh token.
+const tokenRefreshPath = "/auth/token"
+
+// tokenRefreshMargin is how long before its known expiry an access token is
+// refreshed, so that requests in flight do not race the expiry.
+const tokenRefreshMargin = 30 * time.Second
+
+// accessToken returns the current access token, which changes whenever it
+// is refreshed.
+func (c *CheckConfig) accessToken() string {
+	c.accessTokenMu.Lock()
+	defer c.accessTokenMu.Unlock()
+	return c.sensuAccessToken
+}
+
+// accessTokenCredential authenticates with an access token, which can be
+// refreshed when a refresh token is configured.
+func (c *CheckConfig) accessTokenCredential(token string) sensuCredential {
+	c.accessTokenMu.Lock()
+	defer c.accessTokenMu.Unlock()
+	return sensuCredential{
+		name:        "access token",
+		header:      fmt.Sprintf("Bearer %s", token),
+		token:       token,
+		refreshable: c.sensuRefreshToken != "",
+	}
+}
+
+// accessTokenExpiring reports whether the access token is known to expire
+// within tokenRefreshMargin. The expiry of the token given on the command
+// line is unknown until it is first refreshed.
+func (c *CheckConfig) accessTokenExpiring(now time.Time) bool {
+	c.accessTokenMu.Lock()
+	defer c.accessTokenMu.Unlock()
+	return !c.accessTokenExpiresAt.IsZero() && now.Add(tokenRefreshMargin).After(c.accessTokenExpiresAt)
+}
+
+// refreshAccessToken exchanges the refresh token for a new access token,
+// unless the stale access token was already replaced by a concurrent
+// request. Sensu rotates the refresh token along with the access token, so
+// both are kept. Tokens are never logged.
+func (c *CheckConfig) refreshAccessToken(stale string) (string, error) {
+	c.accessTokenMu.Lock()
+	defer c.accessTokenMu.Unlock()
+	if c.sensuAccessToken != stale {
+		return c.sensuAccessToken, nil
+	}
+
+	payload, err := json.Marshal(map[string]string{"refresh_token": c.sensuRefreshToken})
+	if err != nil {
+		return "", err
+	}
+	credential := sensuCredential{name: "access token", header: fmt.Sprintf("Bearer %s", stale)}
+	resp, err := c.sendSensuApiRequest("POST", tokenRefreshPath, payload, credential)
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh the Sensu access token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to refresh the Sensu access token: %v", c.statusError(resp))
+	}
+	tokens := &corev2.Tokens{}
+	if err := json.NewDecoder(resp.Body).Decode(tokens); err != nil {
+		return "", fmt.Errorf("failed to parse the refreshed Sensu access token: %v", err)
+	}
+	if tokens.Access == "" {
+		return "", fmt.Errorf("failed to refresh the Sensu access token: no access token in the response")
+	}
+
+	c.sensuAccessToken = tokens.Access
+	if tokens.Refresh != "" {
+		c.sensuRefreshToken = tokens.Refresh
+	}
+	c.accessTokenExpiresAt = time.Time{}
+	if tokens.ExpiresAt > 0 {
+		c.accessTokenExpiresAt = time.Unix(tokens.ExpiresAt, 0)
+	}
+	if c.accessTokenExpiresAt.IsZero() {
+		log.Printf("INFO: refreshed the Sensu access token")
+	} else {
+		log.Printf("INFO: refreshed the Sensu access token, valid until %s", c.accessTokenExpiresAt.UTC().Format(time.RFC3339))
+	}
+	return c.sensuAccessToken, nil
+}
+
+// doSensuApiRequest sends a request, refreshing the access token it is
+// authenticated with when it is about to expire or is rejected with 401.
+// When the refresh fails, the rejected response is returned as is.
+func (c *CheckConfig) doSensuApiRequest(method string, path string, payload []byte, credential sensuCredential) (*http.Response, error) {
+	if credential.refreshable && c.accessTokenExpiring(time.Now()) {
+		token, err := c.refreshAccessToken(credential.token)
+		if err != nil {
+			log.Printf("WARNING: %v", err)
+		} else {
+			credential = c.accessTokenCredential(token)
+		}
+	}
+	resp, err := c.sendSensuApiRequest(method, path, payload, credential)
+	if err != nil || !credential.refreshable || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	token, err := c.refreshAccessToken(credential.token)
+	if err != nil {
+		log.Printf("WARNING: %v", err)
+		return resp, nil
+	}
+	resp.Body.Close()
+	return c.sendSensuApiRequest(method, path, payload, c.accessTokenCredential(token))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTokenServer returns a Sensu API on which the initial access token has
+// expired, accepting only the one minted by a refresh, which rotates the
+// refresh token.
+func newTokenServer(t *testing.T, refreshStatus int, seen *[]string) *httptest.Server {
+	var mu sync.Mutex
+	access, refresh := "", "refresh-1"
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		*seen = append(*seen, r.Method+" "+r.URL.Path+" "+r.Header.Get("Authorization"))
+		if r.URL.Path == tokenRefreshPath {
+			var body map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			if refreshStatus != http.StatusOK || body["refresh_token"] != refresh {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			access, refresh = "fresh-token", "refresh-2"
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  access,
+				"refresh_token": refresh,
+				"expires_at":    time.Now().Add(time.Hour).Unix(),
+			})
+			return
+		}
+		if access == "" || r.Header.Get("Authorization") != "Bearer "+access {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestRefreshAccessToken(t *testing.T) {
+	var seen []string
+	server := newTokenServer(t, http.StatusOK, &seen)
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuAccessToken = "expired-token"
+	c.sensuRefreshToken = "refresh-1"
+	for i := 0; i < 2; i++ {
+		resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("request %d: unexpected status %d", i, resp.StatusCode)
+		}
+	}
+
+	path := entitiesPath("default")
+	expected := []string{
+		"GET " + path + " Bearer expired-token",
+		"POST " + tokenRefreshPath + " Bearer expired-token",
+		"GET " + path + " Bearer fresh-token",
+		"GET " + path + " Bearer fresh-token",
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("unexpected requests %q", seen)
+	}
+	if c.sensuRefreshToken != "refresh-2" {
+		t.Errorf("the rotated refresh token was not kept: %q", c.sensuRefreshToken)
+	}
+	if c.accessTokenExpiring(time.Now()) || !c.accessTokenExpiring(time.Now().Add(time.Hour)) {
+		t.Errorf("unexpected expiry %s", c.accessTokenExpiresAt)
+	}
+}
+
+func TestRefreshAccessTokenBeforeExpiry(t *testing.T) {
+	var seen []string
+	server := newTokenServer(t, http.StatusOK, &seen)
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuAccessToken = "expired-token"
+	c.sensuRefreshToken = "refresh-1"
+	c.accessTokenExpiresAt = time.Now().Add(time.Second)
+	resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(seen) != 2 || seen[0] != "POST "+tokenRefreshPath+" Bearer expired-token" {
+		t.Errorf("expected a refresh ahead of the request, got %q", seen)
+	}
+}
+
+func TestRefreshAccessTokenFailure(t *testing.T) {
+	var seen []string
+	server := newTokenServer(t, http.StatusUnauthorized, &seen)
+	defer server.Close()
+
+	c := testConfig()
+	c.sensuApiUrl = server.URL
+	c.sensuAccessToken = "expired-token"
+	c.sensuRefreshToken = "refresh-1"
+	resp, err := c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the rejected response, got %d", resp.StatusCode)
+	}
+	if c.sensuAccessToken != "expired-token" {
+		t.Errorf("the access token was replaced: %q", c.sensuAccessToken)
+	}
+
+	// Without a refresh token, a 401 is returned as is.
+	seen = nil
+	c.sensuRefreshToken = ""
+	resp, err = c.sensuApiRequest("GET", "default", entitiesPath("default"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(seen) != 1 {
+		t.Errorf("unexpected requests %q", seen)
+	}
+}
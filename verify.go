@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// writtenEntities samples the entities a run created or updated, for
+// --verify to read back. Up to --verify-sample entities are kept, every
+// written entity being equally likely to be kept, or all of them when the
+// sample size is 0.
+type writtenEntities struct {
+	sync.Mutex
+	size     int
+	written  int
+	entities []*corev2.Entity
+	random   *rand.Rand
+}
+
+func newWrittenEntities(size int) *writtenEntities {
+	return &writtenEntities{size: size, random: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+func (w *writtenEntities) add(entity *corev2.Entity) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.written++
+	if w.size == 0 || len(w.entities) < w.size {
+		w.entities = append(w.entities, entity)
+		return
+	}
+	if i := w.random.Intn(w.written); i < w.size {
+		w.entities[i] = entity
+	}
+}
+
+func (c *CheckConfig) validateVerifyArgs() error {
+	if !c.verify {
+		return nil
+	}
+	if c.transport == transportAgentApi || c.simulateSink {
+		return fmt.Errorf("--verify cannot be combined with --transport %s or --simulate-sink, whose entities cannot be read back", transportAgentApi)
+	}
+	return nil
+}
+
+// verificationFailure is a written entity that could not be read back as
+// written.
+type verificationFailure struct {
+	namespace string
+	name      string
+	reason    string
+}
+
+// verificationReport is the outcome of the --verify pass of a run.
+type verificationReport struct {
+	written   int
+	verified  int
+	rewritten int
+	failures  []verificationFailure
+}
+
+// verifyEntities reads back the sampled written entities, as concurrently
+// as registration, and checks that they exist with the labels they were
+// written with. With --verify-retry, an entity failing verification is
+// written once more and verified again.
+func (c *CheckConfig) verifyEntities() *verificationReport {
+	c.written.Lock()
+	entities := c.written.entities
+	report := &verificationReport{written: c.written.written}
+	c.written.Unlock()
+
+	workers := int(c.workers)
+	if workers == 0 {
+		workers = 1
+	}
+	queue := make(chan *corev2.Entity)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entity := range queue {
+				reason := c.verifyEntity(entity)
+				rewritten := false
+				if reason != "" && c.verifyRetry {
+					if err := c.putEntity(entity); err != nil {
+						reason = fmt.Sprintf("%s, rewriting failed: %s", reason, err)
+					} else {
+						rewritten = true
+						if reason = c.verifyEntity(entity); reason != "" {
+							reason += " after rewriting"
+						}
+					}
+				}
+				mu.Lock()
+				report.verified++
+				if rewritten {
+					report.rewritten++
+				}
+				if reason != "" {
+					report.failures = append(report.failures, verificationFailure{namespace: entity.Namespace, name: entity.Name, reason: reason})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, entity := range entities {
+		queue <- entity
+	}
+	close(queue)
+	wg.Wait()
+
+	sort.Slice(report.failures, func(i, j int) bool {
+		if report.failures[i].namespace != report.failures[j].namespace {
+			return report.failures[i].namespace < report.failures[j].namespace
+		}
+		return report.failures[i].name < report.failures[j].name
+	})
+	for _, failure := range report.failures {
+		log.Printf("WARNING: verification of entity \"%s\" in namespace \"%s\" failed: %s", failure.name, failure.namespace, failure.reason)
+	}
+	return report
+}
+
+// verifyEntity returns why a written entity cannot be read back as written,
+// "" if it can.
+func (c *CheckConfig) verifyEntity(written *corev2.Entity) string {
+	stored, err := c.getEntity(written.Namespace, written.Name)
+	if err != nil {
+		return fmt.Sprintf("failed to get entity: %s", err)
+	}
+	if stored == nil {
+		return "entity not found"
+	}
+	var keys []string
+	for key := range written.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value, ok := stored.Labels[key]; !ok || value != written.Labels[key] {
+			return fmt.Sprintf("label %s is \"%s\", expected \"%s\"", key, value, written.Labels[key])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestWrittenEntitiesSample(t *testing.T) {
+	written := newWrittenEntities(3)
+	for i := 0; i < 10; i++ {
+		written.add(corev2.FixtureEntity(fmt.Sprintf("i-%d", i)))
+	}
+	if written.written != 10 || len(written.entities) != 3 {
+		t.Errorf("sampled %d of %d entities", len(written.entities), written.written)
+	}
+	var disabled *writtenEntities
+	disabled.add(corev2.FixtureEntity("i-0"))
+}
+
+func TestVerifyEntities(t *testing.T) {
+	backend := newFakeBackend()
+	defer backend.Close()
+	c := backend.checkConfig()
+	c.verify = true
+	c.written = newWrittenEntities(0)
+	c.workers = 2
+	c.maxReportedFailures = 10
+	for _, id := range []string{"i-0", "i-1", "i-2"} {
+		if result := c.registerInstance(testInstance(id, "running")); result.Outcome != outcomeCreated {
+			t.Fatalf("unexpected outcome %s", result.Outcome)
+		}
+	}
+
+	// The backend lost one entity and a label of another.
+	backend.Lock()
+	delete(backend.entities, "i-1")
+	backend.entities["i-2"].Labels[instanceStateLabel] = "pending"
+	backend.Unlock()
+
+	report := c.verifyEntities()
+	if report.verified != 3 || len(report.failures) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	summary := newRunSummary()
+	summary.verification = report
+	var output bytes.Buffer
+	summary.print(&output, c)
+	for _, expected := range []string{
+		"verification: 3 of 3 written entities read back, 2 failed, 0 rewritten\n",
+		"verification failed: default/i-1: entity not found\n",
+		"verification failed: default/i-2: label aws_instance_state is \"pending\", expected \"running\"\n",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("summary is missing %q:\n%s", expected, output.String())
+		}
+	}
+	if status, category := summary.statusCause(c); status != statusWarning || category != categoryVerificationFailed {
+		t.Errorf("unexpected status: %d (%s)", status, category)
+	}
+
+	c.verifyRetry = true
+	report = c.verifyEntities()
+	if report.rewritten != 2 || len(report.failures) != 0 {
+		t.Errorf("unexpected report after rewriting %+v", report)
+	}
+	if backend.entity("i-1") == nil {
+		t.Error("the lost entity was not written again")
+	}
+}
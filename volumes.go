@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// The volume labels of --resolve-volumes: the type and size of the root
+// EBS volume and the size of all the EBS volumes attached to the instance.
+const (
+	rootVolumeTypeLabel = "aws_root_volume_type"
+	rootVolumeSizeLabel = "aws_root_volume_size_gib"
+	ebsTotalSizeLabel   = "aws_ebs_total_gib"
+)
+
+// maxVolumeIdsPerCall caps the volume IDs of a DescribeVolumes filter.
+const maxVolumeIdsPerCall = 200
+
+// instanceVolumes is what --resolve-volumes found out about the EBS volumes
+// of an instance.
+type instanceVolumes struct {
+	RootType    string
+	RootSizeGiB int64
+	TotalGiB    int64
+}
+
+// volumeCache holds the EBS volumes described during the run, by ID.
+type volumeCache struct {
+	sync.Mutex
+	volumes   map[string]*ec2.Volume
+	described int
+	missing   int
+	failed    int
+}
+
+func newVolumeCache() *volumeCache {
+	return &volumeCache{volumes: make(map[string]*ec2.Volume)}
+}
+
+// instanceVolumeIds returns the IDs of the EBS volumes mapped to an
+// instance.
+func instanceVolumeIds(instance *ec2.Instance) []string {
+	var ids []string
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil {
+			ids = append(ids, aws.StringValue(mapping.Ebs.VolumeId))
+		}
+	}
+	return ids
+}
+
+// resolveInstanceVolumes describes the EBS volumes of the instances of a
+// region page not described yet during the run, in batches, and sets the
+// volumes of the instances. Filtering on volume-id rather than listing
+// VolumeIds keeps a volume deleted since DescribeInstances from failing the
+// whole batch.
+func (c *CheckConfig) resolveInstanceVolumes(ctx context.Context, svc ec2iface.EC2API, region string, instances []*discoveredInstance) {
+	if c.volumes == nil || len(instances) == 0 {
+		return
+	}
+	defer c.timings.since("enrichment", time.Now())
+	var ids []string
+	c.volumes.Lock()
+	for _, instance := range instances {
+		for _, id := range instanceVolumeIds(instance.Instance) {
+			if _, ok := c.volumes.volumes[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	c.volumes.Unlock()
+
+	failed := false
+	for start := 0; start < len(ids); start += maxVolumeIdsPerCall {
+		end := start + maxVolumeIdsPerCall
+		if end > len(ids) {
+			end = len(ids)
+		}
+		input := &ec2.DescribeVolumesInput{
+			Filters: []*ec2.Filter{{Name: aws.String("volume-id"), Values: aws.StringSlice(ids[start:end])}},
+		}
+		var described []*ec2.Volume
+		err := svc.DescribeVolumesPagesWithContext(ctx, input, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+			described = append(described, page.Volumes...)
+			return true
+		})
+		if err != nil {
+			c.volumesFailed(region, end-start, classifyAwsError(err, "ec2:DescribeVolumes", region))
+			failed = true
+			continue
+		}
+		c.volumes.Lock()
+		for _, volume := range described {
+			c.volumes.volumes[aws.StringValue(volume.VolumeId)] = volume
+		}
+		c.volumes.described += len(described)
+		c.volumes.Unlock()
+	}
+
+	for _, instance := range instances {
+		instance.Volumes = c.instanceVolumes(instance.Instance, failed)
+	}
+}
+
+// instanceVolumes sums up the described volumes of an instance. Volumes
+// gone or detached from the instance since DescribeInstances are left out;
+// nil is returned when its root volume is unknown because a call failed.
+func (c *CheckConfig) instanceVolumes(instance *ec2.Instance, failed bool) *instanceVolumes {
+	c.volumes.Lock()
+	defer c.volumes.Unlock()
+	volumes := &instanceVolumes{}
+	rootFound := false
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs == nil || mapping.Ebs.VolumeId == nil {
+			continue
+		}
+		volume, ok := c.volumes.volumes[aws.StringValue(mapping.Ebs.VolumeId)]
+		if !ok || !volumeAttachedTo(volume, aws.StringValue(instance.InstanceId)) {
+			if !failed {
+				c.volumes.missing++
+			}
+			continue
+		}
+		volumes.TotalGiB += aws.Int64Value(volume.Size)
+		if aws.StringValue(mapping.DeviceName) == aws.StringValue(instance.RootDeviceName) {
+			volumes.RootType = aws.StringValue(volume.VolumeType)
+			volumes.RootSizeGiB = aws.Int64Value(volume.Size)
+			rootFound = true
+		}
+	}
+	if failed && !rootFound {
+		return nil
+	}
+	return volumes
+}
+
+func volumeAttachedTo(volume *ec2.Volume, instanceId string) bool {
+	for _, attachment := range volume.Attachments {
+		if aws.StringValue(attachment.InstanceId) != instanceId {
+			continue
+		}
+		switch aws.StringValue(attachment.State) {
+		case ec2.VolumeAttachmentStateAttached, ec2.VolumeAttachmentStateAttaching:
+			return true
+		}
+	}
+	return false
+}
+
+// volumesFailed logs the first failure of the run as a warning, like
+// protectionFailed, and the others at debug.
+func (c *CheckConfig) volumesFailed(region string, count int, err error) {
+	c.volumes.Lock()
+	c.volumes.failed += count
+	first := c.volumes.failed == count
+	c.volumes.Unlock()
+	if first {
+		log.Printf("WARNING: failed to describe %d EBS volumes in %s: %s", count, region, err)
+		return
+	}
+	c.logDebug("failed to describe %d EBS volumes in %s: %s", count, region, err)
+}
+
+// volumeLabels returns the volume labels of an instance, if resolved.
+func volumeLabels(instance *discoveredInstance) map[string]string {
+	if instance.Volumes == nil {
+		return nil
+	}
+	labels := map[string]string{ebsTotalSizeLabel: strconv.FormatInt(instance.Volumes.TotalGiB, 10)}
+	if instance.Volumes.RootType != "" {
+		labels[rootVolumeTypeLabel] = instance.Volumes.RootType
+		labels[rootVolumeSizeLabel] = strconv.FormatInt(instance.Volumes.RootSizeGiB, 10)
+	}
+	return labels
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeVolumes answers DescribeVolumes with the volumes among those
+// filtered on, failing when fail is set.
+type fakeVolumes struct {
+	ec2iface.EC2API
+	volumes map[string]*ec2.Volume
+	calls   [][]string
+	fail    bool
+}
+
+func (f *fakeVolumes) DescribeVolumesPagesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, fn func(*ec2.DescribeVolumesOutput, bool) bool, opts ...request.Option) error {
+	ids := aws.StringValueSlice(input.Filters[0].Values)
+	f.calls = append(f.calls, ids)
+	if f.fail {
+		return awserr.New("UnauthorizedOperation", "not authorized", nil)
+	}
+	page := &ec2.DescribeVolumesOutput{}
+	for _, id := range ids {
+		if volume, ok := f.volumes[id]; ok {
+			page.Volumes = append(page.Volumes, volume)
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+func testVolume(id string, volumeType string, size int64, instanceId string) *ec2.Volume {
+	return &ec2.Volume{
+		VolumeId:   aws.String(id),
+		VolumeType: aws.String(volumeType),
+		Size:       aws.Int64(size),
+		Attachments: []*ec2.VolumeAttachment{{
+			InstanceId: aws.String(instanceId),
+			State:      aws.String(ec2.VolumeAttachmentStateAttached),
+		}},
+	}
+}
+
+// volumeInstance returns an instance with its root volume on /dev/xvda.
+func volumeInstance(id string, volumeIds ...string) *discoveredInstance {
+	instance := testInstance(id, "running")
+	instance.RootDeviceName = aws.String("/dev/xvda")
+	for i, volumeId := range volumeIds {
+		device := "/dev/xvda"
+		if i > 0 {
+			device = "/dev/xvd" + string(rune('a'+i))
+		}
+		instance.BlockDeviceMappings = append(instance.BlockDeviceMappings, &ec2.InstanceBlockDeviceMapping{
+			DeviceName: aws.String(device),
+			Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: aws.String(volumeId)},
+		})
+	}
+	return instance
+}
+
+func TestResolveInstanceVolumes(t *testing.T) {
+	c := testConfig()
+	c.volumes = newVolumeCache()
+	detached := testVolume("vol-detached", "gp2", 50, "i-0123")
+	detached.Attachments[0].State = aws.String(ec2.VolumeAttachmentStateDetached)
+	svc := &fakeVolumes{volumes: map[string]*ec2.Volume{
+		"vol-root":     testVolume("vol-root", "gp3", 20, "i-0123"),
+		"vol-data":     testVolume("vol-data", "st1", 500, "i-0123"),
+		"vol-detached": detached,
+		"vol-other":    testVolume("vol-other", "gp2", 8, "i-0456"),
+	}}
+	instances := []*discoveredInstance{
+		volumeInstance("i-0123", "vol-root", "vol-data", "vol-detached", "vol-deleted"),
+		volumeInstance("i-0456", "vol-other"),
+		testInstance("i-0789", "running"),
+	}
+	c.resolveInstanceVolumes(context.Background(), svc, "us-west-2", instances)
+
+	if len(svc.calls) != 1 || len(svc.calls[0]) != 5 {
+		t.Errorf("unexpected calls %v", svc.calls)
+	}
+	for i, expected := range []map[string]string{
+		{rootVolumeTypeLabel: "gp3", rootVolumeSizeLabel: "20", ebsTotalSizeLabel: "520"},
+		{rootVolumeTypeLabel: "gp2", rootVolumeSizeLabel: "8", ebsTotalSizeLabel: "8"},
+		{ebsTotalSizeLabel: "0"},
+	} {
+		if labels := volumeLabels(instances[i]); !reflect.DeepEqual(labels, expected) {
+			t.Errorf("%s: unexpected labels %v", aws.StringValue(instances[i].InstanceId), labels)
+		}
+	}
+	if c.volumes.described != 4 || c.volumes.missing != 2 {
+		t.Errorf("unexpected counts %+v", c.volumes)
+	}
+
+	// Volumes described earlier in the run are not described again.
+	again := volumeInstance("i-0123", "vol-root", "vol-data")
+	c.resolveInstanceVolumes(context.Background(), svc, "us-west-2", []*discoveredInstance{again})
+	if len(svc.calls) != 1 {
+		t.Errorf("unexpected calls %v", svc.calls)
+	}
+	if entity := c.buildEntity(again); entity.Labels[ebsTotalSizeLabel] != "520" || entity.Labels[rootVolumeTypeLabel] != "gp3" {
+		t.Errorf("unexpected labels %v", entity.Labels)
+	}
+}
+
+func TestResolveInstanceVolumesFailure(t *testing.T) {
+	c := testConfig()
+	c.volumes = newVolumeCache()
+	svc := &fakeVolumes{fail: true}
+	instance := volumeInstance("i-0123", "vol-root")
+	c.resolveInstanceVolumes(context.Background(), svc, "us-west-2", []*discoveredInstance{instance})
+	if instance.Volumes != nil || c.volumes.failed != 1 {
+		t.Errorf("unexpected volumes %+v, counts %+v", instance.Volumes, c.volumes)
+	}
+	if _, ok := c.buildEntity(instance).Labels[ebsTotalSizeLabel]; ok {
+		t.Error("unexpected volume labels")
+	}
+}